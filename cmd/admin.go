@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+)
+
+// stater is a worker that reports its current view.
+type stater interface {
+	State() types.WorkerState
+}
+
+// forcedReconfigurer is a worker whose forced reconfiguration can be turned
+// on and off while it runs.
+type forcedReconfigurer interface {
+	SetForcedReconfigure(enabled bool)
+}
+
+// drainer is a worker that can be taken out of service and put back.
+type drainer interface {
+	Drain() error
+	Undrain() error
+}
+
+// drainHandler drains the node on POST and undrains it on DELETE, e.g.
+//
+//	curl -X POST http://127.0.0.1:10235/drain
+func drainHandler(worker drainer, logger logrus.FieldLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		switch r.Method {
+		case http.MethodPost:
+			logger.Info("drain requested")
+			err = worker.Drain()
+		case http.MethodDelete:
+			logger.Info("undrain requested")
+			err = worker.Undrain()
+		default:
+			http.Error(w, "use POST to drain or DELETE to undrain", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			logger.Errorf("unable to change drain state. %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// statuser is a worker that summarizes its last applies and parity checks.
+type statuser interface {
+	Status() types.WorkerStatus
+}
+
+// statusHandler answers with the worker's status as JSON, 200 while it is
+// healthy and 503 otherwise, e.g. for a liveness probe or monitoring.
+func statusHandler(worker statuser) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		status := worker.Status()
+		b, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if status.Health() != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(b)
+	}
+}
+
+// serveAdmin serves the worker's current view on 127.0.0.1:port until ctx is
+// done, e.g.
+//
+//	curl http://127.0.0.1:10235/state
+//
+// and turns its forced reconfiguration on with POST and off with DELETE, if
+// it has one, e.g.
+//
+//	curl -X DELETE http://127.0.0.1:10235/forced-reconfigure
+//
+// and drains the worker with POST and undrains it with DELETE, if it can be
+// drained. These are served on localhost only, as anyone able to drain the
+// node can take it out of service.
+//
+// A port of 0 serves nothing. The worker runs on when the port can not be
+// bound, as the endpoint is only for debugging.
+func serveAdmin(ctx context.Context, port int, worker stater, logger logrus.FieldLogger) {
+	if port == 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", func(w http.ResponseWriter, _ *http.Request) {
+		b, err := json.MarshalIndent(worker.State(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	if forced, ok := worker.(forcedReconfigurer); ok {
+		mux.HandleFunc("/forced-reconfigure", func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPost:
+				forced.SetForcedReconfigure(true)
+			case http.MethodDelete:
+				forced.SetForcedReconfigure(false)
+			default:
+				http.Error(w, "use POST to enable or DELETE to disable", http.StatusMethodNotAllowed)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+	if d, ok := worker.(drainer); ok {
+		mux.HandleFunc("/drain", drainHandler(d, logger))
+	}
+	server := &http.Server{Addr: fmt.Sprintf("127.0.0.1:%d", port), Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		logger.Infof("serving worker state on %s", server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("unable to serve worker state on %s. %v", server.Addr, err)
+		}
+	}()
+}
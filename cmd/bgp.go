@@ -3,16 +3,24 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/bgp"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/haproxy"
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/system"
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
 )
 
+const (
+	bgpBackendGoBGP = "gobgp"
+	bgpBackendFRR   = "frr"
+	bgpBackendBIRD  = "bird"
+)
+
 // BGP configures IPVS, attracts packets in multi-master BGP mode
 func BGP(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
 
@@ -33,6 +41,11 @@ func BGP(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
 				return err
 			}
 
+			// select the primary interfaces of this node
+			if err := config.Net.SelectInterfaces(); err != nil {
+				return err
+			}
+
 			// instantiate a watcher
 			logger.Info("starting watcher")
 			watcher, err := system.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindBGP, config.DefaultListener.Service, config.DefaultListener.Port, logger)
@@ -79,12 +92,12 @@ func BGP(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
 
 			            // listen for health
 			            logger.Info("starting health endpoint")
-			            go util.ListenForHealth(config.Net.Interface, 10201, logger)
+			            go util.ListenForHealth(config.Net.Interfaces(), 10201, logger)
 			*/
 
 			// instantiate a new IPVS manager
 			logger.Info("Initializing ipvs helper")
-			ipvs, err := system.NewIPVS(ctx, config.Net.PrimaryIP, config.IPVS.WeightOverride, config.IPVS.IgnoreCordon, logger)
+			ipvs, err := system.NewIPVS(ctx, config.IPVS.Options(config.Net.PrimaryIP), logger)
 			if err != nil {
 				return err
 			}
@@ -110,9 +123,54 @@ func BGP(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
 			}
 
 			// instantiate BGP handler
-			bgpController := bgp.NewBGPDController(config.BGP.Binary, logger)
+			var localASN uint32
+			if config.BGP.ASN != "" {
+				if localASN, err = bgp.ParseASN(config.BGP.ASN); err != nil {
+					return err
+				}
+			}
+			peers, err := bgp.ParsePeers(config.BGP.Peers)
+			if err != nil {
+				return err
+			}
+			var bgpController bgp.Controller
+			switch config.BGP.Backend {
+			case bgpBackendFRR:
+				if bgpController, err = bgp.NewFRRController(config.BGP.VtyshBinary, localASN, config.BGP.NextHop, config.BGP.NextHop6, logger); err != nil {
+					return err
+				}
+			case bgpBackendBIRD:
+				if bgpController, err = bgp.NewBIRDController(config.BGP.BirdcBinary, config.BGP.BirdConfig, localASN, config.BGP.NextHop, config.BGP.NextHop6, logger); err != nil {
+					return err
+				}
+			default:
+				bgpController = bgp.NewBGPDController(config.BGP.Binary, localASN, config.Net.PrimaryIP, config.BGP.NextHop, config.BGP.NextHop6, logger)
+			}
 
-			worker, err := bgp.NewBGPWorker(ctx, config.ConfigKey, watcher, ipLoopback, ipPrimary, ipvs, bgpController, logger)
+			haproxyTemplate, err := haproxy.LoadTemplate(config.BGP.HAProxyTemplate)
+			if err != nil {
+				return err
+			}
+
+			worker, err := bgp.NewBGPWorker(ctx, bgp.WorkerOptions{
+				NodeName:            config.NodeName,
+				ConfigKey:           config.ConfigKey,
+				Watcher:             watcher,
+				IPLoopback:          ipLoopback,
+				IPPrimary:           ipPrimary,
+				IPVS:                ipvs,
+				Controller:          bgpController,
+				Peers:               peers,
+				Aggregate:           config.BGP.Aggregate,
+				ParityInterval:      config.BGP.ParityInterval,
+				ReconfigureInterval: config.BGP.ReconfigureInterval,
+				ReconfigureJitter:   config.BGP.ReconfigureJitter,
+				QuietPeriod:         config.BGP.QuietPeriod,
+				HAProxyTemplate:     haproxyTemplate,
+				HAProxyStatsPort:    config.BGP.HAProxyStatsPort,
+				Nameservers:         config.BGP.HAProxyNameservers,
+				ClusterDomain:       config.BGP.ClusterDomain,
+			}, logger)
 			if err != nil {
 				return err
 			}
@@ -122,6 +180,11 @@ func BGP(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
 				return err
 			}
 
+			// report the status through the stats-port server, and drain and
+			// undrain through the localhost admin port
+			http.HandleFunc("/status", statusHandler(worker))
+			serveAdmin(ctx, config.AdminPort, worker, logger)
+
 			// catching exit signals sent from the parent context
 			<-ctx.Done()
 			return worker.Stop()
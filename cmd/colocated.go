@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/director"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/iptables"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/realserver"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/system"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
+)
+
+// Colocated runs the ipvs director and the realserver in one process
+func Colocated(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
+
+	var cmd = &cobra.Command{
+		Use:           "colocated",
+		Short:         "kube2ipvs director and realserver",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Long: `
+kube2ipvs colocated will run the kube2ipvs daemon in both director and
+realserver mode in one process, for small clusters that run a single
+kube2ipvs per node. Both workers share one watcher of the kubernetes API and
+one set of metrics.
+
+The director owns IPVS, its sync daemon, the dscp rules and the primary
+interface, and is started first. The realserver owns iptables and the
+loopback interface, and is started once the director is running. It runs
+until kube2ipvs exits, rather than stopping while a director answers on the
+coordinator port. Its rules only capture the node's share of each service's
+traffic, with a statistic probability, and leave the rest to the director's
+IPVS. The director's iptables colocation mode is not supported, as the
+realserver writes those rules itself.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config := NewConfig(cmd.Flags())
+			logger.Debugf("got config %+v", config)
+			b, _ := json.MarshalIndent(config, " ", " ")
+			fmt.Println(string(b))
+
+			// validate flags
+			logger.Info("validating")
+			if err := config.Invalid(); err != nil {
+				return err
+			}
+			if config.IPVS.ColocationMode == "iptables" {
+				return fmt.Errorf("ipvs-colocation-mode=iptables is not supported in colocated mode. the realserver owns iptables")
+			}
+
+			// select the primary interfaces of this node
+			if err := config.Net.SelectInterfaces(); err != nil {
+				return err
+			}
+
+			// write IPVS Sysctl flags to the node
+			if err := config.IPVS.WriteToNode(); err != nil {
+				return err
+			}
+
+			// instantiate a watcher, shared by both workers
+			logger.Info("starting watcher")
+			watcher, err := system.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindColocated, config.DefaultListener.Service, config.DefaultListener.Port, logger)
+			if err != nil {
+				return err
+			}
+
+			// initialize statistics
+			s, err := stats.NewStats(ctx, stats.KindColocated, config.Stats.Interface, config.Stats.ListenAddr, config.Stats.ListenPort, config.Stats.Interval, logger)
+			if err != nil {
+				return fmt.Errorf("failed to initialize metrics. %v", err)
+			}
+			go func() {
+				configs := make(chan *types.ClusterConfig, 100)
+				watcher.ConfigMap(ctx, "stats", configs)
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case c := <-configs:
+						s.UpdateConfig(c)
+					}
+				}
+			}()
+			if config.Stats.Enabled {
+				if err := s.EnableBPFStats(); err != nil {
+					return fmt.Errorf("failed to initialize BPF capture. if=%v sa=%s %v", config.Stats.Interface, config.Stats.ListenAddr, err)
+				}
+			}
+			// emit the version metric
+			emitVersionMetric(stats.KindColocated, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey)
+
+			// answer on the coordinator ports, so that a realserver run
+			// on its own on this node stands down
+			logger.Infof("starting listen controllers on %v", config.Coordinator.Ports)
+			cm := NewCoordinationMetrics(stats.KindColocated)
+			for _, port := range config.Coordinator.Ports {
+				go listenController(port, cm, logger)
+			}
+
+			// listen for health
+			logger.Info("starting health endpoint")
+			go util.ListenForHealth(config.Net.Interfaces(), 10201, logger)
+
+			// instantiate a new IPVS manager for the director
+			logger.Info("initializing ipvs helper")
+			ipvs, err := system.NewIPVS(ctx, config.IPVS.Options(config.Net.PrimaryIP), logger)
+			if err != nil {
+				return err
+			}
+
+			// instantiate an IP helper for loopback, for the realserver
+			logger.Info("initializing loopback helper")
+			ipLoopback, err := system.NewIP(ctx, config.Net.LocalInterface, config.Net.Gateway, config.Arp.LoAnnounce, config.Arp.LoIgnore, logger)
+			if err != nil {
+				return err
+			}
+
+			// instantiate an IP helper for the tunnel interface, for VIPs forwarded in tunnel mode
+			var ipTunnel system.IP
+			if config.RealServerTunnel {
+				logger.Info("initializing tunnel helper")
+				ipTunnel, err = system.NewIP(ctx, config.Net.TunnelInterface, config.Net.Gateway, config.Arp.LoAnnounce, config.Arp.LoIgnore, logger)
+				if err != nil {
+					return err
+				}
+			}
+
+			// instantiate an IP helper for the primary interface, for the director
+			logger.Info("initializing primary ip helper")
+			ip, err := system.NewIP(ctx, config.Net.Interface, config.Net.Gateway, config.Arp.PrimaryAnnounce, config.Arp.PrimaryIgnore, logger)
+			if err != nil {
+				return err
+			}
+
+			// announce the VIPs that move onto the primary interface
+			var announcer system.Announcer
+			if config.AnnounceCount > 0 {
+				announcer = system.NewAnnouncer(ctx, config.Net.Interface, config.AnnounceCount, config.AnnounceInterval, logger)
+			}
+
+			// instantiate an iptables interface, shared by both workers as
+			// only the director's Start flushes it
+			logger.Info("initializing iptables helper")
+			ipt, err := iptables.NewIPTables(ctx, stats.KindColocated, config.ConfigKey, config.PodCIDRMasq, config.IPTablesTable, config.IPTablesChain, config.IPTablesJumpFrom, config.IPTablesMasq, config.IPTablesIPSet, config.IPTablesNoFlush, config.IPTablesDryRun, config.IPTablesLockWait, logger)
+			if err != nil {
+				return err
+			}
+
+			// evaluate the node's local health, if its VIPs are gated on it
+			var health realserver.HealthEvaluator
+			if config.RealServerHealthGating {
+				evaluators := realserver.HealthEvaluators{realserver.NodeReady{}}
+				for _, check := range config.RealServerHealthChecks {
+					if check != "" {
+						evaluators = append(evaluators, realserver.CommandCheck{Command: check, Timeout: config.RealServerHealthCheckTimeout})
+					}
+				}
+				health = evaluators
+			}
+
+			// instantiate the director worker.
+			logger.Info("initializing director")
+			directorWorker, err := director.NewDirector(ctx, config.NodeName, config.ConfigKey, config.CleanupMaster, watcher, ipvs, ip, announcer, ipt, iptables.NewCapture(config.IPTablesCaptureDir, stats.KindDirector, config.IPTablesCaptureRetain), config.IPVS.ColocationMode, config.ForcedReconfigure, config.ForcedReconfigureInterval, logger)
+			if err != nil {
+				return err
+			}
+
+			// instantiate the realserver worker, leaving the primary
+			// interface and IPVS to the director, with weighted rules
+			logger.Info("initializing realserver")
+			realserverWorker, err := realserver.NewRealServer(ctx, realserver.Options{
+				NodeName:                  config.NodeName,
+				ConfigKey:                 config.ConfigKey,
+				Watcher:                   watcher,
+				IPLoopback:                ipLoopback,
+				IPTables:                  ipt,
+				Capture:                   iptables.NewCapture(config.IPTablesCaptureDir, stats.KindRealServer, config.IPTablesCaptureRetain),
+				IPTunnel:                  ipTunnel,
+				Weighted:                  true,
+				ForcedReconfigure:         config.ForcedReconfigure,
+				ForcedReconfigureInterval: config.ForcedReconfigureInterval,
+				ParityInterval:            config.RealServerParityInterval,
+				DrainDelay:                config.RealServerDrainDelay,
+				IgnoreCordon:              config.IPVS.IgnoreCordon,
+				DrainTaints:               config.IPVS.DrainTaints,
+				Health:                    health,
+			}, logger)
+			if err != nil {
+				return err
+			}
+
+			// report the realserver's readiness and status through the
+			// stats-port server, and drain and undrain it through the
+			// localhost admin port
+			http.HandleFunc("/ready", readyHandler(realserverWorker))
+			http.HandleFunc("/status", statusHandler(realserverWorker))
+			serveAdmin(ctx, config.AdminPort, realserverWorker, logger)
+
+			// the director flushes iptables as it starts, so it must be
+			// running before the realserver writes its rules
+			logger.Info("starting director")
+			if err := directorWorker.Start(); err != nil {
+				return err
+			}
+			logger.Info("starting realserver")
+			if err := realserverWorker.Start(); err != nil {
+				return err
+			}
+			cm.Running(true)
+			logger.Info("started")
+
+			// catching exit signals sent from the parent context. As in
+			// director mode, the director is not cleaned up on exit.
+			<-ctx.Done()
+			cm.Running(false)
+			return realserverWorker.Stop()
+		},
+	}
+
+	return cmd
+}
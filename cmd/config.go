@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"reflect"
 	"strconv"
@@ -10,6 +11,9 @@ import (
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/system"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
 )
 
 type Config struct {
@@ -24,9 +28,51 @@ type Config struct {
 	PodCIDRMasq  string
 	IPTablesMasq bool
 
+	// IPTablesIPSet matches VIPs with ipsets rather than a rule per VIP:port
+	IPTablesIPSet bool
+
+	// IPTablesNoFlush restores only ravel's own chains, with --noflush
+	IPTablesNoFlush bool
+
+	// IPTablesDryRun logs the diff of the iptables rules that would be
+	// applied, rather than applying them
+	IPTablesDryRun bool
+
+	// IPTablesLockWait is how long iptables waits for the xtables lock
+	IPTablesLockWait time.Duration
+
+	// IPTablesCaptureDir is where the rules of failed restores are written,
+	// and IPTablesCaptureRetain how many of them are kept
+	IPTablesCaptureDir    string
+	IPTablesCaptureRetain int
+
 	// Periodic reconfigure
 	ForcedReconfigure bool
 
+	// ForcedReconfigureInterval is how often the director and realserver
+	// reconfigure without a parity check, when ForcedReconfigure is set.
+	// RealServerParityInterval is how often the realserver reapplies its
+	// configuration.
+	ForcedReconfigureInterval time.Duration
+	RealServerParityInterval  time.Duration
+
+	// RealServerHealthGating withdraws the realserver's VIPs while its node
+	// is NotReady or fails one of RealServerHealthChecks, shell commands
+	// that each must exit 0 within RealServerHealthCheckTimeout.
+	RealServerHealthGating       bool
+	RealServerHealthChecks       []string
+	RealServerHealthCheckTimeout time.Duration
+
+	// RealServerDrainDelay is how long a draining realserver gives its
+	// established connections between the removal of the VIPs' rules and
+	// their addresses.
+	RealServerDrainDelay time.Duration
+
+	// RealServerTunnel puts the realserver in tunnel mode, where it brings up
+	// the Net.TunnelInterface and binds the VIPs forwarded to it in tunnel
+	// mode there, for directors in other subnets.
+	RealServerTunnel bool
+
 	// This is the IP address of the node - the node as it is known to Kubernetes
 	NodeName string
 
@@ -36,11 +82,26 @@ type Config struct {
 	// This is the IPTables prefix to use.
 	IPTablesChain string
 
+	// IPTablesTable is the table that holds the chains, and IPTablesJumpFrom
+	// the chain in it that jumps to the base chain.
+	IPTablesTable    string
+	IPTablesJumpFrom string
+
 	// FailoverTimeout is used by the realserver to specify the
 	// number of seconds between a loss of the director and the realserver
 	// initiating its reconfiguration routine
 	FailoverTimeout int
 
+	// AdminPort is the localhost port that the worker's current view is
+	// served on for debugging, or 0 for none.
+	AdminPort int
+
+	// AnnounceCount is how many gratuitous ARPs or neighbor advertisements
+	// the director sends of each VIP it adds to the primary interface,
+	// AnnounceInterval apart. 0 sends none.
+	AnnounceCount    int
+	AnnounceInterval time.Duration
+
 	Stats StatsConfig
 	IPVS  IPVSConfig
 	Net   NetConfig
@@ -57,12 +118,80 @@ func (c *Config) Invalid() error {
 	if c.IPTablesChain == "" {
 		return fmt.Errorf("iptables-chain must be set")
 	}
+	if c.IPTablesTable == "" || c.IPTablesJumpFrom == "" {
+		return fmt.Errorf("iptables-table and iptables-jump-from must be set")
+	}
+	if strings.HasPrefix(c.IPTablesJumpFrom, c.IPTablesChain) {
+		return fmt.Errorf("iptables-jump-from %s must not be named with the iptables-chain prefix %s, as ravel owns those chains", c.IPTablesJumpFrom, c.IPTablesChain)
+	}
+	if c.IPTablesLockWait < time.Second {
+		return fmt.Errorf("iptables-lock-wait must be at least 1s")
+	}
+	if c.IPTablesCaptureRetain < 0 {
+		return fmt.Errorf("iptables-capture-retain must not be negative")
+	}
+	if c.AnnounceCount < 0 {
+		return fmt.Errorf("announce-count must not be negative")
+	}
+	if c.AdminPort < 0 || c.AdminPort > 65535 {
+		return fmt.Errorf("admin-port must be between 0 and 65535")
+	}
 	if c.FailoverTimeout < 1 || c.FailoverTimeout > 120 {
 		return fmt.Errorf("failover-timeout must be between 1 and 120s")
 	}
 	if c.NodeName == "" {
 		return fmt.Errorf("nodename must be set. this is the ip address of the node, or its name in kubernetes")
 	}
+	intervals := map[string]time.Duration{
+		"forced-reconfigure-interval":     c.ForcedReconfigureInterval,
+		"realserver-parity-interval":      c.RealServerParityInterval,
+		"realserver-health-check-timeout": c.RealServerHealthCheckTimeout,
+		"announce-interval":               c.AnnounceInterval,
+		"bgp-parity-interval":             c.BGP.ParityInterval,
+		"bgp-reconfigure-interval":        c.BGP.ReconfigureInterval,
+	}
+	for flag, interval := range intervals {
+		if interval <= 0 {
+			return fmt.Errorf("%s must be greater than zero", flag)
+		}
+	}
+	if c.IPVS.DrainGracePeriod < 0 {
+		return fmt.Errorf("ipvs-drain-grace-period must not be negative")
+	}
+	if c.RealServerDrainDelay < 0 {
+		return fmt.Errorf("realserver-drain-delay must not be negative")
+	}
+	if c.IPVS.WeightBalance.Enabled {
+		if c.IPVS.WeightOverride {
+			return fmt.Errorf("ipvs-weight-balance cannot be combined with ipvs-weight-override")
+		}
+		if c.IPVS.WeightBalance.Threshold <= 0 || c.IPVS.WeightBalance.Threshold >= 1 {
+			return fmt.Errorf("ipvs-weight-balance-threshold must be between 0 and 1")
+		}
+		if c.IPVS.WeightBalance.Interval <= 0 {
+			return fmt.Errorf("ipvs-weight-balance-interval must be greater than zero")
+		}
+	}
+	if c.IPVS.SyncID < 0 || c.IPVS.SyncID > 255 {
+		return fmt.Errorf("ipvs-sync-id %d must be between 0 and 255", c.IPVS.SyncID)
+	}
+	if c.IPVS.Backend != system.IPVSBackendIPVSAdm && c.IPVS.Backend != system.IPVSBackendNetlink {
+		return fmt.Errorf("ipvs-backend %q must be %s or %s", c.IPVS.Backend, system.IPVSBackendIPVSAdm, system.IPVSBackendNetlink)
+	}
+	switch c.BGP.Backend {
+	case bgpBackendGoBGP:
+	case bgpBackendFRR, bgpBackendBIRD:
+		if c.BGP.ASN == "" {
+			return fmt.Errorf("bgp-asn must be set for the %s bgp backend", c.BGP.Backend)
+		}
+	default:
+		return fmt.Errorf("bgp-backend %q must be one of %s, %s or %s", c.BGP.Backend, bgpBackendGoBGP, bgpBackendFRR, bgpBackendBIRD)
+	}
+	for _, nextHop := range []string{c.BGP.NextHop, c.BGP.NextHop6} {
+		if nextHop != "" && nextHop != types.NextHopSelf && net.ParseIP(nextHop) == nil {
+			return fmt.Errorf("bgp next hop %q must be 'self' or an ip address", nextHop)
+		}
+	}
 	return nil
 }
 
@@ -124,6 +253,29 @@ type IPVSConfig struct {
 	// When true, do not evaluate the Cordoned criteria when determining whether a node is an eligible backend
 	IgnoreCordon bool
 
+	// DrainTaints are the taint keys that take a node out of service as a
+	// cordon does: directors stop sending to it and its realserver drains
+	DrainTaints []string
+
+	// Backend is the way rules are applied, "ipvsadm" or "netlink"
+	Backend string
+
+	// DrainGracePeriod is how long a realserver that leaves the backend set
+	// is kept at weight 0 before it is deleted. 0 deletes it right away.
+	DrainGracePeriod time.Duration
+
+	// SyncInterface is the interface the IPVS sync daemon multicasts on, and
+	// SyncID the id that sets apart this cluster's sync messages. Directors
+	// run the daemon as master and realservers as backup. Empty disables it.
+	SyncInterface string
+	SyncID        int
+
+	// DryRun logs the IPVS rules that would be applied, rather than applying them
+	DryRun bool
+
+	// WeightBalance adjusts realserver weights from their active connections
+	WeightBalance system.WeightBalance
+
 	// Sysctl settings for IPVS.
 	AmDroprate              string `ipvs:"am_droprate,10"`
 	AMemThresh              string `ipvs:"amemthresh,1024"`
@@ -208,6 +360,42 @@ func (i *IPVSConfig) WriteToNode() error {
 	return nil
 }
 
+// ManagedSysctls returns the values of the ipvs sysctls that workers keep in
+// place as they run, by name.
+func (i *IPVSConfig) ManagedSysctls() map[string]string {
+	managed := map[string]bool{}
+	for _, name := range system.ManagedIPVSSysctls {
+		managed[name] = true
+	}
+
+	out := map[string]string{}
+	reflectVal := reflect.ValueOf(*i)
+	for n := 0; n < reflectVal.NumField(); n++ {
+		_, _, _, tag, value := processReflection(reflectVal, n)
+		if managed[tag] {
+			out[tag] = value.String()
+		}
+	}
+	return out
+}
+
+// Options returns the settings of the IPVS manager of a node with primaryIP.
+func (i *IPVSConfig) Options(primaryIP string) system.IPVSOptions {
+	return system.IPVSOptions{
+		PrimaryIP:        primaryIP,
+		WeightOverride:   i.WeightOverride,
+		IgnoreCordon:     i.IgnoreCordon,
+		DrainTaints:      i.DrainTaints,
+		Backend:          i.Backend,
+		DrainGracePeriod: i.DrainGracePeriod,
+		SyncInterface:    i.SyncInterface,
+		SyncID:           i.SyncID,
+		DryRun:           i.DryRun,
+		Sysctls:          i.ManagedSysctls(),
+		WeightBalance:    i.WeightBalance,
+	}
+}
+
 // SetSysctl sets the value of /proc/sys/net/ipv4/vs/<path> to value in config struct
 func (i *IPVSConfig) SetSysctl(setting, value string) error {
 	// guard against values produced by the struct with no tag
@@ -265,10 +453,43 @@ func setValue(name string, valueOR string, reflectVal reflect.Value) {
 }
 
 type NetConfig struct {
-	LocalInterface string
-	Interface      string
-	PrimaryIP      string
-	Gateway        string
+	LocalInterface  string
+	TunnelInterface string
+
+	// Interface and Interface6 are the primary interfaces that the node's
+	// ipv4 and ipv6 traffic arrive on, given as selectors of
+	// system.SelectInterface until SelectInterfaces resolves them.
+	// Interface6 is Interface when empty.
+	Interface  string
+	Interface6 string
+
+	PrimaryIP string
+	Gateway   string
+}
+
+// SelectInterfaces resolves the selectors of the primary interfaces to the
+// names of the interfaces of this node.
+func (n *NetConfig) SelectInterfaces() error {
+	selector, selector6 := n.Interface, n.Interface6
+	if selector6 == "" {
+		selector6 = selector
+	}
+	var err error
+	if n.Interface, err = system.SelectInterface(selector, false); err != nil {
+		return fmt.Errorf("unable to select the compute-iface. %v", err)
+	}
+	if n.Interface6, err = system.SelectInterface(selector6, true); err != nil {
+		return fmt.Errorf("unable to select the compute-iface6. %v", err)
+	}
+	return nil
+}
+
+// Interfaces returns the distinct primary interfaces.
+func (n *NetConfig) Interfaces() []string {
+	if n.Interface6 == "" || n.Interface6 == n.Interface {
+		return []string{n.Interface}
+	}
+	return []string{n.Interface, n.Interface6}
 }
 
 type ArpConfig struct {
@@ -279,7 +500,61 @@ type ArpConfig struct {
 }
 
 type BGPConfig struct {
+	// Backend selects the Controller implementation, "gobgp", "frr" or "bird"
+	Backend string
+
 	Binary string
+
+	// VtyshBinary is the path to FRR's vtysh, used by the frr backend
+	VtyshBinary string
+
+	// BirdcBinary and BirdConfig are used by the bird backend. BirdConfig is
+	// the file that Ravel renders, which bird.conf must include.
+	BirdcBinary string
+	BirdConfig  string
+
+	// ASN is the local autonomous system, in asplain or asdot notation.
+	// When empty, gobgpd's own configuration is used.
+	ASN string
+
+	// Peers are neighbor descriptions, as parsed by bgp.ParsePeer. ipv4 and
+	// ipv6 neighbors each carry only their own address family.
+	Peers []string
+
+	// NextHop and NextHop6 are the default next hops attached to ipv4 and
+	// ipv6 announcements. Each is an ip address or "self".
+	NextHop  string
+	NextHop6 string
+
+	// Aggregate advertises contiguous VIPs as summary prefixes
+	Aggregate bool
+
+	// ParityInterval is how often the advertisements and IPVS rules are
+	// checked for drift, in addition to the checks that follow updates.
+	// ReconfigureInterval is how often they are reapplied without a check.
+	ParityInterval      time.Duration
+	ReconfigureInterval time.Duration
+
+	// ReconfigureJitter and QuietPeriod spread and postpone the mandatory
+	// periodic reconfiguration
+	ReconfigureJitter time.Duration
+	QuietPeriod       time.Duration
+
+	// HAProxyTemplate is the file of a template that replaces the built-in
+	// haproxy configuration. When empty, the built-in template is used.
+	HAProxyTemplate string
+
+	// HAProxyStatsPort is the first port of the stats pages that the
+	// haproxy instances serve on localhost, one port per instance counting
+	// up from it. 0 disables them.
+	HAProxyStatsPort int
+
+	// HAProxyNameservers are the DNS servers that haproxy resolves the
+	// endpoints of haproxyDNS ports with, as ip or ip:port. When empty,
+	// the nameservers of the node's /etc/resolv.conf are used.
+	// ClusterDomain is the DNS domain of the cluster's services.
+	HAProxyNameservers []string
+	ClusterDomain      string
 }
 
 func NewConfig(flags *pflag.FlagSet) *Config {
@@ -291,11 +566,29 @@ func NewConfig(flags *pflag.FlagSet) *Config {
 	config.NodeName = viper.GetString("nodename")
 	config.KubeConfigFile = viper.GetString("kubeconfig")
 	config.IPTablesChain = viper.GetString("iptables-chain")
+	config.IPTablesTable = viper.GetString("iptables-table")
+	config.IPTablesJumpFrom = viper.GetString("iptables-jump-from")
 	config.FailoverTimeout = viper.GetInt("failover-timeout")
+	config.AdminPort = viper.GetInt("admin-port")
+	config.AnnounceCount = viper.GetInt("announce-count")
+	config.AnnounceInterval = viper.GetDuration("announce-interval")
 	config.CleanupMaster = viper.GetBool("cleanup-master")
 	config.PodCIDRMasq = viper.GetString("pod-cidr-masq")
 	config.IPTablesMasq = viper.GetBool("iptables-masq")
+	config.IPTablesIPSet = viper.GetBool("iptables-ipset")
+	config.IPTablesNoFlush = viper.GetBool("iptables-noflush")
+	config.IPTablesDryRun = viper.GetBool("iptables-dry-run")
+	config.IPTablesLockWait = viper.GetDuration("iptables-lock-wait")
+	config.IPTablesCaptureDir = viper.GetString("iptables-capture-dir")
+	config.IPTablesCaptureRetain = viper.GetInt("iptables-capture-retain")
 	config.ForcedReconfigure = viper.GetBool("forced-reconfigure")
+	config.ForcedReconfigureInterval = viper.GetDuration("forced-reconfigure-interval")
+	config.RealServerParityInterval = viper.GetDuration("realserver-parity-interval")
+	config.RealServerHealthGating = viper.GetBool("realserver-health-gating")
+	config.RealServerTunnel = viper.GetBool("realserver-tunnel")
+	config.RealServerDrainDelay = viper.GetDuration("realserver-drain-delay")
+	config.RealServerHealthChecks = viper.GetStringSlice("realserver-health-check")
+	config.RealServerHealthCheckTimeout = viper.GetDuration("realserver-health-check-timeout")
 
 	if c, err := NewCoordinatorConfig(viper.GetStringSlice("coordinator-port")); err != nil {
 		config.Coordinator = DefaultCoordinatorConfig()
@@ -304,7 +597,9 @@ func NewConfig(flags *pflag.FlagSet) *Config {
 	}
 
 	config.Net.LocalInterface = viper.GetString("compute-iface-local")
+	config.Net.TunnelInterface = viper.GetString("compute-iface-tunnel")
 	config.Net.Interface = viper.GetString("compute-iface")
+	config.Net.Interface6 = viper.GetString("compute-iface6")
 	config.Net.Gateway = viper.GetString("gateway")
 	config.Net.PrimaryIP = viper.GetString("primary-ip")
 
@@ -317,6 +612,15 @@ func NewConfig(flags *pflag.FlagSet) *Config {
 	config.IPVS.ColocationMode = viper.GetString("ipvs-colocation-mode")
 	config.IPVS.WeightOverride = viper.GetBool("ipvs-weight-override")
 	config.IPVS.IgnoreCordon = viper.GetBool("ipvs-ignore-node-cordon")
+	config.IPVS.DrainTaints = viper.GetStringSlice("node-drain-taint")
+	config.IPVS.Backend = viper.GetString("ipvs-backend")
+	config.IPVS.DrainGracePeriod = viper.GetDuration("ipvs-drain-grace-period")
+	config.IPVS.SyncInterface = viper.GetString("ipvs-sync-interface")
+	config.IPVS.SyncID = viper.GetInt("ipvs-sync-id")
+	config.IPVS.DryRun = viper.GetBool("ipvs-dry-run")
+	config.IPVS.WeightBalance.Enabled = viper.GetBool("ipvs-weight-balance")
+	config.IPVS.WeightBalance.Threshold = viper.GetFloat64("ipvs-weight-balance-threshold")
+	config.IPVS.WeightBalance.Interval = viper.GetDuration("ipvs-weight-balance-interval")
 
 	config.Arp.LoAnnounce = viper.GetInt("lo-announce")
 	config.Arp.LoIgnore = viper.GetInt("lo-ignore")
@@ -332,7 +636,24 @@ func NewConfig(flags *pflag.FlagSet) *Config {
 	config.DefaultListener.Service = viper.GetString("auto-configure-service")
 	config.DefaultListener.Port = viper.GetInt("auto-configure-port")
 
+	config.BGP.Backend = viper.GetString("bgp-backend")
 	config.BGP.Binary = viper.GetString("bgp-bin")
+	config.BGP.VtyshBinary = viper.GetString("bgp-vtysh-bin")
+	config.BGP.BirdcBinary = viper.GetString("bgp-birdc-bin")
+	config.BGP.BirdConfig = viper.GetString("bgp-bird-config")
+	config.BGP.ASN = viper.GetString("bgp-asn")
+	config.BGP.Peers = viper.GetStringSlice("bgp-peer")
+	config.BGP.NextHop = viper.GetString("bgp-nexthop")
+	config.BGP.NextHop6 = viper.GetString("bgp-nexthop6")
+	config.BGP.Aggregate = viper.GetBool("bgp-aggregate")
+	config.BGP.ParityInterval = viper.GetDuration("bgp-parity-interval")
+	config.BGP.ReconfigureInterval = viper.GetDuration("bgp-reconfigure-interval")
+	config.BGP.ReconfigureJitter = viper.GetDuration("bgp-reconfigure-jitter")
+	config.BGP.QuietPeriod = viper.GetDuration("bgp-quiet-period")
+	config.BGP.HAProxyTemplate = viper.GetString("haproxy-template")
+	config.BGP.HAProxyStatsPort = viper.GetInt("haproxy-stats-port")
+	config.BGP.HAProxyNameservers = viper.GetStringSlice("haproxy-nameservers")
+	config.BGP.ClusterDomain = viper.GetString("cluster-domain")
 
 	return config
 }
@@ -7,7 +7,6 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/director"
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/iptables"
@@ -45,6 +44,11 @@ are missing from the configuration.`,
 				return err
 			}
 
+			// select the primary interfaces of this node
+			if err := config.Net.SelectInterfaces(); err != nil {
+				return err
+			}
+
 			// write IPVS Sysctl flags to director node
 			if err := config.IPVS.WriteToNode(); err != nil {
 				return err
@@ -91,11 +95,11 @@ are missing from the configuration.`,
 
 			// listen for health
 			logger.Info("starting health endpoint")
-			go util.ListenForHealth(config.Net.Interface, 10201, logger)
+			go util.ListenForHealth(config.Net.Interfaces(), 10201, logger)
 
 			// instantiate a new IPVS manager
 			logger.Info("initializing ipvs helper")
-			ipvs, err := system.NewIPVS(ctx, config.Net.PrimaryIP, config.IPVS.WeightOverride, config.IPVS.IgnoreCordon, logger)
+			ipvs, err := system.NewIPVS(ctx, config.IPVS.Options(config.Net.PrimaryIP), logger)
 			if err != nil {
 				return err
 			}
@@ -118,19 +122,26 @@ are missing from the configuration.`,
 				return err
 			}
 
+			// announce the VIPs that move onto the primary interface
+			var announcer system.Announcer
+			if config.AnnounceCount > 0 {
+				announcer = system.NewAnnouncer(ctx, config.Net.Interface, config.AnnounceCount, config.AnnounceInterval, logger)
+			}
+
 			// instantiate an iptables interface
 			logger.Info("initializing iptables")
-			ipt, err := iptables.NewIPTables(ctx, stats.KindDirector, config.ConfigKey, config.PodCIDRMasq, config.IPTablesChain, config.IPTablesMasq, logger)
+			ipt, err := iptables.NewIPTables(ctx, stats.KindDirector, config.ConfigKey, config.PodCIDRMasq, config.IPTablesTable, config.IPTablesChain, config.IPTablesJumpFrom, config.IPTablesMasq, config.IPTablesIPSet, config.IPTablesNoFlush, config.IPTablesDryRun, config.IPTablesLockWait, logger)
 			if err != nil {
 				return err
 			}
 
 			// instantiate the director worker.
 			logger.Info("initializing director")
-			worker, err := director.NewDirector(ctx, config.NodeName, config.ConfigKey, config.CleanupMaster, watcher, ipvs, ip, ipt, config.IPVS.ColocationMode, config.ForcedReconfigure, logger)
+			worker, err := director.NewDirector(ctx, config.NodeName, config.ConfigKey, config.CleanupMaster, watcher, ipvs, ip, announcer, ipt, iptables.NewCapture(config.IPTablesCaptureDir, stats.KindDirector, config.IPTablesCaptureRetain), config.IPVS.ColocationMode, config.ForcedReconfigure, config.ForcedReconfigureInterval, logger)
 			if err != nil {
 				return err
 			}
+			serveAdmin(ctx, config.AdminPort, worker, logger)
 
 			// start the director
 			logger.Info("starting worker")
@@ -150,8 +161,5 @@ are missing from the configuration.`,
 		},
 	}
 
-	cmd.Flags().StringSlice("ipvs-sysctl", []string{""}, "sysctl setting for ipvs. can be passed multiple times. '--ipvs-sysctl=conntrack=0 --ipvs-sysctl=ignore_tunneled=0'")
-	viper.BindPFlag("ipvs-sysctl", cmd.Flags().Lookup("ipvs-sysctl"))
-
 	return cmd
 }
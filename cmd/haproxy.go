@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/haproxy"
+)
+
+// HAProxy creates the haproxy command for kube2ipvs, which holds the commands
+// for debugging the haproxy instances of the bgp worker
+func HAProxy(logger logrus.FieldLogger) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "haproxy",
+		Short: "debug the haproxy instances that serve the ipv6 addresses of ipv4 VIPs",
+	}
+	cmd.AddCommand(HAProxyRender(logger))
+	return cmd
+}
+
+// HAProxyRender creates the haproxy render command for kube2ipvs
+func HAProxyRender(logger logrus.FieldLogger) *cobra.Command {
+	var vipFile, bundleFile, configDir string
+
+	var cmd = &cobra.Command{
+		Use:          "render",
+		Short:        "print the haproxy configuration of a VIP",
+		SilenceUsage: true,
+		Long: `
+kube2ipvs haproxy render reads the JSON configuration of a VIP, as the bgp
+worker passes it to its haproxy instance, and prints the configuration that
+the instance would be started with, from the built-in template or the file
+of --haproxy-template, then exits. Nothing is written and haproxy is not
+started.
+
+e.g.
+  {"addr6": "2001:558:1044:100::10", "serviceAddrs": [["10.96.0.10:80"]], "listenPorts": [80]}`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config := NewConfig(cmd.Flags())
+			logger.Debugf("got config %+v", config)
+
+			configTemplate, err := haproxy.LoadTemplate(config.BGP.HAProxyTemplate)
+			if err != nil {
+				return err
+			}
+
+			var b []byte
+			if vipFile == "-" {
+				b, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				b, err = ioutil.ReadFile(vipFile)
+			}
+			if err != nil {
+				return fmt.Errorf("unable to read the VIP configuration. %v", err)
+			}
+			vip := haproxy.VIPConfig{}
+			if err := json.Unmarshal(b, &vip); err != nil {
+				return fmt.Errorf("unable to parse the VIP configuration. %v", err)
+			}
+
+			if bundleFile != "" {
+				vip.TLSBundle, err = ioutil.ReadFile(bundleFile)
+				if err != nil {
+					return fmt.Errorf("unable to read the TLS bundle. %v", err)
+				}
+			}
+
+			out, err := haproxy.Render(configTemplate, configDir, vip)
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(out))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&vipFile, "vip", "-", "file of the JSON configuration of the VIP, or - to read it from stdin")
+	cmd.Flags().StringVar(&bundleFile, "tls-bundle", "", "file of the PEM bundle that the VIP terminates TLS with, if any")
+	cmd.Flags().StringVar(&configDir, "config-dir", "/etc/ravel", "directory that the instance's socket and PEM bundle are placed in")
+	return cmd
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/iptables"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/system"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+)
+
+// IPTablesDiff creates the iptables-diff command for kube2ipvs
+func IPTablesDiff(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
+	var timeout time.Duration
+
+	var cmd = &cobra.Command{
+		Use:          "iptables-diff",
+		Short:        "print the iptables changes that the realserver would apply",
+		SilenceUsage: true,
+		Long: `
+kube2ipvs iptables-diff reads the configuration and the node of this host
+from kubernetes, as the realserver does, and prints a unified diff from the
+live iptables rules to the rules that the realserver would apply, then exits.
+Nothing is applied.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config := NewConfig(cmd.Flags())
+			logger.Debugf("got config %+v", config)
+
+			// validate flags
+			if err := config.Invalid(); err != nil {
+				return err
+			}
+
+			watcher, err := system.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindRealServer, config.DefaultListener.Service, config.DefaultListener.Port, logger)
+			if err != nil {
+				return err
+			}
+
+			// a dry run never applies the rules
+			ipt, err := iptables.NewIPTables(ctx, stats.KindRealServer, config.ConfigKey, config.PodCIDRMasq, config.IPTablesTable, config.IPTablesChain, config.IPTablesJumpFrom, config.IPTablesMasq, config.IPTablesIPSet, config.IPTablesNoFlush, true, config.IPTablesLockWait, logger)
+			if err != nil {
+				return err
+			}
+
+			clusterConfig, node, err := awaitRealServerConfig(ctx, watcher, config.NodeName, timeout)
+			if err != nil {
+				return err
+			}
+
+			diff, err := diffIPTables(ipt, node, clusterConfig, false)
+			if err != nil {
+				return err
+			}
+			if len(clusterConfig.Config6) > 0 {
+				diff6, err := diffIPTables(ipt, node, clusterConfig, true)
+				if err != nil {
+					return err
+				}
+				if diff6 != "" {
+					diff += "# ip6tables\n" + diff6
+				}
+			}
+
+			if diff == "" {
+				fmt.Println("no changes")
+				return nil
+			}
+			fmt.Print(diff)
+			return nil
+		},
+	}
+	cmd.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "how long to wait for the configuration and node from kubernetes")
+	return cmd
+}
+
+// awaitRealServerConfig waits for the first configuration and the node named
+// nodeName from the watcher.
+func awaitRealServerConfig(ctx context.Context, watcher system.Watcher, nodeName string, timeout time.Duration) (*types.ClusterConfig, types.Node, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	configs := make(chan *types.ClusterConfig, 1)
+	nodes := make(chan types.NodesList, 1)
+	watcher.ConfigMap(ctx, "iptables-diff", configs)
+	watcher.Nodes(ctx, "iptables-diff", nodes)
+
+	var config *types.ClusterConfig
+	var node types.Node
+	for config == nil || node.Name == "" {
+		select {
+		case <-ctx.Done():
+			return nil, node, fmt.Errorf("timed out waiting for the configuration and node %s. %v", nodeName, ctx.Err())
+		case config = <-configs:
+		case list := <-nodes:
+			for _, n := range list {
+				if n.Name == nodeName {
+					node = n
+				}
+			}
+		}
+	}
+	return config, node, nil
+}
+
+// diffIPTables generates and merges the iptables rules of node as the
+// realserver does, or the ip6tables rules when ipv6 is set, and returns the
+// diff from the live rules.
+func diffIPTables(ipt iptables.IPTables, node types.Node, config *types.ClusterConfig, ipv6 bool) (string, error) {
+	if ipv6 {
+		existing, err := ipt.Save6()
+		if err != nil {
+			return "", err
+		}
+		generated, err := ipt.GenerateRulesForNodes6(node, config, false)
+		if err != nil {
+			return "", err
+		}
+		merged, _, err := ipt.Merge6(generated, existing)
+		if err != nil {
+			return "", err
+		}
+		return iptables.Diff(existing, merged), nil
+	}
+
+	existing, err := ipt.Save()
+	if err != nil {
+		return "", err
+	}
+	generated, err := ipt.GenerateRulesForNodes(node, config, false)
+	if err != nil {
+		return "", err
+	}
+	merged, _, err := ipt.Merge(generated, existing)
+	if err != nil {
+		return "", err
+	}
+	return iptables.Diff(existing, merged), nil
+}
@@ -74,8 +74,10 @@ func init() {
 	rootCmd.PersistentFlags().String("config-key", "", "The identity of the configuration key that contains the configuration for this kube2ipvs instance in Kubernetes.")
 	rootCmd.PersistentFlags().String("config-namespace", "", "The namespace containing the configmap")
 	rootCmd.PersistentFlags().String("config-name", "", "The name of the configmap")
-	rootCmd.PersistentFlags().String("compute-iface", "", "The name of the desired inbound configKey interface for the director.")
+	rootCmd.PersistentFlags().String("compute-iface", "", "The primary interface that ipv4 traffic arrives on. A name, a glob such as 'en*' selecting the first matching interface that is up with an ipv4 address, or a CIDR selecting the first interface that is up with an address in it.")
+	rootCmd.PersistentFlags().String("compute-iface6", "", "The primary interface that ipv6 traffic arrives on, selected as for compute-iface by ipv6 address. Defaults to compute-iface.")
 	rootCmd.PersistentFlags().String("compute-iface-local", "lo", "The name of the local interface to use. Defaults to lo. Can also be dummy0")
+	rootCmd.PersistentFlags().String("compute-iface-tunnel", "tunl0", "The name of the IPIP tunnel interface that realservers bind tunnel-mode VIPs on.")
 	rootCmd.PersistentFlags().String("gateway", "", "primary inteface gateway")
 	rootCmd.PersistentFlags().String("nodename", "", "required field. the ip address of the node; its identity from kubernetes' standpoint.")
 	rootCmd.PersistentFlags().String("kubeconfig", "", "the path to the kubeconfig file containing a crt and key.")
@@ -83,12 +85,32 @@ func init() {
 
 	rootCmd.PersistentFlags().Bool("cleanup-master", false, "Cleanup IPVS master on shutdown")
 	rootCmd.PersistentFlags().String("pod-cidr-masq", "", "Pod CIDR used to exclude pod network from RDEI-MASQ rules")
-	rootCmd.PersistentFlags().Bool("forced-reconfigure", false, "Reconfigure happens every 10 minutes")
+	rootCmd.PersistentFlags().Bool("forced-reconfigure", false, "Reconfigure happens every forced-reconfigure-interval. can be toggled while running through the admin-port")
+	rootCmd.PersistentFlags().Duration("forced-reconfigure-interval", 10*time.Minute, "interval between forced reconfigurations of the director and realserver, when forced-reconfigure is set")
+	rootCmd.PersistentFlags().Duration("realserver-parity-interval", 60*time.Second, "interval at which the realserver reapplies its configuration regardless of updates")
+	rootCmd.PersistentFlags().Duration("realserver-drain-delay", 60*time.Second, "how long a realserver drained through POST /drain keeps its VIP addresses after removing their rules, so that established connections finish before the addresses are removed")
+	rootCmd.PersistentFlags().Bool("realserver-tunnel", false, "run the realserver in tunnel mode, for directors in other subnets that forward to it over IPIP. it loads the ipip module, brings up compute-iface-tunnel with rp_filter off and binds the VIPs forwarded in tunnel mode on it. otherwise those VIPs are not bound")
+	rootCmd.PersistentFlags().Bool("realserver-health-gating", false, "withdraw the realserver's VIP addresses and rules while its node is NotReady or fails a realserver-health-check, so that it stops accepting DSR traffic, and restore them once it recovers")
+	rootCmd.PersistentFlags().StringSlice("realserver-health-check", []string{}, "critical local check of the realserver's node, a shell command that must exit 0, e.g. 'systemctl is-active containerd'. may be repeated. only run with realserver-health-gating")
+	rootCmd.PersistentFlags().Duration("realserver-health-check-timeout", 5*time.Second, "how long each realserver-health-check may run before it fails")
 	rootCmd.PersistentFlags().Bool("ipvs-weight-override", false, "set all IPVS wrr weights to 1 regardless")
-	rootCmd.PersistentFlags().Bool("ipvs-ignore-node-cordon", false, "ignore cordoned flag when determining whether a node is an eligible backend")
+	rootCmd.PersistentFlags().Bool("ipvs-ignore-node-cordon", false, "ignore cordoned flag when determining whether a node is an eligible backend, and keep the realserver of a cordoned node in service")
+	rootCmd.PersistentFlags().StringSlice("node-drain-taint", []string{}, "taint key that takes a node out of service like a cordon, e.g. 'maintenance'. directors stop sending to the node and its realserver drains, and it rejoins once the taint is removed. may be repeated")
+	rootCmd.PersistentFlags().String("ipvs-backend", "ipvsadm", "how IPVS rules are applied. ipvsadm|netlink. netlink programs the kernel directly, without exec'ing ipvsadm")
+	rootCmd.PersistentFlags().String("ipvs-sync-interface", "", "the interface the ipvs connection sync daemon multicasts on. directors sync as master, realservers as backup. empty disables the daemon")
+	rootCmd.PersistentFlags().Int("ipvs-sync-id", 0, "the ipvs sync daemon id, 0-255, that sets apart the sync messages of directors sharing a network")
+	rootCmd.PersistentFlags().Bool("ipvs-dry-run", false, "log the ipvs rules that a configuration change would apply, without applying them. for previewing a configmap change on a canary node")
+	rootCmd.PersistentFlags().StringSlice("ipvs-sysctl", []string{""}, "sysctl setting for ipvs. can be passed multiple times. '--ipvs-sysctl=conntrack=0 --ipvs-sysctl=ignore_tunneled=0'. directors write them all at startup. conn_reuse_mode and expire_nodest_conn are also kept in place by every worker as it runs")
+	rootCmd.PersistentFlags().Bool("ipvs-weight-balance", false, "adjust realserver weights from their active connection counts, lowering the weights of hot nodes and raising them again as they cool. balanced weights are expressed in hundredths")
+	rootCmd.PersistentFlags().Float64("ipvs-weight-balance-threshold", 0.25, "how far, as a fraction, a realserver's active connections per unit of weight must stray from its service's mean before its weight is adjusted")
+	rootCmd.PersistentFlags().Duration("ipvs-weight-balance-interval", time.Minute, "the least time between two adjustments of one realserver's weight")
+	rootCmd.PersistentFlags().Duration("ipvs-drain-grace-period", 60*time.Second, "how long a realserver that is no longer a backend is kept at weight 0, finishing its established connections, before it is deleted. 0 deletes it right away")
 
 	rootCmd.PersistentFlags().String("iptables-chain", "RAVEL", "The name of the iptables chain to use.")
+	rootCmd.PersistentFlags().String("iptables-table", "nat", "the iptables table that holds ravel's chains. the generated DNAT rules require a table that supports them")
+	rootCmd.PersistentFlags().String("iptables-jump-from", "PREROUTING", "the chain of iptables-table that jumps to iptables-chain. a custom chain is created if it does not exist, and must be jumped to by something else")
 	rootCmd.PersistentFlags().Int("failover-timeout", 1, "number of seconds for the realserver to wait before reconfiguring itself")
+	rootCmd.PersistentFlags().Int("admin-port", 0, "port on 127.0.0.1 that serves the worker's current view at /state, for debugging: the config and nodes it last received, when it last received an update and reconfigured, and its queue depths. It also drains and undrains the worker at /drain. 0 disables it")
 
 	rootCmd.PersistentFlags().Int("lo-announce", 0, "arp_announce setting for loopback interface")
 	rootCmd.PersistentFlags().Int("lo-ignore", 0, "arp_ignore setting for loopback interface")
@@ -98,7 +120,24 @@ func init() {
 	rootCmd.PersistentFlags().String("calico-version", "2", "calico major version. interfaces change between 2 and 3.")
 	rootCmd.PersistentFlags().String("calico-dir", "/etc/calico/ravel", "Directory on disk where calico IPPool configurations are written")
 	rootCmd.PersistentFlags().String("calico-bin", "/usr/local/bin/calicoctl", "path to calico binary")
+	rootCmd.PersistentFlags().String("bgp-backend", "gobgp", "bgp daemon that VIPs are advertised through. one of gobgp, frr or bird. frr and bird require bgp-asn. for frr, the bgpd instance for it must already be configured. for bird, bird.conf must include bgp-bird-config.")
 	rootCmd.PersistentFlags().String("bgp-bin", "/bin/gobgp", "path to gobgp binary")
+	rootCmd.PersistentFlags().String("bgp-vtysh-bin", "/usr/bin/vtysh", "path to frr's vtysh binary, for the frr bgp backend")
+	rootCmd.PersistentFlags().String("bgp-birdc-bin", "/usr/sbin/birdc", "path to the birdc binary, for the bird bgp backend")
+	rootCmd.PersistentFlags().String("bgp-bird-config", "/etc/bird/ravel.conf", "configuration file rendered for the bird bgp backend. it is overwritten on every change.")
+	rootCmd.PersistentFlags().String("bgp-asn", "", "local autonomous system number, asplain or asdot. 4 byte ASNs are supported. when empty, gobgpd's own configuration is used and the primary-ip is not applied as router id.")
+	rootCmd.PersistentFlags().StringSlice("bgp-peer", []string{}, "bgp neighbor managed by the bgp worker, as address,asn=N[,multihop=TTL][,extended-nexthop][,group=NAME], or interface=NAME,asn=N for unnumbered peering. may be repeated. replaced by the node's ravel.io/bgp-peer* annotations, when it has any. ipv6 neighbors carry ipv6 routes only, unless extended-nexthop is set.")
+	rootCmd.PersistentFlags().String("bgp-nexthop", "self", "next hop attached to ipv4 announcements. an ip address, or 'self' for the session address. an ipv6 address requires extended-nexthop peers. may be overridden per VIP by a routePolicy.")
+	rootCmd.PersistentFlags().Bool("bgp-aggregate", false, "advertise contiguous VIPs with identical route policies as summary prefixes instead of host routes. a summary is only formed when every address in it is a VIP.")
+	rootCmd.PersistentFlags().String("bgp-nexthop6", "", "next hop attached to ipv6 announcements. an ip address, or 'self' for the session address.")
+	rootCmd.PersistentFlags().Duration("bgp-parity-interval", 10*time.Second, "interval at which the bgp worker checks its peers, advertisements, loopback addresses and ipvs rules for drift and repairs it, whether or not a node or config update has arrived")
+	rootCmd.PersistentFlags().Duration("bgp-reconfigure-interval", 30*time.Second, "interval at which the bgp worker reapplies its configuration without a parity check")
+	rootCmd.PersistentFlags().Duration("bgp-reconfigure-jitter", 10*time.Second, "random delay of up to this long added to each mandatory periodic reconfiguration of the bgp worker, so that nodes do not reapply at the same time")
+	rootCmd.PersistentFlags().Duration("bgp-quiet-period", 5*time.Second, "the mandatory periodic reconfiguration of the bgp worker waits until no node or config update has arrived for this long")
+	rootCmd.PersistentFlags().String("haproxy-template", "", "file of a go template that replaces the built-in configuration of the haproxy instances that serve the ipv6 addresses of ipv4 VIPs, e.g. mounted from a ConfigMap, for site-specific logging, timeouts or compression. it is executed with the fields of the built-in template, and checked against a sample VIP at startup.")
+	rootCmd.PersistentFlags().Int("haproxy-stats-port", 0, "first port of the stats pages that the haproxy instances serve on 127.0.0.1, for inspecting the sessions of each VIP on a node. each instance is given the lowest free port from it, as logged when it is configured. 0 disables them.")
+	rootCmd.PersistentFlags().StringSlice("haproxy-nameservers", []string{}, "DNS server, as ip or ip:port, that the haproxy instances resolve the endpoints of haproxyDNS ports with, e.g. the cluster IP of the cluster DNS. may be repeated. the nameservers of the node's /etc/resolv.conf are used when none is given.")
+	rootCmd.PersistentFlags().String("cluster-domain", "cluster.local", "DNS domain of the cluster, that the SRV records of haproxyDNS ports are named in")
 	rootCmd.PersistentFlags().Bool("stats-enabled", false, "toggle to enable statistics collection. statistics will be collected from the specified interface device using libpcap. may have a performance implication.")
 	rootCmd.PersistentFlags().String("stats-interface", "", "specify the network interface to pcap for stats.")
 	rootCmd.PersistentFlags().String("stats-listen", "0.0.0.0", "listen address for prometheus endpoint")
@@ -115,8 +154,25 @@ Mode "iptables" will result in the worker writing iptables rules to capture inbo
 Mode "ipvs" will result in pod ip addresses being added to the ipvs configuraton. iptables and ipvs modes require the conntrack flag be set.`)
 	rootCmd.PersistentFlags().Bool("iptables-masq", true, "determines whether masquerade chain is used in generated iptables rules.")
 	viper.BindPFlag("iptables-masq", rootCmd.PersistentFlags().Lookup("iptables-masq"))
+	rootCmd.PersistentFlags().Bool("iptables-ipset", false, "match VIPs with hash:ip,port ipsets, one set per service, rather than a rule per VIP and port. requires the ipset binary and an iptables-chain of at most 10 characters")
+	viper.BindPFlag("iptables-ipset", rootCmd.PersistentFlags().Lookup("iptables-ipset"))
+	rootCmd.PersistentFlags().Bool("iptables-noflush", false, "apply only ravel's own chains, with iptables-restore --noflush, leaving the chains of kube-proxy, cni plugins and other agents in the nat table untouched")
+	viper.BindPFlag("iptables-noflush", rootCmd.PersistentFlags().Lookup("iptables-noflush"))
+	rootCmd.PersistentFlags().Bool("iptables-dry-run", false, "log a diff of the iptables rules that a configuration change would apply, without applying them")
+	viper.BindPFlag("iptables-dry-run", rootCmd.PersistentFlags().Lookup("iptables-dry-run"))
+	rootCmd.PersistentFlags().Duration("iptables-lock-wait", 2*time.Second, "how long iptables commands wait for the xtables lock held by kube-proxy, cni plugins and other agents, in whole seconds. operations that still cannot take it are retried with backoff")
+	viper.BindPFlag("iptables-lock-wait", rootCmd.PersistentFlags().Lookup("iptables-lock-wait"))
+	rootCmd.PersistentFlags().String("iptables-capture-dir", "/tmp", "directory that the rules of a failed iptables restore are written to, in a timestamped file with the error, the diff from the live rules and the node, for debugging")
+	viper.BindPFlag("iptables-capture-dir", rootCmd.PersistentFlags().Lookup("iptables-capture-dir"))
+	rootCmd.PersistentFlags().Int("iptables-capture-retain", 10, "how many of the newest failed iptables restores are kept in iptables-capture-dir. 0 captures none")
+	viper.BindPFlag("iptables-capture-retain", rootCmd.PersistentFlags().Lookup("iptables-capture-retain"))
 	viper.BindPFlag("ipvs-colocation-mode", rootCmd.PersistentFlags().Lookup("ipvs-colocation-mode"))
 	viper.BindPFlag("failover-timeout", rootCmd.PersistentFlags().Lookup("failover-timeout"))
+	rootCmd.PersistentFlags().Int("announce-count", 3, "how many gratuitous ARPs, or unsolicited neighbor advertisements for ipv6, the director sends of each VIP it adds to compute-iface, so that neighbors drop their stale entries. 0 sends none")
+	viper.BindPFlag("announce-count", rootCmd.PersistentFlags().Lookup("announce-count"))
+	rootCmd.PersistentFlags().Duration("announce-interval", time.Second, "the time between two announcements of a VIP")
+	viper.BindPFlag("announce-interval", rootCmd.PersistentFlags().Lookup("announce-interval"))
+	viper.BindPFlag("admin-port", rootCmd.PersistentFlags().Lookup("admin-port"))
 	viper.BindPFlag("auto-configure-service", rootCmd.PersistentFlags().Lookup("auto-configure-service"))
 	viper.BindPFlag("auto-configure-port", rootCmd.PersistentFlags().Lookup("auto-configure-port"))
 	viper.BindPFlag("coordinator-port", rootCmd.PersistentFlags().Lookup("coordinator-port"))
@@ -128,17 +184,38 @@ Mode "ipvs" will result in pod ip addresses being added to the ipvs configuraton
 	viper.BindPFlag("calico-version", rootCmd.PersistentFlags().Lookup("calico-version"))
 	viper.BindPFlag("calico-dir", rootCmd.PersistentFlags().Lookup("calico-dir"))
 	viper.BindPFlag("calico-bin", rootCmd.PersistentFlags().Lookup("calico-bin"))
+	viper.BindPFlag("bgp-backend", rootCmd.PersistentFlags().Lookup("bgp-backend"))
 	viper.BindPFlag("bgp-bin", rootCmd.PersistentFlags().Lookup("bgp-bin"))
+	viper.BindPFlag("bgp-vtysh-bin", rootCmd.PersistentFlags().Lookup("bgp-vtysh-bin"))
+	viper.BindPFlag("bgp-birdc-bin", rootCmd.PersistentFlags().Lookup("bgp-birdc-bin"))
+	viper.BindPFlag("bgp-bird-config", rootCmd.PersistentFlags().Lookup("bgp-bird-config"))
+	viper.BindPFlag("bgp-asn", rootCmd.PersistentFlags().Lookup("bgp-asn"))
+	viper.BindPFlag("bgp-peer", rootCmd.PersistentFlags().Lookup("bgp-peer"))
+	viper.BindPFlag("bgp-nexthop", rootCmd.PersistentFlags().Lookup("bgp-nexthop"))
+	viper.BindPFlag("bgp-aggregate", rootCmd.PersistentFlags().Lookup("bgp-aggregate"))
+	viper.BindPFlag("bgp-nexthop6", rootCmd.PersistentFlags().Lookup("bgp-nexthop6"))
+	viper.BindPFlag("bgp-parity-interval", rootCmd.PersistentFlags().Lookup("bgp-parity-interval"))
+	viper.BindPFlag("bgp-reconfigure-interval", rootCmd.PersistentFlags().Lookup("bgp-reconfigure-interval"))
+	viper.BindPFlag("bgp-reconfigure-jitter", rootCmd.PersistentFlags().Lookup("bgp-reconfigure-jitter"))
+	viper.BindPFlag("bgp-quiet-period", rootCmd.PersistentFlags().Lookup("bgp-quiet-period"))
+	viper.BindPFlag("haproxy-template", rootCmd.PersistentFlags().Lookup("haproxy-template"))
+	viper.BindPFlag("haproxy-stats-port", rootCmd.PersistentFlags().Lookup("haproxy-stats-port"))
+	viper.BindPFlag("haproxy-nameservers", rootCmd.PersistentFlags().Lookup("haproxy-nameservers"))
+	viper.BindPFlag("cluster-domain", rootCmd.PersistentFlags().Lookup("cluster-domain"))
 	viper.BindPFlag("config-key", rootCmd.PersistentFlags().Lookup("config-key"))
 	viper.BindPFlag("config-namespace", rootCmd.PersistentFlags().Lookup("config-namespace"))
 	viper.BindPFlag("config-name", rootCmd.PersistentFlags().Lookup("config-name"))
 	viper.BindPFlag("compute-iface", rootCmd.PersistentFlags().Lookup("compute-iface"))
+	viper.BindPFlag("compute-iface6", rootCmd.PersistentFlags().Lookup("compute-iface6"))
 	viper.BindPFlag("compute-iface-local", rootCmd.PersistentFlags().Lookup("compute-iface-local"))
+	viper.BindPFlag("compute-iface-tunnel", rootCmd.PersistentFlags().Lookup("compute-iface-tunnel"))
 	viper.BindPFlag("gateway", rootCmd.PersistentFlags().Lookup("gateway"))
 	viper.BindPFlag("nodename", rootCmd.PersistentFlags().Lookup("nodename"))
 	viper.BindPFlag("kubeconfig", rootCmd.PersistentFlags().Lookup("kubeconfig"))
 	viper.BindPFlag("primary-ip", rootCmd.PersistentFlags().Lookup("primary-ip"))
 	viper.BindPFlag("iptables-chain", rootCmd.PersistentFlags().Lookup("iptables-chain"))
+	viper.BindPFlag("iptables-table", rootCmd.PersistentFlags().Lookup("iptables-table"))
+	viper.BindPFlag("iptables-jump-from", rootCmd.PersistentFlags().Lookup("iptables-jump-from"))
 	viper.BindPFlag("lo-announce", rootCmd.PersistentFlags().Lookup("lo-announce"))
 	viper.BindPFlag("lo-ignore", rootCmd.PersistentFlags().Lookup("lo-ignore"))
 	viper.BindPFlag("primary-announce", rootCmd.PersistentFlags().Lookup("primary-announce"))
@@ -146,8 +223,25 @@ Mode "ipvs" will result in pod ip addresses being added to the ipvs configuraton
 	viper.BindPFlag("cleanup-master", rootCmd.PersistentFlags().Lookup("cleanup-master"))
 	viper.BindPFlag("pod-cidr-masq", rootCmd.PersistentFlags().Lookup("pod-cidr-masq"))
 	viper.BindPFlag("forced-reconfigure", rootCmd.PersistentFlags().Lookup("forced-reconfigure"))
+	viper.BindPFlag("forced-reconfigure-interval", rootCmd.PersistentFlags().Lookup("forced-reconfigure-interval"))
+	viper.BindPFlag("realserver-parity-interval", rootCmd.PersistentFlags().Lookup("realserver-parity-interval"))
+	viper.BindPFlag("realserver-drain-delay", rootCmd.PersistentFlags().Lookup("realserver-drain-delay"))
+	viper.BindPFlag("realserver-tunnel", rootCmd.PersistentFlags().Lookup("realserver-tunnel"))
+	viper.BindPFlag("realserver-health-gating", rootCmd.PersistentFlags().Lookup("realserver-health-gating"))
+	viper.BindPFlag("realserver-health-check", rootCmd.PersistentFlags().Lookup("realserver-health-check"))
+	viper.BindPFlag("realserver-health-check-timeout", rootCmd.PersistentFlags().Lookup("realserver-health-check-timeout"))
 	viper.BindPFlag("ipvs-weight-override", rootCmd.PersistentFlags().Lookup("ipvs-weight-override"))
 	viper.BindPFlag("ipvs-ignore-node-cordon", rootCmd.PersistentFlags().Lookup("ipvs-ignore-node-cordon"))
+	viper.BindPFlag("node-drain-taint", rootCmd.PersistentFlags().Lookup("node-drain-taint"))
+	viper.BindPFlag("ipvs-backend", rootCmd.PersistentFlags().Lookup("ipvs-backend"))
+	viper.BindPFlag("ipvs-drain-grace-period", rootCmd.PersistentFlags().Lookup("ipvs-drain-grace-period"))
+	viper.BindPFlag("ipvs-sync-interface", rootCmd.PersistentFlags().Lookup("ipvs-sync-interface"))
+	viper.BindPFlag("ipvs-sync-id", rootCmd.PersistentFlags().Lookup("ipvs-sync-id"))
+	viper.BindPFlag("ipvs-dry-run", rootCmd.PersistentFlags().Lookup("ipvs-dry-run"))
+	viper.BindPFlag("ipvs-sysctl", rootCmd.PersistentFlags().Lookup("ipvs-sysctl"))
+	viper.BindPFlag("ipvs-weight-balance", rootCmd.PersistentFlags().Lookup("ipvs-weight-balance"))
+	viper.BindPFlag("ipvs-weight-balance-threshold", rootCmd.PersistentFlags().Lookup("ipvs-weight-balance-threshold"))
+	viper.BindPFlag("ipvs-weight-balance-interval", rootCmd.PersistentFlags().Lookup("ipvs-weight-balance-interval"))
 }
 
 func main() {
@@ -160,7 +254,10 @@ func main() {
 
 	rootCmd.AddCommand(Director(ctx, log))
 	rootCmd.AddCommand(RealServer(ctx, log))
+	rootCmd.AddCommand(Colocated(ctx, log))
 	rootCmd.AddCommand(BGP(ctx, log))
+	rootCmd.AddCommand(IPTablesDiff(ctx, log))
+	rootCmd.AddCommand(HAProxy(log))
 	rootCmd.AddCommand(Version())
 
 	// Performing a nonblocking run of the application, reading error state through a chan.
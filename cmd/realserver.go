@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -40,6 +41,11 @@ are missing from the configuration.`,
 				return err
 			}
 
+			// select the primary interfaces of this node
+			if err := config.Net.SelectInterfaces(); err != nil {
+				return err
+			}
+
 			// instantiate a watcher
 			watcher, err := system.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindRealServer, config.DefaultListener.Service, config.DefaultListener.Port, logger)
 			if err != nil {
@@ -72,7 +78,7 @@ are missing from the configuration.`,
 			emitVersionMetric(stats.KindRealServer, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey)
 
 			// listen for health
-			go util.ListenForHealth(config.Net.Interface, 10200, logger)
+			go util.ListenForHealth(config.Net.Interfaces(), 10200, logger)
 
 			// instantiate an IP helper for loopback
 			logger.Info("initializing loopback helper")
@@ -81,6 +87,16 @@ are missing from the configuration.`,
 				return err
 			}
 
+			// instantiate an IP helper for the tunnel interface, for VIPs forwarded in tunnel mode
+			var ipTunnel system.IP
+			if config.RealServerTunnel {
+				logger.Info("initializing tunnel helper")
+				ipTunnel, err = system.NewIP(ctx, config.Net.TunnelInterface, config.Net.Gateway, config.Arp.LoAnnounce, config.Arp.LoIgnore, logger)
+				if err != nil {
+					return err
+				}
+			}
+
 			// instantiate an IP helper for primary interface
 			logger.Info("initializing primary helper")
 			ipPrimary, err := system.NewIP(ctx, config.Net.Interface, config.Net.Gateway, config.Arp.PrimaryAnnounce, config.Arp.PrimaryIgnore, logger)
@@ -90,25 +106,60 @@ are missing from the configuration.`,
 
 			// instantiate an iptables interface
 			logger.Info("initializing iptables helper")
-			ipt, err := iptables.NewIPTables(ctx, stats.KindRealServer, config.ConfigKey, config.PodCIDRMasq, config.IPTablesChain, config.IPTablesMasq, logger)
+			ipt, err := iptables.NewIPTables(ctx, stats.KindRealServer, config.ConfigKey, config.PodCIDRMasq, config.IPTablesTable, config.IPTablesChain, config.IPTablesJumpFrom, config.IPTablesMasq, config.IPTablesIPSet, config.IPTablesNoFlush, config.IPTablesDryRun, config.IPTablesLockWait, logger)
 			if err != nil {
 				return err
 			}
 
 			// instantiate a new IPVS manager
 			logger.Info("initializing ipvs helper")
-			ipvs, err := system.NewIPVS(ctx, config.Net.PrimaryIP, config.IPVS.WeightOverride, config.IPVS.IgnoreCordon, logger)
+			ipvs, err := system.NewIPVS(ctx, config.IPVS.Options(config.Net.PrimaryIP), logger)
 			if err != nil {
 				return err
 			}
 
+			// evaluate the node's local health, if its VIPs are gated on it
+			var health realserver.HealthEvaluator
+			if config.RealServerHealthGating {
+				evaluators := realserver.HealthEvaluators{realserver.NodeReady{}}
+				for _, check := range config.RealServerHealthChecks {
+					if check != "" {
+						evaluators = append(evaluators, realserver.CommandCheck{Command: check, Timeout: config.RealServerHealthCheckTimeout})
+					}
+				}
+				health = evaluators
+			}
+
 			// instantiate the realserver worker.
 			logger.Info("initializing realserver")
-			worker, err := realserver.NewRealServer(ctx, config.NodeName, config.ConfigKey, watcher, ipPrimary, ipLoopback, ipvs, ipt, config.ForcedReconfigure, logger)
+			worker, err := realserver.NewRealServer(ctx, realserver.Options{
+				NodeName:                  config.NodeName,
+				ConfigKey:                 config.ConfigKey,
+				Watcher:                   watcher,
+				IPPrimary:                 ipPrimary,
+				IPLoopback:                ipLoopback,
+				IPTunnel:                  ipTunnel,
+				IPVS:                      ipvs,
+				IPTables:                  ipt,
+				Capture:                   iptables.NewCapture(config.IPTablesCaptureDir, stats.KindRealServer, config.IPTablesCaptureRetain),
+				ForcedReconfigure:         config.ForcedReconfigure,
+				ForcedReconfigureInterval: config.ForcedReconfigureInterval,
+				ParityInterval:            config.RealServerParityInterval,
+				DrainDelay:                config.RealServerDrainDelay,
+				IgnoreCordon:              config.IPVS.IgnoreCordon,
+				DrainTaints:               config.IPVS.DrainTaints,
+				Health:                    health,
+			}, logger)
 			if err != nil {
 				return err
 			}
 
+			// report readiness and status through the stats-port server, and
+			// drain and undrain through the localhost admin port
+			http.HandleFunc("/ready", readyHandler(worker))
+			http.HandleFunc("/status", statusHandler(worker))
+			serveAdmin(ctx, config.AdminPort, worker, logger)
+
 			logger.Infof("starting continuous poll to find director, using 127.0.0.1:%d", config.Coordinator.Ports[0])
 			cm := NewCoordinationMetrics(stats.KindRealServer)
 			return blockForever(ctx, worker, config.Coordinator.Ports[0], config.FailoverTimeout, cm, logger)
@@ -118,6 +169,18 @@ are missing from the configuration.`,
 	return cmd
 }
 
+// readyHandler answers 200 once the realserver accepts traffic, and 503 with
+// the stage it is in until then, for a readiness probe.
+func readyHandler(worker realserver.RealServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if err := worker.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
 func blockForever(ctx context.Context, worker realserver.RealServer, port, maxTries int, cm *coordinationMetrics, logger logrus.FieldLogger) error {
 	controlChan := make(chan bool)
 	go watchForMaster(ctx, port, controlChan)
@@ -11,6 +11,9 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
 )
 
 type mockWorker struct {
@@ -24,7 +27,18 @@ func (m *mockWorker) Start() error {
 	}
 	return nil
 }
-func (m *mockWorker) Stop() error { return nil }
+func (m *mockWorker) Stop() error    { return nil }
+func (m *mockWorker) Drain() error   { return nil }
+func (m *mockWorker) Undrain() error { return nil }
+func (m *mockWorker) Ready() error   { return nil }
+func (m *mockWorker) Health() error  { return nil }
+func (m *mockWorker) Status() types.WorkerStatus {
+	return types.WorkerStatus{}
+}
+func (m *mockWorker) SetForcedReconfigure(bool) {}
+func (m *mockWorker) State() types.WorkerState {
+	return types.WorkerState{}
+}
 func (m *mockWorker) drain() {
 	for len(m.started) > 0 {
 		<-m.started
@@ -38,13 +52,14 @@ func TestBlockForever(t *testing.T) {
 	logger := logrus.New()
 	maxTries := 2
 	worker := &mockWorker{make(chan bool)}
+	cm := NewCoordinationMetrics(stats.KindRealServer)
 
 	ln, port := testListener()
 	fmt.Println("got port ", port)
 
 	// base case
 	worker.drain()
-	go blockForever(ctx, worker, port, maxTries, logger)
+	go blockForever(ctx, worker, port, maxTries, cm, logger)
 	select {
 	case <-ctx.Done():
 		// pass
@@ -57,7 +72,7 @@ func TestBlockForever(t *testing.T) {
 	ctx, cxl = context.WithTimeout(context.Background(), 3000*time.Millisecond)
 	defer cxl()
 	worker.drain()
-	go blockForever(ctx, worker, 0, maxTries, logger)
+	go blockForever(ctx, worker, 0, maxTries, cm, logger)
 	select {
 	case <-ctx.Done():
 		t.Fatal("worker didn't start before context expired")
@@ -70,7 +85,7 @@ func TestBlockForever(t *testing.T) {
 	ctx, cxl = context.WithTimeout(context.Background(), 6000*time.Millisecond)
 	defer cxl()
 	worker.drain()
-	go blockForever(ctx, worker, port, maxTries, logger)
+	go blockForever(ctx, worker, port, maxTries, cm, logger)
 	select {
 	case <-time.After(500 * time.Millisecond):
 		fmt.Println("closed listener")
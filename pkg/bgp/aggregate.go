@@ -0,0 +1,100 @@
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Aggregate replaces runs of contiguous routes with the prefixes that cover
+// them exactly. Two routes are only combined when they carry the same path
+// attributes, and a summary is only formed when every address in it is
+// present, so traffic is never attracted for an address that is not a VIP.
+// When a VIP is removed from a summary, the summary breaks back up into the
+// prefixes that remain.
+func Aggregate(routes []Route) []Route {
+	groups := map[string][]Route{}
+	keys := []string{}
+	for _, r := range routes {
+		k := r.attributeKey()
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], r)
+	}
+	sort.Strings(keys)
+
+	aggregated := []Route{}
+	for _, k := range keys {
+		group := groups[k]
+		prefixes := []string{}
+		for _, r := range group {
+			prefixes = append(prefixes, r.Prefix)
+		}
+		for _, prefix := range aggregatePrefixes(prefixes) {
+			r := group[0]
+			r.Prefix = prefix
+			aggregated = append(aggregated, r)
+		}
+	}
+	return aggregated
+}
+
+// attributeKey identifies the path attributes of a route.
+func (r Route) attributeKey() string {
+	return fmt.Sprintf("%s|%d|%d|%s|%d|%s", r.NextHop, r.LocalPref, r.MED, strings.Join(r.Communities, ","), r.Prepend, r.PeerGroup)
+}
+
+// aggregatePrefixes merges sibling prefixes into their parent until no two
+// siblings remain. Prefixes that cannot be parsed are returned unchanged.
+func aggregatePrefixes(prefixes []string) []string {
+	set := map[string]*net.IPNet{}
+	out := []string{}
+	for _, p := range prefixes {
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			out = append(out, p)
+			continue
+		}
+		set[n.String()] = n
+	}
+
+	for merged := true; merged; {
+		merged = false
+		for k, n := range set {
+			if _, ok := set[k]; !ok {
+				// merged into its parent earlier in this pass
+				continue
+			}
+			ones, bits := n.Mask.Size()
+			if ones == 0 {
+				continue
+			}
+			sibling := siblingOf(n)
+			if _, ok := set[sibling.String()]; !ok {
+				continue
+			}
+			parent := &net.IPNet{IP: n.IP.Mask(net.CIDRMask(ones-1, bits)), Mask: net.CIDRMask(ones-1, bits)}
+			delete(set, k)
+			delete(set, sibling.String())
+			set[parent.String()] = parent
+			merged = true
+		}
+	}
+
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// siblingOf returns the prefix that shares n's parent.
+func siblingOf(n *net.IPNet) *net.IPNet {
+	ones, bits := n.Mask.Size()
+	ip := make(net.IP, len(n.IP))
+	copy(ip, n.IP)
+	ip[(ones-1)/8] ^= 1 << uint(7-(ones-1)%8)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}
+}
@@ -1,12 +1,18 @@
 package bgp
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"net"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/Sirupsen/logrus"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
 )
 
 // The Controller provides an interface for configuring BGP.
@@ -14,40 +20,470 @@ import (
 // and it will manage the whole add/remove/change process.
 type Controller interface {
 
-	// Set receives a list of ip addresses and performs the necessary
-	// steps to configure each address in BGP.
-	Set(ctx context.Context, addresses []string) error
+	// Set receives a list of ipv4 routes and performs the necessary
+	// steps to configure each one in BGP. Routes that are advertised
+	// but absent from routes are withdrawn.
+	Set(ctx context.Context, routes []Route) error
 
-	// Teardown removes all addresses from BGP.
-	// Perhaps this will never be applied.
+	// Set6 is Set for the ipv6 address family. ipv4 and ipv6 routes are
+	// reconciled independently of one another.
+	Set6(ctx context.Context, routes []Route) error
+
+	// Get returns the ipv4 prefixes, in CIDR notation, that are currently
+	// originated by this node.
+	Get(ctx context.Context) ([]string, error)
+
+	// Get6 returns the originated ipv6 prefixes.
+	Get6(ctx context.Context) ([]string, error)
+
+	// SetPeers establishes sessions with the given peers, removing any
+	// sessions previously established by SetPeers that are no longer wanted.
+	// Sessions configured outside of the controller are left alone.
+	SetPeers(ctx context.Context, peers []Peer) error
+
+	// Status reports the state of the sessions established by SetPeers.
+	Status(ctx context.Context) ([]PeerStatus, error)
+
+	// Teardown withdraws every route that has been advertised, so that
+	// upstream routers stop sending traffic to this node.
 	Teardown(context.Context) error
 }
 
+// A Route is a prefix to be advertised along with the path attributes
+// to attach to it.
+type Route struct {
+	Prefix string
+
+	// NextHop overrides the next hop of the route's address family. It is an
+	// ip address, or types.NextHopSelf to advertise the session address. An
+	// ipv4 route may carry an ipv6 next hop when it is advertised over an
+	// extended next hop session.
+	NextHop string
+
+	// LocalPref and MED are attached to the route when non-zero.
+	LocalPref uint32
+	MED       uint32
+
+	// Communities are attached to the route, as accepted by gobgp.
+	Communities []string
+
+	// Prepend is the number of times to prepend the local ASN to the AS_PATH.
+	Prepend int
+
+	// PeerGroup limits the advertisement to peers with the same Group.
+	PeerGroup string
+}
+
+// NewRoute returns a host route for address carrying the attributes in policy,
+// which may be nil.
+func NewRoute(address string, policy *types.RoutePolicy) Route {
+	r := HostRoute(address)
+	if policy == nil {
+		return r
+	}
+	r.NextHop = policy.NextHop
+	r.LocalPref = policy.LocalPref
+	r.MED = policy.MED
+	r.Communities = policy.Communities
+	r.Prepend = policy.Prepend
+	r.PeerGroup = policy.PeerGroup
+	return r
+}
+
+// HostRoute returns a /32 or /128 route for address.
+func HostRoute(address string) Route {
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		return Route{Prefix: address + "/128"}
+	}
+	return Route{Prefix: address + "/32"}
+}
+
+// addressFamily holds the settings used to originate routes in one AFI.
+type addressFamily struct {
+	name    string
+	nextHop string
+}
+
+// nextHopFor returns the next hop to advertise with r, or an empty string if
+// gobgpd should advertise its own session address.
+func (a addressFamily) nextHopFor(r Route) string {
+	nextHop := a.nextHop
+	if r.NextHop != "" {
+		nextHop = r.NextHop
+	}
+	if nextHop == types.NextHopSelf {
+		return ""
+	}
+	return nextHop
+}
+
 type GoBGPDController struct {
 	commandPath string
-	logger      logrus.FieldLogger
+
+	// localASN and routerID start the gobgpd global configuration. When
+	// localASN is zero, gobgpd is expected to be configured by its own
+	// config file.
+	localASN      uint32
+	routerID      string
+	globalStarted bool
+
+	ipv4 addressFamily
+	ipv6 addressFamily
+
+	// peers are the sessions established by SetPeers, by Peer.Key
+	peers map[string]Peer
+
+	// groups tracks the gobgpd policy objects that implement peer groups
+	groups *peerGroups
+
+	logger logrus.FieldLogger
+}
+
+func (g *GoBGPDController) Set(ctx context.Context, routes []Route) error {
+	return g.set(ctx, g.ipv4, routes)
+}
+
+func (g *GoBGPDController) Set6(ctx context.Context, routes []Route) error {
+	return g.set(ctx, g.ipv6, routes)
+}
+
+func (g *GoBGPDController) set(ctx context.Context, afi addressFamily, routes []Route) error {
+	advertised, err := g.get(ctx, afi)
+	if err != nil {
+		return err
+	}
+
+	desired := map[string]bool{}
+	for _, r := range routes {
+		desired[r.Prefix] = true
+	}
+
+	if err := g.setPeerGroupRoutes(ctx, afi, routes); err != nil {
+		return err
+	}
+
+	// $PATH/gobgp global rib -a ipv4 add 10.54.213.148/32 [nexthop 10.131.153.70] [local-pref 200] ...
+	for _, r := range routes {
+		if r.PeerGroup != "" && !g.hasPeerGroup(r.PeerGroup) {
+			// without the group's export policy in place, the route would be
+			// advertised to every peer.
+			g.logger.Errorf("not advertising %s. peer group %q has no peers", r.Prefix, r.PeerGroup)
+			delete(desired, r.Prefix)
+			continue
+		}
+		g.logger.Debugf("Advertising route to %s", r.Prefix)
+		if err := g.run(ctx, g.routeArgs(afi, r)...); err != nil {
+			return fmt.Errorf("adding route %s with %v", r.Prefix, err)
+		}
+	}
+
+	// $PATH/gobgp global rib -a ipv4 del 10.54.213.148/32
+	for _, cidr := range advertised {
+		if desired[cidr] {
+			continue
+		}
+		g.logger.Infof("Withdrawing stale route to %s", cidr)
+		if err := g.run(ctx, "global", "rib", "-a", afi.name, "del", cidr); err != nil {
+			return fmt.Errorf("withdrawing route %s with %v", cidr, err)
+		}
+	}
+	return nil
+}
+
+// routeArgs returns the gobgp arguments that originate r.
+func (g *GoBGPDController) routeArgs(afi addressFamily, r Route) []string {
+	args := []string{"global", "rib", "-a", afi.name, "add", r.Prefix}
+	if nextHop := afi.nextHopFor(r); nextHop != "" {
+		args = append(args, "nexthop", nextHop)
+	}
+	if r.LocalPref > 0 {
+		args = append(args, "local-pref", strconv.FormatUint(uint64(r.LocalPref), 10))
+	}
+	if r.MED > 0 {
+		args = append(args, "med", strconv.FormatUint(uint64(r.MED), 10))
+	}
+	if len(r.Communities) > 0 {
+		args = append(args, "community", strings.Join(r.Communities, ","))
+	}
+	if r.Prepend > 0 {
+		if g.localASN == 0 {
+			g.logger.Warnf("not prepending to %s. the local asn is not configured", r.Prefix)
+		} else {
+			path := make([]string, r.Prepend)
+			for i := range path {
+				path[i] = strconv.FormatUint(uint64(g.localASN), 10)
+			}
+			args = append(args, "aspath", strings.Join(path, ","))
+		}
+	}
+	return args
+}
+
+func (g *GoBGPDController) Get(ctx context.Context) ([]string, error) {
+	return g.get(ctx, g.ipv4)
+}
+
+func (g *GoBGPDController) Get6(ctx context.Context) ([]string, error) {
+	return g.get(ctx, g.ipv6)
+}
+
+func (g *GoBGPDController) get(ctx context.Context, afi addressFamily) ([]string, error) {
+	// $PATH/gobgp global rib -a ipv4
+	args := []string{"global", "rib", "-a", afi.name}
+	out, err := exec.CommandContext(ctx, g.commandPath, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing routes with %s: %s", strings.Join(append([]string{g.commandPath}, args...), " "), err)
+	}
+	return parseRIB(out, g.localASN), nil
 }
 
-func (g *GoBGPDController) Set(ctx context.Context, addresses []string) error {
-	// $PATH/gobgp global rib -a ipv4 add 10.54.213.148/32
-	for _, address := range addresses {
-		cidr := address + "/32"
-		g.logger.Debugf("Advertising route to %s", cidr)
-		args := []string{"global", "rib", "-a", "ipv4", "add", cidr}
-		if err := exec.CommandContext(ctx, g.commandPath, args...).Run(); err != nil {
-			return fmt.Errorf("adding route %s with %s: %s", cidr, strings.Join(append([]string{g.commandPath}, args...), " "), err)
+func (g *GoBGPDController) SetPeers(ctx context.Context, peers []Peer) error {
+	if err := g.startGlobal(ctx); err != nil {
+		return err
+	}
+
+	desired := map[string]Peer{}
+	for _, p := range peers {
+		desired[p.Key()] = p
+	}
+
+	// $PATH/gobgp neighbor del 10.131.153.66
+	for key, p := range g.peers {
+		if d, ok := desired[key]; ok && d == p {
+			continue
+		}
+		g.logger.Infof("Removing BGP peer %s", p)
+		if err := g.run(ctx, append([]string{"neighbor", "del"}, p.neighborArgs()...)...); err != nil {
+			return fmt.Errorf("removing peer %s with %v", p, err)
+		}
+		delete(g.peers, key)
+	}
+
+	// $PATH/gobgp neighbor add 10.131.153.66 as 65001 family ipv4-unicast
+	// $PATH/gobgp neighbor add interface swp1 as 65001 family ipv6-unicast,ipv4-unicast
+	for key, p := range desired {
+		if _, ok := g.peers[key]; ok {
+			continue
+		}
+		g.logger.Infof("Adding BGP peer %s", p)
+		args := append([]string{"neighbor", "add"}, p.neighborArgs()...)
+		args = append(args, "as", strconv.FormatUint(uint64(p.ASN), 10), "family", strings.Join(p.families(), ","))
+		if p.MultihopTTL > 0 {
+			args = append(args, "ebgp-multihop-ttl", strconv.Itoa(int(p.MultihopTTL)))
+		}
+		err := g.run(ctx, args...)
+		if err != nil && strings.Contains(err.Error(), "existing") {
+			// left over from a previous run. replace it so that the session
+			// reflects the current settings.
+			if err = g.run(ctx, append([]string{"neighbor", "del"}, p.neighborArgs()...)...); err == nil {
+				err = g.run(ctx, args...)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("adding peer %s with %v", p, err)
 		}
+		g.peers[key] = p
 	}
+	return g.setPeerGroups(ctx)
+}
+
+// startGlobal configures the local ASN and router id, once.
+func (g *GoBGPDController) startGlobal(ctx context.Context) error {
+	if g.localASN == 0 || g.globalStarted {
+		return nil
+	}
+
+	// $PATH/gobgp global as 4200000001 router-id 10.131.153.70
+	g.logger.Infof("Starting BGP as %d with router id %s", g.localASN, g.routerID)
+	err := g.run(ctx, "global", "as", strconv.FormatUint(uint64(g.localASN), 10), "router-id", g.routerID)
+	if err != nil && !strings.Contains(err.Error(), "already") {
+		return fmt.Errorf("starting bgp with %v", err)
+	}
+	g.globalStarted = true
 	return nil
 }
 
-func (g *GoBGPDController) Teardown(context.Context) error {
-	// I suspect that we don't want to remove all addresses' routes,
-	// but rather one at a time, if any at all.
-	g.logger.Info("Tear down ALL BGP routes")
+func (g *GoBGPDController) Status(ctx context.Context) ([]PeerStatus, error) {
+	// $PATH/gobgp neighbor
+	out, err := exec.CommandContext(ctx, g.commandPath, "neighbor").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing neighbors with %s neighbor: %s", g.commandPath, err)
+	}
+	states := parseNeighbors(out)
+
+	keys := []string{}
+	for key := range g.peers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	statuses := []PeerStatus{}
+	for _, key := range keys {
+		p := g.peers[key]
+		name := p.Address
+		if p.Interface != "" {
+			name = p.Interface
+		}
+		status := PeerStatus{Peer: key, State: StateUnknown}
+		if state, ok := states[name]; ok {
+			status.State = state
+		}
+		if status.State == StateEstablished {
+			// $PATH/gobgp neighbor 10.131.153.66 adj-out -a ipv4
+			for _, family := range p.families() {
+				args := append([]string{"neighbor"}, p.neighborArgs()...)
+				args = append(args, "adj-out", "-a", strings.TrimSuffix(family, "-unicast"))
+				out, err := exec.CommandContext(ctx, g.commandPath, args...).Output()
+				if err != nil {
+					// gobgp exits non-zero when nothing is advertised
+					continue
+				}
+				status.Advertised += len(parseAdjOut(out))
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (g *GoBGPDController) Teardown(ctx context.Context) error {
+	// $PATH/gobgp global rib -a ipv4 del all
+	g.logger.Info("Withdrawing ALL BGP routes")
+	errs := []string{}
+	for _, afi := range []addressFamily{g.ipv4, g.ipv6} {
+		if err := g.run(ctx, "global", "rib", "-a", afi.name, "del", "all"); err != nil {
+			errs = append(errs, fmt.Sprintf("withdrawing %s routes with %v", afi.name, err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v", errs)
+}
+
+// run executes gobgp with args, folding the command line and its output into
+// the returned error.
+func (g *GoBGPDController) run(ctx context.Context, args ...string) error {
+	if out, err := exec.CommandContext(ctx, g.commandPath, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s. %s", strings.Join(append([]string{g.commandPath}, args...), " "), err, strings.TrimSpace(string(out)))
+	}
 	return nil
 }
 
-func NewBGPDController(executablePath string, logger logrus.FieldLogger) *GoBGPDController {
-	return &GoBGPDController{commandPath: executablePath, logger: logger}
+// parseRIB extracts the locally originated prefixes from the output of
+// `gobgp global rib`. The output looks like this:
+//
+//    Network              Next Hop             AS_PATH              Age        Attrs
+// *> 10.54.213.148/32     0.0.0.0                                   00:00:26   [{Origin: ?}]
+// *> 0.0.0.0/0            10.131.153.66        65001                3d 01:02:03 [{Origin: i}]
+//
+// *> 10.54.213.149/32     0.0.0.0              65000 65000          00:00:26   [{Origin: ?}]
+//
+// Routes learned from a peer carry the peer's AS in their AS_PATH, so only the
+// rows whose AS_PATH is empty or holds nothing but localASN, as prepended by
+// routeArgs, are returned.
+func parseRIB(b []byte, localASN uint32) []string {
+	seen := map[string]bool{}
+	prefixes := []string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "*") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimLeft(line, "*> "))
+		if len(fields) < 3 {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(fields[0]); err != nil {
+			continue
+		}
+		if !localPath(fields[2:], localASN) {
+			continue
+		}
+		if !seen[fields[0]] {
+			seen[fields[0]] = true
+			prefixes = append(prefixes, fields[0])
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// localPath reports whether the AS_PATH that starts fields, and runs up to the
+// age, is empty or made up of localASN alone.
+func localPath(fields []string, localASN uint32) bool {
+	local := strconv.FormatUint(uint64(localASN), 10)
+	for _, f := range fields {
+		if strings.Contains(f, ":") || strings.HasSuffix(f, "d") {
+			return true
+		}
+		if localASN == 0 || f != local {
+			return false
+		}
+	}
+	return false
+}
+
+// parseNeighbors returns the session state of each neighbor listed by
+// `gobgp neighbor`:
+//
+//	Peer              AS  Up/Down State       |#Received  Accepted
+//	10.131.153.66  65001 00:05:12 Establ      |        0         0
+//	172.16.0.1     65100    never Active      |        0         0
+func parseNeighbors(b []byte) map[string]string {
+	states := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "Peer" {
+			continue
+		}
+		// the up/down column may hold a space, so find the state by the
+		// separator that follows it.
+		for i, f := range fields {
+			if strings.HasPrefix(f, "|") && i > 0 {
+				states[fields[0]] = normalizeState(fields[i-1])
+				break
+			}
+		}
+	}
+	return states
+}
+
+// parseAdjOut returns the prefixes listed by `gobgp neighbor ADDR adj-out`:
+//
+//	   ID  Network              Next Hop             AS_PATH              Attrs
+//	   1   10.54.213.148/32     10.131.153.70        65000                [{Origin: ?}]
+func parseAdjOut(b []byte) []string {
+	prefixes := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		for _, f := range strings.Fields(scanner.Text()) {
+			if _, _, err := net.ParseCIDR(f); err == nil {
+				prefixes = append(prefixes, f)
+				break
+			}
+		}
+	}
+	return prefixes
+}
+
+// NewBGPDController returns a Controller that drives gobgpd through the gobgp
+// executable. localASN and routerID are applied to gobgpd before any peers
+// are added, unless localASN is zero. nextHop and nextHop6 are the default
+// next hops attached to ipv4 and ipv6 announcements, either an ip address or
+// types.NextHopSelf. An empty next hop is the same as types.NextHopSelf.
+func NewBGPDController(executablePath string, localASN uint32, routerID string, nextHop, nextHop6 string, logger logrus.FieldLogger) *GoBGPDController {
+	return &GoBGPDController{
+		commandPath: executablePath,
+		localASN:    localASN,
+		routerID:    routerID,
+		ipv4:        addressFamily{name: familyIPv4, nextHop: nextHop},
+		ipv6:        addressFamily{name: familyIPv6, nextHop: nextHop6},
+		peers:       map[string]Peer{},
+		groups:      newPeerGroups(),
+		logger:      logger,
+	}
 }
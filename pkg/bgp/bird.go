@@ -0,0 +1,432 @@
+package bgp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// BIRDController is a Controller for nodes standardized on BIRD 2. Rather than
+// issuing commands, it renders the VIPs and peers into a configuration file
+// that bird.conf includes, and has BIRD reload its configuration whenever the
+// rendered file changes. VIPs are originated by the static protocols ravel4
+// and ravel6, and each peer gets a bgp protocol that exports only those.
+//
+// Path attributes other than the next hop are set on the static routes. Next
+// hops and peer groups are applied in an export filter shared by the peers of
+// each group.
+type BIRDController struct {
+	commandPath string
+	configFile  string
+	localASN    uint32
+
+	ipv4 addressFamily
+	ipv6 addressFamily
+
+	// routes and peers are the desired state. Both are rendered on every
+	// change, so Set does not lose the peers and SetPeers does not lose
+	// the routes.
+	routes map[string][]Route
+	peers  []Peer
+
+	// rendered is the configuration BIRD last accepted
+	rendered []byte
+	template *template.Template
+
+	logger logrus.FieldLogger
+}
+
+type birdTemplateContext struct {
+	LocalASN uint32
+	Routes4  []birdRoute
+	Routes6  []birdRoute
+	Filters  []birdFilter
+	Peers    []birdPeer
+}
+
+type birdRoute struct {
+	Prefix     string
+	Attributes []string
+}
+
+type birdFilter struct {
+	Name     string
+	Reject   []string
+	NextHops []birdNextHop
+}
+
+type birdNextHop struct {
+	Prefix  string
+	NextHop string
+}
+
+type birdPeer struct {
+	Name        string
+	Address     string
+	ASN         uint32
+	MultihopTTL uint8
+	Channels    []birdChannel
+}
+
+type birdChannel struct {
+	Family          string
+	ExtendedNextHop bool
+	Filter          string
+}
+
+// birdCommunities maps the well-known communities accepted in a route policy
+// to BIRD's pair notation.
+var birdCommunities = map[string]string{
+	"no-export":           "(65535, 65281)",
+	"no-advertise":        "(65535, 65282)",
+	"no-export-subconfed": "(65535, 65283)",
+}
+
+func (b *BIRDController) Set(ctx context.Context, routes []Route) error {
+	b.routes[familyIPv4] = routes
+	if err := b.apply(ctx); err != nil {
+		return fmt.Errorf("advertising %s routes with %v", familyIPv4, err)
+	}
+	return nil
+}
+
+func (b *BIRDController) Set6(ctx context.Context, routes []Route) error {
+	b.routes[familyIPv6] = routes
+	if err := b.apply(ctx); err != nil {
+		return fmt.Errorf("advertising %s routes with %v", familyIPv6, err)
+	}
+	return nil
+}
+
+func (b *BIRDController) Get(ctx context.Context) ([]string, error) {
+	return b.get(ctx, "ravel4")
+}
+
+func (b *BIRDController) Get6(ctx context.Context) ([]string, error) {
+	return b.get(ctx, "ravel6")
+}
+
+// $PATH/birdc show route protocol ravel4
+func (b *BIRDController) get(ctx context.Context, protocol string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, b.commandPath, "show", "route", "protocol", protocol).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s show route: %v. %s", b.commandPath, err, strings.TrimSpace(string(out)))
+	}
+	return parseBIRDRoutes(out), nil
+}
+
+func (b *BIRDController) SetPeers(ctx context.Context, peers []Peer) error {
+	for _, p := range peers {
+		if p.Interface != "" {
+			return fmt.Errorf("peer %s: the bird backend does not support unnumbered peers", p)
+		}
+	}
+	b.peers = peers
+	if err := b.apply(ctx); err != nil {
+		return fmt.Errorf("configuring peers with %v", err)
+	}
+	return nil
+}
+
+func (b *BIRDController) Status(ctx context.Context) ([]PeerStatus, error) {
+	// $PATH/birdc show protocols all
+	out, err := exec.CommandContext(ctx, b.commandPath, "show", "protocols", "all").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s show protocols: %v. %s", b.commandPath, err, strings.TrimSpace(string(out)))
+	}
+	protocols := parseBIRDProtocols(out)
+
+	statuses := []PeerStatus{}
+	for _, p := range b.peers {
+		status, ok := protocols[birdPeerName(p)]
+		if !ok {
+			status = PeerStatus{State: StateUnknown}
+		}
+		status.Peer = p.Key()
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (b *BIRDController) Teardown(ctx context.Context) error {
+	b.logger.Info("Withdrawing ALL BGP routes")
+	b.routes = map[string][]Route{}
+	return b.apply(ctx)
+}
+
+// apply renders the desired state and, if it differs from the configuration
+// BIRD is running, writes and reloads it. When BIRD rejects the new file, the
+// previous one is put back. Before the first accepted configuration, that is
+// the file found on disk, or no file at all.
+func (b *BIRDController) apply(ctx context.Context) error {
+	out, err := b.render()
+	if err != nil {
+		return fmt.Errorf("error rendering bird configuration. %v", err)
+	}
+	if b.rendered != nil && bytes.Equal(out, b.rendered) {
+		return nil
+	}
+
+	previous := b.rendered
+	if previous == nil {
+		if previous, err = ioutil.ReadFile(b.configFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error reading bird configuration. %v", err)
+		}
+	}
+	if err := b.write(out); err != nil {
+		return fmt.Errorf("error writing bird configuration. %v", err)
+	}
+	if err := b.reload(ctx); err != nil {
+		var unroll error
+		if previous != nil {
+			unroll = b.write(previous)
+		} else {
+			unroll = os.Remove(b.configFile)
+		}
+		if unroll != nil {
+			b.logger.Errorf("unable to unroll bird config. config on disk and config in memory may be out of sync. %v", unroll)
+		}
+		return err
+	}
+	b.rendered = out
+	return nil
+}
+
+func (b *BIRDController) render() ([]byte, error) {
+	grouped := map[string]bool{}
+	for _, p := range b.peers {
+		grouped[p.Group] = true
+	}
+
+	c := birdTemplateContext{LocalASN: b.localASN}
+
+	// restricted holds the prefixes of each peer group, and nextHops the
+	// routes whose next hop is not the session address
+	restricted := map[string][]string{}
+	nextHops := []birdNextHop{}
+	for _, afi := range []addressFamily{b.ipv4, b.ipv6} {
+		for _, r := range b.routes[afi.name] {
+			if r.PeerGroup != "" {
+				if !grouped[r.PeerGroup] {
+					b.logger.Errorf("not advertising %s. peer group %q has no peers", r.Prefix, r.PeerGroup)
+					continue
+				}
+				restricted[r.PeerGroup] = append(restricted[r.PeerGroup], r.Prefix)
+			}
+			if nextHop := afi.nextHopFor(r); nextHop != "" {
+				nextHops = append(nextHops, birdNextHop{Prefix: r.Prefix, NextHop: nextHop})
+			}
+			route := birdRoute{Prefix: r.Prefix, Attributes: birdAttributes(r, b.localASN)}
+			if afi.name == familyIPv4 {
+				c.Routes4 = append(c.Routes4, route)
+			} else {
+				c.Routes6 = append(c.Routes6, route)
+			}
+		}
+	}
+
+	groups := []string{}
+	for group := range grouped {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		filter := birdFilter{Name: birdFilterName(group), NextHops: nextHops}
+		for other, prefixes := range restricted {
+			if other != group {
+				filter.Reject = append(filter.Reject, prefixes...)
+			}
+		}
+		sort.Strings(filter.Reject)
+		c.Filters = append(c.Filters, filter)
+	}
+
+	for _, p := range b.peers {
+		peer := birdPeer{
+			Name:        birdPeerName(p),
+			Address:     p.Address,
+			ASN:         p.ASN,
+			MultihopTTL: p.MultihopTTL,
+		}
+		filter := birdFilterName(p.Group)
+		peer.Channels = append(peer.Channels, birdChannel{Family: p.Family(), Filter: filter})
+		if p.ExtendedNextHop {
+			peer.Channels = append(peer.Channels, birdChannel{Family: familyIPv4, ExtendedNextHop: true, Filter: filter})
+		}
+		c.Peers = append(c.Peers, peer)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := b.template.Execute(buf, c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// birdPeerName returns the name of the bgp protocol of p.
+func birdPeerName(p Peer) string {
+	return "ravel_peer_" + strings.NewReplacer(".", "_", ":", "_").Replace(p.Address)
+}
+
+// birdAttributes returns the filter statements that set r's path attributes
+// on its static route.
+func birdAttributes(r Route, localASN uint32) []string {
+	attrs := []string{}
+	if r.LocalPref > 0 {
+		attrs = append(attrs, fmt.Sprintf("bgp_local_pref = %d;", r.LocalPref))
+	}
+	if r.MED > 0 {
+		attrs = append(attrs, fmt.Sprintf("bgp_med = %d;", r.MED))
+	}
+	for _, community := range r.Communities {
+		pair, ok := birdCommunities[community]
+		if !ok {
+			pair = "(" + strings.Replace(community, ":", ", ", 1) + ")"
+		}
+		attrs = append(attrs, fmt.Sprintf("bgp_community.add(%s);", pair))
+	}
+	for i := 0; i < r.Prepend; i++ {
+		attrs = append(attrs, fmt.Sprintf("bgp_path.prepend(%d);", localASN))
+	}
+	return attrs
+}
+
+// birdFilterName returns the name of the export filter of a peer group. Dashes
+// are not allowed in BIRD symbols, and underscores are not allowed in group
+// names, so the mapping is unambiguous.
+func birdFilterName(group string) string {
+	if group == "" {
+		return "ravel_export"
+	}
+	return "ravel_export_" + strings.Replace(group, "-", "_", -1)
+}
+
+// reload asks BIRD to read its configuration again.
+// $PATH/birdc configure
+func (b *BIRDController) reload(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, b.commandPath, "configure").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s configure: %v. %s", b.commandPath, err, strings.TrimSpace(string(out)))
+	}
+	// birdc exits zero when the configuration is rejected
+	if !bytes.Contains(out, []byte("Reconfigur")) {
+		return fmt.Errorf("%s configure: %s", b.commandPath, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// write replaces the existing configuration with the data stored in out, or else creates a new file.
+func (b *BIRDController) write(out []byte) error {
+	f, err := os.OpenFile(b.configFile, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(out)
+	return err
+}
+
+// parseBIRDRoutes returns the prefixes listed by `birdc show route`:
+//
+//	BIRD 2.0.7 ready.
+//	Table master4:
+//	10.54.213.148/32     unicast [ravel4 2020-06-01] * (200)
+//		dev lo
+func parseBIRDRoutes(out []byte) []string {
+	prefixes := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(scanner.Text(), " ") || strings.HasPrefix(scanner.Text(), "\t") {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(fields[0]); err == nil {
+			prefixes = append(prefixes, fields[0])
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// parseBIRDProtocols returns the status of each bgp protocol listed by
+// `birdc show protocols all`, by protocol name:
+//
+//	ravel_peer_10_131_153_66 BGP        ---        up     2020-06-01    Established
+//	  BGP state:          Established
+//	    Neighbor address: 10.131.153.66
+//	  Channel ipv4
+//	    Routes:         0 imported, 2 exported, 0 preferred
+func parseBIRDProtocols(out []byte) map[string]PeerStatus {
+	statuses := map[string]PeerStatus{}
+	name := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			name = ""
+			if len(fields) > 1 && fields[1] == "BGP" {
+				name = fields[0]
+				statuses[name] = PeerStatus{State: StateUnknown}
+			}
+			continue
+		}
+		if name == "" {
+			continue
+		}
+		status := statuses[name]
+		switch {
+		case len(fields) > 2 && fields[0] == "BGP" && fields[1] == "state:":
+			status.State = normalizeState(fields[2])
+		case fields[0] == "Routes:":
+			for i := 1; i+1 < len(fields); i++ {
+				if strings.TrimSuffix(fields[i+1], ",") != "exported" {
+					continue
+				}
+				if n, err := strconv.Atoi(fields[i]); err == nil {
+					status.Advertised += n
+				}
+			}
+		}
+		statuses[name] = status
+	}
+	return statuses
+}
+
+// NewBIRDController returns a Controller that renders its configuration to
+// configFile, which bird.conf must include, and reloads BIRD with the birdc
+// executable. nextHop and nextHop6 are as described for NewBGPDController.
+func NewBIRDController(executablePath, configFile string, localASN uint32, nextHop, nextHop6 string, logger logrus.FieldLogger) (*BIRDController, error) {
+	if localASN == 0 {
+		return nil, fmt.Errorf("the bird bgp backend requires the local asn")
+	}
+	t, err := template.New("bird").Parse(birdConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &BIRDController{
+		commandPath: executablePath,
+		configFile:  configFile,
+		localASN:    localASN,
+		ipv4:        addressFamily{name: familyIPv4, nextHop: nextHop},
+		ipv6:        addressFamily{name: familyIPv6, nextHop: nextHop6},
+		routes:      map[string][]Route{},
+		peers:       []Peer{},
+		template:    t,
+		logger:      logger,
+	}, nil
+}
@@ -0,0 +1,48 @@
+package bgp
+
+var birdConfig string = `
+# Autogenerated by Ravel. Do not change.
+
+protocol static ravel4 {
+	ipv4;
+{{- range .Routes4 }}
+	route {{ .Prefix }} via "lo"{{ if .Attributes }} { {{ range .Attributes }}{{ . }} {{ end }}}{{ end }};
+{{- end }}
+}
+
+protocol static ravel6 {
+	ipv6;
+{{- range .Routes6 }}
+	route {{ .Prefix }} via "lo"{{ if .Attributes }} { {{ range .Attributes }}{{ . }} {{ end }}}{{ end }};
+{{- end }}
+}
+{{ range .Filters }}
+filter {{ .Name }} {
+	if proto != "ravel4" && proto != "ravel6" then reject;
+{{- range .Reject }}
+	if net = {{ . }} then reject;
+{{- end }}
+{{- range .NextHops }}
+	if net = {{ .Prefix }} then bgp_next_hop = {{ .NextHop }};
+{{- end }}
+	accept;
+}
+{{ end }}
+{{- range .Peers }}
+protocol bgp {{ .Name }} {
+	local as {{ $.LocalASN }};
+	neighbor {{ .Address }} as {{ .ASN }};
+{{- if .MultihopTTL }}
+	multihop {{ .MultihopTTL }};
+{{- end }}
+{{- range .Channels }}
+	{{ .Family }} {
+{{- if .ExtendedNextHop }}
+		extended next hop on;
+{{- end }}
+		import none;
+		export filter {{ .Filter }};
+	};
+{{- end }}
+}
+{{ end }}`
@@ -0,0 +1,553 @@
+package bgp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// FRRController is a Controller that drives an FRRouting bgpd through vtysh,
+// for nodes that already run FRR. VIPs are originated with network statements
+// in the bgpd instance of the local ASN. Path attributes are applied with one
+// route-map per distinct set of attributes, and peer groups are enforced with
+// an outbound route-map per group that denies the prefix lists of every other
+// group.
+//
+// Only configuration named RAVEL-* and the networks and neighbors that Ravel
+// added are changed; the rest of the FRR configuration is left alone. Peer
+// group prefix lists are not cleared of entries left behind by a previous run.
+type FRRController struct {
+	commandPath string
+	localASN    uint32
+
+	ipv4 addressFamily
+	ipv6 addressFamily
+
+	// peers are the sessions established by SetPeers, by Peer.Key
+	peers map[string]Peer
+
+	// routeMaps are the attribute route-maps in use, per address family
+	routeMaps map[string]map[string]bool
+
+	// groupPrefixes are the contents of each peer group's prefix list, per
+	// address family
+	groupPrefixes map[string]map[string]map[string]bool
+
+	// exportRouteMaps are the outbound route-maps that have been defined
+	exportRouteMaps map[string]bool
+
+	logger logrus.FieldLogger
+}
+
+func (f *FRRController) Set(ctx context.Context, routes []Route) error {
+	return f.set(ctx, f.ipv4, routes)
+}
+
+func (f *FRRController) Set6(ctx context.Context, routes []Route) error {
+	return f.set(ctx, f.ipv6, routes)
+}
+
+func (f *FRRController) set(ctx context.Context, afi addressFamily, routes []Route) error {
+	advertised, err := f.get(ctx, afi)
+	if err != nil {
+		return err
+	}
+
+	if err := f.setPeerGroupRoutes(ctx, afi, routes); err != nil {
+		return err
+	}
+
+	desired := map[string]bool{}
+	routeMaps := map[string]bool{}
+	commands := []string{}
+	networks := []string{}
+	for _, r := range routes {
+		if r.PeerGroup != "" && !f.hasPeerGroup(r.PeerGroup) {
+			f.logger.Errorf("not advertising %s. peer group %q has no peers", r.Prefix, r.PeerGroup)
+			continue
+		}
+		desired[r.Prefix] = true
+
+		name, lines := f.routeMap(afi, r)
+		if !routeMaps[name] {
+			routeMaps[name] = true
+			commands = append(commands, lines...)
+		}
+		networks = append(networks, fmt.Sprintf("network %s route-map %s", r.Prefix, name))
+	}
+
+	// network statements are replaced in place, so additions go first and
+	// a route is never withdrawn while its attributes change.
+	commands = append(commands, f.routerCommands(afi)...)
+	commands = append(commands, networks...)
+	for _, prefix := range advertised {
+		if desired[prefix] {
+			continue
+		}
+		f.logger.Infof("Withdrawing stale route to %s", prefix)
+		commands = append(commands, "no network "+prefix)
+	}
+	if err := f.configure(ctx, commands...); err != nil {
+		return fmt.Errorf("advertising %s routes with %v", afi.name, err)
+	}
+
+	// drop the route-maps that no longer have any networks
+	stale := []string{}
+	for name := range f.routeMaps[afi.name] {
+		if !routeMaps[name] {
+			stale = append(stale, "no route-map "+name)
+		}
+	}
+	if len(stale) > 0 {
+		if err := f.configure(ctx, stale...); err != nil {
+			f.logger.Warnf("unable to remove stale route-maps. %v", err)
+		}
+	}
+	f.routeMaps[afi.name] = routeMaps
+	return nil
+}
+
+// routeMap returns the name of the route-map holding r's attributes and the
+// commands that define it. The name is derived from the attributes, so that
+// routes with the same policy share a route-map.
+func (f *FRRController) routeMap(afi addressFamily, r Route) (string, []string) {
+	h := fnv.New32a()
+	h.Write([]byte(afi.name + "|" + r.attributeKey()))
+	name := fmt.Sprintf("RAVEL-%s-%08x", strings.ToUpper(afi.name), h.Sum32())
+
+	lines := []string{"route-map " + name + " permit 10"}
+	if nextHop := afi.nextHopFor(r); nextHop != "" {
+		if afi.name == familyIPv6 {
+			lines = append(lines, "set ipv6 next-hop global "+nextHop)
+		} else {
+			lines = append(lines, "set ip next-hop "+nextHop)
+		}
+	}
+	if r.LocalPref > 0 {
+		lines = append(lines, fmt.Sprintf("set local-preference %d", r.LocalPref))
+	}
+	if r.MED > 0 {
+		lines = append(lines, fmt.Sprintf("set metric %d", r.MED))
+	}
+	if len(r.Communities) > 0 {
+		lines = append(lines, "set community "+strings.Join(r.Communities, " "))
+	}
+	if r.Prepend > 0 {
+		path := make([]string, r.Prepend)
+		for i := range path {
+			path[i] = strconv.FormatUint(uint64(f.localASN), 10)
+		}
+		lines = append(lines, "set as-path prepend "+strings.Join(path, " "))
+	}
+	return name, append(lines, "exit")
+}
+
+// routerCommands enters the address family of the bgpd instance.
+func (f *FRRController) routerCommands(afi addressFamily) []string {
+	return []string{
+		fmt.Sprintf("router bgp %d", f.localASN),
+		fmt.Sprintf("address-family %s unicast", afi.name),
+	}
+}
+
+func (f *FRRController) Get(ctx context.Context) ([]string, error) {
+	return f.get(ctx, f.ipv4)
+}
+
+func (f *FRRController) Get6(ctx context.Context) ([]string, error) {
+	return f.get(ctx, f.ipv6)
+}
+
+func (f *FRRController) get(ctx context.Context, afi addressFamily) ([]string, error) {
+	// $PATH/vtysh -c 'show running-config'
+	out, err := exec.CommandContext(ctx, f.commandPath, "-c", "show running-config").Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading running config with %s: %v", f.commandPath, err)
+	}
+	return parseFRRNetworks(out, f.localASN, afi.name), nil
+}
+
+func (f *FRRController) SetPeers(ctx context.Context, peers []Peer) error {
+	desired := map[string]Peer{}
+	for _, p := range peers {
+		desired[p.Key()] = p
+	}
+
+	commands := []string{fmt.Sprintf("router bgp %d", f.localASN)}
+	removed := []string{}
+	for key, p := range f.peers {
+		if d, ok := desired[key]; ok && d == p {
+			continue
+		}
+		f.logger.Infof("Removing BGP peer %s", p)
+		commands = append(commands, "no neighbor "+f.neighbor(p))
+		removed = append(removed, key)
+	}
+	added := map[string]Peer{}
+	for key, p := range desired {
+		if d, ok := f.peers[key]; !ok || d != p {
+			f.logger.Infof("Adding BGP peer %s", p)
+			commands = append(commands, f.peerCommands(p)...)
+			added[key] = p
+		}
+	}
+	if err := f.configure(ctx, commands...); err != nil {
+		return fmt.Errorf("configuring peers with %v", err)
+	}
+
+	// only record the peers once vtysh has applied them, so that a failed
+	// apply is retried on the next call
+	for _, key := range removed {
+		delete(f.peers, key)
+	}
+	for key, p := range added {
+		f.peers[key] = p
+	}
+	return f.setExportRouteMaps(ctx)
+}
+
+func (f *FRRController) neighbor(p Peer) string {
+	if p.Interface != "" {
+		return p.Interface
+	}
+	return p.Address
+}
+
+// peerCommands returns the commands, run in the router bgp context, that
+// define the session with p.
+func (f *FRRController) peerCommands(p Peer) []string {
+	n := f.neighbor(p)
+	asn := strconv.FormatUint(uint64(p.ASN), 10)
+
+	lines := []string{}
+	if p.Interface != "" {
+		lines = append(lines, fmt.Sprintf("neighbor %s interface remote-as %s", n, asn))
+	} else {
+		lines = append(lines, fmt.Sprintf("neighbor %s remote-as %s", n, asn))
+	}
+	if p.MultihopTTL > 0 {
+		lines = append(lines, fmt.Sprintf("neighbor %s ebgp-multihop %d", n, p.MultihopTTL))
+	}
+	if p.ExtendedNextHop {
+		lines = append(lines, fmt.Sprintf("neighbor %s capability extended-nexthop", n))
+	}
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		lines = append(lines, fmt.Sprintf("address-family %s unicast", family))
+		if strings.Contains(strings.Join(p.families(), ","), family+"-unicast") {
+			lines = append(lines,
+				fmt.Sprintf("neighbor %s activate", n),
+				fmt.Sprintf("neighbor %s route-map %s out", n, exportRouteMapName(p.Group)))
+		} else {
+			lines = append(lines, fmt.Sprintf("no neighbor %s activate", n))
+		}
+		lines = append(lines, "exit-address-family")
+	}
+	return lines
+}
+
+// exportRouteMapName is the outbound route-map for the members of group.
+// Peers without a group share RAVEL-EXPORT.
+func exportRouteMapName(group string) string {
+	if group == "" {
+		return "RAVEL-EXPORT"
+	}
+	return "RAVEL-EXPORT-" + group
+}
+
+func groupPrefixListName(group string, family string) string {
+	return fmt.Sprintf("RAVEL-PG-%s-%s", group, strings.ToUpper(family))
+}
+
+func (f *FRRController) hasPeerGroup(group string) bool {
+	for _, p := range f.peers {
+		if p.Group == group {
+			return true
+		}
+	}
+	return false
+}
+
+// groups returns the sorted names of the peer groups in use.
+func (f *FRRController) groups() []string {
+	seen := map[string]bool{}
+	groups := []string{}
+	for _, p := range f.peers {
+		if p.Group != "" && !seen[p.Group] {
+			seen[p.Group] = true
+			groups = append(groups, p.Group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// setExportRouteMaps rewrites the outbound route-maps. Each one denies the
+// prefix lists of every group other than the one it is applied to.
+func (f *FRRController) setExportRouteMaps(ctx context.Context) error {
+	groups := f.groups()
+	commands := []string{}
+	for name := range f.exportRouteMaps {
+		commands = append(commands, "no route-map "+name)
+	}
+	defined := map[string]bool{}
+	for _, member := range append([]string{""}, groups...) {
+		name := exportRouteMapName(member)
+		defined[name] = true
+		seq := 10
+		for _, other := range groups {
+			if other == member {
+				continue
+			}
+			for _, family := range []string{familyIPv4, familyIPv6} {
+				match := "ip"
+				if family == familyIPv6 {
+					match = "ipv6"
+				}
+				commands = append(commands,
+					fmt.Sprintf("route-map %s deny %d", name, seq),
+					fmt.Sprintf("match %s address prefix-list %s", match, groupPrefixListName(other, family)),
+					"exit")
+				seq += 10
+			}
+		}
+		commands = append(commands, fmt.Sprintf("route-map %s permit %d", name, seq), "exit")
+	}
+	if err := f.configure(ctx, commands...); err != nil {
+		return fmt.Errorf("configuring export route-maps with %v", err)
+	}
+	f.exportRouteMaps = defined
+	return nil
+}
+
+// setPeerGroupRoutes brings the prefix lists of the peer groups in line with
+// routes, before the routes themselves are advertised.
+func (f *FRRController) setPeerGroupRoutes(ctx context.Context, afi addressFamily, routes []Route) error {
+	listType, placeholder := "ip", "0.0.0.0/32"
+	if afi.name == familyIPv6 {
+		listType, placeholder = "ipv6", "::/128"
+	}
+
+	desired := map[string]map[string]bool{}
+	for _, group := range f.groups() {
+		desired[group] = map[string]bool{}
+	}
+	for _, r := range routes {
+		if _, ok := desired[r.PeerGroup]; ok {
+			desired[r.PeerGroup][r.Prefix] = true
+		}
+	}
+
+	if f.groupPrefixes[afi.name] == nil {
+		f.groupPrefixes[afi.name] = map[string]map[string]bool{}
+	}
+	current := f.groupPrefixes[afi.name]
+
+	commands := []string{}
+	for group, prefixes := range desired {
+		name := groupPrefixListName(group, afi.name)
+		if current[group] == nil {
+			// define the list with an entry that is never advertised, so
+			// that it exists before any of the group's routes do.
+			commands = append(commands, fmt.Sprintf("%s prefix-list %s seq 1 deny %s", listType, name, placeholder))
+			current[group] = map[string]bool{}
+		}
+		for prefix := range prefixes {
+			if !current[group][prefix] {
+				commands = append(commands, fmt.Sprintf("%s prefix-list %s permit %s", listType, name, prefix))
+				current[group][prefix] = true
+			}
+		}
+		for prefix := range current[group] {
+			if !prefixes[prefix] {
+				commands = append(commands, fmt.Sprintf("no %s prefix-list %s permit %s", listType, name, prefix))
+				delete(current[group], prefix)
+			}
+		}
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	if err := f.configure(ctx, commands...); err != nil {
+		return fmt.Errorf("configuring peer group prefix lists with %v", err)
+	}
+	return nil
+}
+
+func (f *FRRController) Status(ctx context.Context) ([]PeerStatus, error) {
+	// $PATH/vtysh -c 'show bgp summary json'
+	out, err := exec.CommandContext(ctx, f.commandPath, "-c", "show bgp summary json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading bgp summary with %s: %v", f.commandPath, err)
+	}
+	summary, err := parseFRRSummary(out)
+	if err != nil {
+		return nil, fmt.Errorf("reading bgp summary with %s: %v", f.commandPath, err)
+	}
+
+	keys := []string{}
+	for key := range f.peers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	statuses := []PeerStatus{}
+	for _, key := range keys {
+		status, ok := summary[f.neighbor(f.peers[key])]
+		if !ok {
+			status = PeerStatus{State: StateUnknown}
+		}
+		status.Peer = key
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// parseFRRSummary returns the status of each neighbor in the output of
+// `show bgp summary json`, keyed by neighbor address or interface name. The
+// summary holds one section per address family:
+//
+//	{"ipv4Unicast": {"peers": {"10.131.153.66": {"state": "Established", "pfxSnt": 2}}}}
+func parseFRRSummary(b []byte) (map[string]PeerStatus, error) {
+	families := map[string]struct {
+		Peers map[string]struct {
+			State  string `json:"state"`
+			PfxSnt int    `json:"pfxSnt"`
+		} `json:"peers"`
+	}{}
+	if err := json.Unmarshal(b, &families); err != nil {
+		return nil, err
+	}
+
+	statuses := map[string]PeerStatus{}
+	for _, family := range families {
+		for neighbor, p := range family.Peers {
+			status := statuses[neighbor]
+			status.State = normalizeState(p.State)
+			if status.State == StateEstablished {
+				status.Advertised += p.PfxSnt
+			}
+			statuses[neighbor] = status
+		}
+	}
+	return statuses, nil
+}
+
+func (f *FRRController) Teardown(ctx context.Context) error {
+	f.logger.Info("Withdrawing ALL BGP routes")
+	errs := []string{}
+	for _, afi := range []addressFamily{f.ipv4, f.ipv6} {
+		advertised, err := f.get(ctx, afi)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if len(advertised) == 0 {
+			continue
+		}
+		commands := f.routerCommands(afi)
+		for _, prefix := range advertised {
+			commands = append(commands, "no network "+prefix)
+		}
+		if err := f.configure(ctx, commands...); err != nil {
+			errs = append(errs, fmt.Sprintf("withdrawing %s routes with %v", afi.name, err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v", errs)
+}
+
+// configure runs commands in vtysh's configuration mode.
+func (f *FRRController) configure(ctx context.Context, commands ...string) error {
+	args := []string{"-c", "configure terminal"}
+	for _, c := range commands {
+		args = append(args, "-c", c)
+	}
+	out, err := exec.CommandContext(ctx, f.commandPath, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v. %s", f.commandPath, err, strings.TrimSpace(string(out)))
+	}
+	// vtysh exits zero for many rejected commands, reporting them on stdout
+	if bytes.Contains(out, []byte("% ")) {
+		return fmt.Errorf("%s: %s", f.commandPath, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// parseFRRNetworks returns the prefixes of the network statements that Ravel
+// added, with a RAVEL-* route-map, in the given address family of the router
+// bgp section of an FRR running config. Networks the operator configured are
+// not returned, so that they are never withdrawn:
+//
+// router bgp 65001
+//
+//	bgp router-id 10.131.153.70
+//	!
+//	address-family ipv4 unicast
+//	 network 10.54.213.148/32 route-map RAVEL-IPV4-1c2b3a4d
+//	exit-address-family
+//
+// !
+func parseFRRNetworks(b []byte, asn uint32, family string) []string {
+	prefixes := []string{}
+
+	inRouter, inFamily := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "router bgp "):
+			inRouter = trimmed == fmt.Sprintf("router bgp %d", asn)
+			inFamily = false
+		case inRouter && !strings.HasPrefix(line, " "):
+			inRouter, inFamily = false, false
+		case inRouter && strings.HasPrefix(trimmed, "address-family "):
+			inFamily = trimmed == fmt.Sprintf("address-family %s unicast", family)
+		case inRouter && trimmed == "exit-address-family":
+			inFamily = false
+		case inFamily && strings.HasPrefix(trimmed, "network "):
+			// only the networks Ravel added, tagged with its route-maps
+			fields := strings.Fields(trimmed)
+			if len(fields) != 4 || fields[2] != "route-map" || !strings.HasPrefix(fields[3], "RAVEL-") {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(fields[1]); err == nil {
+				prefixes = append(prefixes, fields[1])
+			}
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// NewFRRController returns a Controller that drives FRR with the vtysh
+// executable. The bgpd instance for localASN must already exist. nextHop and
+// nextHop6 are as described for NewBGPDController.
+func NewFRRController(executablePath string, localASN uint32, nextHop, nextHop6 string, logger logrus.FieldLogger) (*FRRController, error) {
+	if localASN == 0 {
+		return nil, fmt.Errorf("the frr bgp backend requires the local asn")
+	}
+	return &FRRController{
+		commandPath:     executablePath,
+		localASN:        localASN,
+		ipv4:            addressFamily{name: familyIPv4, nextHop: nextHop},
+		ipv6:            addressFamily{name: familyIPv6, nextHop: nextHop6},
+		peers:           map[string]Peer{},
+		routeMaps:       map[string]map[string]bool{},
+		groupPrefixes:   map[string]map[string]map[string]bool{},
+		exportRouteMaps: map[string]bool{},
+		logger:          logger,
+	}, nil
+}
@@ -0,0 +1,259 @@
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+)
+
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// PeerAnnotation prefixes the node annotations that describe the node's own
+// peers, in the format accepted by ParsePeer. Each annotation holds a single
+// peer, so a node with two peers carries e.g. ravel.io/bgp-peer-a and
+// ravel.io/bgp-peer-b.
+const PeerAnnotation = types.AnnotationPrefix + "bgp-peer"
+
+// A Peer is a BGP neighbor that the controller establishes a session with.
+// Peers are described on the command line as a comma-separated list whose
+// first element is the neighbor address, followed by key=value options, e.g.
+//
+//    10.131.153.66,asn=65001
+//    2001:558:1044:159::1,asn=65001
+//    172.16.0.1,asn=65100,multihop=4
+//    2001:558:1044:159::1,asn=65001,extended-nexthop
+//    10.131.153.67,asn=65001,group=edge
+//    interface=swp1,asn=65001
+//
+// multihop sets the eBGP multihop TTL, for peers such as route servers that
+// are several routed hops away. When it is omitted the session is single-hop.
+//
+// extended-nexthop negotiates the ipv4 address family on an ipv6 session, so
+// that ipv4 VIPs can be advertised with an ipv6 next hop (RFC 5549). gobgpd
+// advertises the extended next hop capability for such sessions.
+//
+// group places the peer in a peer group. VIPs whose route policy names a
+// peer group are advertised to the members of that group only.
+//
+// interface= in place of an address peers without a configured neighbor
+// address (BGP unnumbered), over the ipv6 link-local addresses of the named
+// interface, the way Cumulus and SONiC switches are usually set up. Both
+// address families are negotiated on an unnumbered session, ipv4 using
+// extended next hops. Unnumbered peers cannot be placed in a group.
+//
+// The address family of the session otherwise follows the neighbor address,
+// so that ipv4 and ipv6 announcements are negotiated on independent sessions.
+//
+// ASNs may be 4 bytes wide, as described by ParseASN. gobgpd advertises the
+// four-octet AS capability on every session and falls back to AS_TRANS for
+// peers that do not support it.
+type Peer struct {
+	Address         string
+	Interface       string
+	ASN             uint32
+	MultihopTTL     uint8
+	ExtendedNextHop bool
+	Group           string
+}
+
+// Key identifies the peer's session.
+func (p Peer) Key() string {
+	if p.Interface != "" {
+		return "interface=" + p.Interface
+	}
+	return p.Address
+}
+
+// neighborArgs returns the gobgp arguments naming the peer.
+func (p Peer) neighborArgs() []string {
+	if p.Interface != "" {
+		return []string{"interface", p.Interface}
+	}
+	return []string{p.Address}
+}
+
+// Family returns the address family of the peer's session.
+func (p Peer) Family() string {
+	if p.Interface != "" {
+		return familyIPv6
+	}
+	if ip := net.ParseIP(p.Address); ip != nil && ip.To4() == nil {
+		return familyIPv6
+	}
+	return familyIPv4
+}
+
+// families returns the gobgp address families to negotiate with the peer.
+func (p Peer) families() []string {
+	families := []string{p.Family() + "-unicast"}
+	if p.ExtendedNextHop || p.Interface != "" {
+		families = append(families, familyIPv4+"-unicast")
+	}
+	return families
+}
+
+func (p Peer) String() string {
+	s := fmt.Sprintf("%s,asn=%d", p.Key(), p.ASN)
+	if p.MultihopTTL > 0 {
+		s += fmt.Sprintf(",multihop=%d", p.MultihopTTL)
+	}
+	if p.ExtendedNextHop {
+		s += ",extended-nexthop"
+	}
+	if p.Group != "" {
+		s += ",group=" + p.Group
+	}
+	return s
+}
+
+// ParsePeer parses a peer description. See Peer for the format.
+func ParsePeer(s string) (Peer, error) {
+	p := Peer{}
+
+	parts := strings.Split(strings.TrimSpace(s), ",")
+	if strings.HasPrefix(parts[0], "interface=") {
+		p.Interface = strings.TrimPrefix(parts[0], "interface=")
+		if p.Interface == "" {
+			return p, fmt.Errorf("peer %q: interface name is required", s)
+		}
+	} else if net.ParseIP(parts[0]) != nil {
+		p.Address = parts[0]
+	} else {
+		return p, fmt.Errorf("peer %q: invalid address %q", s, parts[0])
+	}
+
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		switch kv[0] {
+		case "extended-nexthop":
+			if len(kv) != 1 {
+				return p, fmt.Errorf("peer %q: extended-nexthop takes no value", s)
+			}
+			if p.Family() != familyIPv6 {
+				return p, fmt.Errorf("peer %q: extended-nexthop requires an ipv6 peer", s)
+			}
+			p.ExtendedNextHop = true
+			continue
+		}
+		if len(kv) != 2 {
+			return p, fmt.Errorf("peer %q: option %q must be key=value", s, opt)
+		}
+		switch kv[0] {
+		case "asn":
+			asn, err := ParseASN(kv[1])
+			if err != nil {
+				return p, fmt.Errorf("peer %q: %v", s, err)
+			}
+			p.ASN = asn
+		case "multihop":
+			ttl, err := strconv.ParseUint(kv[1], 10, 8)
+			if err != nil || ttl == 0 {
+				return p, fmt.Errorf("peer %q: multihop ttl %q must be between 1 and 255", s, kv[1])
+			}
+			p.MultihopTTL = uint8(ttl)
+		case "group":
+			if !validGroupName(kv[1]) {
+				return p, fmt.Errorf("peer %q: group %q may only contain letters, digits and dashes", s, kv[1])
+			}
+			p.Group = kv[1]
+		default:
+			return p, fmt.Errorf("peer %q: unknown option %q", s, kv[0])
+		}
+	}
+
+	if p.ASN == 0 {
+		return p, fmt.Errorf("peer %q: asn is required", s)
+	}
+	if p.Interface != "" && p.Group != "" {
+		return p, fmt.Errorf("peer %q: unnumbered peers cannot be placed in a group", s)
+	}
+	return p, nil
+}
+
+func validGroupName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseASN parses a 2 or 4 byte autonomous system number, in either asplain
+// ("4200000001") or asdot ("64086.59905") notation. See RFC 5396.
+func ParseASN(s string) (uint32, error) {
+	if parts := strings.Split(s, "."); len(parts) == 2 {
+		high, errHigh := strconv.ParseUint(parts[0], 10, 16)
+		low, errLow := strconv.ParseUint(parts[1], 10, 16)
+		if errHigh != nil || errLow != nil || high|low == 0 {
+			return 0, fmt.Errorf("invalid asdot asn %q", s)
+		}
+		return uint32(high<<16 | low), nil
+	}
+	asn, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || asn == 0 {
+		return 0, fmt.Errorf("invalid asn %q. must be between 1 and 4294967295", s)
+	}
+	return uint32(asn), nil
+}
+
+// NodePeers returns the peers described by a node's annotations, ordered by
+// annotation key. A node without peer annotations has no peers.
+func NodePeers(annotations map[string]string) ([]Peer, error) {
+	keys := []string{}
+	for k := range annotations {
+		if strings.HasPrefix(k, PeerAnnotation) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	peers := []Peer{}
+	for _, k := range keys {
+		p, err := ParsePeer(annotations[k])
+		if err != nil {
+			return nil, fmt.Errorf("annotation %s: %v", k, err)
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// ParsePeers parses a list of peer descriptions. Slice flags split their
+// values on commas, so an element that is not an address is treated as an
+// option of the peer before it.
+func ParsePeers(specs []string) ([]Peer, error) {
+	joined := []string{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first := strings.Split(spec, ",")[0]
+		if net.ParseIP(first) == nil && !strings.HasPrefix(first, "interface=") && len(joined) > 0 {
+			joined[len(joined)-1] += "," + spec
+			continue
+		}
+		joined = append(joined, spec)
+	}
+
+	peers := []Peer{}
+	for _, spec := range joined {
+		p, err := ParsePeer(spec)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
@@ -0,0 +1,223 @@
+package bgp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// gobgpd has no way to originate a route towards only some of its peers, so
+// peer groups are implemented with a global export policy. Each group has a
+// neighbor set holding its peers and, per address family, a prefix set holding
+// the routes restricted to the group. One statement per prefix set rejects
+// those routes towards every neighbor outside of the group.
+//
+// gobgpd will not hold an empty prefix set, so each one is created with a
+// placeholder prefix that is never advertised.
+
+const exportPolicy = "ravel-export"
+
+var placeholderPrefix = map[string]string{
+	familyIPv4: "0.0.0.0/32",
+	familyIPv6: "::/128",
+}
+
+type peerGroups struct {
+	// initialized is set once the policy objects of a previous run are gone
+	initialized bool
+
+	// members is the content of each group's neighbor set
+	members map[string]map[string]bool
+
+	// prefixes is the content of each prefix set, less the placeholder
+	prefixes map[string]map[string]bool
+}
+
+func newPeerGroups() *peerGroups {
+	return &peerGroups{
+		members:  map[string]map[string]bool{},
+		prefixes: map[string]map[string]bool{},
+	}
+}
+
+func neighborSetName(group string) string {
+	return "ravel-" + group
+}
+
+func prefixSetName(group, family string) string {
+	return "ravel-" + group + "-" + family
+}
+
+// hasPeerGroup reports whether any peer belongs to group.
+func (g *GoBGPDController) hasPeerGroup(group string) bool {
+	for _, p := range g.peers {
+		if p.Group == group {
+			return true
+		}
+	}
+	return false
+}
+
+// setPeerGroups brings the neighbor sets in line with the peers established
+// by SetPeers, creating the policy objects of groups seen for the first time.
+func (g *GoBGPDController) setPeerGroups(ctx context.Context) error {
+	desired := map[string]map[string]bool{}
+	for addr, p := range g.peers {
+		if p.Group == "" {
+			continue
+		}
+		if desired[p.Group] == nil {
+			desired[p.Group] = map[string]bool{}
+		}
+		desired[p.Group][addr] = true
+	}
+
+	if !g.groups.initialized && len(desired) > 0 {
+		g.resetPeerGroups(ctx, desired)
+		g.groups.initialized = true
+	}
+
+	for group, addrs := range desired {
+		members, ok := g.groups.members[group]
+		if !ok {
+			if err := g.createPeerGroup(ctx, group, addrs); err != nil {
+				return err
+			}
+			continue
+		}
+		// $PATH/gobgp policy neighbor add ravel-edge 10.131.153.66
+		for addr := range addrs {
+			if members[addr] {
+				continue
+			}
+			if err := g.run(ctx, "policy", "neighbor", "add", neighborSetName(group), addr); err != nil {
+				return fmt.Errorf("adding %s to peer group %s with %v", addr, group, err)
+			}
+			members[addr] = true
+		}
+	}
+
+	// $PATH/gobgp policy neighbor del ravel-edge 10.131.153.66
+	for group, members := range g.groups.members {
+		for addr := range members {
+			if desired[group][addr] {
+				continue
+			}
+			if len(members) == 1 {
+				// a neighbor set cannot be emptied while the statements use it.
+				// routes for a group without peers are not advertised at all.
+				continue
+			}
+			if err := g.run(ctx, "policy", "neighbor", "del", neighborSetName(group), addr); err != nil {
+				return fmt.Errorf("removing %s from peer group %s with %v", addr, group, err)
+			}
+			delete(members, addr)
+		}
+	}
+	return nil
+}
+
+// resetPeerGroups removes policy objects left behind by a previous run, whose
+// prefix sets may restrict routes that are no longer in a group. Errors are
+// ignored; most of the objects will not exist.
+func (g *GoBGPDController) resetPeerGroups(ctx context.Context, groups map[string]map[string]bool) {
+	g.run(ctx, "global", "policy", "export", "del", exportPolicy)
+	g.run(ctx, "policy", "del", exportPolicy)
+	for group := range groups {
+		for _, family := range []string{familyIPv4, familyIPv6} {
+			g.run(ctx, "policy", "statement", "del", prefixSetName(group, family))
+			g.run(ctx, "policy", "prefix", "del", prefixSetName(group, family))
+		}
+		g.run(ctx, "policy", "neighbor", "del", neighborSetName(group))
+	}
+}
+
+func (g *GoBGPDController) createPeerGroup(ctx context.Context, group string, addrs map[string]bool) error {
+	g.logger.Infof("Creating export policy for BGP peer group %s", group)
+
+	neighbors := neighborSetName(group)
+	for addr := range addrs {
+		if err := g.run(ctx, "policy", "neighbor", "add", neighbors, addr); err != nil {
+			return fmt.Errorf("creating peer group %s with %v", group, err)
+		}
+	}
+
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		set := prefixSetName(group, family)
+		commands := [][]string{
+			{"policy", "prefix", "add", set, placeholderPrefix[family]},
+			{"policy", "statement", "add", set},
+			{"policy", "statement", set, "add", "condition", "prefix", set},
+			{"policy", "statement", set, "add", "condition", "neighbor", neighbors, "invert"},
+			{"policy", "statement", set, "add", "action", "reject"},
+			{"policy", "add", exportPolicy, set},
+		}
+		for _, args := range commands {
+			if err := g.run(ctx, args...); err != nil {
+				return fmt.Errorf("creating peer group %s with %v", group, err)
+			}
+		}
+		g.groups.prefixes[set] = map[string]bool{}
+	}
+
+	// $PATH/gobgp global policy export add ravel-export default accept
+	err := g.run(ctx, "global", "policy", "export", "add", exportPolicy, "default", "accept")
+	if err != nil && !strings.Contains(err.Error(), "already") {
+		return fmt.Errorf("assigning export policy with %v", err)
+	}
+
+	members := map[string]bool{}
+	for addr := range addrs {
+		members[addr] = true
+	}
+	g.groups.members[group] = members
+	return nil
+}
+
+// setPeerGroupRoutes brings the prefix sets of family in line with the peer
+// groups of routes. It runs before routes are added, so that a restricted
+// route is never advertised to the wrong peers.
+func (g *GoBGPDController) setPeerGroupRoutes(ctx context.Context, afi addressFamily, routes []Route) error {
+	desired := map[string]map[string]bool{}
+	for _, r := range routes {
+		if r.PeerGroup == "" || !g.hasPeerGroup(r.PeerGroup) {
+			continue
+		}
+		set := prefixSetName(r.PeerGroup, afi.name)
+		if desired[set] == nil {
+			desired[set] = map[string]bool{}
+		}
+		desired[set][r.Prefix] = true
+	}
+
+	// $PATH/gobgp policy prefix add ravel-edge-ipv4 10.54.213.148/32
+	for set, prefixes := range desired {
+		current := g.groups.prefixes[set]
+		for prefix := range prefixes {
+			if current[prefix] {
+				continue
+			}
+			if err := g.run(ctx, "policy", "prefix", "add", set, prefix); err != nil {
+				return fmt.Errorf("restricting %s to %s with %v", prefix, set, err)
+			}
+			current[prefix] = true
+		}
+	}
+
+	// $PATH/gobgp policy prefix del ravel-edge-ipv4 10.54.213.148/32
+	for set, current := range g.groups.prefixes {
+		if !strings.HasSuffix(set, "-"+afi.name) {
+			continue
+		}
+		for prefix := range current {
+			if desired[set][prefix] {
+				continue
+			}
+			if err := g.run(ctx, "policy", "prefix", "del", set, prefix); err != nil {
+				return fmt.Errorf("unrestricting %s from %s with %v", prefix, set, err)
+			}
+			delete(current, prefix)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package bgp
+
+import (
+	"strings"
+)
+
+// BGP finite state machine states, as reported in PeerStatus.State.
+const (
+	StateIdle        = "idle"
+	StateConnect     = "connect"
+	StateActive      = "active"
+	StateOpenSent    = "opensent"
+	StateOpenConfirm = "openconfirm"
+	StateEstablished = "established"
+	StateUnknown     = "unknown"
+)
+
+// States lists every value of PeerStatus.State.
+var States = []string{StateIdle, StateConnect, StateActive, StateOpenSent, StateOpenConfirm, StateEstablished, StateUnknown}
+
+// PeerStatus is the state of the session with one of the peers established
+// by SetPeers.
+type PeerStatus struct {
+	// Peer is the Peer.Key of the session
+	Peer  string
+	State string
+
+	// Advertised is the number of prefixes advertised to the peer, across
+	// address families. It is only counted for established sessions.
+	Advertised int
+}
+
+// normalizeState maps the state names printed by the BGP daemons, such as
+// gobgp's "Establ" or BIRD's "OpenSent", to one of States.
+func normalizeState(s string) string {
+	s = strings.ToLower(s)
+	if i := strings.IndexAny(s, "( "); i >= 0 {
+		// gobgp reports administratively down sessions as Idle(Admin)
+		s = s[:i]
+	}
+	switch s {
+	case "establ", StateEstablished:
+		return StateEstablished
+	case StateIdle, StateConnect, StateActive, StateOpenSent, StateOpenConfirm:
+		return s
+	}
+	return StateUnknown
+}
@@ -3,6 +3,10 @@ package bgp
 import (
 	"context"
 	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -12,11 +16,59 @@ import (
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/system"
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+	v1 "k8s.io/api/core/v1"
 )
 
+// bgpTeardownTimeout bounds how long cleanup waits for the BGP controller to
+// withdraw routes, so that a wedged gobgpd cannot block shutdown.
+const bgpTeardownTimeout = 2000 * time.Millisecond
+
+// bgpDebounce is how long the worker waits for updates from the watcher to
+// stop arriving before it reconfigures, so that a burst of node and config
+// updates results in a single reconfiguration.
+const bgpDebounce = 200 * time.Millisecond
+
+// bgpMaxWait bounds the debounce, so that updates arriving without a pause
+// still reconfigure at most this long after the first of them.
+const bgpMaxWait = 2000 * time.Millisecond
+
+// bgpSessionInterval is how often the state of the BGP sessions is reported.
+const bgpSessionInterval = 10 * time.Second
+
 type BGPWorker interface {
 	Start() error
 	Stop() error
+
+	// Drain withdraws every advertisement, leaving the loopback addresses,
+	// IPVS rules and haproxy in place so that established connections can
+	// finish while new traffic shifts to other nodes. Undrain advertises the
+	// VIPs again.
+	Drain() error
+	Undrain() error
+
+	// State returns the worker's current view, for debugging.
+	State() types.WorkerState
+
+	// Status summarizes the worker's last applies and parity checks of both
+	// address families, and Health returns an error unless it is running
+	// with the node in parity.
+	Status() types.WorkerStatus
+	Health() error
+}
+
+// familyStatus is what the last apply or parity check of an address family
+// left the node with.
+type familyStatus struct {
+	parity   bool
+	vips     int
+	services int
+}
+
+// drainRequest asks the periodic loop, which owns the BGP controller, to
+// drain or undrain the node.
+type drainRequest struct {
+	drain bool
+	reply chan error
 }
 
 type bgpserver struct {
@@ -30,13 +82,48 @@ type bgpserver struct {
 	ipvs       system.IPVS
 	bgp        Controller
 
+	// peers are the peers given on the command line. They are replaced by
+	// the peers in this node's annotations, when it has any.
+	nodeName     string
+	peers        []Peer
+	appliedPeers []Peer
+
+	// aggregate summarizes contiguous VIPs before they are advertised
+	aggregate bool
+
+	// drained withdraws all routes while the data plane stays up. It is only
+	// accessed by the periodic loop.
+	drained   bool
+	drainChan chan drainRequest
+
+	// parityInterval is the backstop parity check, and reconfigureInterval
+	// the mandatory reconfigure. reconfigureJitter spreads the mandatory
+	// reconfigure of the nodes in a cluster, and quietPeriod postpones it
+	// until inbound updates stop.
+	parityInterval      time.Duration
+	reconfigureInterval time.Duration
+	reconfigureJitter   time.Duration
+	quietPeriod         time.Duration
+
 	doneChan chan struct{}
 
+	// running, status and families are guarded by the lock. families holds
+	// the state of each address family, which Status sums.
+	running  bool
+	status   types.WorkerStatus
+	families map[string]*familyStatus
+
 	lastInboundUpdate time.Time
 	lastReconfigure   time.Time
 
-	// haproxy configs
-	haproxy haproxy.HAProxySet
+	// haproxy configs. haproxyChan is sent the failures of its instances
+	haproxy     haproxy.HAProxySet
+	haproxyChan chan haproxy.HAProxyError
+
+	// nameservers and clusterDomain resolve the endpoints of haproxyDNS
+	// ports
+	nameservers   []string
+	clusterDomain string
 
 	nodes             types.NodesList
 	config            *types.ClusterConfig
@@ -44,56 +131,105 @@ type bgpserver struct {
 	newConfig         bool
 	nodeChan          chan types.NodesList
 	configChan        chan *types.ClusterConfig
+	secrets           map[string]*v1.Secret
+	secretChan        chan map[string]*v1.Secret
+	updateChan        chan struct{}
 	ctxWatch          context.Context
 	cxlWatch          context.CancelFunc
 
-	ctx     context.Context
-	logger  logrus.FieldLogger
-	metrics *stats.WorkerStateMetrics
+	ctx            context.Context
+	logger         logrus.FieldLogger
+	metrics        *stats.WorkerStateMetrics
+	sessionMetrics *stats.BGPSessionMetrics
+	ipvsMetrics    *stats.IPVSMetrics
+}
+
+// WorkerOptions are the collaborators and settings of a bgp worker.
+type WorkerOptions struct {
+	NodeName  string
+	ConfigKey string
+
+	Watcher    system.Watcher
+	IPLoopback system.IP
+	IPPrimary  system.IP
+	IPVS       system.IPVS
+	Controller Controller
+	Peers      []Peer
+	Aggregate  bool
+
+	ParityInterval      time.Duration
+	ReconfigureInterval time.Duration
+	ReconfigureJitter   time.Duration
+	QuietPeriod         time.Duration
+
+	// HAProxyTemplate renders the configuration of each haproxy instance,
+	// whose stats page listens on HAProxyStatsPort.
+	HAProxyTemplate  string
+	HAProxyStatsPort int
+
+	// Nameservers and ClusterDomain resolve the endpoints of haproxyDNS
+	// ports.
+	Nameservers   []string
+	ClusterDomain string
 }
 
-func NewBGPWorker(
-	ctx context.Context,
-	configKey string,
-	watcher system.Watcher,
-	ipLoopback system.IP,
-	ipPrimary system.IP,
-	ipvs system.IPVS,
-	bgpController Controller,
-	logger logrus.FieldLogger) (BGPWorker, error) {
+func NewBGPWorker(ctx context.Context, opts WorkerOptions, logger logrus.FieldLogger) (BGPWorker, error) {
 
 	logger.Debugf("Enter NewBGPWorker()")
 	defer logger.Debugf("Exit NewBGPWorker()")
 
-	haproxy := haproxy.NewHAProxySet(ctx, "/usr/sbin/haproxy", "/etc/ravel", logger)
-	logger.Debugf("NewBGPWorker(), haproxy %+v", haproxy)
+	haproxySet := haproxy.NewHAProxySet(ctx, "/usr/sbin/haproxy", "/etc/ravel", opts.HAProxyTemplate, opts.HAProxyStatsPort, stats.NewHAProxyMetrics(stats.KindBGP, opts.ConfigKey), logger)
+	logger.Debugf("NewBGPWorker(), haproxy %+v", haproxySet)
 
 	r := &bgpserver{
-		watcher:    watcher,
-		ipLoopback: ipLoopback,
-		ipPrimary:  ipPrimary,
-		ipvs:       ipvs,
-		bgp:        bgpController,
+		watcher:    opts.Watcher,
+		ipLoopback: opts.IPLoopback,
+		ipPrimary:  opts.IPPrimary,
+		ipvs:       opts.IPVS,
+		bgp:        opts.Controller,
+		nodeName:   opts.NodeName,
+		peers:      opts.Peers,
+		aggregate:  opts.Aggregate,
+
+		parityInterval:      opts.ParityInterval,
+		reconfigureInterval: opts.ReconfigureInterval,
+		reconfigureJitter:   opts.ReconfigureJitter,
+		quietPeriod:         opts.QuietPeriod,
 
 		services: map[string]string{},
 
-		haproxy: haproxy,
+		haproxy:     haproxySet,
+		haproxyChan: make(chan haproxy.HAProxyError, 10),
+
+		nameservers:   nameserverAddrs(opts.Nameservers),
+		clusterDomain: opts.ClusterDomain,
 
 		doneChan:   make(chan struct{}),
+		drainChan:  make(chan drainRequest),
+		families:   map[string]*familyStatus{familyIPv4: {}, familyIPv6: {}},
 		configChan: make(chan *types.ClusterConfig, 1),
 		nodeChan:   make(chan types.NodesList, 1),
-
-		ctx:     ctx,
-		logger:  logger,
-		metrics: stats.NewWorkerStateMetrics(stats.KindBGP, configKey),
+		secretChan: make(chan map[string]*v1.Secret, 1),
+		updateChan: make(chan struct{}, 1),
+
+		ctx:            ctx,
+		logger:         logger,
+		metrics:        stats.NewWorkerStateMetrics(stats.KindBGP, opts.ConfigKey),
+		sessionMetrics: stats.NewBGPSessionMetrics(stats.KindBGP, opts.ConfigKey, States),
+		ipvsMetrics:    stats.NewIPVSMetrics(stats.KindBGP, opts.ConfigKey),
 	}
 
+	haproxySet.Failures(r.haproxyChan)
+
 	logger.Debugf("Exit NewBGPWorker(), return %+v", r)
 	return r, nil
 }
 
 func (b *bgpserver) Stop() error {
 	b.cxlWatch()
+	b.Lock()
+	b.running = false
+	b.Unlock()
 
 	b.logger.Info("blocking until periodic tasks complete")
 	select {
@@ -107,12 +243,144 @@ func (b *bgpserver) Stop() error {
 	b.logger.Info("starting cleanup")
 	err := b.cleanup(ctxDestroy)
 	b.logger.Infof("cleanup complete. error=%v", err)
+
+	// with the VIPs gone, the devices' sysctls go back to what they were
+	for _, device := range []system.IP{b.ipLoopback, b.ipPrimary} {
+		if restoreErr := device.RestoreSysctls(); restoreErr != nil {
+			b.logger.Errorf("unable to restore the sysctls of %s. %v", device.Device(), restoreErr)
+		}
+	}
 	return err
 }
 
+func (b *bgpserver) State() types.WorkerState {
+	b.Lock()
+	defer b.Unlock()
+	return types.WorkerState{
+		Config:            b.config.Copy(),
+		Nodes:             b.nodes.Copy(),
+		LastInboundUpdate: b.lastInboundUpdate,
+		LastReconfigure:   b.lastReconfigure,
+		QueueDepths: map[string]int{
+			"config":  len(b.configChan),
+			"nodes":   len(b.nodeChan),
+			"secrets": len(b.secretChan),
+			"haproxy": len(b.haproxyChan),
+		},
+	}
+}
+
+func (b *bgpserver) Status() types.WorkerStatus {
+	b.Lock()
+	defer b.Unlock()
+	status := b.status
+	status.Running = b.running
+	status.Parity = true
+	for _, family := range b.families {
+		status.Parity = status.Parity && family.parity
+		status.VIPs += family.vips
+		status.Rules += family.services
+	}
+	return status
+}
+
+func (b *bgpserver) Health() error {
+	return b.Status().Health()
+}
+
+// recordParity records a parity check of family that found the node in
+// parity.
+func (b *bgpserver) recordParity(family string) {
+	b.Lock()
+	b.families[family].parity = true
+	b.Unlock()
+}
+
+// recordError records a failed apply or parity check of family.
+func (b *bgpserver) recordError(family string, err error) {
+	b.Lock()
+	b.status.LastError = fmt.Sprintf("%s: %v", family, err)
+	b.status.LastErrorTime = time.Now()
+	b.families[family].parity = false
+	b.Unlock()
+}
+
+// recorded records the outcome err of an apply of family from config, and
+// returns err.
+func (b *bgpserver) recorded(family string, config *types.ClusterConfig, err error) error {
+	if err != nil {
+		b.recordError(family, err)
+		return err
+	}
+	vips := config.Config
+	if family == familyIPv6 {
+		vips = config.Config6
+	}
+	services := 0
+	for _, ports := range vips {
+		services += len(ports)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.status.LastApply = time.Now()
+	b.families[family] = &familyStatus{parity: true, vips: len(vips), services: services}
+	return nil
+}
+
+func (b *bgpserver) Drain() error {
+	return b.requestDrain(true)
+}
+
+func (b *bgpserver) Undrain() error {
+	return b.requestDrain(false)
+}
+
+func (b *bgpserver) requestDrain(drain bool) error {
+	if b.ctxWatch == nil {
+		return fmt.Errorf("bgp worker is not started")
+	}
+	req := drainRequest{drain: drain, reply: make(chan error, 1)}
+	select {
+	case b.drainChan <- req:
+	case <-b.ctxWatch.Done():
+		return fmt.Errorf("bgp worker is stopping")
+	}
+	return <-req.reply
+}
+
+// setDrained withdraws or restores the advertisements of the current config.
+func (b *bgpserver) setDrained(drain bool) error {
+	b.drained = drain
+	if drain {
+		b.logger.Info("draining. withdrawing all bgp routes")
+		ctx, cxl := context.WithTimeout(b.ctx, bgpTeardownTimeout)
+		defer cxl()
+		return b.bgp.Teardown(ctx)
+	}
+
+	b.logger.Info("undraining. advertising bgp routes")
+	config, _ := b.snapshot()
+	if config == nil {
+		return nil
+	}
+	if err := b.bgp.Set(b.ctx, b.routes(config, config.Config)); err != nil {
+		return err
+	}
+	return b.bgp.Set6(b.ctx, b.routes(config, config.Config6))
+}
+
 func (b *bgpserver) cleanup(ctx context.Context) error {
 	errs := []string{}
 
+	// Withdraw the routes first. Upstream routers need to stop sending traffic
+	// here before the VIPs are removed from the loopback and haproxy goes away.
+	ctxTeardown, cxl := context.WithTimeout(ctx, bgpTeardownTimeout)
+	defer cxl()
+	if err := b.bgp.Teardown(ctxTeardown); err != nil {
+		errs = append(errs, fmt.Sprintf("cleanup - failed to withdraw bgp routes - %v", err))
+	}
+
 	// Stop all of the HAProxy instances.
 	// Not sure whether the best approach is to unpublish the VIPs first, or to
 	// close haproxy connections. Depends on whether existing sessions are interrupted
@@ -141,6 +409,18 @@ func (b *bgpserver) setup() error {
 		return err
 	}
 
+	// establish sessions with the configured peers
+	if err := b.bgp.SetPeers(b.ctx, b.peers); err != nil {
+		return err
+	}
+	b.appliedPeers = b.peers
+
+	// the ip_vs module may not be loaded until ipvs is first configured, so
+	// the periodic check sets the sysctls then
+	if err := b.ipvs.EnsureSysctls(); err != nil {
+		b.logger.Warnf("unable to set ipvs sysctls. %v", err)
+	}
+
 	ctxWatch, cxlWatch := context.WithCancel(b.ctx)
 	b.cxlWatch = cxlWatch
 	b.ctxWatch = ctxWatch
@@ -148,6 +428,7 @@ func (b *bgpserver) setup() error {
 	// register the watcher for both nodes and the configmap
 	b.watcher.Nodes(ctxWatch, "bpg-nodes", b.nodeChan)
 	b.watcher.ConfigMap(ctxWatch, "bgp-configmap", b.configChan)
+	b.watcher.Secrets(ctxWatch, "bgp-secrets", b.secretChan)
 	return nil
 }
 
@@ -163,6 +444,9 @@ func (b *bgpserver) Start() error {
 
 	go b.watches()
 	go b.periodic()
+	b.Lock()
+	b.running = true
+	b.Unlock()
 	return nil
 }
 
@@ -207,63 +491,84 @@ func (b *bgpserver) getClusterAddr(identity string) (string, error) {
 	return ip, nil
 }
 
-func (b *bgpserver) configure() error {
+// snapshot returns deep copies of the config and nodes, which watches()
+// replaces as updates arrive, for a reconfiguration to work from.
+func (b *bgpserver) snapshot() (*types.ClusterConfig, types.NodesList) {
+	b.Lock()
+	defer b.Unlock()
+	return b.config.Copy(), b.nodes.Copy()
+}
+
+// configure applies the ipv4 VIPs of config, a snapshot of the config and
+// nodes.
+func (b *bgpserver) configure(config *types.ClusterConfig, nodes types.NodesList) error {
 	logger := b.logger.WithFields(logrus.Fields{"protocol": "ipv4"})
 	logger.Debug("Enter func (b *bgpserver) configure()")
 	defer logger.Debug("Exit func (b *bgpserver) configure()")
 
 	// add/remove vip addresses on loopback
-	err := b.setAddresses()
+	err := b.setAddresses(config)
 	if err != nil {
 		return err
 	}
 
-	// Do something BGP-ish with VIPs from configmap
-	// This only adds, and never removes, VIPs
+	// Advertise VIPs from configmap, withdrawing any that were removed
 	logger.Debug("applying bgp settings")
-	addrs := []string{}
-	for ip, _ := range b.config.Config {
-		addrs = append(addrs, string(ip))
-	}
-	err = b.bgp.Set(b.ctx, addrs)
+	err = b.bgp.Set(b.ctx, b.routes(config, config.Config))
 	if err != nil {
 		return err
 	}
 
 	// Set IPVS rules based on VIPs, pods associated with each VIP
 	// and some other settings bgpserver receives from RDEI.
-	err = b.ipvs.SetIPVS(b.nodes, b.config, b.logger)
+	ipvsConfig, _ := ipvsConfig(config, nil)
+	err = b.ipvs.SetIPVS(nodes, ipvsConfig, b.logger)
 	if err != nil {
 		return fmt.Errorf("unable to configure ipvs with error %v", err)
 	}
 	b.logger.Debug("IPVS configured")
+
+	// the limits take the VIPs that haproxy serves, and the ipv6 addresses
+	// it serves them on, that SetIPVS leaves out
+	err = b.ipvs.SetLimits(config)
+	if err != nil {
+		return fmt.Errorf("unable to configure limits with error %v", err)
+	}
+	b.Lock()
 	b.lastReconfigure = time.Now()
+	b.Unlock()
 
 	return nil
 }
 
-func (b *bgpserver) configure6() error {
+// configure6 applies the ipv6 VIPs of config, and the haproxy instances that
+// serve the ipv6 addresses of its ipv4 VIPs.
+func (b *bgpserver) configure6(config *types.ClusterConfig, nodes types.NodesList) error {
 	logger := b.logger.WithFields(logrus.Fields{"protocol": "ipv6"})
 
 	logger.Debug("starting configuration")
 	// add vip addresses to loopback
-	err := b.setAddresses6()
+	err := b.setAddresses6(config)
 	if err != nil {
 		return err
 	}
 
 	logger.Debug("configuring haproxy")
-	err = b.configureHAProxy()
+	err = b.configureHAProxy(config, nodes)
 	if err != nil {
 		return err
 	}
 
-	logger.Debug("setting up bgp")
-	addrs := []string{}
-	for ip, _ := range b.config.Config6 {
-		addrs = append(addrs, string(ip))
+	// ipv6 VIPs are balanced natively by IPVS. haproxy above serves the ipv6
+	// addresses of ipv4 VIPs, translating to ipv4
+	logger.Debug("configuring ipvs")
+	err = b.ipvs.SetIPVS6(nodes, config, logger)
+	if err != nil {
+		return fmt.Errorf("unable to configure ipv6 ipvs with error %v", err)
 	}
-	err = b.bgp.Set(b.ctx, addrs)
+
+	logger.Debug("setting up bgp")
+	err = b.bgp.Set6(b.ctx, b.routes(config, config.Config6))
 	if err != nil {
 		return err
 	}
@@ -280,35 +585,143 @@ func (b *bgpserver) periodic() {
 	queueDepthTicker := time.NewTicker(60 * time.Second)
 	defer queueDepthTicker.Stop()
 
-	bgpInterval := 2000 * time.Millisecond
-	bgpTicker := time.NewTicker(bgpInterval)
+	// updates from the watcher trigger a reconfigure once they settle. the
+	// ticker is a backstop that catches drift in the kernel or bgp daemon.
+	debounce := time.NewTimer(bgpDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+	var pending time.Time // when the first unapplied update arrived
+
+	bgpTicker := time.NewTicker(b.parityInterval)
 	defer bgpTicker.Stop()
 
-	b.logger.Infof("starting BGP periodic ticker, interval %v", bgpInterval)
+	b.logger.Infof("starting BGP periodic ticker, interval %v", b.parityInterval)
+
+	// Session state metrics ticker
+	sessionTicker := time.NewTicker(bgpSessionInterval)
+	defer sessionTicker.Stop()
+
+	// IPVS traffic metrics ticker
+	ipvsStatsTicker := time.NewTicker(stats.IPVSStatsInterval)
+	defer ipvsStatsTicker.Stop()
 
-	// every so many seconds, reapply configuration without checking parity
-	reconfigureDuration := 30 * time.Second
-	reconfigureTicker := time.NewTicker(reconfigureDuration)
-	defer reconfigureTicker.Stop()
+	// IPVS sysctl verification ticker
+	sysctlTicker := time.NewTicker(system.SysctlInterval)
+	defer sysctlTicker.Stop()
+
+	// realserver weight balancing ticker
+	weightTicker := time.NewTicker(system.WeightBalanceInterval)
+	defer weightTicker.Stop()
+
+	// every so many seconds, reapply configuration without checking parity.
+	// the interval is jittered so that the nodes of a cluster do not all
+	// reapply at once, and the reapply waits for inbound updates to quiet.
+	reconfigureDuration := b.reconfigureInterval
+	jitter := rand.New(rand.NewSource(time.Now().UnixNano()))
+	reconfigureTimer := time.NewTimer(b.jittered(reconfigureDuration, jitter))
+	defer reconfigureTimer.Stop()
 
 	for {
 		select {
 		case <-queueDepthTicker.C:
 			b.metrics.QueueDepth(len(b.configChan))
+			b.Lock()
 			b.logger.Debugf("periodic - config=%+v", b.config)
+			b.Unlock()
 
-		case <-reconfigureTicker.C:
+		case <-reconfigureTimer.C:
+			if wait := b.quietRemaining(); wait > 0 {
+				b.logger.Debugf("mandatory periodic reconfigure postponed %v for inbound updates to quiet", wait)
+				reconfigureTimer.Reset(wait)
+				continue
+			}
+			reconfigureTimer.Reset(b.jittered(reconfigureDuration, jitter))
+			config, nodes := b.snapshot()
+			if config == nil {
+				continue
+			}
 			b.logger.Debugf("mandatory periodic reconfigure executing after %v", reconfigureDuration)
 			start := time.Now()
-			if err := b.configure(); err != nil {
+			if err := b.recorded(familyIPv4, config, b.configure(config, nodes)); err != nil {
 				b.metrics.Reconfigure("critical", time.Now().Sub(start))
 				b.logger.Infof("unable to apply mandatory ipv4 reconfiguration. %v", err)
 			}
+			start = time.Now()
+			if err := b.recorded(familyIPv6, config, b.configure6(config, nodes)); err != nil {
+				b.metrics.Reconfigure("critical", time.Now().Sub(start))
+				b.logger.Infof("unable to apply mandatory ipv6 reconfiguration. %v", err)
+			}
 
-		case <-bgpTicker.C:
-			b.logger.Debug("BGP ticker expired, checking parity & etc")
+		case <-sessionTicker.C:
+			b.reportSessions()
+
+		case <-ipvsStatsTicker.C:
+			b.reportIPVSStats()
+
+		case <-sysctlTicker.C:
+			if err := b.ipvs.EnsureSysctls(); err != nil {
+				b.logger.Warnf("unable to verify ipvs sysctls. %v", err)
+			}
+			for _, device := range []system.IP{b.ipLoopback, b.ipPrimary} {
+				if err := device.EnsureSysctls(); err != nil {
+					b.logger.Warnf("unable to verify the sysctls of %s. %v", device.Device(), err)
+				}
+			}
+
+		case <-weightTicker.C:
+			if changed, err := b.ipvs.BalanceWeights(); err != nil {
+				b.logger.Warnf("unable to balance realserver weights. %v", err)
+			} else if changed {
+				// the new weights are applied without waiting on an update
+				if config, nodes := b.snapshot(); config != nil {
+					b.performReconfigure4(config, nodes)
+					b.performReconfigure6(config, nodes)
+				}
+			}
+
+		case req := <-b.drainChan:
+			req.reply <- b.setDrained(req.drain)
+
+		case secrets := <-b.secretChan:
+			// a rotated certificate reloads the haproxy instances that
+			// terminate TLS with it. the others are left as they are.
+			b.secrets = secrets
+			if config, nodes := b.snapshot(); config != nil {
+				if err := b.configureHAProxy(config, nodes); err != nil {
+					b.logger.Errorf("unable to configure haproxy with the updated secrets. %v", err)
+				}
+			}
+
+		case failure := <-b.haproxyChan:
+			b.haproxyFailure(failure)
+
+		case <-b.updateChan:
+			now := time.Now()
+			if pending.IsZero() {
+				pending = now
+			}
+			wait := bgpDebounce
+			if remaining := pending.Add(bgpMaxWait).Sub(now); remaining < wait {
+				wait = remaining
+			}
+			debounce.Reset(wait)
+
+		case <-debounce.C:
+			pending = time.Time{}
+			b.logger.Debug("updates settled, checking parity & etc")
 			b.performReconfigure()
 
+		case <-bgpTicker.C:
+			// the backstop for drift that no update announces. until a
+			// config arrives there is nothing to be out of parity with.
+			b.Lock()
+			configured := b.config != nil
+			b.Unlock()
+			if configured {
+				b.logger.Debug("BGP ticker expired, checking parity & etc")
+				b.checkParity()
+			}
+
 		case <-b.ctx.Done():
 			b.logger.Info("periodic(): parent context closed. exiting run loop")
 			b.doneChan <- struct{}{}
@@ -320,11 +733,125 @@ func (b *bgpserver) periodic() {
 	}
 }
 
+// routes builds the BGP routes for vips, the ipv4 or ipv6 VIPs of config,
+// attaching the path attributes from each VIP's route policy. A drained node
+// has no routes.
+func (b *bgpserver) routes(config *types.ClusterConfig, vips map[types.ServiceIP]types.PortMap) []Route {
+	routes := []Route{}
+	if b.drained {
+		return routes
+	}
+	for ip := range vips {
+		// an ipv4 VIP that only haproxy serves is withdrawn once its
+		// instance is given up on
+		if config.HAProxyFrontend(ip) && b.haproxy.Failed(haproxyVIP(config, ip).ListenAddr()) {
+			continue
+		}
+		routes = append(routes, NewRoute(string(ip), config.RoutePolicy(ip)))
+	}
+	if b.aggregate {
+		return Aggregate(routes)
+	}
+	return routes
+}
+
+// advertisementParity reports whether the set of advertised prefixes matches
+// the desired routes.
+func advertisementParity(advertised []string, desired []Route) bool {
+	if len(advertised) != len(desired) {
+		return false
+	}
+	prefixes := map[string]bool{}
+	for _, prefix := range advertised {
+		prefixes[prefix] = true
+	}
+	for _, r := range desired {
+		if !prefixes[r.Prefix] {
+			return false
+		}
+	}
+	return true
+}
+
+// setPeers establishes sessions with the peers in this node's annotations,
+// falling back to the peers from the command line when there are none.
+func (b *bgpserver) setPeers(nodes types.NodesList) error {
+	peers := b.peers
+	for _, n := range nodes {
+		if n.Name != b.nodeName {
+			continue
+		}
+		annotated, err := NodePeers(n.Annotations)
+		if err != nil {
+			return err
+		}
+		if len(annotated) > 0 {
+			peers = annotated
+		}
+		break
+	}
+	if reflect.DeepEqual(peers, b.appliedPeers) {
+		return nil
+	}
+
+	b.logger.Infof("setting bgp peers %v", peers)
+	if err := b.bgp.SetPeers(b.ctx, peers); err != nil {
+		return err
+	}
+	b.appliedPeers = peers
+	return nil
+}
+
+// reportSessions updates the session metrics with the state of each peer.
+func (b *bgpserver) reportSessions() {
+	ctx, cxl := context.WithTimeout(b.ctx, bgpSessionInterval)
+	defer cxl()
+	statuses, err := b.bgp.Status(ctx)
+	if err != nil {
+		b.logger.Warnf("unable to read bgp session state. %v", err)
+		return
+	}
+	sessions := []stats.BGPSession{}
+	for _, s := range statuses {
+		if s.State != StateEstablished {
+			b.logger.Debugf("bgp session with %s is %s", s.Peer, s.State)
+		}
+		sessions = append(sessions, stats.BGPSession{Peer: s.Peer, State: s.State, Advertised: s.Advertised})
+	}
+	b.sessionMetrics.Sessions(sessions)
+}
+
+// reportIPVSStats updates the IPVS traffic metrics with the kernel's counters.
+func (b *bgpserver) reportIPVSStats() {
+	counters, err := b.ipvs.Stats()
+	if err != nil {
+		b.logger.Warnf("unable to read ipvs stats. %v", err)
+		return
+	}
+	b.ipvsMetrics.Stats(counters)
+}
+
+// jittered returns d plus a random duration of up to the reconfigure jitter.
+func (b *bgpserver) jittered(d time.Duration, r *rand.Rand) time.Duration {
+	if b.reconfigureJitter <= 0 {
+		return d
+	}
+	return d + time.Duration(r.Int63n(int64(b.reconfigureJitter)))
+}
+
+// quietRemaining returns how long to wait until the quiet period after the
+// last inbound update has passed.
+func (b *bgpserver) quietRemaining() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	return b.lastInboundUpdate.Add(b.quietPeriod).Sub(time.Now())
+}
+
 func (b *bgpserver) noUpdatesReady() bool {
 	return b.lastReconfigure.Sub(b.lastInboundUpdate) > 0
 }
 
-func (b *bgpserver) setAddresses6() error {
+func (b *bgpserver) setAddresses6(config *types.ClusterConfig) error {
 	// pull existing
 	configured, err := b.ipLoopback.Get6()
 	if err != nil {
@@ -333,7 +860,7 @@ func (b *bgpserver) setAddresses6() error {
 
 	// get desired set VIP addresses
 	desired := []string{}
-	for ip, _ := range b.config.Config6 {
+	for ip, _ := range config.Config6 {
 		desired = append(desired, string(ip))
 	}
 
@@ -359,7 +886,7 @@ func (b *bgpserver) setAddresses6() error {
 // setAddresses adds or removes IP address from the loopback device (lo).
 // The IP addresses should be VIPs, from the configmap that a kubernetes
 // watcher gives to a bgpserver in func (b *bgpserver) watches()
-func (b *bgpserver) setAddresses() error {
+func (b *bgpserver) setAddresses(config *types.ClusterConfig) error {
 	// pull existing
 	configured, err := b.ipLoopback.Get()
 	if err != nil {
@@ -368,7 +895,7 @@ func (b *bgpserver) setAddresses() error {
 
 	// get desired set VIP addresses
 	desired := []string{}
-	for ip, _ := range b.config.Config {
+	for ip, _ := range config.Config {
 		desired = append(desired, string(ip))
 	}
 
@@ -403,9 +930,10 @@ func (b *bgpserver) setAddresses() error {
 // so, an array of ClusterIP:Port mirrored with an array of listen ports
 // configureHAProxy determines whether the VIP should be configured at all, and
 // generates a pair of slices of cluster-internal addresses and external listen ports.
-func (b *bgpserver) configureHAProxy() error {
+func (b *bgpserver) configureHAProxy(config *types.ClusterConfig, nodes types.NodesList) error {
 
-	// this is the list of ipv6 addresses
+	// this is the list of listen addresses, the ipv6 address of each VIP or
+	// the ipv4 VIP that haproxy fronts if it has none
 	addrs := []string{}
 
 	// this is the complete set of configurations to be sent to haproxy
@@ -413,34 +941,88 @@ func (b *bgpserver) configureHAProxy() error {
 
 	// iterating over the ClusterConfig. For each IP address in the config, a PortMap
 	// contains mapping of listen ports to service identities.
-	for ip, portMap := range b.config.Config {
-		// First, look up and store the IPV6 address
-		addr6 := string(b.config.IPV6[ip])
-		addrs = append(addrs, addr6)
+	for ip, portMap := range config.Config {
+		// First, look up and store the IPV6 address, and the ipv4 VIP if
+		// haproxy serves it in place of IPVS
+		vip := haproxyVIP(config, ip)
+		addrs = append(addrs, vip.ListenAddr())
 
 		// next, build up the list of clusterIPs and listenPorts
-		serviceAddrs := []string{}
+		serviceAddrs := [][]string{}
 		listenPorts := []uint16{}
+		proxyMode := []bool{}
+		modes := []string{}
+		http2 := []bool{}
+		healthChecks := []*haproxy.HealthCheck{}
+		sourceRanges := [][]string{}
+		serverTemplates := []*haproxy.ServerTemplate{}
 		for port, cfg := range portMap {
 
-			// first, get the service identity and look up a cluster address
+			// first, get the service identity and look up a cluster address,
+			// or the endpoints of the service when haproxy balances them or
+			// resolves them from DNS
 			identity := cfg.Namespace + "/" + cfg.Service + ":" + cfg.PortName
-			if addr4, err := b.getClusterAddr(identity); err != nil {
+			if cfg.HAProxyDNS != nil {
+				serviceAddrs = append(serviceAddrs, []string{})
+				serverTemplates = append(serverTemplates, &haproxy.ServerTemplate{Name: b.srvName(cfg), Slots: cfg.HAProxyDNS.Slots})
+			} else if cfg.HAProxyEndpoints {
+				endpoints := endpointAddrs(nodes, cfg)
+				if len(endpoints) == 0 {
+					b.logger.Errorf("unable to configure haproxy v6 for %v. no endpoints", identity)
+					continue
+				}
+				serviceAddrs = append(serviceAddrs, endpoints)
+			} else if addr4, err := b.getClusterAddr(identity); err != nil {
 				b.logger.Errorf("unable to configure haproxy v6 for %v. %v", identity, err)
 				continue
 			} else {
-				serviceAddrs = append(serviceAddrs, addr4)
+				serviceAddrs = append(serviceAddrs, []string{addr4})
 			}
 
 			// first, get the listen port.
 			p, _ := strconv.Atoi(port)
 			listenPorts = append(listenPorts, uint16(p))
+			proxyMode = append(proxyMode, cfg.ProxyProtocolEnabled)
+			modes = append(modes, cfg.HAProxyMode)
+			http2 = append(http2, cfg.HAProxyHTTP2)
+			healthChecks = append(healthChecks, healthCheck(cfg.HealthCheck))
+			sourceRanges = append(sourceRanges, cfg.SourceRanges)
+			if cfg.HAProxyDNS == nil {
+				serverTemplates = append(serverTemplates, nil)
+			}
 		}
-		configSet[addr6] = haproxy.VIPConfig{
-			Addr6:        addr6,
-			ServiceAddrs: serviceAddrs,
-			ListenPorts:  listenPorts,
+
+		// then the certificate, if the VIP terminates TLS. without it, the
+		// instance is left as it is rather than serve the VIP without TLS
+		var tlsBundle []byte
+		if name := config.TLSSecret(ip); name != "" {
+			bundle, err := pemBundle(b.secrets[name])
+			if err != nil {
+				b.logger.Errorf("unable to terminate tls for %v with secret %s. %v", ip, name, err)
+				continue
+			}
+			tlsBundle = bundle
+		}
+
+		vip.ServiceAddrs = serviceAddrs
+		vip.ListenPorts = listenPorts
+		vip.ProxyMode = proxyMode
+		vip.Modes = modes
+		vip.HTTP2 = http2
+		vip.HealthChecks = healthChecks
+		vip.SourceRanges = sourceRanges
+		vip.ServerTemplates = serverTemplates
+		vip.Nameservers = b.nameservers
+		vip.TLSBundle = tlsBundle
+		if tuning := config.HAProxy(ip); tuning != nil {
+			vip.MaxConn = tuning.MaxConn
+			vip.NBThread = tuning.NBThread
+			vip.FrontendMaxConn = tuning.FrontendMaxConn
+			vip.ConnectTimeout = tuning.ConnectTimeout
+			vip.ClientTimeout = tuning.ClientTimeout
+			vip.ServerTimeout = tuning.ServerTimeout
 		}
+		configSet[vip.ListenAddr()] = vip
 	}
 	removals := b.haproxy.GetRemovals(addrs)
 
@@ -451,7 +1033,11 @@ func (b *bgpserver) configureHAProxy() error {
 
 	b.logger.Debugf("got %d haproxy addresses", len(addrs))
 	for _, addition := range addrs {
-		if err := b.haproxy.Configure(configSet[addition]); err != nil {
+		vip, ok := configSet[addition]
+		if !ok {
+			continue
+		}
+		if err := b.haproxy.Configure(vip); err != nil {
 			return err
 		}
 	}
@@ -459,10 +1045,141 @@ func (b *bgpserver) configureHAProxy() error {
 	return nil
 }
 
+// srvName returns the name of the SRV record of a port of a headless service,
+// whose records name each endpoint's address and port.
+func (b *bgpserver) srvName(cfg *types.ServiceDef) string {
+	return fmt.Sprintf("_%s._tcp.%s.%s.svc.%s", cfg.PortName, cfg.Service, cfg.Namespace, b.clusterDomain)
+}
+
+// nameserverAddrs adds the DNS port to each nameserver given without one.
+func nameserverAddrs(nameservers []string) []string {
+	out := []string{}
+	for _, ns := range nameservers {
+		if ns == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(ns); err != nil {
+			ns = net.JoinHostPort(ns, "53")
+		}
+		out = append(out, ns)
+	}
+	return out
+}
+
+// haproxyVIP returns the addresses that the haproxy instance of an ipv4 VIP
+// serves: its ipv6 address, and the VIP itself if haproxy fronts it.
+func haproxyVIP(config *types.ClusterConfig, ip types.ServiceIP) haproxy.VIPConfig {
+	vip := haproxy.VIPConfig{Addr6: string(config.IPV6[ip])}
+	if config.HAProxyFrontend(ip) {
+		vip.Addr4 = string(ip)
+	}
+	return vip
+}
+
+// haproxyFailure counts a failure of an haproxy instance, which restarts on
+// its own. Once the instance is given up on, the advertisements are brought
+// in line, withdrawing the VIP if it is only served by haproxy.
+func (b *bgpserver) haproxyFailure(failure haproxy.HAProxyError) {
+	if !failure.GaveUp {
+		b.metrics.HAProxyFailure("restart")
+		return
+	}
+	b.metrics.HAProxyFailure("failed")
+	b.logger.Errorf("haproxy for %s was given up on. %v", failure.Source, failure.Error)
+	config, _ := b.snapshot()
+	if config == nil {
+		return
+	}
+	if err := b.bgp.Set(b.ctx, b.routes(config, config.Config)); err != nil {
+		b.logger.Errorf("unable to withdraw the VIPs of failed haproxy instances. %v", err)
+	}
+}
+
+// ipvsConfig returns the configuration that IPVS balances, leaving out the
+// ipv4 VIPs that haproxy fronts, and the loopback addresses among addresses
+// that it covers. Those VIPs stay on the loopback and are advertised, but an
+// IPVS service on them would take their traffic from haproxy.
+func ipvsConfig(config *types.ClusterConfig, addresses []string) (*types.ClusterConfig, []string) {
+	if config == nil {
+		return config, addresses
+	}
+	out := *config
+	out.Config = map[types.ServiceIP]types.PortMap{}
+	for ip, ports := range config.Config {
+		if !config.HAProxyFrontend(ip) {
+			out.Config[ip] = ports
+		}
+	}
+	if len(out.Config) == len(config.Config) {
+		return config, addresses
+	}
+
+	filtered := []string{}
+	for _, addr := range addresses {
+		if !config.HAProxyFrontend(types.ServiceIP(addr)) {
+			filtered = append(filtered, addr)
+		}
+	}
+	return &out, filtered
+}
+
+// endpointAddrs returns the address:port of each endpoint of a service port,
+// across the nodes, in order.
+func endpointAddrs(nodes types.NodesList, service *types.ServiceDef) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, node := range nodes {
+		port := node.GetPortNumber(service.Namespace, service.Service, service.PortName)
+		if port == 0 {
+			continue
+		}
+		for _, ip := range node.GetPodIPs(service.Namespace, service.Service, service.PortName) {
+			addr := net.JoinHostPort(ip, strconv.Itoa(port))
+			if !seen[addr] {
+				seen[addr] = true
+				out = append(out, addr)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// healthCheck returns the haproxy health check of a port, or nil if it has
+// none.
+func healthCheck(check *types.HealthCheck) *haproxy.HealthCheck {
+	if check == nil {
+		return nil
+	}
+	return &haproxy.HealthCheck{
+		Interval: check.Interval,
+		Rise:     check.Rise,
+		Fall:     check.Fall,
+		HTTPPath: check.HTTPPath,
+	}
+}
+
+// pemBundle returns the certificate chain of a kubernetes.io/tls secret
+// followed by its private key, the PEM bundle that haproxy terminates TLS with.
+func pemBundle(secret *v1.Secret) ([]byte, error) {
+	if secret == nil {
+		return nil, fmt.Errorf("secret not found")
+	}
+	cert, key := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+	if len(cert) == 0 || len(key) == 0 {
+		return nil, fmt.Errorf("secret must have %s and %s", v1.TLSCertKey, v1.TLSPrivateKeyKey)
+	}
+	bundle := append([]byte{}, cert...)
+	if bundle[len(bundle)-1] != '\n' {
+		bundle = append(bundle, '\n')
+	}
+	return append(bundle, key...), nil
+}
+
 // watches just selects from node updates and config updates channels,
 // setting appropriate instance variable in the receiver b.
-// func periodic() will act on any changes in nodes list or config
-// when one or more of its timers expire.
+// func periodic() is notified of each change in nodes list or config,
+// and acts on them once the updates settle.
 func (b *bgpserver) watches() {
 	b.logger.Debugf("Enter func (b *bgpserver) watches()\n")
 	defer b.logger.Debugf("Exit func (b *bgpserver) watches()\n")
@@ -484,6 +1201,7 @@ func (b *bgpserver) watches() {
 
 			b.lastInboundUpdate = time.Now()
 			b.Unlock()
+			b.notifyUpdate()
 
 		case configs := <-b.configChan:
 			b.logger.Debug("recv configChan")
@@ -493,6 +1211,7 @@ func (b *bgpserver) watches() {
 			b.lastInboundUpdate = time.Now()
 			b.Unlock()
 			b.metrics.ConfigUpdate()
+			b.notifyUpdate()
 
 		// Administrative
 		case <-b.ctx.Done():
@@ -506,6 +1225,15 @@ func (b *bgpserver) watches() {
 	}
 }
 
+// notifyUpdate wakes the periodic loop without blocking. An update that is
+// already pending covers this one.
+func (b *bgpserver) notifyUpdate() {
+	select {
+	case b.updateChan <- struct{}{}:
+	default:
+	}
+}
+
 func (b *bgpserver) configReady() bool {
 	newConfig := false
 	b.Lock()
@@ -527,7 +1255,30 @@ func (b *bgpserver) performReconfigure() {
 		// last update happened before the last reconfigure
 		return
 	}
+	b.checkParity()
+}
+
+// checkParity compares the peers, IPVS rules, loopback addresses and
+// advertisements with the configuration, and reconfigures whatever has
+// drifted, whether or not an update arrived since the last reconfigure.
+func (b *bgpserver) checkParity() {
+	// the config and nodes are copied, so that watches() can replace them
+	// while they are applied
+	config, nodes := b.snapshot()
+
+	// the node's annotations may name different peers
+	if err := b.setPeers(nodes); err != nil {
+		b.logger.Errorf("unable to set bgp peers from node annotations. %v", err)
+	}
 
+	b.performReconfigure4(config, nodes)
+	b.performReconfigure6(config, nodes)
+}
+
+// performReconfigure4 compares the IPVS rules, loopback addresses and
+// advertisements with the configuration, and reconfigures ipv4 if any of
+// them differ.
+func (b *bgpserver) performReconfigure4(config *types.ClusterConfig, nodes types.NodesList) {
 	start := time.Now()
 
 	// these are the VIP addresses
@@ -535,28 +1286,101 @@ func (b *bgpserver) performReconfigure() {
 	if err != nil {
 		b.metrics.Reconfigure("error", time.Now().Sub(start))
 		b.logger.Infof("unable to compare configurations with error %v", err)
+		b.recordError(familyIPv4, err)
 		return
 	}
 
 	// compare configurations and apply new IPVS rules if they're different
-	same, err := b.ipvs.CheckConfigParity(b.nodes, b.config, addresses, b.configReady())
+	ipvsConfig, addresses := ipvsConfig(config, addresses)
+	same, err := b.ipvs.CheckConfigParity(nodes, ipvsConfig, addresses, b.configReady())
 	if err != nil {
 		b.metrics.Reconfigure("error", time.Now().Sub(start))
 		b.logger.Infof("unable to compare configurations with error %v", err)
+		b.recordError(familyIPv4, err)
 		return
 	}
 
+	// a VIP that is configured but not advertised, or advertised but no longer
+	// configured, is as much a reason to reconfigure as an IPVS difference.
+	if same && config != nil {
+		advertised, err := b.bgp.Get(b.ctx)
+		if err != nil {
+			b.metrics.Reconfigure("error", time.Now().Sub(start))
+			b.logger.Infof("unable to compare bgp advertisements with error %v", err)
+			b.recordError(familyIPv4, err)
+			return
+		}
+		same = advertisementParity(advertised, b.routes(config, config.Config))
+	}
+
 	if same {
 		b.logger.Debug("parity same")
 		b.metrics.Reconfigure("noop", time.Now().Sub(start))
+		b.recordParity(familyIPv4)
 		return
 	}
 
 	b.logger.Debug("parity different, reconfiguring")
-	if err := b.configure(); err != nil {
+	if err := b.recorded(familyIPv4, config, b.configure(config, nodes)); err != nil {
 		b.metrics.Reconfigure("critical", time.Now().Sub(start))
 		b.logger.Infof("unable to apply ipv4 configuration. %v", err)
 		return
 	}
 	b.metrics.Reconfigure("complete", time.Now().Sub(start))
 }
+
+// performReconfigure6 checks the ipv6 loopback addresses and advertisements
+// against the configuration, and reconfigures ipv6 if either has drifted.
+func (b *bgpserver) performReconfigure6(config *types.ClusterConfig, nodes types.NodesList) {
+	if config == nil {
+		// without a config, there is nothing to be out of parity with
+		b.recordParity(familyIPv6)
+		return
+	}
+	start := time.Now()
+
+	same, err := b.parity6(config, nodes)
+	if err != nil {
+		b.metrics.Reconfigure("error", time.Now().Sub(start))
+		b.logger.Infof("unable to compare ipv6 configurations with error %v", err)
+		b.recordError(familyIPv6, err)
+		return
+	}
+	if same {
+		b.logger.Debug("ipv6 parity same")
+		b.recordParity(familyIPv6)
+		return
+	}
+
+	b.logger.Debug("ipv6 parity different, reconfiguring")
+	if err := b.recorded(familyIPv6, config, b.configure6(config, nodes)); err != nil {
+		b.metrics.Reconfigure("critical", time.Now().Sub(start))
+		b.logger.Infof("unable to apply ipv6 configuration. %v", err)
+		return
+	}
+	b.metrics.Reconfigure("complete", time.Now().Sub(start))
+}
+
+func (b *bgpserver) parity6(config *types.ClusterConfig, nodes types.NodesList) (bool, error) {
+	configured, err := b.ipLoopback.Get6()
+	if err != nil {
+		return false, err
+	}
+	desired := []string{}
+	for ip := range config.Config6 {
+		desired = append(desired, string(ip))
+	}
+	if removals, additions := b.ipLoopback.Compare(configured, desired); len(removals) > 0 || len(additions) > 0 {
+		return false, nil
+	}
+
+	if same, err := b.ipvs.CheckConfigParity6(nodes, config); err != nil || !same {
+		return false, err
+	}
+
+	advertised, err := b.bgp.Get6(b.ctx)
+	if err != nil {
+		return false, err
+	}
+	return advertisementParity(advertised, b.routes(config, config.Config6)), nil
+}
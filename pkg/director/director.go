@@ -3,7 +3,6 @@ package director
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
 	"sync"
 	"time"
 
@@ -26,6 +25,12 @@ const (
 type Director interface {
 	Start() error
 	Stop() error
+
+	// State returns the director's current view, for debugging.
+	State() types.WorkerState
+
+	// SetForcedReconfigure turns the forced reconfiguration on or off.
+	SetForcedReconfigure(enabled bool)
 }
 
 type director struct {
@@ -58,26 +63,40 @@ type director struct {
 	ip       system.IP
 	iptables iptables.IPTables
 
+	// announcer announces the VIPs added to the primary interface, or is nil
+	// to leave the neighbors' entries to expire
+	announcer system.Announcer
+
+	// capture writes the rules of failed restores for debugging
+	capture *iptables.Capture
+
 	// cli flag default false
 	doCleanup          bool
 	colocationMode     string
 	forcedReconfigure  bool
 	ipvsWeightOverride bool
 
+	// forcedReconfigureInterval is how often a forced reconfigure runs
+	forcedReconfigureInterval time.Duration
+
 	// boilerplate.  when this context is canceled, the director must cease all activties
 	ctx     context.Context
 	logger  logrus.FieldLogger
 	metrics *stats.WorkerStateMetrics
+
+	ipvsMetrics *stats.IPVSMetrics
 }
 
-func NewDirector(ctx context.Context, nodeName, configKey string, cleanup bool, watcher system.Watcher, ipvs system.IPVS, ip system.IP, ipt iptables.IPTables, colocationMode string, forcedReconfigure bool, logger logrus.FieldLogger) (Director, error) {
+func NewDirector(ctx context.Context, nodeName, configKey string, cleanup bool, watcher system.Watcher, ipvs system.IPVS, ip system.IP, announcer system.Announcer, ipt iptables.IPTables, capture *iptables.Capture, colocationMode string, forcedReconfigure bool, forcedReconfigureInterval time.Duration, logger logrus.FieldLogger) (Director, error) {
 	d := &director{
-		watcher:  watcher,
-		ipvs:     ipvs,
-		ip:       ip,
-		nodeName: nodeName,
+		watcher:   watcher,
+		ipvs:      ipvs,
+		ip:        ip,
+		announcer: announcer,
+		nodeName:  nodeName,
 
 		iptables: ipt,
+		capture:  capture,
 
 		doneChan:   make(chan struct{}),
 		nodeChan:   make(chan types.NodesList, 1),
@@ -87,8 +106,11 @@ func NewDirector(ctx context.Context, nodeName, configKey string, cleanup bool,
 		ctx:               ctx,
 		logger:            logger,
 		metrics:           stats.NewWorkerStateMetrics(stats.KindDirector, configKey),
+		ipvsMetrics:       stats.NewIPVSMetrics(stats.KindDirector, configKey),
 		colocationMode:    colocationMode,
 		forcedReconfigure: forcedReconfigure,
+
+		forcedReconfigureInterval: forcedReconfigureInterval,
 	}
 
 	return d, nil
@@ -124,6 +146,15 @@ func (d *director) Start() error {
 	// If director is co-located with a realserver, the realserver
 	// will deal with setting up new iptables rules
 
+	// sync connections to the nodes standing by to take over
+	if err := d.ipvs.StartSyncDaemon(system.SyncDaemonMaster); err != nil {
+		return err
+	}
+
+	if err := d.ipvs.EnsureSysctls(); err != nil {
+		return err
+	}
+
 	// instantitate a watcher and load this watcher instance into self
 	ctxWatch, cxlWatch := context.WithCancel(d.ctx)
 	d.ctxWatch = ctxWatch
@@ -160,12 +191,39 @@ func (d *director) cleanup(ctx context.Context) error {
 		errs = append(errs, fmt.Sprintf("cleanup - failed to remove existing ipvs config - %v", err))
 	}
 
+	if err := d.ipvs.StopSyncDaemon(system.SyncDaemonMaster); err != nil {
+		errs = append(errs, fmt.Sprintf("cleanup - failed to stop ipvs sync daemon - %v", err))
+	}
+
 	if len(errs) == 0 {
 		return nil
 	}
 	return fmt.Errorf("%v", errs)
 }
 
+func (d *director) State() types.WorkerState {
+	d.Lock()
+	defer d.Unlock()
+	return types.WorkerState{
+		Config:            d.config.Copy(),
+		Nodes:             d.nodes.Copy(),
+		LastInboundUpdate: d.lastInboundUpdate,
+		LastReconfigure:   d.lastReconfigure,
+		ForcedReconfigure: d.forcedReconfigure,
+		QueueDepths: map[string]int{
+			"config": len(d.configChan),
+			"nodes":  len(d.nodeChan),
+		},
+	}
+}
+
+func (d *director) SetForcedReconfigure(enabled bool) {
+	d.Lock()
+	d.forcedReconfigure = enabled
+	d.Unlock()
+	d.logger.Infof("forced reconfiguration set to %v", enabled)
+}
+
 func (d *director) Stop() error {
 	if d.reconfiguring {
 		return fmt.Errorf("unable to Stop. reconfiguration already in progress.")
@@ -293,21 +351,65 @@ func (d *director) periodic() {
 	t := time.NewTicker(checkInterval)
 	d.logger.Infof("starting periodic ticker. config check %v", checkInterval)
 
-	forcedReconfigureInterval := 10 * 60 * time.Second
-	forceReconfigure := time.NewTicker(forcedReconfigureInterval)
+	forceReconfigure := time.NewTicker(d.forcedReconfigureInterval)
+
+	// report ipvs traffic
+	ipvsStats := time.NewTicker(stats.IPVSStatsInterval)
+
+	// verify ipvs sysctls
+	sysctls := time.NewTicker(system.SysctlInterval)
+
+	// balance realserver weights
+	weights := time.NewTicker(system.WeightBalanceInterval)
+
+	// check the iptables rules for changes by other agents
+	drift := time.NewTicker(iptables.DriftInterval)
 
 	defer t.Stop()
 	defer forceReconfigure.Stop()
+	defer ipvsStats.Stop()
+	defer sysctls.Stop()
+	defer weights.Stop()
+	defer drift.Stop()
 
 	for {
 		select {
 
 		case <-forceReconfigure.C:
-			if d.config != nil && d.nodes != nil {
+			d.Lock()
+			forced := d.forcedReconfigure
+			d.Unlock()
+			if forced && d.config != nil && d.nodes != nil {
 				d.logger.Info("Force reconfiguration w/o parity check timer went off")
 				d.reconfigure(true)
 			}
 
+		case <-ipvsStats.C:
+			d.reportIPVSStats()
+
+		case <-sysctls.C:
+			if err := d.ipvs.EnsureSysctls(); err != nil {
+				d.logger.Warnf("unable to verify ipvs sysctls. %v", err)
+			}
+			if err := d.ip.EnsureSysctls(); err != nil {
+				d.logger.Warnf("unable to verify the sysctls of %s. %v", d.ip.Device(), err)
+			}
+
+		case <-weights.C:
+			if changed, err := d.ipvs.BalanceWeights(); err != nil {
+				d.logger.Warnf("unable to balance realserver weights. %v", err)
+			} else if changed && d.config != nil && d.nodes != nil {
+				d.reconfigure(false)
+			}
+
+		case <-drift.C:
+			if d.colocationMode != colocationModeIPTables {
+				continue
+			}
+			if _, err := d.iptables.CheckDrift(); err != nil {
+				d.logger.Warnf("unable to check iptables rules for drift. %v", err)
+			}
+
 		case <-t.C: // periodically apply declared state
 
 			if d.lastReconfigure.Sub(d.lastInboundUpdate) > 0 {
@@ -336,6 +438,16 @@ func (d *director) periodic() {
 	}
 }
 
+// reportIPVSStats updates the IPVS traffic metrics with the kernel's counters.
+func (d *director) reportIPVSStats() {
+	counters, err := d.ipvs.Stats()
+	if err != nil {
+		d.logger.Warnf("unable to read ipvs stats. %v", err)
+		return
+	}
+	d.ipvsMetrics.Stats(counters)
+}
+
 func (d *director) reconfigure(force bool) {
 	d.logger.Infof("reconfiguring")
 	start := time.Now()
@@ -344,7 +456,9 @@ func (d *director) reconfigure(force bool) {
 		return
 	}
 	d.logger.Infof("reconfiguration completed successfully in %v", time.Now().Sub(start))
+	d.Lock()
 	d.lastReconfigure = start
+	d.Unlock()
 }
 
 func (d *director) applyConf(force bool) error {
@@ -401,6 +515,13 @@ func (d *director) applyConf(force bool) error {
 	}
 	d.logger.Debugf("ipvs configured")
 
+	// limit the connections and syns of the VIPs that ask for it
+	err = d.ipvs.SetLimits(d.config)
+	if err != nil {
+		d.metrics.Reconfigure("error", time.Now().Sub(start))
+		return fmt.Errorf("unable to configure limits with error %v", err)
+	}
+
 	d.metrics.Reconfigure("complete", time.Now().Sub(start))
 	return nil
 }
@@ -436,10 +557,12 @@ func (d *director) setIPTables() error {
 	err = d.iptables.Restore(merged)
 	if err != nil {
 		// write erroneous rule set to file to capture later
-		d.logger.Errorf("error applying rules. writing erroneous rule change to /tmp/director-ruleset-err for debugging")
-		writeErr := ioutil.WriteFile("/tmp/director-ruleset-err", createErrorLog(err, iptables.BytesFromRules(merged)), 0644)
+		fields := map[string]string{"node": d.nodeName, "chains": fmt.Sprint(len(generated))}
+		filename, writeErr := d.capture.Write(err, fields, d.iptables.Table(), existing, merged)
 		if writeErr != nil {
-			d.logger.Errorf("error writing to file; logging rules: %s", string(iptables.BytesFromRules(merged)))
+			d.logger.Errorf("error applying rules. error writing them for debugging. %v; logging rules: %s", writeErr, string(iptables.BytesFromRules(d.iptables.Table(), merged)))
+		} else if filename != "" {
+			d.logger.Errorf("error applying rules. wrote erroneous rule change to %s for debugging", filename)
 		}
 
 		return err
@@ -490,6 +613,11 @@ func (d *director) setAddresses() error {
 		if err := d.ip.Add(addr); err != nil {
 			return err
 		}
+		if d.announcer != nil {
+			if err := d.announcer.Announce(addr); err != nil {
+				d.logger.Warnf("unable to announce VIP %s. %v", addr, err)
+			}
+		}
 	}
 
 	return nil
@@ -500,12 +628,3 @@ func (d *director) setReconfiguring(v bool) {
 	d.reconfiguring = v
 	d.Unlock()
 }
-
-func createErrorLog(err error, rules []byte) []byte {
-	if err == nil {
-		return rules
-	}
-
-	errBytes := []byte(fmt.Sprintf("ipvs restore error: %v\n", err.Error()))
-	return append(errBytes, rules...)
-}
@@ -0,0 +1,58 @@
+package haproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// instanceSuffixes are the suffixes of the files that an instance keeps in
+// the config dir, named after its listen address: its configuration, admin
+// socket and PEM bundle.
+var instanceSuffixes = []string{".conf", ".sock", ".pem"}
+
+// removeFiles removes the files of the instance serving listenAddr once it is
+// retired.
+func removeFiles(configDir, listenAddr string, logger logrus.FieldLogger) {
+	for _, suffix := range instanceSuffixes {
+		path := filepath.Join(configDir, listenAddr+suffix)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("unable to remove %s. %v", path, err)
+		}
+	}
+}
+
+// sweep removes the files left in configDir by the instances of a previous
+// run, e.g. of VIPs that were removed while ravel was down. The files of an
+// instance whose admin socket still answers are left, as a new instance
+// takes over its listening sockets. Files not named after an address are not
+// ravel's, and are left alone.
+func sweep(configDir string, logger logrus.FieldLogger) {
+	files, err := ioutil.ReadDir(configDir)
+	if err != nil {
+		logger.Debugf("unable to sweep %s. %v", configDir, err)
+		return
+	}
+
+	orphans := map[string]bool{}
+	for _, f := range files {
+		for _, suffix := range instanceSuffixes {
+			addr := strings.TrimSuffix(f.Name(), suffix)
+			if addr != f.Name() && net.ParseIP(addr) != nil {
+				orphans[addr] = true
+			}
+		}
+	}
+	for addr := range orphans {
+		if conn, err := net.DialTimeout("unix", socketPath(configDir, addr), runtimeTimeout); err == nil {
+			conn.Close()
+			continue
+		}
+		logger.Infof("removing the files of a retired haproxy instance. s=%s", addr)
+		removeFiles(configDir, addr, logger)
+	}
+}
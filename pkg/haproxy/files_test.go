@@ -0,0 +1,49 @@
+package haproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a retired instance, a running one and files that are not ravel's
+	for _, name := range []string{"10.54.213.10.conf", "2001:db8::1.conf", "2001:db8::1.pem", "2001:db8::1.sock", "2001:db8::2.conf", "haproxy.cfg", "notes.sock"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "2001:db8::2.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	sweep(dir, logrus.New())
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	expects := []string{"2001:db8::2.conf", "2001:db8::2.sock", "haproxy.cfg", "notes.sock"}
+	if !reflect.DeepEqual(names, expects) {
+		t.Fatalf("expected %v. saw %v", expects, names)
+	}
+}
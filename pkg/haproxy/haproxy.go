@@ -4,16 +4,20 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"html/template"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
 )
 
 // An HAProxy VIPConfig contains an IPV6 address and a trio of arrays
@@ -22,13 +26,109 @@ import (
 // must be generated in a way that ensures the length and order of each of the
 // three arrays is aligned.
 type VIPConfig struct {
-	Addr6 string
+	Addr6 string `json:"addr6"`
+	// Addr4 is the ipv4 VIP, which the instance also serves when haproxy
+	// fronts it in place of IPVS. It is empty otherwise.
+	Addr4 string `json:"addr4"`
+
+	// ServiceAddrs are the addresses that each port balances across, e.g.
+	// the cluster address of its service or each of its endpoints. A port
+	// without any is not served.
+	ServiceAddrs [][]string `json:"serviceAddrs"`
+	ListenPorts  []uint16   `json:"listenPorts"`
+	// ProxyMode sends the PROXY protocol v2 header to a port's backend, in
+	// place of the v1 header, so that it receives the client's ipv6 address
+	// in binary form. It may be shorter than ListenPorts, or nil.
+	ProxyMode []bool `json:"proxyMode"`
+	// Modes are the modes that haproxy proxies each port in, ModeTCP or
+	// ModeHTTP. A port without one is proxied in tcp mode.
+	Modes []string `json:"modes"`
+	// HTTP2 speaks HTTP/2 in cleartext to the backends of an http mode
+	// port. It may be shorter than ListenPorts, or nil.
+	HTTP2 []bool `json:"http2"`
+	// HealthChecks are the checks of each port's service address. A port
+	// without one is not checked.
+	HealthChecks []*HealthCheck `json:"healthChecks"`
+	// SourceRanges are the CIDRs of the clients that may connect to each
+	// port. Others are rejected. A port without any accepts every client.
+	SourceRanges [][]string `json:"sourceRanges"`
+	// ServerTemplates resolve the servers of a port from DNS in place of
+	// its ServiceAddrs, so that they follow the endpoints of a headless
+	// service without a reload. A port without one uses its ServiceAddrs.
+	ServerTemplates []*ServerTemplate `json:"serverTemplates"`
+	// Nameservers are the ip:port addresses of the DNS servers that the
+	// ServerTemplates are resolved with. Without any, the nameservers of
+	// /etc/resolv.conf are used.
+	Nameservers []string `json:"nameservers"`
+
+	// MaxConn, NBThread and FrontendMaxConn size the instance: its global
+	// maxconn and threads, and the maxconn of each port. Zero keeps the
+	// default of each.
+	MaxConn         int `json:"maxConn"`
+	NBThread        int `json:"nbThread"`
+	FrontendMaxConn int `json:"frontendMaxConn"`
+
+	// ConnectTimeout, ClientTimeout and ServerTimeout are the instance's
+	// timeouts, in milliseconds. Zero keeps the default of each.
+	ConnectTimeout int `json:"connectTimeout"`
+	ClientTimeout  int `json:"clientTimeout"`
+	ServerTimeout  int `json:"serverTimeout"`
+
+	// StatsPort is the port of the stats page that the instance serves on
+	// localhost, or 0 for none. The HAProxySet assigns it.
+	StatsPort int `json:"statsPort"`
+
+	// TLSBundle is the PEM certificate chain followed by the private key
+	// that the VIP terminates TLS with on all of its ports, or nil if the
+	// VIP passes TLS through to its backends.
+	TLSBundle []byte `json:"-"`
+}
+
+// ListenAddr returns the address that the instance serving config is known
+// by: its ipv6 address, or its ipv4 address if it has no ipv6 address.
+func (c VIPConfig) ListenAddr() string {
+	if c.Addr6 == "" {
+		return c.Addr4
+	}
+	return c.Addr6
+}
 
-	ServiceAddrs []string
-	ListenPorts  []uint16
-	ProxyMode    []bool
+// Modes of a port. In http mode, the client address is sent to the backend in
+// the X-Forwarded-For and Forwarded headers rather than the PROXY protocol.
+const (
+	ModeTCP  = "tcp"
+	ModeHTTP = "http"
+)
+
+// HealthCheck describes the check of a port's service address, a tcp connect
+// or, with an HTTPPath, an http GET. Zero values keep the defaults.
+type HealthCheck struct {
+	// Interval is the time between checks, in milliseconds
+	Interval int    `json:"interval"`
+	Rise     int    `json:"rise"`
+	Fall     int    `json:"fall"`
+	HTTPPath string `json:"httpPath"`
 }
 
+// ServerTemplate describes servers that haproxy resolves from the SRV record
+// Name, e.g. _http._tcp.app.default.svc.cluster.local, filling up to Slots
+// servers with the records' addresses and ports. Slots left empty are kept in
+// maintenance until the record grows. Zero Slots keeps the default.
+type ServerTemplate struct {
+	Name  string `json:"name"`
+	Slots int    `json:"slots"`
+}
+
+// defaultServerSlots is the default of ServerTemplate.Slots.
+const defaultServerSlots = 16
+
+// The defaults of a HealthCheck, as haproxy's own.
+const (
+	defaultCheckInterval = 2000
+	defaultCheckRise     = 2
+	defaultCheckFall     = 3
+)
+
 // The HAProxySet provides a simple mechanism for managing a group of HAProxy services for
 // multiple source and destination IP addresses. Specifically it provides a mechanism to
 // create and reconfigure an HAProxy instance, as well as an instance to stop all running
@@ -44,7 +144,18 @@ type HAProxySet interface {
 	// StopOne will stop a single HAProxy instance.
 	StopOne(listenAddr string)
 
-	GetRemovals(v6Addrs []string) (removals []string)
+	// Failures registers a channel that is sent each error of an instance,
+	// with GaveUp set once the instance is no longer restarted. Errors are
+	// dropped while the channel is full.
+	Failures(failureChan chan HAProxyError)
+
+	// Failed returns true if the instance serving listenAddr was given up
+	// on, until it is configured differently.
+	Failed(listenAddr string) bool
+
+	// GetRemovals returns the listen addresses of the instances that are
+	// not among listenAddrs.
+	GetRemovals(listenAddrs []string) (removals []string)
 }
 
 type HAProxySetManager struct {
@@ -54,8 +165,14 @@ type HAProxySetManager struct {
 	cancelFuncs map[string]context.CancelFunc
 	errChan     chan HAProxyError
 
-	binary    string
-	configDir string
+	binary         string
+	configDir      string
+	configTemplate string
+
+	// statsPort is the first port of the stats pages of the instances, or
+	// 0 for none, and statsPorts the port of each instance's page
+	statsPort  int
+	statsPorts map[string]int
 
 	cxl       context.CancelFunc
 	ctx       context.Context
@@ -63,32 +180,69 @@ type HAProxySetManager struct {
 
 	services map[string]string
 
-	logger logrus.FieldLogger
+	// failures counts the failures in a row of the instance serving each
+	// listen address, and started holds when each was last started. broken
+	// holds the config of each instance that failed maxRestarts times in a
+	// row, which is not started again until it is configured differently.
+	failures map[string]int
+	started  map[string]time.Time
+	broken   map[string]VIPConfig
+	// pending holds the config of each instance waiting out its backoff,
+	// which Configure updates rather than start it early.
+	pending map[string]VIPConfig
+
+	failureChan chan HAProxyError
+
+	metrics *stats.HAProxyMetrics
+	logger  logrus.FieldLogger
 }
 
-func NewHAProxySet(ctx context.Context, binary, configDir string, logger logrus.FieldLogger) *HAProxySetManager {
+// A failed instance is restarted after a backoff that doubles from
+// minRestartBackoff up to maxRestartBackoff with each failure in a row. Once
+// it has failed maxRestarts times in a row it is given up on. An instance
+// that has run for stableAfter before it fails starts counting again.
+const (
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 2 * time.Minute
+	maxRestarts       = 10
+	stableAfter       = 5 * time.Minute
+)
+
+func NewHAProxySet(ctx context.Context, binary, configDir, configTemplate string, statsPort int, metrics *stats.HAProxyMetrics, logger logrus.FieldLogger) *HAProxySetManager {
 
 	c2, cxl := context.WithCancel(ctx)
 
-	return &HAProxySetManager{
+	h := &HAProxySetManager{
 		sources:     map[string]HAProxy{},
 		cancelFuncs: map[string]context.CancelFunc{},
 		errChan:     make(chan HAProxyError, 100),
 
 		services: map[string]string{},
 
-		binary:    binary,
-		configDir: configDir,
-		parentCtx: ctx,
-		ctx:       c2,
-		cxl:       cxl,
-
-		logger: logger.WithFields(logrus.Fields{"parent": "haproxy"}),
+		failures: map[string]int{},
+		started:  map[string]time.Time{},
+		broken:   map[string]VIPConfig{},
+		pending:  map[string]VIPConfig{},
+
+		binary:         binary,
+		configDir:      configDir,
+		configTemplate: configTemplate,
+		statsPort:      statsPort,
+		statsPorts:     map[string]int{},
+		parentCtx:      ctx,
+		ctx:            c2,
+		cxl:            cxl,
+
+		metrics: metrics,
+		logger:  logger.WithFields(logrus.Fields{"parent": "haproxy"}),
 	}
+	sweep(configDir, h.logger)
+	go h.run()
+	return h
 }
 
 // GetRemovals documented in HAProxySet interface
-func (h *HAProxySetManager) GetRemovals(v6addrs []string) []string {
+func (h *HAProxySetManager) GetRemovals(listenAddrs []string) []string {
 
 	// build a set of currently configured addresses
 	h.Lock()
@@ -96,6 +250,9 @@ func (h *HAProxySetManager) GetRemovals(v6addrs []string) []string {
 	for addr, _ := range h.sources {
 		configured = append(configured, addr)
 	}
+	for addr := range h.broken {
+		configured = append(configured, addr)
+	}
 	h.Unlock()
 
 	// iterate over the inbound set.
@@ -103,7 +260,7 @@ func (h *HAProxySetManager) GetRemovals(v6addrs []string) []string {
 	removals := []string{}
 	for _, i := range configured {
 		match := false
-		for _, j := range v6addrs {
+		for _, j := range listenAddrs {
 			if i == j {
 				match = true
 				break
@@ -122,37 +279,96 @@ func (h *HAProxySetManager) StopAll() {
 	h.cxl()
 
 	// rebuild the internal state
+	h.Lock()
+	defer h.Unlock()
 	h.sources = map[string]HAProxy{}
 	h.cancelFuncs = map[string]context.CancelFunc{}
+	for addr := range h.broken {
+		h.metrics.Remove(addr)
+		removeFiles(h.configDir, addr, h.logger)
+	}
+	for addr := range h.pending {
+		removeFiles(h.configDir, addr, h.logger)
+	}
+	h.failures = map[string]int{}
+	h.started = map[string]time.Time{}
+	h.broken = map[string]VIPConfig{}
+	h.pending = map[string]VIPConfig{}
+	h.statsPorts = map[string]int{}
 
 	h.ctx, h.cxl = context.WithCancel(h.parentCtx)
 }
 
+// Failures documented in HAProxySet interface
+func (h *HAProxySetManager) Failures(failureChan chan HAProxyError) {
+	h.Lock()
+	defer h.Unlock()
+	h.failureChan = failureChan
+}
+
+// Failed documented in HAProxySet interface
+func (h *HAProxySetManager) Failed(listenAddr string) bool {
+	h.Lock()
+	defer h.Unlock()
+	_, ok := h.broken[listenAddr]
+	return ok
+}
+
 func (h *HAProxySetManager) StopOne(listenAddr string) {
 	h.Lock()
 	defer h.Unlock()
 	h.logger.Debugf("StopOne called for %v", listenAddr)
 
-	if cxl, ok := h.cancelFuncs[listenAddr]; !ok {
-		return
-	} else {
+	// forgetting the failures of the instance also calls off a pending
+	// restart
+	delete(h.failures, listenAddr)
+	delete(h.started, listenAddr)
+	delete(h.broken, listenAddr)
+	delete(h.pending, listenAddr)
+	delete(h.statsPorts, listenAddr)
+	h.metrics.Remove(listenAddr)
+
+	// a running instance removes its files once it stops
+	if cxl, ok := h.cancelFuncs[listenAddr]; ok {
 		cxl()
+	} else {
+		removeFiles(h.configDir, listenAddr, h.logger)
 	}
+	delete(h.sources, listenAddr)
+	delete(h.cancelFuncs, listenAddr)
 }
 
 func (h *HAProxySetManager) Configure(config VIPConfig) error {
-	listenAddr := config.Addr6
-	serviceAddrs := config.ServiceAddrs
-	ports := config.ListenPorts
+	listenAddr := config.ListenAddr()
 
-	h.logger.Debugf("configuring s=%v d=%v p=%v", listenAddr, serviceAddrs, ports)
+	h.logger.Debugf("configuring s=%v d=%v p=%v", listenAddr, config.ServiceAddrs, config.ListenPorts)
 	h.Lock()
 	defer h.Unlock()
+	config.StatsPort = h.statsPortOf(listenAddr)
+
+	// an instance that was given up on stays down until its config changes
+	if failed, ok := h.broken[listenAddr]; ok {
+		if reflect.DeepEqual(failed, config) {
+			h.logger.Debugf("not configuring haproxy, which failed %d times in a row with this config. s=%v", maxRestarts, listenAddr)
+			return nil
+		}
+		h.logger.Infof("configuring haproxy, which failed %d times in a row, with a new config. s=%v", maxRestarts, listenAddr)
+		delete(h.broken, listenAddr)
+		delete(h.failures, listenAddr)
+		h.metrics.Failed(listenAddr, false)
+	}
+
+	// an instance waiting out its backoff starts with the latest config
+	if _, ok := h.pending[listenAddr]; ok {
+		h.logger.Debugf("haproxy is waiting to restart. configuring it when it does. s=%v", listenAddr)
+		h.pending[listenAddr] = config
+		return nil
+	}
 
 	// create the instance if it doesn't exist
 	if _, found := h.sources[listenAddr]; !found {
 		c2, cxl := context.WithCancel(h.ctx)
-		instance, err := NewHAProxy(c2, h.binary, h.configDir, listenAddr, serviceAddrs, ports, h.errChan, h.logger)
+		instance, err := NewHAProxy(c2, h.binary, h.configDir, h.configTemplate, config, h.errChan, h.logger)
 		if err != nil {
 			h.logger.Errorf("error creating new haproxy. canceling context. %v", err)
 			cxl()
@@ -160,50 +376,168 @@ func (h *HAProxySetManager) Configure(config VIPConfig) error {
 		}
 		h.sources[listenAddr] = instance
 		h.cancelFuncs[listenAddr] = cxl
+		h.started[listenAddr] = time.Now()
 	}
 
 	// then configure it
-	return h.sources[listenAddr].Reload(ports)
+	return h.sources[listenAddr].Reload(config)
+}
+
+// statsPortOf returns the port of the stats page of the instance serving
+// listenAddr, the lowest free port from statsPort for a new instance, or 0
+// when the instances serve no stats page. h must be locked.
+func (h *HAProxySetManager) statsPortOf(listenAddr string) int {
+	if h.statsPort == 0 {
+		return 0
+	}
+	if port, ok := h.statsPorts[listenAddr]; ok {
+		return port
+	}
+	used := map[int]bool{}
+	for _, port := range h.statsPorts {
+		used[port] = true
+	}
+	port := h.statsPort
+	for used[port] {
+		port++
+	}
+	h.statsPorts[listenAddr] = port
+	h.logger.Infof("serving the haproxy stats page on 127.0.0.1:%d. s=%s", port, listenAddr)
+	return port
 }
 
+// run restarts the instances that report an error, with a backoff, until
+// they fail maxRestarts times in a row.
 func (h *HAProxySetManager) run() {
 	for {
 		select {
-		case <-h.ctx.Done():
+		case <-h.parentCtx.Done():
 			return
 		case instanceError := <-h.errChan:
 			h.logger.Errorf("got error from instance. %v", instanceError.Error)
 
-			// delete the instance that's in an error state, then rebuild a new one and attach it to the sources set
+			// delete the instance that's in an error state, then rebuild a
+			// new one once it has backed off
 			h.Lock()
 			delete(h.sources, instanceError.Source)
 			delete(h.cancelFuncs, instanceError.Source)
-			c2, cxl := context.WithCancel(h.ctx)
-			if instance, err := NewHAProxy(c2, h.binary, h.configDir, instanceError.Source, instanceError.Dest, instanceError.Ports, h.errChan, h.logger); err != nil {
-				h.logger.Errorf("error recreating haproxy. canceling context. %v", err)
-				cxl()
-				h.errChan <- instanceError
-			} else {
-				h.sources[instanceError.Source] = instance
-				h.cancelFuncs[instanceError.Source] = cxl
-			}
+			h.scheduleRestart(instanceError.Source, instanceError.Config, instanceError.Error)
 			h.Unlock()
-
-			// rate limit
-			time.Sleep(1000 * time.Millisecond)
 		}
 	}
 }
 
+// scheduleRestart records a failure of the instance serving source and
+// restarts it with config after its backoff, or gives up on it. h must be
+// locked.
+func (h *HAProxySetManager) scheduleRestart(source string, config VIPConfig, err error) {
+	delay, ok := h.restartAfter(source, config, time.Now())
+	h.notify(HAProxyError{Error: err, Source: source, Config: config, GaveUp: !ok})
+	if !ok {
+		delete(h.pending, source)
+		h.logger.Errorf("haproxy failed %d times in a row. not restarting it until it is configured differently. s=%s", maxRestarts, source)
+		return
+	}
+	h.pending[source] = config
+	h.logger.Warnf("restarting haproxy in %v after %d failures in a row. s=%s", delay, h.failures[source], source)
+	go h.restart(h.ctx, source, h.failures[source], delay)
+}
+
+// notify sends a failure to the registered channel, if any, unless it is
+// full. h must be locked.
+func (h *HAProxySetManager) notify(failure HAProxyError) {
+	if h.failureChan == nil {
+		return
+	}
+	select {
+	case h.failureChan <- failure:
+	default:
+		h.logger.Warnf("dropped haproxy failure. s=%s. %v", failure.Source, failure.Error)
+	}
+}
+
+// restartAfter records a failure of the instance serving source at now, and
+// returns how long to wait before restarting it, or false once it has failed
+// maxRestarts times in a row and is given up on. h must be locked.
+func (h *HAProxySetManager) restartAfter(source string, config VIPConfig, now time.Time) (time.Duration, bool) {
+	if started, ok := h.started[source]; ok && now.Sub(started) > stableAfter {
+		h.failures[source] = 0
+	}
+	delete(h.started, source)
+
+	h.failures[source]++
+	failures := h.failures[source]
+	if failures >= maxRestarts {
+		h.broken[source] = config
+		h.metrics.Failed(source, true)
+		return 0, false
+	}
+	h.metrics.Restart(source)
+
+	backoff := minRestartBackoff << uint(failures-1)
+	if backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+	return backoff, true
+}
+
+// restart recreates the instance serving source with its pending config after
+// delay, unless the instance has since been stopped.
+func (h *HAProxySetManager) restart(ctx context.Context, source string, failures int, delay time.Duration) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(delay):
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	config, ok := h.pending[source]
+	if !ok || h.failures[source] != failures {
+		return
+	}
+	delete(h.pending, source)
+	c2, cxl := context.WithCancel(ctx)
+	instance, err := NewHAProxy(c2, h.binary, h.configDir, h.configTemplate, config, h.errChan, h.logger)
+	if err != nil {
+		h.logger.Errorf("error recreating haproxy. canceling context. %v", err)
+		cxl()
+		h.scheduleRestart(source, config, err)
+		return
+	}
+	h.sources[source] = instance
+	h.cancelFuncs[source] = cxl
+	h.started[source] = time.Now()
+}
+
 type HAProxyError struct {
 	Error  error
 	Source string
-	Dest   []string
-	Ports  []uint16
+	Config VIPConfig
+	// GaveUp is set on the error after which the instance is no longer
+	// restarted.
+	GaveUp bool
 }
 
+// The defaults of VIPConfig.MaxConn and VIPConfig.FrontendMaxConn.
+const (
+	defaultMaxConn         = 4096
+	defaultFrontendMaxConn = 28000
+)
+
+// The defaults of the timeouts of a VIPConfig, in milliseconds.
+const (
+	defaultConnectTimeout = 5000
+	defaultClientTimeout  = 50000
+	defaultServerTimeout  = 50000
+)
+
+// stopTimeout is how long haproxy is given to stop its workers before it is
+// killed.
+const stopTimeout = 5 * time.Second
+
 type HAProxy interface {
-	Reload(ports []uint16) error
+	Reload(config VIPConfig) error
 }
 
 type HAProxyManager struct {
@@ -211,13 +545,15 @@ type HAProxyManager struct {
 	configDir  string
 	listenAddr string
 
-	serviceAddrs []string
-	ports        []uint16
+	// config is the configuration that haproxy is running with
+	config VIPConfig
 
 	rendered []byte
 	template *template.Template
 
+	// cmd is the haproxy master, once it has started
 	cmd     *exec.Cmd
+	cmdLock sync.Mutex
 	errChan chan HAProxyError
 
 	ctx    context.Context
@@ -225,13 +561,52 @@ type HAProxyManager struct {
 }
 
 type templateContext struct {
-	Port   uint16
-	Source string
-	Dest   string
+	Socket          string
+	MaxConn         int
+	NBThread        int
+	FrontendMaxConn int
+	ConnectTimeout  int
+	ClientTimeout   int
+	ServerTimeout   int
+	// StatsPort is the port of the stats page on localhost, if any
+	StatsPort int
+	// Cert is the path of the PEM bundle that the listeners terminate TLS
+	// with, if any.
+	Cert      string
+	Listeners []listenerContext
+	// Resolvers is set when a listener has a server template, which
+	// resolves with the Nameservers, or /etc/resolv.conf without any.
+	Resolvers   bool
+	Nameservers []string
 }
 
-func NewHAProxy(ctx context.Context, binary string, configDir, listenAddr string, serviceAddrs []string, ports []uint16, errChan chan HAProxyError, logger logrus.FieldLogger) (*HAProxyManager, error) {
-	t, err := template.New("conf").Parse(haproxyConfig)
+// listenerContext is a port of the VIP. Source is the address the instance is
+// known by, and Binds each address it listens on, the ipv6 address and, when
+// haproxy fronts it, the ipv4 VIP.
+type listenerContext struct {
+	Port    uint16
+	Source  string
+	Binds   []string
+	Servers []serverContext
+	ProxyV2 bool
+	Mode    string
+	HTTP2   bool
+	Check   *HealthCheck
+	// Allow are the CIDRs of the clients that the listener accepts, or
+	// empty to accept every client.
+	Allow []string
+}
+
+// serverContext is a server of a listener, or with Slots, a server template
+// whose Name is the prefix of its servers and Addr the name they resolve.
+type serverContext struct {
+	Name  string
+	Addr  string
+	Slots int
+}
+
+func NewHAProxy(ctx context.Context, binary string, configDir, configTemplate string, config VIPConfig, errChan chan HAProxyError, logger logrus.FieldLogger) (*HAProxyManager, error) {
+	t, err := parseTemplate(configTemplate)
 	if err != nil {
 		return nil, err
 	}
@@ -239,22 +614,24 @@ func NewHAProxy(ctx context.Context, binary string, configDir, listenAddr string
 	h := &HAProxyManager{
 		binary:     binary,
 		configDir:  configDir,
-		listenAddr: listenAddr,
+		listenAddr: config.ListenAddr(),
 
-		serviceAddrs: serviceAddrs,
-		ports:        ports,
-		errChan:      errChan,
+		config:  config,
+		errChan: errChan,
 
 		template: t,
 		ctx:      ctx,
-		logger:   logger,
+		logger:   logger.WithFields(logrus.Fields{"vip": config.ListenAddr()}),
 	}
 
 	// bootstrap the configuration. this is redundant with the operations in Reload()
-	if b, err := h.render(ports); err != nil {
-		return nil, fmt.Errorf("error rendering configuration. s=%s d=%v p=%v. %v", h.listenAddr, h.serviceAddrs, ports, err)
+	if err := h.writeCert(config.TLSBundle); err != nil {
+		return nil, fmt.Errorf("error writing certificate. s=%s. %v", h.listenAddr, err)
+	}
+	if b, err := h.render(h.context(config)); err != nil {
+		return nil, fmt.Errorf("error rendering configuration. s=%s d=%v p=%v. %v", h.listenAddr, config.ServiceAddrs, config.ListenPorts, err)
 	} else if err := h.write(b); err != nil {
-		return nil, fmt.Errorf("error writing configuration. s=%s d=%v p=%v. %v", h.listenAddr, h.serviceAddrs, ports, err)
+		return nil, fmt.Errorf("error writing configuration. s=%s d=%v p=%v. %v", h.listenAddr, config.ServiceAddrs, config.ListenPorts, err)
 	}
 
 	// spin up the process
@@ -263,120 +640,187 @@ func NewHAProxy(ctx context.Context, binary string, configDir, listenAddr string
 	return h, nil
 }
 
+// run starts haproxy in master-worker mode, -W, taking the listening sockets
+// of any worker left running on the instance's admin socket with -x. Reloads
+// are signaled to the master, which starts a new worker with the sockets of
+// the old one, so that in-flight connections survive. Once the context is
+// done, the master is stopped with its workers.
 func (h *HAProxyManager) run() {
-	args := []string{"-f", h.filename()}
+	args := []string{"-W", "-f", h.filename(), "-x", h.socket()}
 	h.logger.Debugf("starting haproxy with binary %v and args %v", h.binary, args)
-	cmd := exec.CommandContext(h.ctx, h.binary, args...)
-	h.cmd = cmd
+	cmd := exec.Command(h.binary, args...)
+	stdout, stderr := newOutputLogger("stdout", h.logger), newOutputLogger("stderr", h.logger)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
 
 	cmdErr := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		h.sendError(fmt.Errorf("haproxy could not start. s=%s d=%s p=%v. %v", h.listenAddr, h.config.ServiceAddrs, h.config.ListenPorts, err))
+		return
+	}
+	h.setCmd(cmd)
 	go func() {
 		h.logger.Debugf("waiting for exit code")
-		cmdErr <- cmd.Run()
+		err := cmd.Wait()
+		stdout.flush()
+		stderr.flush()
+		cmdErr <- err
 		h.logger.Debugf("command exited")
 	}()
 
-	for {
+	select {
+	case <-h.ctx.Done():
+		// the master passes SIGTERM on to its workers
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			h.logger.Warnf("haproxy could not receive sigterm. s=%s. %v", h.listenAddr, err)
+		}
 		select {
-		case <-h.ctx.Done():
-			/*
-				// Keeping this around as an example of how to gracefully shutdown when the parent context is closed.
-				// In this case, HAProxy would progress through SIGUSR1, SIGTERM, finally SIGKILL. What's missing from this
-				// is a way to communicate back to the caller that haproxy has been killed.
-				// At any rate, get rid of CommandContext and instead deal with the complexity here. Implement HAProxy.Done()
-				// or somesuch to deal with the communication factor.
-
-				// if the context completes, the process needs to be stopped gracefully
-				if err := h.cmd.Process.Signal(syscall.SIGUSR1); err != nil {
-				        h.sendError(fmt.Errorf("haproxy could not receive sigusr1. s=%s d=%s p=%v. %v", h.listenAddr, h.serviceAddrs, h.ports, err))
-				        return
-				} else {
-				        select {
-				        case <-time.After(5000 * time.Millisecond):
-				        case <-cmdErr:
-				                return
-				        }
-				}
-
-				// okay, so graceful shutdown didn't work. send SIGTERM
-				if err := h.cmd.Process.Signal(syscall.SIGTERM); err != nil {
-				        h.sendError(fmt.Errorf("haproxy could not receive sigterm. s=%s d=%s p=%v. %v", h.listenAddr, h.serviceAddrs, h.ports, err))
-				        return
-				} else {
-				        select {
-				        case <-time.After(2000 * time.Millisecond):
-				        case <-cmdErr:
-				                return
-				        }
-				}
-
-				// kill the process
-				if err := h.cmd.Process.Signal(syscall.SIGKILL); err != nil {
-				        h.sendError(fmt.Errorf("haproxy could not receive sigkill. s=%s d=%s p=%v. %v", h.listenAddr, h.serviceAddrs, h.ports, err))
-				        return
-				}
-				return
-			*/
+		case <-time.After(stopTimeout):
+			h.logger.Warnf("haproxy did not stop within %v. killing it. s=%s", stopTimeout, h.listenAddr)
+			cmd.Process.Kill()
+			<-cmdErr
+		case <-cmdErr:
+		}
+		removeFiles(h.configDir, h.listenAddr, h.logger)
+		return
 
-		case err := <-cmdErr:
-			if err == nil {
-				h.logger.Infof("exited without error")
-				return
-			}
-			e2 := fmt.Errorf("haproxy exited with error. s=%s d=%s p=%v. %v", h.listenAddr, h.serviceAddrs, h.ports, err)
-			h.logger.Errorf("wat. %v", e2)
-			// the the command errors out, we need to report the error
-			h.sendError(e2)
+	case err := <-cmdErr:
+		if err == nil {
+			h.logger.Infof("exited without error")
 			return
 		}
+		if stderr.lastAlert != "" {
+			err = fmt.Errorf("%v. %s", err, stderr.lastAlert)
+		}
+		e2 := fmt.Errorf("haproxy exited with error. s=%s d=%s p=%v. %v", h.listenAddr, h.config.ServiceAddrs, h.config.ListenPorts, err)
+		h.logger.Errorf("wat. %v", e2)
+		// the the command errors out, we need to report the error
+		h.sendError(e2)
+		return
 	}
 }
 
-// Reload rewrites the configuration and sends a signal to HAProxy to initiate the reload
-func (h *HAProxyManager) Reload(ports []uint16) error {
-	// compare ports and do nothing if they are the same
-	if reflect.DeepEqual(ports, h.ports) {
+// Reload rewrites the configuration and brings HAProxy in line with it. When
+// only the service addresses of existing ports change, the servers are
+// pointed at them through the runtime API, without a reload, so that no
+// connection is reset. Other changes, to the set of ports, their options or
+// the TLS certificate, reload HAProxy.
+func (h *HAProxyManager) Reload(config VIPConfig) error {
+	serviceAddrs, ports := config.ServiceAddrs, config.ListenPorts
+	current, desired := destinations(h.config.ServiceAddrs, h.config.ListenPorts), destinations(serviceAddrs, ports)
+	currentContext, desiredContext := h.context(h.config), h.context(config)
+	sameCert := bytes.Equal(h.config.TLSBundle, config.TLSBundle)
+	// compare the listeners and certificates and do nothing if they are the same
+	if reflect.DeepEqual(currentContext, desiredContext) && sameCert {
 		return nil
 	}
 
 	// render template
-	b, err := h.render(ports)
+	b, err := h.render(desiredContext)
 	if err != nil {
-		return fmt.Errorf("error rendering configuration. s=%s d=%v p=%v. %v", h.listenAddr, h.serviceAddrs, ports, err)
+		return fmt.Errorf("error rendering configuration. s=%s d=%v p=%v. %v", h.listenAddr, serviceAddrs, ports, err)
 	}
 
-	// write template
+	// write the certificate, then the template
+	if !sameCert {
+		if err := h.writeCert(config.TLSBundle); err != nil {
+			return fmt.Errorf("error writing certificate. s=%s. %v", h.listenAddr, err)
+		}
+	}
 	if err := h.write(b); err != nil {
-		return fmt.Errorf("error writing configuration. s=%s d=%v p=%v. %v", h.listenAddr, h.serviceAddrs, ports, err)
+		return fmt.Errorf("error writing configuration. s=%s d=%v p=%v. %v", h.listenAddr, serviceAddrs, ports, err)
+	}
+
+	if sameCert && sameOptions(currentContext, desiredContext) {
+		err := h.setServers(current, desired)
+		if err == nil {
+			h.rendered = b
+			h.config = config
+			return nil
+		}
+		h.logger.Warnf("unable to update haproxy servers at runtime. reloading. s=%s d=%v p=%v. %v", h.listenAddr, serviceAddrs, ports, err)
 	}
 
 	// reload haproxy
 	if err := h.reload(); err != nil {
 		// if things go wrong, unroll the write
 		h.unroll()
-		return fmt.Errorf("unable to reload haproxy. s=%s d=%v p=%v. %v", h.listenAddr, h.serviceAddrs, ports, err)
+		return fmt.Errorf("unable to reload haproxy. s=%s d=%v p=%v. %v", h.listenAddr, serviceAddrs, ports, err)
 	}
 
 	h.rendered = b
-	h.ports = ports
+	h.config = config
 
 	return nil
 }
 
-// render accepts a list of ports and renders a valid HAProxy configuration to forward traffic from
-// h.listenAddr to h.serviceAddrs on each port.
-func (h *HAProxyManager) render(ports []uint16) ([]byte, error) {
-
-	// prepare the context
-	d := make([]templateContext, len(ports))
+// destinations maps each port to the addresses of its servers.
+func destinations(serviceAddrs [][]string, ports []uint16) map[uint16][]string {
+	out := map[uint16][]string{}
 	for i, port := range ports {
-		if i == len(h.serviceAddrs) {
-			h.logger.Warnf("got port index %d, but only have %d service addrs. ports=%v serviceAddrs=%v", i, len(h.serviceAddrs), ports, h.serviceAddrs)
-			continue
+		if i < len(serviceAddrs) && len(serviceAddrs[i]) > 0 {
+			out[port] = serviceAddrs[i]
+		}
+	}
+	return out
+}
+
+// serverName names the nth server of a port, counted from 0.
+func serverName(port uint16, n int) string {
+	return fmt.Sprintf("dest4-%d-%d", port, n+1)
+}
+
+// sameOptions reports whether two template contexts differ in no more than
+// the addresses of their servers, which the runtime API can change. A port
+// whose number of servers changed, or whose server template changed, needs a
+// reload.
+func sameOptions(a, b templateContext) bool {
+	withoutAddrs := func(c templateContext) templateContext {
+		listeners := make([]listenerContext, len(c.Listeners))
+		for i, l := range c.Listeners {
+			servers := make([]serverContext, len(l.Servers))
+			for n, s := range l.Servers {
+				servers[n] = serverContext{Name: s.Name}
+				if s.Slots > 0 {
+					servers[n] = s
+				}
+			}
+			l.Servers = servers
+			listeners[i] = l
 		}
-		d[i] = templateContext{Port: port, Source: h.listenAddr, Dest: h.serviceAddrs[i]}
+		c.Listeners = listeners
+		return c
+	}
+	return reflect.DeepEqual(withoutAddrs(a), withoutAddrs(b))
+}
+
+// setServers points each server whose address changed at its new address,
+// through the runtime API.
+func (h *HAProxyManager) setServers(current, desired map[uint16][]string) error {
+	for port, addrs := range desired {
+		for n, addr := range addrs {
+			if n < len(current[port]) && current[port][n] == addr {
+				continue
+			}
+			if err := setServerAddr(h.socket(), fmt.Sprintf("listen6-%d", port), serverName(port, n), addr); err != nil {
+				return err
+			}
+			h.logger.Infof("pointed haproxy server %s of %s at %s", serverName(port, n), h.listenAddr, addr)
+		}
+	}
+	return nil
+}
+
+// context prepares the template context of config, warning of ports that
+// have no service addresses to match.
+func (h *HAProxyManager) context(config VIPConfig) templateContext {
+	if len(config.ServiceAddrs) < len(config.ListenPorts) {
+		h.logger.Warnf("got %d ports, but only have %d service addrs. ports=%v serviceAddrs=%v", len(config.ListenPorts), len(config.ServiceAddrs), config.ListenPorts, config.ServiceAddrs)
 	}
+	return newContext(h.configDir, config)
+}
 
+// render renders a valid HAProxy configuration from the template context d.
+func (h *HAProxyManager) render(d templateContext) ([]byte, error) {
 	// render the template
 	buf := &bytes.Buffer{}
 	if err := h.template.Execute(buf, d); err != nil {
@@ -385,9 +829,28 @@ func (h *HAProxyManager) render(ports []uint16) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// reload sends sighup into the haproxy process
+// reload checks the configuration on disk with haproxy -c, then sends sigusr2
+// to the haproxy master, which reloads it into a new worker, handing it the
+// listening sockets. A configuration that fails the check is never signaled,
+// as the master would drop its worker for it.
 func (h *HAProxyManager) reload() error {
-	return h.cmd.Process.Signal(syscall.SIGHUP)
+	// $BINARY -c -f /etc/ravel/2001:558:1044:100::10.conf
+	if out, err := exec.Command(h.binary, "-c", "-f", h.filename()).CombinedOutput(); err != nil {
+		return fmt.Errorf("configuration check failed. %v. %s", err, strings.TrimSpace(string(out)))
+	}
+
+	h.cmdLock.Lock()
+	defer h.cmdLock.Unlock()
+	if h.cmd == nil || h.cmd.Process == nil {
+		return fmt.Errorf("haproxy is not running")
+	}
+	return h.cmd.Process.Signal(syscall.SIGUSR2)
+}
+
+func (h *HAProxyManager) setCmd(cmd *exec.Cmd) {
+	h.cmdLock.Lock()
+	defer h.cmdLock.Unlock()
+	h.cmd = cmd
 }
 
 // write replaces the existing configuration with the data stored in b, or else creates a new file.
@@ -402,14 +865,41 @@ func (h *HAProxyManager) write(b []byte) error {
 	return err
 }
 
+// writeCert writes the PEM bundle that the instance terminates TLS with, or
+// removes it when there is none. It is readable by its owner alone.
+func (h *HAProxyManager) writeCert(tlsBundle []byte) error {
+	if len(tlsBundle) == 0 {
+		if err := os.Remove(h.certFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(h.certFile(), tlsBundle, 0600)
+}
+
 // filename returns the configuration filename, concatenating the configDir, the ipv6 address, and .conf
 func (h *HAProxyManager) filename() string {
 	return filepath.Join(h.configDir, h.listenAddr+".conf")
 }
 
+// socket returns the path of the instance's admin socket, beside its
+// configuration.
+func (h *HAProxyManager) socket() string {
+	return socketPath(h.configDir, h.listenAddr)
+}
+
+// certFile returns the path of the instance's PEM bundle, beside its
+// configuration.
+func (h *HAProxyManager) certFile() string {
+	return certPath(h.configDir, h.listenAddr)
+}
+
 // unroll is called by Reload when an error is generated after a new config file is written.
 // It overwrites the file on disk with the former configuration.
 func (h *HAProxyManager) unroll() {
+	if err := h.writeCert(h.config.TLSBundle); err != nil {
+		h.sendError(err)
+	}
 	if err := h.write(h.rendered); err != nil {
 		h.sendError(err)
 	}
@@ -417,10 +907,9 @@ func (h *HAProxyManager) unroll() {
 
 func (h *HAProxyManager) sendError(err error) {
 	msg := HAProxyError{
-		Error:  fmt.Errorf("unable to unroll haproxy config. config on disk and config in memory may be out of sync. s=%s d=%v. %v", h.listenAddr, h.serviceAddrs, err),
+		Error:  fmt.Errorf("unable to unroll haproxy config. config on disk and config in memory may be out of sync. s=%s d=%v. %v", h.listenAddr, h.config.ServiceAddrs, err),
 		Source: h.listenAddr,
-		Dest:   h.serviceAddrs,
-		Ports:  h.ports,
+		Config: h.config,
 	}
 	select {
 	case h.errChan <- msg:
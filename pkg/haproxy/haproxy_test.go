@@ -0,0 +1,374 @@
+package haproxy
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
+)
+
+func testManager() *HAProxyManager {
+	return &HAProxyManager{
+		configDir:  "/etc/ravel",
+		listenAddr: "2001:558:1044:100::10",
+		template:   template.Must(parseTemplate(haproxyConfig)),
+		logger:     logrus.New(),
+	}
+}
+
+func TestRenderProxyMode(t *testing.T) {
+	h := testManager()
+	config := VIPConfig{
+		Addr6:        "2001:558:1044:100::10",
+		ServiceAddrs: [][]string{{"10.96.0.20:443"}, {"10.96.0.10:80"}},
+		ListenPorts:  []uint16{443, 80},
+		ProxyMode:    []bool{true},
+	}
+	d := h.context(config)
+	if len(d.Listeners) != 2 || d.Listeners[0].Port != 80 || d.Listeners[0].ProxyV2 || !d.Listeners[1].ProxyV2 {
+		t.Fatalf("expected listeners in order of port, with v2 on 443 only. saw %+v", d.Listeners)
+	}
+
+	b, err := h.render(d)
+	if err != nil {
+		t.Fatalf("unexpected error rendering. %v", err)
+	}
+	for _, expect := range []string{"dest4-80-1    10.96.0.10:80 send-proxy\n", "dest4-443-1    10.96.0.20:443 send-proxy-v2\n"} {
+		if !bytes.Contains(b, []byte(expect)) {
+			t.Fatalf("expected %q in\n%s", expect, b)
+		}
+	}
+
+	moved := config
+	moved.ServiceAddrs = [][]string{{"10.96.0.21:443"}, {"10.96.0.10:80"}}
+	if !sameOptions(d, h.context(moved)) {
+		t.Fatalf("expected a moved service address to keep the options")
+	}
+	more := config
+	more.ServiceAddrs = [][]string{{"10.96.0.20:443", "10.96.0.21:443"}, {"10.96.0.10:80"}}
+	if sameOptions(d, h.context(more)) {
+		t.Fatalf("expected another server to change the options")
+	}
+	v1 := config
+	v1.ProxyMode = nil
+	if sameOptions(d, h.context(v1)) {
+		t.Fatalf("expected a changed proxy mode to change the options")
+	}
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// haproxy -c rejects every configuration
+	binary := filepath.Join(dir, "haproxy")
+	if err := ioutil.WriteFile(binary, []byte("#!/bin/sh\necho '[ALERT] parsing failed'\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	h := testManager()
+	h.binary, h.configDir = binary, dir
+	h.config = VIPConfig{
+		Addr6:        "2001:558:1044:100::10",
+		ServiceAddrs: [][]string{{"10.96.0.10:80"}},
+		ListenPorts:  []uint16{80},
+	}
+	h.rendered = []byte("# previous\n")
+	if err := h.write(h.rendered); err != nil {
+		t.Fatal(err)
+	}
+
+	config := h.config
+	config.ServiceAddrs = [][]string{{"10.96.0.10:80"}, {"10.96.0.20:443"}}
+	config.ListenPorts = []uint16{80, 443}
+	err = h.Reload(config)
+	if err == nil || !strings.Contains(err.Error(), "parsing failed") {
+		t.Fatalf("expected the configuration check to fail the reload. saw %v", err)
+	}
+	if !reflect.DeepEqual(h.config.ListenPorts, []uint16{80}) {
+		t.Fatalf("expected the previous config to be kept. saw %+v", h.config)
+	}
+	b, err := ioutil.ReadFile(h.filename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "# previous\n" {
+		t.Fatalf("expected the previous configuration to be put back. saw %s", b)
+	}
+}
+
+func TestRenderHTTPMode(t *testing.T) {
+	h := testManager()
+	b, err := h.render(h.context(VIPConfig{
+		Addr6:        "2001:558:1044:100::10",
+		ServiceAddrs: [][]string{{"10.96.0.10:80"}, {"10.96.0.30:25"}},
+		ListenPorts:  []uint16{80, 25},
+		Modes:        []string{ModeHTTP},
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error rendering. %v", err)
+	}
+	for _, expect := range []string{
+		"mode    http\n        option  forwardfor\n" +
+			"        http-request set-header Forwarded \"for=%[src]\" if { src 0.0.0.0/0 }\n" +
+			"        http-request set-header Forwarded \"for=\\\"[%[src]]\\\"\" if !{ src 0.0.0.0/0 }\n" +
+			"        server  dest4-80-1    10.96.0.10:80\n",
+		"mode    tcp\n        server  dest4-25-1    10.96.0.30:25 send-proxy\n",
+	} {
+		if !bytes.Contains(b, []byte(expect)) {
+			t.Fatalf("expected %q in\n%s", expect, b)
+		}
+	}
+}
+
+func TestRenderTuning(t *testing.T) {
+	h := testManager()
+	config := VIPConfig{
+		Addr6:        "2001:558:1044:100::10",
+		ServiceAddrs: [][]string{{"10.96.0.10:80"}},
+		ListenPorts:  []uint16{80},
+	}
+	b, err := h.render(h.context(config))
+	if err != nil {
+		t.Fatalf("unexpected error rendering. %v", err)
+	}
+	if !bytes.Contains(b, []byte("maxconn              4096\n    user")) || !bytes.Contains(b, []byte("maxconn 28000\n")) || !bytes.Contains(b, []byte("timeout client          50000\n")) {
+		t.Fatalf("expected the default limits in\n%s", b)
+	}
+
+	config.MaxConn, config.NBThread, config.FrontendMaxConn = 100000, 4, 50000
+	config.ConnectTimeout, config.ClientTimeout, config.ServerTimeout = 2000, 3600000, 3600000
+	b, err = h.render(h.context(config))
+	if err != nil {
+		t.Fatalf("unexpected error rendering. %v", err)
+	}
+	for _, expect := range []string{"maxconn              100000\n    nbthread             4\n", "maxconn 50000\n", "timeout connect         2000\n    timeout client          3600000\n    timeout server          3600000\n"} {
+		if !bytes.Contains(b, []byte(expect)) {
+			t.Fatalf("expected %q in\n%s", expect, b)
+		}
+	}
+}
+
+func TestRenderHealthChecks(t *testing.T) {
+	h := testManager()
+	b, err := h.render(h.context(VIPConfig{
+		Addr6:        "2001:558:1044:100::10",
+		ServiceAddrs: [][]string{{"10.96.0.10:80"}, {"10.96.0.30:25"}, {"10.96.0.40:53"}},
+		ListenPorts:  []uint16{80, 25, 53},
+		Modes:        []string{ModeHTTP},
+		HealthChecks: []*HealthCheck{{HTTPPath: "/healthz"}, {Interval: 500, Fall: 1}},
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error rendering. %v", err)
+	}
+	for _, expect := range []string{
+		"mode    http\n        option  httpchk GET /healthz\n        option  forwardfor\n",
+		"dest4-80-1    10.96.0.10:80 check inter 2000 rise 2 fall 3\n",
+		"mode    tcp\n        option  tcp-check\n        server  dest4-25-1    10.96.0.30:25 send-proxy check inter 500 rise 2 fall 1\n",
+		"mode    tcp\n        server  dest4-53-1    10.96.0.40:53 send-proxy\n",
+	} {
+		if !bytes.Contains(b, []byte(expect)) {
+			t.Fatalf("expected %q in\n%s", expect, b)
+		}
+	}
+}
+
+func TestLoadTemplate(t *testing.T) {
+	if tmpl, err := LoadTemplate(""); err != nil || tmpl != haproxyConfig {
+		t.Fatalf("expected the built-in template. saw %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatalf("unexpected error creating a directory. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	custom := filepath.Join(dir, "custom.tmpl")
+	ioutil.WriteFile(custom, []byte(haproxyConfig+"\n    compression algo gzip\n"), 0644)
+	if tmpl, err := LoadTemplate(custom); err != nil || !strings.Contains(tmpl, "compression") {
+		t.Fatalf("expected the custom template. saw %v", err)
+	}
+
+	for _, bad := range []string{"{{ range .Listeners }}", "{{ .Listeners.Backend }}", "{{ .Backends }}"} {
+		ioutil.WriteFile(custom, []byte(bad), 0644)
+		if _, err := LoadTemplate(custom); err == nil {
+			t.Fatalf("expected template %q to fail", bad)
+		}
+	}
+	if _, err := LoadTemplate(filepath.Join(dir, "missing.tmpl")); err == nil {
+		t.Fatalf("expected a missing template to fail")
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files of TestRenderGolden")
+
+// TestRenderGolden renders representative VIPs and compares them with the
+// configurations in testdata. Run with -update to rewrite them after a change
+// to the template.
+func TestRenderGolden(t *testing.T) {
+	for name, config := range map[string]VIPConfig{
+		"tcp": {
+			Addr6:        "2001:558:1044:100::10",
+			ServiceAddrs: [][]string{{"10.96.0.10:80"}, {"10.96.0.20:443"}},
+			ListenPorts:  []uint16{80, 443},
+		},
+		"allow": {
+			Addr6:        "2001:558:1044:100::10",
+			ServiceAddrs: [][]string{{"10.96.0.10:80"}, {"10.96.0.20:8443"}},
+			ListenPorts:  []uint16{80, 8443},
+			SourceRanges: [][]string{nil, {"10.0.0.0/8", "2001:558::/32"}},
+			StatsPort:    9001,
+		},
+		"frontend4": {
+			Addr6:        "2001:558:1044:100::10",
+			Addr4:        "10.54.213.10",
+			ServiceAddrs: [][]string{{"10.2.0.5:8080", "10.2.1.7:8080"}},
+			ListenPorts:  []uint16{80},
+			Modes:        []string{ModeHTTP},
+		},
+		"dns": {
+			Addr6:           "2001:558:1044:100::10",
+			ServiceAddrs:    [][]string{{}, {"10.96.0.20:443"}},
+			ListenPorts:     []uint16{80, 443},
+			ServerTemplates: []*ServerTemplate{{Name: "_http._tcp.app.default.svc.cluster.local", Slots: 8}},
+			Nameservers:     []string{"10.96.0.10:53"},
+			HealthChecks:    []*HealthCheck{{}},
+		},
+		"tls-http": {
+			Addr6:           "2001:558:1044:100::10",
+			ServiceAddrs:    [][]string{{"10.2.0.5:8080", "10.2.1.7:8080"}, {"10.96.0.30:25"}},
+			ListenPorts:     []uint16{443, 25},
+			ProxyMode:       []bool{false, true},
+			Modes:           []string{ModeHTTP, ModeTCP},
+			HTTP2:           []bool{true},
+			HealthChecks:    []*HealthCheck{{HTTPPath: "/healthz?ready=1"}, {Interval: 500}},
+			MaxConn:         100000,
+			NBThread:        4,
+			FrontendMaxConn: 50000,
+			TLSBundle:       []byte("-----BEGIN CERTIFICATE-----\n"),
+		},
+	} {
+		b, err := Render(haproxyConfig, "/etc/ravel", config)
+		if err != nil {
+			t.Fatalf("%s: unexpected error rendering. %v", name, err)
+		}
+		golden := filepath.Join("testdata", name+".conf")
+		if *update {
+			if err := ioutil.WriteFile(golden, b, 0644); err != nil {
+				t.Fatalf("%s: unable to update %s. %v", name, golden, err)
+			}
+		}
+		expect, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("%s: unable to read %s. %v", name, golden, err)
+		}
+		if !bytes.Equal(b, expect) {
+			t.Fatalf("%s: expected\n%s\nsaw\n%s", name, expect, b)
+		}
+	}
+}
+
+var testMetrics = stats.NewHAProxyMetrics(stats.KindBGP, "test")
+
+func TestRestartAfter(t *testing.T) {
+	h := &HAProxySetManager{
+		failures: map[string]int{},
+		started:  map[string]time.Time{},
+		broken:   map[string]VIPConfig{},
+		metrics:  testMetrics,
+	}
+	source := "2001:558:1044:100::10"
+	config := VIPConfig{Addr6: source, ListenPorts: []uint16{80}}
+	now := time.Now()
+
+	expects := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, 64 * time.Second, maxRestartBackoff, maxRestartBackoff}
+	for n, expect := range expects {
+		delay, ok := h.restartAfter(source, config, now)
+		if !ok || delay != expect {
+			t.Fatalf("failure %d: expected a restart after %v. saw %v %v", n+1, expect, delay, ok)
+		}
+	}
+	if _, ok := h.restartAfter(source, config, now); ok || !reflect.DeepEqual(h.broken[source], config) {
+		t.Fatalf("expected the instance to be given up on after %d failures in a row", maxRestarts)
+	}
+
+	// an instance that ran for a while starts counting again
+	delete(h.broken, source)
+	h.started[source] = now
+	if delay, ok := h.restartAfter(source, config, now.Add(stableAfter+time.Second)); !ok || delay != minRestartBackoff {
+		t.Fatalf("expected a stable instance to restart after %v. saw %v %v", minRestartBackoff, delay, ok)
+	}
+	if delay, _ := h.restartAfter(source, config, now.Add(stableAfter+2*time.Second)); delay != 2*minRestartBackoff {
+		t.Fatalf("expected the failures to count from the restart. saw %v", delay)
+	}
+}
+
+func TestScheduleRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failures := make(chan HAProxyError, 2)
+	h := NewHAProxySet(ctx, "/usr/sbin/haproxy", "/etc/ravel", haproxyConfig, 0, testMetrics, logrus.New())
+	h.Failures(failures)
+
+	source := "2001:558:1044:100::10"
+	config := VIPConfig{Addr6: source, ListenPorts: []uint16{80}}
+	h.failures[source] = maxRestarts - 2
+	h.scheduleRestart(source, config, fmt.Errorf("exit status 1"))
+	if failure := <-failures; failure.GaveUp || failure.Source != source {
+		t.Fatalf("expected a restart of %s. saw %+v", source, failure)
+	}
+
+	// a config that arrives during the backoff waits for the restart
+	updated := VIPConfig{Addr6: source, ListenPorts: []uint16{80, 443}}
+	if err := h.Configure(updated); err != nil || !reflect.DeepEqual(h.pending[source], updated) || len(h.sources) != 0 {
+		t.Fatalf("expected the config to wait for the restart. saw %v %v", err, h.pending)
+	}
+
+	h.scheduleRestart(source, updated, fmt.Errorf("exit status 1"))
+	if failure := <-failures; !failure.GaveUp || !h.Failed(source) {
+		t.Fatalf("expected %s to be given up on. saw %+v", source, failure)
+	}
+	if err := h.Configure(updated); err != nil || len(h.sources) != 0 || !h.Failed(source) {
+		t.Fatalf("expected the same config to leave %s down. saw %v", source, err)
+	}
+
+	h.StopOne(source)
+	if h.Failed(source) || len(h.GetRemovals(nil)) != 0 {
+		t.Fatalf("expected a stopped instance to be forgotten")
+	}
+}
+
+func TestStatsPortOf(t *testing.T) {
+	h := &HAProxySetManager{statsPorts: map[string]int{}, logger: logrus.New()}
+	if port := h.statsPortOf("2001:558:1044:100::10"); port != 0 {
+		t.Fatalf("expected no stats page when disabled. saw %d", port)
+	}
+
+	h.statsPort = 9000
+	a, b := h.statsPortOf("2001:558:1044:100::10"), h.statsPortOf("2001:558:1044:100::11")
+	if a != 9000 || b != 9001 || h.statsPortOf("2001:558:1044:100::10") != a {
+		t.Fatalf("expected a stable port per instance. saw %d %d", a, b)
+	}
+
+	// the port of a removed instance is reused
+	delete(h.statsPorts, "2001:558:1044:100::10")
+	if port := h.statsPortOf("2001:558:1044:100::12"); port != 9000 {
+		t.Fatalf("expected the lowest free port. saw %d", port)
+	}
+}
@@ -0,0 +1,94 @@
+package haproxy
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// outputLogger logs each line that an haproxy process writes to its stdout or
+// stderr, at the level of its [ALERT], [WARNING] or [NOTICE] prefix, so that
+// startup problems such as a port already in use are logged with the VIP of
+// the instance rather than lost.
+type outputLogger struct {
+	stream string
+	logger logrus.FieldLogger
+	buf    []byte
+
+	// lastAlert is the message of the last alert, which haproxy writes
+	// before it exits with an error.
+	lastAlert string
+}
+
+func newOutputLogger(stream string, logger logrus.FieldLogger) *outputLogger {
+	return &outputLogger{
+		stream: stream,
+		logger: logger.WithFields(logrus.Fields{"stream": stream}),
+	}
+}
+
+// Write logs each complete line of p, keeping a partial line for the next
+// write.
+func (o *outputLogger) Write(p []byte) (int, error) {
+	o.buf = append(o.buf, p...)
+	for {
+		i := bytes.IndexByte(o.buf, '\n')
+		if i < 0 {
+			break
+		}
+		o.log(string(o.buf[:i]))
+		o.buf = o.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush logs the partial line left when the process exits.
+func (o *outputLogger) flush() {
+	if len(o.buf) > 0 {
+		o.log(string(o.buf))
+		o.buf = nil
+	}
+}
+
+func (o *outputLogger) log(line string) {
+	level, msg := parseOutput(line)
+	if msg == "" {
+		return
+	}
+	switch level {
+	case logrus.ErrorLevel:
+		o.lastAlert = msg
+		o.logger.Error(msg)
+	case logrus.WarnLevel:
+		o.logger.Warn(msg)
+	default:
+		o.logger.Info(msg)
+	}
+}
+
+// parseOutput returns the level of a line of haproxy's output and its message
+// without the prefix, e.g. for
+//
+//	[ALERT]    (1234) : Starting proxy listen6-80: cannot bind socket
+//
+// the error level and "Starting proxy listen6-80: cannot bind socket". Older
+// versions put the date between the prefix and the pid. Lines without a
+// prefix are at the info level.
+func parseOutput(line string) (logrus.Level, string) {
+	line = strings.TrimSpace(line)
+	level := logrus.InfoLevel
+	switch {
+	case strings.HasPrefix(line, "[ALERT]"), strings.HasPrefix(line, "[EMERG]"):
+		level = logrus.ErrorLevel
+	case strings.HasPrefix(line, "[WARNING]"):
+		level = logrus.WarnLevel
+	case strings.HasPrefix(line, "[NOTICE]"):
+	default:
+		return level, line
+	}
+	if i := strings.Index(line, ") : "); i >= 0 {
+		return level, line[i+len(") : "):]
+	}
+	return level, strings.TrimSpace(line[strings.Index(line, "]")+1:])
+}
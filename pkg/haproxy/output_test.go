@@ -0,0 +1,57 @@
+package haproxy
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// entries records the entries logged through it.
+type entries []*logrus.Entry
+
+func (e *entries) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (e *entries) Fire(entry *logrus.Entry) error {
+	*e = append(*e, entry)
+	return nil
+}
+
+func TestParseOutput(t *testing.T) {
+	for _, test := range []struct {
+		line  string
+		level logrus.Level
+		msg   string
+	}{
+		{"[ALERT]    (1234) : Starting proxy listen6-80: cannot bind socket (Address already in use) [10.54.213.10:80]", logrus.ErrorLevel, "Starting proxy listen6-80: cannot bind socket (Address already in use) [10.54.213.10:80]"},
+		{"[WARNING] 283/171215 (1) : config : 'option forwardfor' ignored for proxy 'listen6-25' as it requires HTTP mode.", logrus.WarnLevel, "config : 'option forwardfor' ignored for proxy 'listen6-25' as it requires HTTP mode."},
+		{"[NOTICE]   (1234) : New worker (1240) forked", logrus.InfoLevel, "New worker (1240) forked"},
+		{"[WARNING] no pid", logrus.WarnLevel, "no pid"},
+		{"Configuration file is valid", logrus.InfoLevel, "Configuration file is valid"},
+	} {
+		level, msg := parseOutput(test.line)
+		if level != test.level || msg != test.msg {
+			t.Fatalf("%q: expected %v %q. saw %v %q", test.line, test.level, test.msg, level, msg)
+		}
+	}
+}
+
+func TestOutputLogger(t *testing.T) {
+	logger, logged := logrus.New(), entries{}
+	logger.Out = ioutil.Discard
+	logger.AddHook(&logged)
+	o := newOutputLogger("stderr", logger.WithFields(logrus.Fields{"vip": "10.54.213.10"}))
+	o.Write([]byte("[NOTICE]   (1) : New worker (2) forked\n[ALERT]    (1) : Starting proxy listen6-80: cannot bind"))
+	o.Write([]byte(" socket\n\n[WARNING]  (1) : exiting"))
+	o.flush()
+
+	if len(logged) != 3 {
+		t.Fatalf("expected 3 entries. saw %d", len(logged))
+	}
+	if logged[1].Level != logrus.ErrorLevel || logged[1].Message != "Starting proxy listen6-80: cannot bind socket" || logged[1].Data["vip"] != "10.54.213.10" || logged[1].Data["stream"] != "stderr" {
+		t.Fatalf("expected the alert with the vip and stream. saw %v %q %v", logged[1].Level, logged[1].Message, logged[1].Data)
+	}
+	if logged[2].Level != logrus.WarnLevel || o.lastAlert != "Starting proxy listen6-80: cannot bind socket" {
+		t.Fatalf("expected the partial warning and the last alert. saw %v %q", logged[2].Level, o.lastAlert)
+	}
+}
@@ -0,0 +1,130 @@
+package haproxy
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// Render returns the haproxy configuration of config from configTemplate, as
+// an instance with its files in configDir would be configured. It writes
+// nothing and starts nothing, so that configurations can be checked away
+// from a node.
+func Render(configTemplate, configDir string, config VIPConfig) ([]byte, error) {
+	t, err := parseTemplate(configTemplate)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, newContext(configDir, config)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// socketPath returns the path of the admin socket of the instance serving
+// addr, beside its configuration.
+func socketPath(configDir, addr string) string {
+	return filepath.Join(configDir, addr+".sock")
+}
+
+// certPath returns the path of the PEM bundle of the instance serving addr,
+// beside its configuration.
+func certPath(configDir, addr string) string {
+	return filepath.Join(configDir, addr+".pem")
+}
+
+// newContext prepares the template context of config, with a listener to
+// balance traffic from the VIP's addresses across the service addresses of each port, in
+// order of port, terminating TLS when there is a TLS bundle. Ports without
+// service addresses or a server template are left out.
+func newContext(configDir string, config VIPConfig) templateContext {
+	serviceAddrs, ports := config.ServiceAddrs, config.ListenPorts
+	binds := []string{}
+	for _, addr := range []string{config.Addr6, config.Addr4} {
+		if addr != "" {
+			binds = append(binds, addr)
+		}
+	}
+	d := templateContext{
+		Socket:          socketPath(configDir, config.ListenAddr()),
+		MaxConn:         config.MaxConn,
+		NBThread:        config.NBThread,
+		FrontendMaxConn: config.FrontendMaxConn,
+		ConnectTimeout:  config.ConnectTimeout,
+		ClientTimeout:   config.ClientTimeout,
+		ServerTimeout:   config.ServerTimeout,
+		StatsPort:       config.StatsPort,
+		Listeners:       []listenerContext{},
+	}
+	if d.MaxConn == 0 {
+		d.MaxConn = defaultMaxConn
+	}
+	if d.FrontendMaxConn == 0 {
+		d.FrontendMaxConn = defaultFrontendMaxConn
+	}
+	if d.ConnectTimeout == 0 {
+		d.ConnectTimeout = defaultConnectTimeout
+	}
+	if d.ClientTimeout == 0 {
+		d.ClientTimeout = defaultClientTimeout
+	}
+	if d.ServerTimeout == 0 {
+		d.ServerTimeout = defaultServerTimeout
+	}
+	if len(config.TLSBundle) > 0 {
+		d.Cert = certPath(configDir, config.ListenAddr())
+	}
+	for i, port := range ports {
+		l := listenerContext{Port: port, Source: config.ListenAddr(), Binds: binds, Mode: ModeTCP}
+		if i < len(config.ServerTemplates) && config.ServerTemplates[i] != nil {
+			st := config.ServerTemplates[i]
+			slots := st.Slots
+			if slots == 0 {
+				slots = defaultServerSlots
+			}
+			l.Servers = []serverContext{{Name: fmt.Sprintf("dest4-%d-", port), Addr: st.Name, Slots: slots}}
+			d.Resolvers = true
+		} else if i < len(serviceAddrs) && len(serviceAddrs[i]) > 0 {
+			for n, addr := range serviceAddrs[i] {
+				l.Servers = append(l.Servers, serverContext{Name: serverName(port, n), Addr: addr})
+			}
+		} else {
+			continue
+		}
+		if i < len(config.ProxyMode) {
+			l.ProxyV2 = config.ProxyMode[i]
+		}
+		if i < len(config.Modes) && config.Modes[i] == ModeHTTP {
+			l.Mode = ModeHTTP
+			l.HTTP2 = i < len(config.HTTP2) && config.HTTP2[i]
+		}
+		if i < len(config.SourceRanges) {
+			l.Allow = config.SourceRanges[i]
+		}
+		if i < len(config.HealthChecks) && config.HealthChecks[i] != nil {
+			l.Check = withDefaults(*config.HealthChecks[i])
+		}
+		d.Listeners = append(d.Listeners, l)
+	}
+	if d.Resolvers {
+		d.Nameservers = config.Nameservers
+	}
+	sort.Slice(d.Listeners, func(i, j int) bool { return d.Listeners[i].Port < d.Listeners[j].Port })
+	return d
+}
+
+// withDefaults returns a copy of check with defaults in place of zero values.
+func withDefaults(check HealthCheck) *HealthCheck {
+	if check.Interval == 0 {
+		check.Interval = defaultCheckInterval
+	}
+	if check.Rise == 0 {
+		check.Rise = defaultCheckRise
+	}
+	if check.Fall == 0 {
+		check.Fall = defaultCheckFall
+	}
+	return &check
+}
@@ -0,0 +1,53 @@
+package haproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// runtimeTimeout bounds a command to the runtime API of an haproxy instance.
+const runtimeTimeout = 2 * time.Second
+
+// runtimeCommand sends a command to the admin socket of an haproxy instance
+// and returns its response. The socket answers a single command per
+// connection and then closes it.
+func runtimeCommand(socket, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", socket, runtimeTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(runtimeTimeout))
+
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// setServerAddr points a server of a running haproxy at addr, an address or
+// address:port, without a reload, with `set server <backend>/<server> addr
+// <address> [port <port>]`.
+func setServerAddr(socket, backend, server, addr string) error {
+	command := fmt.Sprintf("set server %s/%s addr %s", backend, server, addr)
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		command = fmt.Sprintf("set server %s/%s addr %s port %s", backend, server, host, port)
+	}
+	response, err := runtimeCommand(socket, command)
+	if err != nil {
+		return err
+	}
+	// haproxy answers "IP changed from ..." or "no need to change the addr"
+	lower := strings.ToLower(response)
+	if !strings.Contains(lower, "changed from") && !strings.Contains(lower, "no need to change") {
+		return fmt.Errorf("set server %s/%s addr %s. %s", backend, server, addr, response)
+	}
+	return nil
+}
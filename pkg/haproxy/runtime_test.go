@@ -0,0 +1,86 @@
+package haproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// serveRuntime answers each command sent to a unix socket at path from
+// responses, and records the commands.
+func serveRuntime(t *testing.T, path string, responses map[string]string, commands chan<- string) net.Listener {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			command, _ := bufio.NewReader(conn).ReadString('\n')
+			command = command[:len(command)-1]
+			commands <- command
+			conn.Write([]byte(responses[command] + "\n"))
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestSetServerAddr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "admin.sock")
+
+	commands := make(chan string, 10)
+	l := serveRuntime(t, socket, map[string]string{
+		"set server listen6-80/dest4-80 addr 10.96.0.11":         "IP changed from '10.96.0.10' to '10.96.0.11' by 'stats socket command'.",
+		"set server listen6-81/dest4-81 addr 10.96.0.11":         "No such server.",
+		"set server listen6-443/dest4-443 addr 10.96.0.10":       "no need to change the addr.",
+		"set server listen6-80/dest4-80 addr 10.2.0.5 port 8080": "IP changed from '10.96.0.11' to '10.2.0.5', port changed from '80' to '8080' by 'stats socket command'.",
+	}, commands)
+	defer l.Close()
+
+	if err := setServerAddr(socket, "listen6-80", "dest4-80", "10.96.0.11"); err != nil {
+		t.Fatalf("expected the address to change. %v", err)
+	}
+	if command := <-commands; command != "set server listen6-80/dest4-80 addr 10.96.0.11" {
+		t.Fatalf("unexpected command %q", command)
+	}
+	if err := setServerAddr(socket, "listen6-80", "dest4-80", "10.2.0.5:8080"); err != nil {
+		t.Fatalf("expected the address and port to change. %v", err)
+	}
+	if command := <-commands; command != "set server listen6-80/dest4-80 addr 10.2.0.5 port 8080" {
+		t.Fatalf("unexpected command %q", command)
+	}
+	if err := setServerAddr(socket, "listen6-443", "dest4-443", "10.96.0.10"); err != nil {
+		t.Fatalf("expected an unchanged address to succeed. %v", err)
+	}
+	if err := setServerAddr(socket, "listen6-81", "dest4-81", "10.96.0.11"); err == nil {
+		t.Fatalf("expected an unknown server to fail")
+	}
+	if err := setServerAddr(filepath.Join(dir, "missing.sock"), "listen6-80", "dest4-80", "10.96.0.11"); err == nil {
+		t.Fatalf("expected a missing socket to fail")
+	}
+}
+
+func TestDestinations(t *testing.T) {
+	current := destinations([][]string{{"10.96.0.10"}, {"10.2.0.5:8443", "10.2.1.7:8443"}}, []uint16{80, 443})
+	reordered := destinations([][]string{{"10.2.0.5:8443", "10.2.1.8:8443"}, {"10.96.0.10"}, {}}, []uint16{443, 80, 8080})
+	expect := map[uint16][]string{80: {"10.96.0.10"}, 443: {"10.2.0.5:8443", "10.2.1.8:8443"}}
+	if !reflect.DeepEqual(reordered, expect) {
+		t.Fatalf("expected %v, without the port that has no addresses. saw %v", expect, reordered)
+	}
+	if reflect.DeepEqual(current, reordered) {
+		t.Fatalf("expected a changed address to change the destinations")
+	}
+}
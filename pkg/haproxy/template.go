@@ -1,5 +1,64 @@
 package haproxy
 
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+)
+
+// parseTemplate parses the template of an haproxy configuration. It is a text
+// template, as the html escaping of html/template would corrupt addresses,
+// paths and quoted strings in the configuration, and it fails on missing keys
+// rather than render "<no value>" into the configuration.
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("conf").Option("missingkey=error").Parse(text)
+}
+
+// LoadTemplate returns the template of the haproxy configuration in the file
+// at path, or the built-in template when path is empty. The template is first
+// rendered against a sample VIP, so that one that does not parse, or names a
+// field that does not exist, fails at startup rather than at a reload.
+func LoadTemplate(path string) (string, error) {
+	if path == "" {
+		return haproxyConfig, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read haproxy template %s. %v", path, err)
+	}
+	t, err := parseTemplate(string(b))
+	if err != nil {
+		return "", fmt.Errorf("unable to parse haproxy template %s. %v", path, err)
+	}
+	if err := t.Execute(&bytes.Buffer{}, sampleContext()); err != nil {
+		return "", fmt.Errorf("unable to render haproxy template %s. %v", path, err)
+	}
+	return string(b), nil
+}
+
+// sampleContext is a VIP that exercises each field of the template context.
+func sampleContext() templateContext {
+	return templateContext{
+		Socket:          "/etc/ravel/2001:db8::10.sock",
+		Cert:            "/etc/ravel/2001:db8::10.pem",
+		MaxConn:         defaultMaxConn,
+		NBThread:        2,
+		FrontendMaxConn: defaultFrontendMaxConn,
+		ConnectTimeout:  defaultConnectTimeout,
+		ClientTimeout:   defaultClientTimeout,
+		ServerTimeout:   defaultServerTimeout,
+		StatsPort:       9000,
+		Resolvers:       true,
+		Nameservers:     []string{"10.96.0.10:53"},
+		Listeners: []listenerContext{
+			{Port: 53, Source: "2001:db8::10", Binds: []string{"2001:db8::10"}, Servers: []serverContext{{Name: "dest4-53-", Addr: "_dns._tcp.coredns.kube-system.svc.cluster.local", Slots: defaultServerSlots}}, Mode: ModeTCP},
+			{Port: 80, Source: "2001:db8::10", Binds: []string{"2001:db8::10", "10.54.213.10"}, Servers: []serverContext{{Name: "dest4-80-1", Addr: "10.96.0.10:80"}}, Mode: ModeHTTP, HTTP2: true, Check: withDefaults(HealthCheck{HTTPPath: "/healthz"})},
+			{Port: 443, Source: "2001:db8::10", Binds: []string{"2001:db8::10", "10.54.213.10"}, Servers: []serverContext{{Name: "dest4-443-1", Addr: "10.2.0.5:8443"}, {Name: "dest4-443-2", Addr: "10.2.1.7:8443"}}, Mode: ModeTCP, ProxyV2: true, Check: withDefaults(HealthCheck{}), Allow: []string{"10.0.0.0/8", "2001:db8::/32"}},
+		},
+	}
+}
+
 var haproxyConfig string = `
 # Autogenerated by Ravel. Do not change.
 
@@ -7,9 +66,13 @@ var haproxyConfig string = `
 global
     log 127.0.0.1        local0
     log 127.0.0.1        local1 notice
-    maxconn              4096
+    maxconn              {{ .MaxConn }}
+{{- if .NBThread }}
+    nbthread             {{ .NBThread }}
+{{- end }}
     user                 haproxy
     group                haproxy
+    stats socket         {{ .Socket }} mode 600 level admin expose-fd listeners
 
 defaults
     log                     global
@@ -17,16 +80,56 @@ defaults
     option                  dontlognull
     retries                 3
     maxconn                 28000
-    timeout connect         5000
-    timeout client          50000
-    timeout server          50000
+    timeout connect         {{ .ConnectTimeout }}
+    timeout client          {{ .ClientTimeout }}
+    timeout server          {{ .ServerTimeout }}
+{{- if .Resolvers }}
+
+resolvers kube
+{{- range $i, $ns := .Nameservers }}
+    nameserver          dns{{ $i }} {{ $ns }}
+{{- else }}
+    parse-resolv-conf
+{{- end }}
+    hold valid          10s
+    accepted_payload_size 8192
+{{- end }}
+{{- if .StatsPort }}
+
+listen stats
+        bind    127.0.0.1:{{ .StatsPort }}
+        mode    http
+        stats   enable
+        stats   uri /
+        stats   refresh 10s
+        stats   show-legends
+{{- end }}
 
-{{ range . }}
+{{ range .Listeners }}{{ $listener := . }}
 listen listen6-{{ .Port }}
-        bind	{{ .Source }}:{{ .Port }}
-        mode    tcp
-        server  dest4-{{ .Port }}    {{ .Dest }} send-proxy
-        maxconn 28000
+{{- range .Binds }}
+        bind	{{ . }}:{{ $listener.Port }}{{ if $.Cert }} ssl crt {{ $.Cert }}{{ if eq $listener.Mode "http" }} alpn h2,http/1.1{{ end }}{{ end }}
+{{- end }}
+        mode    {{ .Mode }}
+{{- if .Allow }}
+        acl     allowed src{{ range .Allow }} {{ . }}{{ end }}
+        tcp-request connection reject if !allowed
+{{- end }}
+{{- if .Check }}{{ if .Check.HTTPPath }}
+        option  httpchk GET {{ .Check.HTTPPath }}{{ else }}
+        option  tcp-check{{ end }}{{ end }}
+{{- if eq .Mode "http" }}
+        option  forwardfor
+        http-request set-header Forwarded "for=%[src]" if { src 0.0.0.0/0 }
+        http-request set-header Forwarded "for=\"[%[src]]\"" if !{ src 0.0.0.0/0 }
+{{- end }}
+{{- range .Servers }}
+        {{ if .Slots }}server-template {{ .Name }} {{ .Slots }} {{ .Addr }} resolvers kube init-addr none{{ else }}server  {{ .Name }}    {{ .Addr }}{{ end }}
+{{- if ne $listener.Mode "http" }} {{ if $listener.ProxyV2 }}send-proxy-v2{{ else }}send-proxy{{ end }}{{ end }}
+{{- if $listener.HTTP2 }} proto h2{{ end }}
+{{- with $listener.Check }} check inter {{ .Interval }} rise {{ .Rise }} fall {{ .Fall }}{{ if and $listener.HTTP2 .HTTPPath }} check-proto h2{{ end }}{{ end }}
+{{- end }}
+        maxconn {{ $.FrontendMaxConn }}
         grace   4000
 {{ end }}
 `
@@ -0,0 +1,94 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// captureTimeFormat names capture files so that they sort by the time they
+// were written.
+const captureTimeFormat = "20060102T150405.000000000Z"
+
+// Capture writes the rules of each failed Restore to its own timestamped file
+// in a directory, with the error, the diff from the live rules and the context
+// of the failure, keeping the newest retain files so that the evidence of one
+// failure is not overwritten by the next.
+type Capture struct {
+	dir    string
+	prefix string
+	retain int
+}
+
+// NewCapture returns a Capture that writes files named prefix-ruleset-err-*
+// to dir, and keeps the newest retain of them. A retain of 0 captures nothing.
+func NewCapture(dir, prefix string, retain int) *Capture {
+	return &Capture{dir: dir, prefix: prefix + "-ruleset-err-", retain: retain}
+}
+
+// Write captures the failure of restoring merged over the existing rules of
+// table, and returns the name of the file written, or "" when it captures
+// nothing. fields are written as the context of the failure.
+func (c *Capture) Write(applyErr error, fields map[string]string, table string, existing, merged map[string]*RuleSet) (string, error) {
+	if c == nil || c.retain == 0 {
+		return "", nil
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return "", fmt.Errorf("unable to create capture directory %s. %v", c.dir, err)
+	}
+
+	now := time.Now().UTC()
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "time: %s\n", now.Format(time.RFC3339Nano))
+	fmt.Fprintf(out, "error: %v\n", applyErr)
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(out, "%s: %s\n", key, fields[key])
+	}
+
+	out.WriteString("\n# diff from the live rules\n")
+	if diff := Diff(existing, merged); diff != "" {
+		out.WriteString(diff)
+	} else {
+		out.WriteString("no changes\n")
+	}
+	out.WriteString("\n# rules that failed to restore\n")
+	out.Write(BytesFromRules(table, merged))
+
+	filename := filepath.Join(c.dir, c.prefix+now.Format(captureTimeFormat))
+	if err := ioutil.WriteFile(filename, out.Bytes(), 0644); err != nil {
+		return "", fmt.Errorf("unable to write capture %s. %v", filename, err)
+	}
+	return filename, c.prune()
+}
+
+// prune removes all but the newest retain capture files.
+func (c *Capture) prune() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("unable to list capture directory %s. %v", c.dir, err)
+	}
+	captures := []string{}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasPrefix(file.Name(), c.prefix) {
+			captures = append(captures, file.Name())
+		}
+	}
+	sort.Strings(captures)
+	for len(captures) > c.retain {
+		if err := os.Remove(filepath.Join(c.dir, captures[0])); err != nil {
+			return fmt.Errorf("unable to remove capture %s. %v", captures[0], err)
+		}
+		captures = captures[1:]
+	}
+	return nil
+}
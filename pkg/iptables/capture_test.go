@@ -0,0 +1,51 @@
+package iptables
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	live := map[string]*RuleSet{"RAVEL": {ChainRule: ":RAVEL - [0:0]"}}
+	merged := map[string]*RuleSet{"RAVEL": {ChainRule: ":RAVEL - [0:0]", Rules: []string{"-A RAVEL -d 10.54.213.253/32 -j RAVEL-SVC-A"}}}
+
+	capture := NewCapture(dir, "realserver", 2)
+	written := []string{}
+	for i := 0; i < 3; i++ {
+		filename, err := capture.Write(fmt.Errorf("restore failed %d", i), map[string]string{"node": "node-a"}, "nat", live, merged)
+		if err != nil {
+			t.Fatalf("expected capture %d to be written. saw %v", i, err)
+		}
+		written = append(written, filename)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Fatalf("expected the newest 2 captures to be kept. saw %d", len(files))
+	}
+	if _, err := os.Stat(written[0]); !os.IsNotExist(err) {
+		t.Fatalf("expected the oldest capture to be removed. saw %v", err)
+	}
+	b, err := ioutil.ReadFile(written[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expects := range []string{"error: restore failed 2", "node: node-a", "+-A RAVEL -d 10.54.213.253/32 -j RAVEL-SVC-A", "*nat"} {
+		if !strings.Contains(string(b), expects) {
+			t.Fatalf("expected the capture to contain %q. saw\n%s", expects, b)
+		}
+	}
+
+	if filename, err := NewCapture(dir, "director", 0).Write(fmt.Errorf("restore failed"), nil, "nat", live, merged); filename != "" || err != nil {
+		t.Fatalf("expected a retain of 0 to capture nothing. saw %s %v", filename, err)
+	}
+}
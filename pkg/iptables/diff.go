@@ -0,0 +1,187 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// diffLine is a line of a diff, prefixed with ' ', '-' or '+'.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// Diff returns a unified diff from the live rules to the merged rules, or an
+// empty string when they are the same. Each side is written as its chain
+// declarations and rules, chain by chain in order of name, so that the diff
+// does not depend on the order the chains were saved or generated in.
+func Diff(live, merged map[string]*RuleSet) string {
+	names := map[string]bool{}
+	for name := range live {
+		names[name] = true
+	}
+	for name := range merged {
+		names[name] = true
+	}
+	chains := []string{}
+	for name := range names {
+		chains = append(chains, name)
+	}
+	sort.Strings(chains)
+
+	lines := []diffLine{}
+	changed := false
+	for _, chain := range chains {
+		for _, line := range diffLines(chainLines(live[chain]), chainLines(merged[chain])) {
+			changed = changed || line.op != ' '
+			lines = append(lines, line)
+		}
+	}
+	if !changed {
+		return ""
+	}
+	return "--- live\n+++ merged\n" + hunks(lines)
+}
+
+// chainLines returns the declaration and rules of a chain, if it exists.
+func chainLines(set *RuleSet) []string {
+	if set == nil {
+		return nil
+	}
+	return append([]string{set.ChainRule}, set.Rules...)
+}
+
+// diffLines returns the lines of a and b as an edit script from a to b, from
+// the longest common subsequence of the two once their common prefix and
+// suffix are trimmed.
+func diffLines(a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	out := []diffLine{}
+	for _, line := range a[:prefix] {
+		out = append(out, diffLine{' ', line})
+	}
+
+	x, y := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	// lcs[i][j] is the length of the longest common subsequence of x[i:]
+	// and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			out = append(out, diffLine{' ', x[i]})
+			i++
+			j++
+		case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, diffLine{'-', x[i]})
+			i++
+		default:
+			out = append(out, diffLine{'+', y[j]})
+			j++
+		}
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		out = append(out, diffLine{' ', line})
+	}
+	return out
+}
+
+// hunks formats the changes among lines as unified diff hunks, with
+// diffContext lines of context around them.
+func hunks(lines []diffLine) string {
+	var b bytes.Buffer
+	for start := 0; start < len(lines); {
+		// find the next change
+		first := start
+		for first < len(lines) && lines[first].op == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+
+		// extend the hunk until the unchanged lines between changes are
+		// more than twice the context
+		last := first
+		for next := first; next < len(lines); next++ {
+			if lines[next].op != ' ' {
+				last = next
+			} else if next-last > 2*diffContext {
+				break
+			}
+		}
+
+		from := first - diffContext
+		if from < start {
+			from = start
+		}
+		to := last + diffContext + 1
+		if to > len(lines) {
+			to = len(lines)
+		}
+
+		// line numbers of the hunk on each side, counted from 1
+		liveStart, mergedStart := 1, 1
+		for _, line := range lines[:from] {
+			if line.op != '+' {
+				liveStart++
+			}
+			if line.op != '-' {
+				mergedStart++
+			}
+		}
+		liveCount, mergedCount := 0, 0
+		for _, line := range lines[from:to] {
+			if line.op != '+' {
+				liveCount++
+			}
+			if line.op != '-' {
+				mergedCount++
+			}
+		}
+
+		// an empty side is numbered after the line before it
+		if liveCount == 0 {
+			liveStart--
+		}
+		if mergedCount == 0 {
+			mergedStart--
+		}
+
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", liveStart, liveCount, mergedStart, mergedCount)
+		for _, line := range lines[from:to] {
+			b.WriteByte(line.op)
+			b.WriteString(line.text)
+			b.WriteByte('\n')
+		}
+		start = to
+	}
+	return b.String()
+}
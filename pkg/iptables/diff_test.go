@@ -0,0 +1,40 @@
+package iptables
+
+import "testing"
+
+func TestDiff(t *testing.T) {
+	live := map[string]*RuleSet{
+		"PREROUTING": {ChainRule: ":PREROUTING ACCEPT [0:0]", Rules: []string{"-A PREROUTING -j RAVEL"}},
+		"RAVEL": {ChainRule: ":RAVEL - [0:0]", Rules: []string{
+			"-A RAVEL -d 10.54.213.253/32 -j RAVEL-SVC-A",
+			"-A RAVEL -d 10.54.213.254/32 -j RAVEL-SVC-B",
+		}},
+		"RAVEL-SVC-B": {ChainRule: ":RAVEL-SVC-B - [0:0]"},
+	}
+	if diff := Diff(live, live); diff != "" {
+		t.Fatalf("expected no diff. saw\n%s", diff)
+	}
+
+	merged := map[string]*RuleSet{
+		"PREROUTING": live["PREROUTING"],
+		"RAVEL": {ChainRule: ":RAVEL - [0:0]", Rules: []string{
+			"-A RAVEL -d 10.54.213.253/32 -j RAVEL-SVC-A",
+			"-A RAVEL -d 10.54.213.255/32 -j RAVEL-SVC-C",
+		}},
+		"RAVEL-SVC-C": {ChainRule: ":RAVEL-SVC-C - [0:0]"},
+	}
+	expects := `--- live
++++ merged
+@@ -2,5 +2,5 @@
+ -A PREROUTING -j RAVEL
+ :RAVEL - [0:0]
+ -A RAVEL -d 10.54.213.253/32 -j RAVEL-SVC-A
+--A RAVEL -d 10.54.213.254/32 -j RAVEL-SVC-B
++-A RAVEL -d 10.54.213.255/32 -j RAVEL-SVC-C
+-:RAVEL-SVC-B - [0:0]
++:RAVEL-SVC-C - [0:0]
+`
+	if diff := Diff(live, merged); diff != expects {
+		t.Fatalf("expected\n%s\nsaw\n%s", expects, diff)
+	}
+}
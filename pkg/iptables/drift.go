@@ -0,0 +1,98 @@
+package iptables
+
+import (
+	"sort"
+	"time"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
+)
+
+// DriftInterval is how often the workers check the owned chains for changes
+// made by other agents, such as kube-proxy, since they were last restored.
+const DriftInterval = 30 * time.Second
+
+// CheckDrift compares the owned chains of iptables and ip6tables with those
+// saved after they were last restored, and logs the rules that another agent
+// added or removed since. It returns the number of such rules. Nothing is
+// checked until rules have been restored.
+func (i *iptables) CheckDrift() (int, error) {
+	drifted, err := i.checkDrift(i.iptables, "save", i.applied, "")
+	if err != nil {
+		return drifted, err
+	}
+	drifted6, err := i.checkDrift(i.iptables6, "save6", i.applied6, "-ipv6")
+	return drifted + drifted6, err
+}
+
+func (i *iptables) checkDrift(ipt util.Interface, operation string, applied map[string]*RuleSet, suffix string) (int, error) {
+	if applied == nil {
+		return 0, nil
+	}
+	live, err := i.save(ipt, operation)
+	if err != nil {
+		return 0, err
+	}
+	added, removed := driftedRules(applied, i.ownedChains(live))
+	for _, rule := range added {
+		i.logger.Warnf("iptables%s rule added by another agent to an owned chain. %s", suffix, rule)
+	}
+	for _, rule := range removed {
+		i.logger.Warnf("iptables%s rule removed by another agent from an owned chain. %s", suffix, rule)
+	}
+	i.metrics.DriftGauge(len(added), "added"+suffix)
+	i.metrics.DriftGauge(len(removed), "removed"+suffix)
+	return len(added) + len(removed), nil
+}
+
+// snapshot saves the owned chains as they were restored, as iptables-save
+// renders them, for CheckDrift to compare with. A failure leaves nothing to
+// compare with until the next restore.
+func (i *iptables) snapshot(ipt util.Interface, operation string) map[string]*RuleSet {
+	live, err := i.save(ipt, operation)
+	if err != nil {
+		i.logger.Warnf("unable to save the restored rules to check for drift. %v", err)
+		return nil
+	}
+	return i.ownedChains(live)
+}
+
+// ownedChains returns the owned chains of rules.
+func (i *iptables) ownedChains(rules map[string]*RuleSet) map[string]*RuleSet {
+	out := map[string]*RuleSet{}
+	for chain, set := range rules {
+		if i.ownsChain(chain) {
+			out[chain] = set
+		}
+	}
+	return out
+}
+
+// driftedRules returns the rules of live that applied lacks, as added, and
+// those of applied that live lacks, as removed, sorted. A rule that appears
+// more often on one side than the other counts once for each extra copy.
+func driftedRules(applied, live map[string]*RuleSet) ([]string, []string) {
+	counts := map[string]int{}
+	for _, set := range applied {
+		for _, rule := range set.Rules {
+			counts[rule]--
+		}
+	}
+	for _, set := range live {
+		for _, rule := range set.Rules {
+			counts[rule]++
+		}
+	}
+
+	added, removed := []string{}, []string{}
+	for rule, count := range counts {
+		for ; count > 0; count-- {
+			added = append(added, rule)
+		}
+		for ; count < 0; count++ {
+			removed = append(removed, rule)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
@@ -0,0 +1,43 @@
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDriftedRules(t *testing.T) {
+	applied := map[string]*RuleSet{
+		"RAVEL": {Rules: []string{
+			`-A RAVEL -d 10.54.213.253/32 -m comment --comment "10.54.213.253" -j RAVEL-VIP-A`,
+			`-A RAVEL -d 10.54.213.254/32 -m comment --comment "10.54.213.254" -j RAVEL-VIP-B`,
+		}},
+		"RAVEL-MASQ": {Rules: []string{"-A RAVEL-MASQ -j MARK --set-xmark 0x4000/0x4000"}},
+	}
+	live := map[string]*RuleSet{
+		"RAVEL": {Rules: []string{
+			`-A RAVEL -d 10.54.213.253/32 -m comment --comment "10.54.213.253" -j RAVEL-VIP-A`,
+			`-A RAVEL -j KUBE-MARK-DROP`,
+		}},
+		"RAVEL-MASQ": {Rules: []string{
+			"-A RAVEL-MASQ -j MARK --set-xmark 0x4000/0x4000",
+			"-A RAVEL-MASQ -j MARK --set-xmark 0x4000/0x4000",
+		}},
+	}
+
+	added, removed := driftedRules(applied, live)
+	expectAdded := []string{
+		`-A RAVEL -j KUBE-MARK-DROP`,
+		"-A RAVEL-MASQ -j MARK --set-xmark 0x4000/0x4000",
+	}
+	expectRemoved := []string{`-A RAVEL -d 10.54.213.254/32 -m comment --comment "10.54.213.254" -j RAVEL-VIP-B`}
+	if !reflect.DeepEqual(added, expectAdded) {
+		t.Fatalf("expected %v added. saw %v", expectAdded, added)
+	}
+	if !reflect.DeepEqual(removed, expectRemoved) {
+		t.Fatalf("expected %v removed. saw %v", expectRemoved, removed)
+	}
+
+	if added, removed := driftedRules(applied, applied); len(added) != 0 || len(removed) != 0 {
+		t.Fatalf("expected no drift. saw %v %v", added, removed)
+	}
+}
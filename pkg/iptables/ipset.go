@@ -0,0 +1,136 @@
+package iptables
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxSetNameLength is the longest name the kernel accepts for an ipset
+const maxSetNameLength = 31
+
+// vipSets collects the VIP:port members of the sets that the base chain
+// matches in ipset mode, by the service chain that each set jumps to.
+type vipSets struct {
+	members     map[string][]string
+	idents      map[string]string
+	probability map[string]float64
+}
+
+func newVIPSets() *vipSets {
+	return &vipSets{
+		members:     map[string][]string{},
+		idents:      map[string]string{},
+		probability: map[string]float64{},
+	}
+}
+
+// add makes dest:dport, e.g. 10.54.213.253:80, a member of the set that jumps
+// to chain.
+func (v *vipSets) add(chain, ident, dest, dport string) {
+	v.members[chain] = append(v.members[chain], dest+",tcp:"+dport)
+	v.idents[chain] = ident
+}
+
+// setName names a set after a hash of its members. A set's members then never
+// change once it is created. New members make a new set, which the base chain
+// switches to atomically as the rules are restored.
+func (i *iptables) setName(members []string) string {
+	sort.Strings(members)
+	hash := sha256.Sum256([]byte(strings.Join(members, " ")))
+	encoded := base32.StdEncoding.EncodeToString(hash[:])
+	return i.setPrefix() + encoded[:16]
+}
+
+func (i *iptables) setPrefix() string {
+	return i.chain.String() + "-SET-"
+}
+
+// setRules returns the rules of the base chain that match the sets in v, a
+// masquerade rule matching every VIP:port when masq is set and a jump rule
+// per service chain, with the probability of each service when weighted is
+// set. The sets are kept for Restore to create.
+func (i *iptables) setRules(v *vipSets, masq, weighted bool) []string {
+	i.sets = map[string][]string{}
+	rules := []string{}
+
+	chains := []string{}
+	all := []string{}
+	for chain, members := range v.members {
+		chains = append(chains, chain)
+		all = append(all, members...)
+	}
+	sort.Strings(chains)
+
+	if masq && len(all) > 0 {
+		name := i.setName(all)
+		i.sets[name] = all
+		rules = append(rules, fmt.Sprintf(`-A %s -m set --match-set %s dst,dst -m comment --comment "ravel vips" -j %s`, i.chain, name, i.masqChain))
+	}
+	for _, chain := range chains {
+		name := i.setName(v.members[chain])
+		i.sets[name] = v.members[chain]
+		if weighted {
+			rules = append(rules, fmt.Sprintf(`-A %s -m set --match-set %s dst,dst -m comment --comment "%s" -m statistic --mode random --probability %0.11f -j %s`, i.chain, name, v.idents[chain], v.probability[chain], chain))
+			continue
+		}
+		rules = append(rules, fmt.Sprintf(`-A %s -m set --match-set %s dst,dst -m comment --comment "%s" -j %s`, i.chain, name, v.idents[chain], chain))
+	}
+	return rules
+}
+
+// createSets creates the sets of the last generated rules that do not exist
+// yet, ahead of the rules that match them.
+func (i *iptables) createSets() error {
+	var err error
+	start := time.Now()
+	defer func() {
+		i.metrics.IPTables("ipset-restore", 1, err, time.Now().Sub(start))
+		if err != nil {
+			i.metrics.RestoreFailure("ipset-restore")
+		}
+	}()
+
+	lines := []string{}
+	for name, members := range i.sets {
+		lines = append(lines, fmt.Sprintf("create %s hash:ip,port -exist", name))
+		for _, member := range members {
+			lines = append(lines, fmt.Sprintf("add %s %s -exist", name, member))
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	cmd := exec.CommandContext(i.ctx, "ipset", "restore")
+	cmd.Stdin = bytes.NewBufferString(strings.Join(lines, "\n") + "\n")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("ipset restore failed. %v %s", err, strings.TrimSpace(string(out)))
+	}
+	return err
+}
+
+// destroySets destroys the sets named with the chain's prefix, other than
+// those in keep. A set that is still matched by a rule cannot be destroyed,
+// and is left for the next attempt.
+func (i *iptables) destroySets(keep map[string][]string) {
+	out, err := exec.CommandContext(i.ctx, "ipset", "list", "-n").Output()
+	if err != nil {
+		i.logger.Warnf("unable to list ipsets. %v", err)
+		return
+	}
+	for _, name := range strings.Fields(string(out)) {
+		if _, ok := keep[name]; ok || !strings.HasPrefix(name, i.setPrefix()) {
+			continue
+		}
+		if out, err := exec.CommandContext(i.ctx, "ipset", "destroy", name).CombinedOutput(); err != nil {
+			i.logger.Debugf("unable to destroy ipset %s. %v %s", name, err, strings.TrimSpace(string(out)))
+		}
+	}
+}
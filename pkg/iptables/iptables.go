@@ -5,12 +5,17 @@ import (
 	"crypto/sha256"
 	"encoding/base32"
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
+	utildbus "github.comcast.com/viper-sde/kube2ipvs/pkg/util/dbus"
+	utilexec "github.comcast.com/viper-sde/kube2ipvs/pkg/util/exec"
 )
 
 type IPTables interface {
@@ -22,42 +27,149 @@ type IPTables interface {
 	GenerateRulesForNodes(node types.Node, config *types.ClusterConfig, useWeightedService bool) (map[string]*RuleSet, error)
 	Merge(subset, wholeset map[string]*RuleSet) (rules map[string]*RuleSet, removals int, err error)
 
+	// The ipv6 counterparts drive ip6tables, for the VIPs in Config6
+	Save6() (map[string]*RuleSet, error)
+	Restore6(map[string]*RuleSet) error
+	Flush6() error
+	GenerateRulesForNodes6(node types.Node, config *types.ClusterConfig, useWeightedService bool) (map[string]*RuleSet, error)
+	Merge6(subset, wholeset map[string]*RuleSet) (rules map[string]*RuleSet, removals int, err error)
+
 	BaseChain() string
+	Table() string
+
+	// CheckDrift reports the rules of owned chains that other agents
+	// changed since the last Restore and Restore6.
+	CheckDrift() (int, error)
 }
 
+// lockRetries is how many times an operation that cannot take the xtables
+// lock is attempted, and lockBackoff how long the first retry waits.
+const (
+	lockRetries = 4
+	lockBackoff = 250 * time.Millisecond
+)
+
 type iptables struct {
 	chain     util.Chain
 	masqChain util.Chain
+
+	// snatChain masquerades the traffic that realservers DNAT to their pods
+	// for nat VIPs, and the hairpin traffic of pods to their own VIPs. It is
+	// jumped to from POSTROUTING.
+	snatChain util.Chain
 	table     util.Table
 
-	iptables util.Interface
+	// jumpFrom is the chain that jumps to the base chain
+	jumpFrom util.Chain
+
+	// owner tags every generated rule, as ravel/owner=<configKey>, so that
+	// the rules left behind by an earlier configuration can be found and
+	// removed, even from chains that ravel does not own.
+	owner string
+
+	iptables  util.Interface
+	iptables6 util.Interface
+
+	// randomFully and randomFully6 add --random-fully to the MASQUERADE rules
+	// of iptables and ip6tables, when iptables and the kernel support it, to
+	// avoid source port collisions under heavy NAT load.
+	randomFully  bool
+	randomFully6 bool
 
 	masq bool
 
 	// cli flag to exclude packets where the client ip is in this cidr range
 	podCidrMasq string
 
+	// ipset matches the VIP:port pairs of each service with a hash:ip,port
+	// set, rather than a rule apiece. sets holds the members of the sets of
+	// the last generated rules, by name, for Restore to create.
+	ipset bool
+	sets  map[string][]string
+
+	// noflush restores only the chains named with the base chain's prefix,
+	// with iptables-restore --noflush, leaving the chains of kube-proxy, CNI
+	// plugins and others untouched. stale and stale6 hold the prefixed chains
+	// that the last Merge and Merge6 found no longer generated, for Restore
+	// and Restore6 to delete.
+	noflush bool
+	stale   []string
+	stale6  []string
+
+	// orphaned and orphaned6 hold the owner's rules that the last Merge and
+	// Merge6 removed from chains that are kept, for noflush mode to delete.
+	orphaned  []string
+	orphaned6 []string
+
+	// unchanged and unchanged6 hold the owned chains that the last Merge and
+	// Merge6 found already as generated, which noflush mode leaves alone.
+	unchanged  map[string]bool
+	unchanged6 map[string]bool
+
+	// applied and applied6 hold the owned chains as saved after the last
+	// Restore and Restore6, for CheckDrift to compare the live rules with.
+	applied  map[string]*RuleSet
+	applied6 map[string]*RuleSet
+
+	// dryRun logs the diff that Restore and Restore6 would apply, rather
+	// than applying it, and leaves the chains unflushed.
+	dryRun bool
+
 	ctx     context.Context
 	logger  logrus.FieldLogger
 	metrics iptablesMetrics
 }
 
-func NewIPTables(ctx context.Context, lbKind, configKey, podCidrMasq, chain string, masq bool, logger logrus.FieldLogger) (IPTables, error) {
+func NewIPTables(ctx context.Context, lbKind, configKey, podCidrMasq, table, chain, jumpFrom string, masq, ipset, noflush, dryRun bool, lockWait time.Duration, logger logrus.FieldLogger) (IPTables, error) {
+	if ipset && len(chain+"-SET-")+16 > maxSetNameLength {
+		return nil, fmt.Errorf("iptables chain %s is too long to name ipsets after. ipset names are at most %d characters", chain, maxSetNameLength)
+	}
+	ipt := util.NewWithLockWait(utilexec.New(), utildbus.New(), util.ProtocolIpv4, lockWait)
+	ipt6 := util.NewWithLockWait(utilexec.New(), utildbus.New(), util.ProtocolIpv6, lockWait)
+	if !ipt.HasRandomFully() {
+		logger.Infof("iptables or the kernel do not support --random-fully. masquerading without it")
+	}
 	return &iptables{
-		iptables: util.NewDefault(),
+		iptables:     ipt,
+		iptables6:    ipt6,
+		randomFully:  ipt.HasRandomFully(),
+		randomFully6: ipt6.HasRandomFully(),
 
 		chain:       util.Chain(chain),
 		masqChain:   util.Chain(chain + "-MASQ"),
-		table:       util.TableNAT,
+		snatChain:   util.Chain(chain + "-SNAT"),
+		table:       util.Table(table),
+		jumpFrom:    util.Chain(jumpFrom),
+		owner:       "ravel/owner=" + configKey,
 		podCidrMasq: podCidrMasq,
 		ctx:         ctx,
 		logger:      logger,
 		masq:        masq,
+		ipset:       ipset,
+		noflush:     noflush,
+		dryRun:      dryRun,
 		metrics:     NewMetrics(lbKind, configKey),
 	}, nil
 }
 
 func (i *iptables) Flush() error {
+	// a flushed chain is not drift
+	i.applied = nil
+	return i.flush(i.iptables, "flush", i.ipset)
+}
+
+// Flush6 flushes the base chain of the ip6tables nat table.
+func (i *iptables) Flush6() error {
+	i.applied6 = nil
+	return i.flush(i.iptables6, "flush6", false)
+}
+
+func (i *iptables) flush(ipt util.Interface, operation string, ipset bool) error {
+	if i.dryRun {
+		i.logger.Infof("iptables dry run. not flushing %s", i.chain)
+		return nil
+	}
+
 	// Make several attempts to flush the chain.  Warn on failures.
 	var err error
 	idx, tries := 0, 5
@@ -65,10 +177,10 @@ func (i *iptables) Flush() error {
 	// emit a metric about the flush
 	start := time.Now()
 	defer func() {
-		i.metrics.IPTables("flush", idx, err, time.Now().Sub(start))
+		i.metrics.IPTables(operation, idx, err, time.Now().Sub(start))
 	}()
 	for idx < tries {
-		err = i.iptables.FlushChain(i.table, i.chain)
+		err = ipt.FlushChain(i.table, i.chain)
 		if err != nil && strings.Contains(err.Error(), "match by that name") {
 			// if the chain does not exist, it's flushed.
 			return nil
@@ -78,20 +190,38 @@ func (i *iptables) Flush() error {
 			<-time.After(111 * time.Millisecond)
 			continue
 		}
+		if ipset {
+			// nothing matches the sets once the chain is flushed
+			i.destroySets(nil)
+		}
 		return nil
 	}
 	return fmt.Errorf("unable to flush chain. %v", err)
 }
 
 func (i *iptables) Save() (map[string]*RuleSet, error) {
+	return i.save(i.iptables, "save")
+}
+
+// Save6 reads the ip6tables nat table.
+func (i *iptables) Save6() (map[string]*RuleSet, error) {
+	return i.save(i.iptables6, "save6")
+}
+
+func (i *iptables) save(ipt util.Interface, operation string) (map[string]*RuleSet, error) {
 	var err error
 	var b []byte
+	tries := 1
 	start := time.Now()
 	defer func() {
-		i.metrics.IPTables("save", 1, err, time.Now().Sub(start))
+		i.metrics.IPTables(operation, tries, err, time.Now().Sub(start))
 	}()
 
-	b, err = i.iptables.Save(i.table)
+	tries, err = i.retryLocked(operation, func() error {
+		var err error
+		b, err = ipt.Save(i.table)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -99,24 +229,281 @@ func (i *iptables) Save() (map[string]*RuleSet, error) {
 }
 
 func (i *iptables) Restore(rules map[string]*RuleSet) error {
+	if i.dryRun {
+		return i.logDiff(i.iptables, "save", rules)
+	}
+
 	var err error
 	start := time.Now()
 	defer func() {
 		i.metrics.IPTables("restore", 1, err, time.Now().Sub(start))
+		if err != nil {
+			i.metrics.RestoreFailure("restore")
+		}
 	}()
-	b := BytesFromRules(rules)
-	// must restore counters; must ? flush
-	err = i.iptables.Restore(i.table, b, !util.NoFlushTables, !util.NoRestoreCounters)
-	return err
+	if i.ipset {
+		// the sets must exist before the rules that match them
+		if err = i.createSets(); err != nil {
+			return err
+		}
+	}
+	err = i.restore(i.iptables, rules, i.stale, i.orphaned, i.unchanged)
+	if err != nil {
+		return err
+	}
+	if i.ipset {
+		i.destroySets(i.sets)
+	}
+	i.applied = i.snapshot(i.iptables, "save")
+	return nil
 }
 
+// Restore6 writes rules to the ip6tables nat table.
+func (i *iptables) Restore6(rules map[string]*RuleSet) error {
+	if i.dryRun {
+		return i.logDiff(i.iptables6, "save6", rules)
+	}
+
+	var err error
+	start := time.Now()
+	defer func() {
+		i.metrics.IPTables("restore6", 1, err, time.Now().Sub(start))
+		if err != nil {
+			i.metrics.RestoreFailure("restore6")
+		}
+	}()
+	err = i.restore(i.iptables6, rules, i.stale6, i.orphaned6, i.unchanged6)
+	if err != nil {
+		return err
+	}
+	i.applied6 = i.snapshot(i.iptables6, "save6")
+	return nil
+}
+
+// logDiff logs the diff from the live rules that restoring rules would
+// apply, for dry runs.
+func (i *iptables) logDiff(ipt util.Interface, operation string, rules map[string]*RuleSet) error {
+	live, err := i.save(ipt, operation)
+	if err != nil {
+		return err
+	}
+	diff := Diff(live, rules)
+	if diff == "" {
+		i.logger.Info("iptables dry run. no changes")
+		return nil
+	}
+	i.logger.Infof("iptables dry run. changes not applied\n%s", diff)
+	return nil
+}
+
+// restore writes the whole table, or in noflush mode only the owned chains of
+// rules that changed, deleting the stale chains and orphaned rules. --noflush
+// leaves other chains alone, so the jump to the base chain is ensured on its
+// own.
+func (i *iptables) restore(ipt util.Interface, rules map[string]*RuleSet, stale, orphaned []string, unchanged map[string]bool) error {
+	if !i.noflush {
+		// must restore counters; must ? flush
+		_, err := i.retryLocked("restore", func() error {
+			return ipt.Restore(i.table, BytesFromRules(i.Table(), rules), !util.NoFlushTables, !util.NoRestoreCounters)
+		})
+		return err
+	}
+	if _, err := i.retryLocked("restore", func() error {
+		return ipt.Restore(i.table, i.ownedBytes(rules, stale, orphaned, unchanged), util.NoFlushTables, !util.NoRestoreCounters)
+	}); err != nil {
+		return err
+	}
+	if _, err := ipt.EnsureRule(util.Append, i.table, i.jumpFrom, "-m", "comment", "--comment", i.owner, "-j", i.chain.String()); err != nil {
+		return fmt.Errorf("unable to jump from %s to %s. %v", i.jumpFrom, i.chain, err)
+	}
+	if _, ok := rules[i.snatChain.String()]; ok {
+		if _, err := ipt.EnsureRule(util.Append, i.table, util.ChainPostrouting, "-m", "comment", "--comment", i.owner, "-j", i.snatChain.String()); err != nil {
+			return fmt.Errorf("unable to jump from %s to %s. %v", util.ChainPostrouting, i.snatChain, err)
+		}
+	}
+	return nil
+}
+
+// retryLocked runs fn, an iptables operation, until it succeeds or fails for
+// a reason other than the xtables lock, which kube-proxy and CNI plugins hold
+// while they apply their rules, up to lockRetries times with a doubling
+// backoff. It returns the number of attempts made.
+func (i *iptables) retryLocked(operation string, fn func() error) (int, error) {
+	backoff := lockBackoff
+	for tries := 1; ; tries++ {
+		err := fn()
+		if err == nil || !util.IsLockError(err) {
+			return tries, err
+		}
+		i.metrics.LockContention(operation)
+		if tries == lockRetries {
+			return tries, fmt.Errorf("xtables lock still held after %d attempts. %v", tries, err)
+		}
+		i.logger.Warnf("iptables %s unable to take the xtables lock. retrying in %v. %v", operation, backoff, err)
+		select {
+		case <-i.ctx.Done():
+			return tries, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// ownedBytes returns the iptables-restore input of the owned chains of rules,
+// other than those unchanged. With --noflush, declaring a chain flushes it,
+// and chains that are not declared are left as they are. The stale chains
+// are declared, so that they are flushed, and then deleted. Orphaned rules
+// are deleted from the chains they are in.
+func (i *iptables) ownedBytes(rules map[string]*RuleSet, stale, orphaned []string, unchanged map[string]bool) []byte {
+	chains := []string{}
+	for chain := range rules {
+		if i.ownsChain(chain) && !unchanged[chain] {
+			chains = append(chains, chain)
+		}
+	}
+	sort.Strings(chains)
+
+	lines := []string{"*" + string(i.table)}
+	for _, chain := range chains {
+		lines = append(lines, rules[chain].ChainRule)
+	}
+	for _, chain := range stale {
+		lines = append(lines, fmt.Sprintf(":%s - [0:0]", chain))
+	}
+	for _, rule := range orphaned {
+		lines = append(lines, "-D"+strings.TrimPrefix(rule, "-A"))
+	}
+	for _, chain := range chains {
+		lines = append(lines, rules[chain].Rules...)
+	}
+	for _, chain := range stale {
+		lines = append(lines, "-X "+chain)
+	}
+	lines = append(lines, "COMMIT\n")
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// Merge combines the generated subset with the wholeset saved from the
+// kernel, garbage collecting the rules tagged with the owner that subset no
+// longer has. The number of chains and rules removed is returned as removals.
 func (i *iptables) Merge(subset, wholeset map[string]*RuleSet) (map[string]*RuleSet, int, error) {
+	kept, orphanChains, orphaned := i.collect(subset, wholeset)
+	out := merge(i.ownsChain, subset, kept)
+	i.stale = append(staleChains(i.ownsChain, subset, wholeset), orphanChains...)
+	i.orphaned = orphaned
+	i.unchanged = i.unchangedChains(subset, wholeset)
+	i.chainMetrics(out, "")
+	i.metrics.RulesRemoved(len(i.stale)+len(i.orphaned), "removed")
+	return out, len(i.stale) + len(i.orphaned), nil
+}
+
+// Merge6 is Merge for the ip6tables nat table. Its chain metrics are labeled
+// with an -ipv6 suffix.
+func (i *iptables) Merge6(subset, wholeset map[string]*RuleSet) (map[string]*RuleSet, int, error) {
+	kept, orphanChains, orphaned := i.collect(subset, wholeset)
+	out := merge(i.ownsChain, subset, kept)
+	i.stale6 = append(staleChains(i.ownsChain, subset, wholeset), orphanChains...)
+	i.orphaned6 = orphaned
+	i.unchanged6 = i.unchangedChains(subset, wholeset)
+	i.chainMetrics(out, "-ipv6")
+	i.metrics.RulesRemoved(len(i.stale6)+len(i.orphaned6), "removed-ipv6")
+	return out, len(i.stale6) + len(i.orphaned6), nil
+}
+
+// collect garbage collects the owner's rules in the chains of wholeset that
+// are not owned chains, those that subset does not
+// have. It returns wholeset without them, the chains that held nothing but
+// such rules, e.g. the chains of a renamed base chain, and the rules removed
+// from the chains that are kept.
+func (i *iptables) collect(subset, wholeset map[string]*RuleSet) (map[string]*RuleSet, []string, []string) {
+	kept := map[string]*RuleSet{}
+	chains := []string{}
+	orphaned := []string{}
+	for chain, set := range wholeset {
+		if i.ownsChain(chain) {
+			kept[chain] = set
+			continue
+		}
+		want := map[string]bool{}
+		if generated, ok := subset[chain]; ok {
+			for _, rule := range generated.Rules {
+				want[rule] = true
+			}
+		}
+
+		rules := []string{}
+		removed := []string{}
+		for _, rule := range set.Rules {
+			if i.owned(rule) && !want[rule] {
+				removed = append(removed, rule)
+				continue
+			}
+			rules = append(rules, rule)
+		}
+		if len(removed) > 0 && len(rules) == 0 && !builtinChain(chain) && subset[chain] == nil {
+			chains = append(chains, chain)
+			continue
+		}
+		orphaned = append(orphaned, removed...)
+		kept[chain] = &RuleSet{ChainRule: set.ChainRule, Rules: rules}
+	}
+	sort.Strings(chains)
+	return kept, chains, orphaned
+}
+
+// owned reports whether rule carries the owner's tag. iptables-save quotes
+// comments of older versions only. The untagged jump to the base chain of
+// earlier releases is owned too.
+func (i *iptables) owned(rule string) bool {
+	if rule == "-A "+i.jumpFrom.String()+" -j "+i.chain.String() {
+		return true
+	}
+	return strings.Contains(rule, `--comment "`+i.owner+`"`) || strings.Contains(rule+" ", "--comment "+i.owner+" ")
+}
+
+// tag adds the owner's comment to every rule of rules, ahead of its target.
+func (i *iptables) tag(rules map[string]*RuleSet) {
+	comment := fmt.Sprintf(` -m comment --comment "%s"`, i.owner)
+	for _, set := range rules {
+		for n, rule := range set.Rules {
+			if target := strings.LastIndex(rule, " -j "); target >= 0 {
+				set.Rules[n] = rule[:target] + comment + rule[target:]
+			}
+		}
+	}
+}
+
+func builtinChain(chain string) bool {
+	switch util.Chain(chain) {
+	case util.ChainPrerouting, util.ChainInput, util.ChainOutput, util.ChainPostrouting, "FORWARD":
+		return true
+	}
+	return false
+}
+
+// staleChains returns the chains of wholeset that owns reports that subset
+// does not have, sorted.
+func staleChains(owns func(string) bool, subset, wholeset map[string]*RuleSet) []string {
+	stale := []string{}
+	for chain := range wholeset {
+		if _, ok := subset[chain]; !ok && owns(chain) {
+			stale = append(stale, chain)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// merge replaces the chains that owns reports in wholeset by those of subset,
+// and adds the rules of subset's other chains, e.g. the jumpFrom chain, that
+// wholeset lacks.
+func merge(owns func(string) bool, subset, wholeset map[string]*RuleSet) map[string]*RuleSet {
 	out := map[string]*RuleSet{}
 
 	// create a copy of the whole set, excluding the kube-ipvs chain
 	for chain, set := range wholeset {
-		// Remove any prefixed chains. We want to deal with them separately
-		if strings.HasPrefix(chain, i.chain.String()) {
+		// Remove any owned chains. We want to deal with them separately
+		if owns(chain) {
 			continue
 		}
 		out[chain] = &RuleSet{
@@ -145,42 +532,50 @@ func (i *iptables) Merge(subset, wholeset map[string]*RuleSet) (map[string]*Rule
 		}
 	}
 
-	// update prerouting if necessary
-	for _, subsetRule := range subset["PREROUTING"].Rules {
-		found := false
-		for _, rule := range wholeset["PREROUTING"].Rules {
-			if subsetRule == rule {
-				found = true
-			}
-		}
-		if !found {
-			out["PREROUTING"].Rules = append(out["PREROUTING"].Rules, subsetRule)
-		}
-	}
-
 	for chainName, ruleSet := range subset {
-		if chainName == "PREROUTING" {
+		if owns(chainName) {
+			out[chainName] = ruleSet
 			continue
 		}
-		out[chainName] = ruleSet
+
+		// update the jump chains if necessary. a custom chain that does
+		// not exist yet is created.
+		if _, ok := out[chainName]; !ok {
+			out[chainName] = &RuleSet{ChainRule: ruleSet.ChainRule}
+		}
+		for _, subsetRule := range ruleSet.Rules {
+			found := false
+			for _, rule := range out[chainName].Rules {
+				if subsetRule == rule {
+					found = true
+				}
+			}
+			if !found {
+				out[chainName].Rules = append(out[chainName].Rules, subsetRule)
+			}
+		}
 	}
+	return out
+}
 
+// chainMetrics records the number of rules in the kube and ravel chains of
+// out, with suffix appended to each kind.
+func (i *iptables) chainMetrics(out map[string]*RuleSet, suffix string) {
 	// metrics about the total # of rules
 	all := 0
 	total, match, svc, sep := chainStats("KUBE", out)
 	all += total
-	i.metrics.ChainGauge(match, "kube")
-	i.metrics.ChainGauge(svc, "kube-services")
-	i.metrics.ChainGauge(sep, "kube-endpoints")
+	i.metrics.ChainGauge(match, "kube"+suffix)
+	i.metrics.ChainGauge(svc, "kube-services"+suffix)
+	i.metrics.ChainGauge(sep, "kube-endpoints"+suffix)
 
 	total, match, svc, sep = chainStats(i.chain.String(), out)
 	all += total
-	i.metrics.ChainGauge(match, "ravel")
-	i.metrics.ChainGauge(svc, "ravel-services")
-	i.metrics.ChainGauge(sep, "ravel-endpoints")
-	i.metrics.ChainGauge(all, "total")
-
-	return out, 0, nil
+	i.metrics.ChainGauge(match, "ravel"+suffix)
+	i.metrics.ChainGauge(svc, "ravel-services"+suffix)
+	i.metrics.ChainGauge(sep, "ravel-endpoints"+suffix)
+	i.metrics.ChainGauge(all, "total"+suffix)
+	i.metrics.RuleGauge(ruleCount(out), "merged"+suffix)
 }
 
 func chainStats(prefix string, subset map[string]*RuleSet) (total, match, svc, sep int) {
@@ -199,16 +594,20 @@ func chainStats(prefix string, subset map[string]*RuleSet) (total, match, svc, s
 	return total, match, svc, sep
 }
 
+// ruleCount returns the number of rules in the chains of rules.
+func ruleCount(rules map[string]*RuleSet) int {
+	count := 0
+	for _, set := range rules {
+		count += len(set.Rules)
+	}
+	return count
+}
+
 // generates a ruleset for only kube-ipvs.  a different function ought to merge these
 // XXX chain rule
 func (i *iptables) GenerateRules(config *types.ClusterConfig) (map[string]*RuleSet, error) {
 	out := map[string]*RuleSet{
-		"PREROUTING": &RuleSet{
-			ChainRule: ":PREROUTING ACCEPT",
-			Rules: []string{
-				"-A PREROUTING -j " + i.chain.String(),
-			},
-		},
+		i.jumpFrom.String(): i.jumpRuleSet(),
 		i.masqChain.String(): &RuleSet{
 			ChainRule: fmt.Sprintf(":%s - [0:0]", i.masqChain.String()),
 			Rules: []string{
@@ -220,42 +619,63 @@ func (i *iptables) GenerateRules(config *types.ClusterConfig) (map[string]*RuleS
 		},
 	}
 
-	// format strings for masq and jump rules
-	masqFmt := fmt.Sprintf(`-A %s -d %%s/32 -p tcp -m tcp --dport %%s -m comment --comment "%%s" -j %s`, i.chain, i.masqChain)
-	jumpFmt := fmt.Sprintf(`-A %s -d %%s/32 -p tcp -m tcp --dport %%s -m comment --comment "%%s" -j %%s`, i.chain)
+	// format strings for masq and jump rules, in the chain of each VIP
+	masqFmt := fmt.Sprintf(`-A %%s%%s -p tcp -m tcp --dport %%s -m comment --comment "%%s" -j %s`, i.masqChain)
+	jumpFmt := `-A %s%s -p tcp -m tcp --dport %s -m comment --comment "%s" -j %s`
 
 	// walk the service configuration and apply all rules
-	rules := []string{}
+	vips := map[string][]string{}
+	sets := newVIPSets()
 	for serviceIP, services := range config.Config {
 		dest := string(serviceIP)
-		for dport, service := range services {
+		vipChain := vipChainName(dest, i.chain.String())
+		for _, dport := range sortedPorts(services) {
+			service := services[dport]
 			ident := types.MakeIdent(service.Namespace, service.Service, service.PortName)
 			chain := servicePortChainName(ident, "tcp") // TODO: dynamic protocol
+			if i.ipset && service.Sources(false) == nil {
+				sets.add(chain, ident, dest, dport)
+				continue
+			}
 
-			rules = append(rules, fmt.Sprintf(masqFmt, dest, dport, ident))
-			rules = append(rules, fmt.Sprintf(jumpFmt, dest, dport, ident, chain))
+			for _, source := range sourceMatches(service, false) {
+				vips[dest] = append(vips[dest], fmt.Sprintf(masqFmt, vipChain, source, dport, ident))
+				vips[dest] = append(vips[dest], fmt.Sprintf(jumpFmt, vipChain, source, dport, ident, chain))
+			}
 		}
 	}
+	out[i.chain.String()].Rules = i.vipChains(out, vips, "/32")
+	if i.ipset {
+		out[i.chain.String()].Rules = append(i.setRules(sets, true, false), out[i.chain.String()].Rules...)
+	}
 
-	// sort and add to output
-	// sort.Sort(sort.StringSlice(rules))
-	out[i.chain.String()].Rules = rules
-
+	i.tag(out)
+	i.metrics.RuleGauge(ruleCount(out), "generated")
 	return out, nil
 }
 
 func (i *iptables) GenerateRulesForNodes(node types.Node, config *types.ClusterConfig, useWeightedService bool) (map[string]*RuleSet, error) {
+	return i.generateRulesForNodes(node, config, config.Config, useWeightedService, false)
+}
+
+// GenerateRulesForNodes6 generates the ip6tables rules for the ipv6 VIPs in
+// config.Config6, DNATing to the ipv6 addresses of the node's pods. Services
+// whose pods have no ipv6 address are left out, as ip6tables cannot DNAT to
+// ipv4. ipv6 VIPs are matched with a rule per VIP:port, in ipset mode too.
+func (i *iptables) GenerateRulesForNodes6(node types.Node, config *types.ClusterConfig, useWeightedService bool) (map[string]*RuleSet, error) {
+	return i.generateRulesForNodes(node, config, config.Config6, useWeightedService, true)
+}
+
+func (i *iptables) generateRulesForNodes(node types.Node, config *types.ClusterConfig, vips map[types.ServiceIP]types.PortMap, useWeightedService, ipv6 bool) (map[string]*RuleSet, error) {
+	// the services the node excludes are not DNATed
+	vips = node.Served(vips)
+
 	out := map[string]*RuleSet{
-		"PREROUTING": &RuleSet{
-			ChainRule: ":PREROUTING ACCEPT",
-			Rules: []string{
-				"-A PREROUTING -j " + i.chain.String(),
-			},
-		},
+		i.jumpFrom.String(): i.jumpRuleSet(),
 		i.masqChain.String(): &RuleSet{
 			ChainRule: fmt.Sprintf(":%s - [0:0]", i.masqChain.String()),
 			Rules: []string{
-				i.generateMasqRule(),
+				i.masqRule(ipv6),
 			},
 		},
 		i.chain.String(): &RuleSet{
@@ -263,47 +683,82 @@ func (i *iptables) GenerateRulesForNodes(node types.Node, config *types.ClusterC
 		},
 	}
 
-	// format strings for masq and jump rules
-	masqFmt := fmt.Sprintf(`-A %s -d %%s/32 -p tcp -m tcp --dport %%s -m comment --comment "%%s" -j %s`, i.chain, i.masqChain)
-	jumpFmt := fmt.Sprintf(`-A %s -d %%s/32 -p tcp -m tcp --dport %%s -m comment --comment "%%s" -j %%s`, i.chain)
-	weightedJumpFmt := fmt.Sprintf(`-A %s -d %%s/32 -p tcp -m tcp --dport %%s -m comment --comment "%%s"  -m statistic --mode random --probability %%0.11f -j %%s`, i.chain)
+	hostMask, nodeIP, ipset := "/32", node.IPV4(), i.ipset
+	if ipv6 {
+		hostMask, nodeIP, ipset = "/128", node.IPV6(), false
+	}
+
+	// format strings for masq and jump rules, in the chain of each VIP
+	masqFmt := fmt.Sprintf(`-A %%s%%s -p tcp -m tcp --dport %%s -m comment --comment "%%s" -j %s`, i.masqChain)
+	jumpFmt := `-A %s%s -p tcp -m tcp --dport %s -m comment --comment "%s" -j %s`
+	weightedJumpFmt := `-A %s%s -p tcp -m tcp --dport %s -m comment --comment "%s" -m statistic --mode random --probability %0.11f -j %s`
 
 	// walk the service configuration and apply all rules
-	rules := []string{}
-	for serviceIP, services := range config.Config {
+	vipRules := map[string][]string{}
+	sets := newVIPSets()
+	for serviceIP, services := range vips {
 		dest := string(serviceIP)
-		for dport, service := range services {
+		if config.Masqueraded(serviceIP) {
+			// directors forward traffic to nat VIPs addressed to the node
+			dest = nodeIP
+		}
+		vipChain := vipChainName(dest, i.chain.String())
+		for _, dport := range sortedPorts(services) {
+			service := services[dport]
 			// iterate over node endpoints to see if this service is running on the node
-			if !node.HasServiceRunning(service.Namespace, service.Service, service.PortName) {
+			if len(podIPs(node, service, ipv6)) == 0 {
 				continue
 			}
+			if config.Masqueraded(serviceIP) && service.TargetPort != "" {
+				// directors translate the port of nat VIPs too
+				dport = service.TargetPort
+			}
 
 			ident := types.MakeIdent(service.Namespace, service.Service, service.PortName)
 			chain := ravelServicePortChainName(ident, "tcp", i.chain.String()) // TODO: dynamic protocol
-			if i.masq {
-				rules = append(rules, fmt.Sprintf(masqFmt, dest, dport, ident))
-			}
 			nodeProbability := node.GetLocalServicePropability(service.Namespace, service.Service, service.PortName, i.logger)
-			if useWeightedService {
-				i.logger.Debugf("probability=%v ident=%v", nodeProbability, ident)
-				rules = append(rules, fmt.Sprintf(weightedJumpFmt, dest, dport, ident, nodeProbability, chain))
-			} else {
-				rules = append(rules, fmt.Sprintf(jumpFmt, dest, dport, ident, chain))
+			if ipset && service.Sources(ipv6) == nil {
+				sets.add(chain, ident, dest, dport)
+				sets.probability[chain] = nodeProbability
+				continue
+			}
+			for _, source := range sourceMatches(service, ipv6) {
+				if i.masq {
+					vipRules[dest] = append(vipRules[dest], fmt.Sprintf(masqFmt, vipChain, source, dport, ident))
+				}
+				if useWeightedService {
+					i.logger.Debugf("probability=%v ident=%v", nodeProbability, ident)
+					vipRules[dest] = append(vipRules[dest], fmt.Sprintf(weightedJumpFmt, vipChain, source, dport, ident, nodeProbability, chain))
+				} else {
+					vipRules[dest] = append(vipRules[dest], fmt.Sprintf(jumpFmt, vipChain, source, dport, ident, chain))
+				}
 			}
 
 		}
 	}
+	out[i.chain.String()].Rules = i.vipChains(out, vipRules, hostMask)
+	if ipset {
+		out[i.chain.String()].Rules = append(i.setRules(sets, i.masq, useWeightedService), out[i.chain.String()].Rules...)
+	}
 
-	// sort and add to output
-	// sort.Sort(sort.StringSlice(rules))
-	out[i.chain.String()].Rules = rules
+	if snat := i.snatRules(node, config, vips, ipv6); len(snat) > 0 {
+		out[util.ChainPostrouting.String()] = &RuleSet{
+			ChainRule: ":" + util.ChainPostrouting.String() + " ACCEPT",
+			Rules:     []string{fmt.Sprintf("-A %s -j %s", util.ChainPostrouting, i.snatChain)},
+		}
+		out[i.snatChain.String()] = &RuleSet{
+			ChainRule: ":" + i.snatChain.String() + " - [0:0]",
+			Rules:     snat,
+		}
+	}
 
 	// create the service chains for each endpoint with probability of calling endpoint emulating WRR
 	// walk the service configuration and apply all rules
-	for _, services := range config.Config {
+	for _, services := range vips {
 		for _, service := range services {
 			// iterate over node endpoints to see if this service is running on the node
-			if !node.HasServiceRunning(service.Namespace, service.Service, service.PortName) {
+			podIPs := podIPs(node, service, ipv6)
+			if len(podIPs) == 0 {
 				continue
 			}
 
@@ -316,21 +771,29 @@ func (i *iptables) GenerateRulesForNodes(node types.Node, config *types.ClusterC
 			}
 
 			portNumber := node.GetPortNumber(service.Namespace, service.Service, service.PortName)
+			if service.TargetPort != "" {
+				portNumber, _ = strconv.Atoi(service.TargetPort)
+			}
 			serviceRules := []string{}
 
-			podIPs := node.GetPodIPs(service.Namespace, service.Service, service.PortName)
-			l := len(podIPs)
+			// each pod is weighted by the weight of its node, and those
+			// without weight are left out of the cascade
+			weights := make([]int, len(podIPs))
+			for n := range podIPs {
+				weights[n] = node.Weight()
+			}
+			probabilities := cascadeProbabilities(weights)
 			for n, ip := range podIPs {
 				sepChain := ravelServiceEndpointChainName(ident, ip, "tcp", i.chain.String())
-				probFmt := computeServiceEndpointString(chain, ident, sepChain, l, n)
-
-				serviceRules = append(serviceRules, probFmt)
+				if probabilities[n] > 0 {
+					serviceRules = append(serviceRules, computeServiceEndpointString(chain, ident, sepChain, probabilities[n]))
+				}
 
 				out[sepChain] = &RuleSet{
 					ChainRule: ":" + sepChain + " - [0:0]",
 					Rules: []string{
-						fmt.Sprintf(`-A %s -d %s/32 -m comment --comment "%s" -j %s`, sepChain, ip, ident, i.masqChain),
-						fmt.Sprintf(`-A %s -p tcp -m comment --comment "%s" -m tcp -j DNAT --to-destination %s:%d`, sepChain, ident, ip, portNumber),
+						fmt.Sprintf(`-A %s -d %s%s -m comment --comment "%s" -j %s`, sepChain, ip, hostMask, ident, i.masqChain),
+						fmt.Sprintf(`-A %s -p tcp -m comment --comment "%s" -m tcp -j DNAT --to-destination %s`, sepChain, ident, net.JoinHostPort(ip, strconv.Itoa(portNumber))),
 					},
 				}
 			}
@@ -342,24 +805,130 @@ func (i *iptables) GenerateRulesForNodes(node types.Node, config *types.ClusterC
 		}
 	}
 
+	i.tag(out)
+	if ipv6 {
+		i.metrics.RuleGauge(ruleCount(out), "generated-ipv6")
+	} else {
+		i.metrics.RuleGauge(ruleCount(out), "generated")
+	}
 	return out, nil
 }
 
+// podIPs returns the addresses of the node's pods of service, of those that
+// are ipv6 when ipv6 is set and ipv4 otherwise. A node without the service
+// running has none.
+func podIPs(node types.Node, service *types.ServiceDef, ipv6 bool) []string {
+	if !node.HasServiceRunning(service.Namespace, service.Service, service.PortName) {
+		return nil
+	}
+	out := []string{}
+	for _, ip := range node.GetPodIPs(service.Namespace, service.Service, service.PortName) {
+		if parsed := net.ParseIP(ip); parsed != nil && (parsed.To4() == nil) == ipv6 {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
 func (i *iptables) BaseChain() string {
 	return i.chain.String()
 }
 
+func (i *iptables) Table() string {
+	return string(i.table)
+}
+
+// jumpRuleSet returns the chain that jumps to the base chain. Built in chains
+// are declared with their ACCEPT policy, and custom chains without one.
+func (i *iptables) jumpRuleSet() *RuleSet {
+	chainRule := ":" + i.jumpFrom.String() + " - [0:0]"
+	if builtinChain(i.jumpFrom.String()) {
+		chainRule = ":" + i.jumpFrom.String() + " ACCEPT"
+	}
+	return &RuleSet{
+		ChainRule: chainRule,
+		Rules: []string{
+			"-A " + i.jumpFrom.String() + " -j " + i.chain.String(),
+		},
+	}
+}
+
 func (i *iptables) rulesFromBytes(b []byte) (map[string]*RuleSet, error) {
 	return GetSaveLines(i.table, b)
 }
 
 func (i *iptables) generateMasqRule() string {
-	if i.podCidrMasq != "" {
+	return i.masqRule(false)
+}
+
+// masqRule returns the rule of the masquerade chain. The pod cidr is only
+// excluded from the chain of its own address family.
+func (i *iptables) masqRule(ipv6 bool) string {
+	ip := net.ParseIP(i.podCidrMasq)
+	if _, cidr, err := net.ParseCIDR(i.podCidrMasq); err == nil {
+		ip = cidr.IP
+	}
+	if ip != nil && (ip.To4() == nil) == ipv6 {
 		return fmt.Sprintf("-A %s -j MARK ! -s %s --set-xmark 0x4000/0x4000", i.masqChain.String(), i.podCidrMasq)
 	}
 	return fmt.Sprintf("-A %s -j MARK --set-xmark 0x4000/0x4000", i.masqChain.String())
 }
 
+// snatRules returns the rules that masquerade the traffic that the node DNATs
+// to its pods for the nat VIPs among vips, sorted, so that the pods reply
+// through the node. Directors forward nat VIPs' traffic to the node's address
+// and the target port. The traffic of a pod to a VIP that the node DNATs back
+// to the same pod, hairpin traffic, is masqueraded too, so that the pod's
+// reply to itself is translated back from the VIP rather than answered
+// locally. MASQUERADE is only valid in the nat table, so there are none in
+// other tables. Ports are chosen with --random-fully where it is supported.
+func (i *iptables) snatRules(node types.Node, config *types.ClusterConfig, vips map[types.ServiceIP]types.PortMap, ipv6 bool) []string {
+	if i.table != util.TableNAT {
+		return nil
+	}
+	hostMask, nodeIP, target := "/32", node.IPV4(), "MASQUERADE"
+	if ipv6 {
+		hostMask, nodeIP = "/128", node.IPV6()
+	}
+	if ipv6 && i.randomFully6 || !ipv6 && i.randomFully {
+		target = "MASQUERADE --random-fully"
+	}
+
+	seen := map[string]bool{}
+	rules := []string{}
+	for serviceIP, services := range vips {
+		for dport, service := range services {
+			pods := podIPs(node, service, ipv6)
+			if len(pods) == 0 {
+				continue
+			}
+			ident := types.MakeIdent(service.Namespace, service.Service, service.PortName)
+			for _, ip := range pods {
+				// -A RAVEL-SNAT -s 100.64.0.5/32 -d 100.64.0.5/32 -m comment --comment "default/nginx:http" -j MASQUERADE
+				rule := fmt.Sprintf(`-A %s -s %s%s -d %s%s -m comment --comment "%s" -j %s`, i.snatChain, ip, hostMask, ip, hostMask, ident, target)
+				if !seen[rule] {
+					seen[rule] = true
+					rules = append(rules, rule)
+				}
+			}
+			if !config.Masqueraded(serviceIP) || nodeIP == "" {
+				continue
+			}
+			if service.TargetPort != "" {
+				dport = service.TargetPort
+			}
+			// -A RAVEL-SNAT -p tcp -m conntrack --ctstate DNAT --ctorigdst 10.131.153.76/32 --ctorigdstport 8080 -m comment --comment "default/nginx:http" -j MASQUERADE
+			rule := fmt.Sprintf(`-A %s -p tcp -m conntrack --ctstate DNAT --ctorigdst %s%s --ctorigdstport %s -m comment --comment "%s" -j %s`, i.snatChain, nodeIP, hostMask, dport, ident, target)
+			if !seen[rule] {
+				seen[rule] = true
+				rules = append(rules, rule)
+			}
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
+
 // servicePortChainName takes the ServicePortName for a service and
 // returns the associated iptables chain.  This is computed by hashing (sha256)
 // then encoding to base32 and truncating with the prefix "KUBE-SVC-".  We do
@@ -385,13 +954,35 @@ func ravelServiceEndpointChainName(ident string, ip string, protocol string, pre
 	return prefix + "-SEP-" + encoded[:16]
 }
 
-func computeEndpointProbability(i int) string {
-	return fmt.Sprintf("%0.11f", 1.0/float64(i))
+// cascadeProbabilities returns the probability of each rule of a cascade that
+// tries weights in turn, so that each is picked in proportion to its weight.
+// A rule only sees the traffic the rules before it passed on, so its
+// probability is its weight over the weights of it and the rules after it,
+// e.g. 1/8, 2/7 and 5/5 for weights of 1, 2 and 5. Rules without weight are
+// never picked, and the last with weight always is.
+func cascadeProbabilities(weights []int) []float64 {
+	remaining := 0
+	for _, weight := range weights {
+		if weight > 0 {
+			remaining += weight
+		}
+	}
+	out := make([]float64, len(weights))
+	for n, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		out[n] = float64(weight) / float64(remaining)
+		remaining -= weight
+	}
+	return out
 }
 
-func computeServiceEndpointString(chain, ident, sepChain string, length, i int) string {
-	// if last RR endpoint, return without probability as it will be 100%
-	if i == length-1 {
+// computeServiceEndpointString returns the rule of a service chain that jumps
+// to the chain of an endpoint with probability, of the traffic that reaches it.
+func computeServiceEndpointString(chain, ident, sepChain string, probability float64) string {
+	// the last endpoint of the cascade takes the rest of the traffic
+	if probability >= 1 {
 		return fmt.Sprintf(`-A %s -m comment --comment "%s" -j %s`,
 			chain,
 			ident,
@@ -401,12 +992,12 @@ func computeServiceEndpointString(chain, ident, sepChain string, length, i int)
 	return fmt.Sprintf(`-A %s -m comment --comment "%s" -m statistic --mode random --probability %s -j %s`,
 		chain,
 		ident,
-		computeEndpointProbability(length-i),
+		fmt.Sprintf("%0.11f", probability),
 		sepChain)
 }
 
-func BytesFromRules(rules map[string]*RuleSet) []byte {
-	iptablesLines := []string{"*nat"}
+func BytesFromRules(table string, rules map[string]*RuleSet) []byte {
+	iptablesLines := []string{"*" + table}
 
 	// Add the chain rule to the iptables rules string
 	// Chain rules must be added before jumps/masqs
@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"strings"
 	"testing"
 
 	"github.com/Sirupsen/logrus"
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
 )
 
 func getTestJSON(fileDesc string) ([]byte, error) {
@@ -24,7 +27,7 @@ func TestCIDRMasq(t *testing.T) {
 
 	l := &logrus.Logger{}
 	// emulate defaults; bgp kind, empty config-key, ravel chain
-	ipTables, err := NewIPTables(context.Background(), stats.KindBGP, "", "1.2.3.4", "RAVEL", l)
+	ipTables, err := NewIPTables(context.Background(), stats.KindBGP, "", "1.2.3.4", "nat", "RAVEL", "PREROUTING", true, false, false, false, 0, l)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -46,7 +49,7 @@ func TestCIDRMasq(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	rules, err := ipTables.GenerateRulesForNodes(n, c)
+	rules, err := ipTables.GenerateRulesForNodes(n, c, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,7 +70,7 @@ func TestWeightEndpoints(t *testing.T) {
 
 	l := &logrus.Logger{}
 	// emulate defaults; bgp kind, empty config-key, ravel chain
-	ipTables, err := NewIPTables(context.Background(), stats.KindBGP, "", "", "RAVEL", l)
+	ipTables, err := NewIPTables(context.Background(), stats.KindBGP, "", "", "nat", "RAVEL", "PREROUTING", true, false, false, false, 0, l)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -89,7 +92,7 @@ func TestWeightEndpoints(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	rules, err := ipTables.GenerateRulesForNodes(n, c)
+	rules, err := ipTables.GenerateRulesForNodes(n, c, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -102,6 +105,42 @@ func TestWeightEndpoints(t *testing.T) {
 	}
 }
 
+func TestWeightedRules(t *testing.T) {
+	i := &iptables{chain: "RAVEL", masqChain: "RAVEL-MASQ", snatChain: "RAVEL-SNAT", table: util.TableNAT, jumpFrom: util.ChainPrerouting, logger: logrus.New(), metrics: NewMetrics(stats.KindRealServer, "")}
+
+	// one of the service's four pods runs on the node
+	node := types.Node{
+		Name:      "node-1",
+		Endpoints: []types.Endpoints{{EndpointMeta: types.EndpointMeta{Namespace: "default", Service: "nginx"}, Subsets: []types.Subset{{Addresses: []types.Address{{PodIP: "100.64.0.5"}}, Ports: []types.Port{{Name: "http", Port: 8080}}}}}},
+	}
+	node.SetTotals(map[string]int{types.MakeIdent("default", "nginx", "http"): 4})
+	config := &types.ClusterConfig{Config: map[types.ServiceIP]types.PortMap{
+		"10.54.213.253": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+	}}
+
+	for _, weighted := range []bool{true, false} {
+		rules, err := i.GenerateRulesForNodes(node, config, weighted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jumps := []string{}
+		for _, chain := range VIPChainRules("RAVEL", rules) {
+			for _, rule := range chain {
+				if strings.Contains(rule, "--dport 80 ") {
+					jumps = append(jumps, rule)
+				}
+			}
+		}
+		if len(jumps) != 1 {
+			t.Fatalf("expected a jump for the service. saw %v", rules)
+		}
+		// a node beside a director only captures its share of the traffic
+		if probability := strings.Contains(jumps[0], "-m statistic --mode random --probability 0.25000000000 "); probability != weighted {
+			t.Fatalf("expected the jump to carry the node's probability only when weighted=%v. saw %s", weighted, jumps[0])
+		}
+	}
+}
+
 func TestComputeProbability(t *testing.T) {
 	probabilities := []string{
 		"0.20000000000",
@@ -111,17 +150,56 @@ func TestComputeProbability(t *testing.T) {
 		"1.00000000000",
 	}
 
-	numEndpoints := len(probabilities)
-	// 5 backends
-	for i := 0; i < 4; i++ {
-		p := computeEndpointProbability(numEndpoints - i)
-		fmt.Println("P:", p)
+	// 5 backends of equal weight
+	cascade := cascadeProbabilities([]int{1, 1, 1, 1, 1})
+	for i := 0; i < 5; i++ {
+		p := fmt.Sprintf("%0.11f", cascade[i])
 		if p != probabilities[i] {
 			t.Fatal(fmt.Sprintf("probabilities did not match for backend. expected: %s got: %s", probabilities[i], p))
 		}
 	}
 }
 
+func TestCascadeProbabilities(t *testing.T) {
+	for _, weights := range [][]int{{1, 2, 5}, {5, 2, 1}, {1, 0, 2, 5}, {3}} {
+		total := 0
+		for _, weight := range weights {
+			total += weight
+		}
+
+		// the share of each rule is its probability of the traffic the
+		// rules before it passed on
+		cascade := cascadeProbabilities(weights)
+		remaining := 1.0
+		for n, p := range cascade {
+			share := remaining * p
+			remaining -= share
+			if expected := float64(weights[n]) / float64(total); math.Abs(share-expected) > 1e-9 {
+				t.Fatalf("expected weight %d of %v to take %v. saw %v with %v", weights[n], weights, expected, share, cascade)
+			}
+		}
+		if remaining > 1e-9 {
+			t.Fatalf("expected the cascade of %v to take all traffic. saw %v passed on", weights, remaining)
+		}
+	}
+
+	// the last rule with weight is certain, and is rendered without a statistic match
+	cascade := cascadeProbabilities([]int{1, 2, 5, 0})
+	if cascade[0] != 0.125 || cascade[2] != 1 || cascade[3] != 0 {
+		t.Fatalf("expected 1/8, 2/7, 1 and 0. saw %v", cascade)
+	}
+	expects := []string{
+		`-A RAVEL-SVC -m comment --comment "default/nginx:http" -m statistic --mode random --probability 0.12500000000 -j RAVEL-SEP-A`,
+		`-A RAVEL-SVC -m comment --comment "default/nginx:http" -m statistic --mode random --probability 0.28571428571 -j RAVEL-SEP-B`,
+		`-A RAVEL-SVC -m comment --comment "default/nginx:http" -j RAVEL-SEP-C`,
+	}
+	for n, sepChain := range []string{"RAVEL-SEP-A", "RAVEL-SEP-B", "RAVEL-SEP-C"} {
+		if rule := computeServiceEndpointString("RAVEL-SVC", "default/nginx:http", sepChain, cascade[n]); rule != expects[n] {
+			t.Fatalf("expected %s. saw %s", expects[n], rule)
+		}
+	}
+}
+
 // func TestGenerateRules(t *testing.T) {
 // 	cc := _getCCForTest()
 // 	i := &iptables{}
@@ -0,0 +1,120 @@
+package iptables
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+)
+
+// vipChainName names the chain that holds the rules of a VIP, or of the node
+// address that directors forward nat VIPs to, after a hash of the address.
+func vipChainName(dest string, prefix string) string {
+	hash := sha256.Sum256([]byte(dest))
+	encoded := base32.StdEncoding.EncodeToString(hash[:])
+	return prefix + "-VIP-" + encoded[:16]
+}
+
+// vipChains adds a chain per address of vips to out, holding that address's
+// rules, and returns the rules of the base chain that jump to them, in order
+// of address. A change to the services of one VIP then rewrites its own small
+// chain, rather than the one chain that every VIP passes through.
+func (i *iptables) vipChains(out map[string]*RuleSet, vips map[string][]string, hostMask string) []string {
+	dests := []string{}
+	for dest := range vips {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+
+	jumps := []string{}
+	for _, dest := range dests {
+		chain := vipChainName(dest, i.chain.String())
+		jumps = append(jumps, fmt.Sprintf(`-A %s -d %s%s -m comment --comment "%s" -j %s`, i.chain, dest, hostMask, dest, chain))
+		out[chain] = &RuleSet{
+			ChainRule: ":" + chain + " - [0:0]",
+			Rules:     vips[dest],
+		}
+	}
+	return jumps
+}
+
+// sortedPorts returns the ports of services in order, so that the rules of a
+// VIP chain are generated the same way each time.
+func sortedPorts(services types.PortMap) []string {
+	ports := []string{}
+	for port := range services {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// sourceMatches returns the source matches of the rules of a VIP's port, one
+// per network of its source ranges, or a single empty match when every client
+// may connect. Traffic from other clients is then left to the node rather than
+// forwarded to pods. A port whose ranges are all of the other address family
+// gets no rules. Ports with source ranges are matched in the VIP chains in
+// ipset mode too, as a set does not match the source.
+func sourceMatches(service *types.ServiceDef, ipv6 bool) []string {
+	sources := service.Sources(ipv6)
+	if sources == nil {
+		return []string{""}
+	}
+	out := []string{}
+	for _, source := range sources {
+		out = append(out, " -s "+source)
+	}
+	return out
+}
+
+// ownsChain reports whether chain is one that the generators create: the base
+// chain, its masquerade and snat chains, or a VIP, service or endpoint chain
+// named after it. Other chains that merely share the prefix, e.g. the
+// RAVEL-NAT chain of the IPVS masquerade, are left alone.
+func (i *iptables) ownsChain(chain string) bool {
+	switch chain {
+	case i.chain.String(), i.masqChain.String(), i.snatChain.String():
+		return true
+	}
+	for _, kind := range []string{"-VIP-", "-SVC-", "-SEP-"} {
+		if strings.HasPrefix(chain, i.chain.String()+kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// unchangedChains returns the owned chains of subset whose rules wholeset
+// already has, which noflush mode need not rewrite.
+func (i *iptables) unchangedChains(subset, wholeset map[string]*RuleSet) map[string]bool {
+	unchanged := map[string]bool{}
+	for chain, set := range subset {
+		if !i.ownsChain(chain) {
+			continue
+		}
+		if live, ok := wholeset[chain]; ok && len(live.Rules) == len(set.Rules) && (len(set.Rules) == 0 || reflect.DeepEqual(live.Rules, set.Rules)) {
+			unchanged[chain] = true
+		}
+	}
+	return unchanged
+}
+
+// VIPChainRules returns the sorted rules of the base chain named prefix and of
+// its VIP chains, by chain, leaving out empty chains, for comparing the rules
+// that match VIPs in the generated and live rules.
+func VIPChainRules(prefix string, rules map[string]*RuleSet) map[string][]string {
+	out := map[string][]string{}
+	for chain, set := range rules {
+		if chain != prefix && !strings.HasPrefix(chain, prefix+"-VIP-") || len(set.Rules) == 0 {
+			continue
+		}
+		sorted := append([]string{}, set.Rules...)
+		sort.Strings(sorted)
+		out[chain] = sorted
+	}
+	return out
+}
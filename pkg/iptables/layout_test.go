@@ -0,0 +1,106 @@
+package iptables
+
+import (
+	"reflect"
+	"testing"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
+)
+
+func TestVIPChains(t *testing.T) {
+	i := &iptables{chain: "RAVEL", masqChain: "RAVEL-MASQ", snatChain: "RAVEL-SNAT"}
+	a, b := vipChainName("10.54.213.253", "RAVEL"), vipChainName("10.54.213.254", "RAVEL")
+	out := map[string]*RuleSet{}
+	jumps := i.vipChains(out, map[string][]string{
+		"10.54.213.254": {"-A " + b + ` -p tcp -m tcp --dport 80 -m comment --comment "default/b:http" -j RAVEL-SVC-B`},
+		"10.54.213.253": {"-A " + a + ` -p tcp -m tcp --dport 80 -m comment --comment "default/a:http" -j RAVEL-SVC-A`},
+	}, "/32")
+	expects := []string{
+		`-A RAVEL -d 10.54.213.253/32 -m comment --comment "10.54.213.253" -j ` + a,
+		`-A RAVEL -d 10.54.213.254/32 -m comment --comment "10.54.213.254" -j ` + b,
+	}
+	if !reflect.DeepEqual(jumps, expects) {
+		t.Fatalf("expected the base chain to jump to each VIP chain in order. saw %v", jumps)
+	}
+	if len(out) != 2 || len(out[a].Rules) != 1 || out[a].ChainRule != ":"+a+" - [0:0]" {
+		t.Fatalf("expected a chain per VIP. saw %v", out)
+	}
+
+	for chain, owned := range map[string]bool{
+		"RAVEL": true, "RAVEL-MASQ": true, "RAVEL-SNAT": true, a: true,
+		"RAVEL-SVC-ABC": true, "RAVEL-SEP-ABC": true,
+		"RAVEL-NAT": false, "RAVEL-FWMARK": false, "KUBE-SERVICES": false, "PREROUTING": false,
+	} {
+		if i.ownsChain(chain) != owned {
+			t.Fatalf("expected ownership of %s to be %v", chain, owned)
+		}
+	}
+
+	// only the chain that changed is rewritten
+	live := map[string]*RuleSet{
+		"RAVEL": {Rules: jumps},
+		a:       {Rules: out[a].Rules},
+		b:       {Rules: []string{"-A " + b + ` -p tcp -m tcp --dport 81 -m comment --comment "default/b:http" -j RAVEL-SVC-B`}},
+	}
+	generated := map[string]*RuleSet{"RAVEL": {Rules: jumps}, a: out[a], b: out[b], "RAVEL-NAT": {}}
+	if unchanged := i.unchangedChains(generated, live); !reflect.DeepEqual(unchanged, map[string]bool{"RAVEL": true, a: true}) {
+		t.Fatalf("expected the base chain and first VIP chain to be unchanged. saw %v", unchanged)
+	}
+
+	if reflect.DeepEqual(VIPChainRules("RAVEL", live), VIPChainRules("RAVEL", generated)) {
+		t.Fatalf("expected the changed VIP chain to differ")
+	}
+	live[b] = out[b]
+	live["RAVEL-MASQ"] = &RuleSet{Rules: []string{"-A RAVEL-MASQ -j MARK --set-xmark 0x4000/0x4000"}}
+	if !reflect.DeepEqual(VIPChainRules("RAVEL", live), VIPChainRules("RAVEL", generated)) {
+		t.Fatalf("expected only the base and VIP chains to be compared")
+	}
+}
+
+func TestSNATRules(t *testing.T) {
+	i := &iptables{chain: "RAVEL", snatChain: "RAVEL-SNAT", table: util.TableNAT}
+	node := types.Node{
+		Addresses: []string{"10.131.153.76"},
+		Endpoints: []types.Endpoints{{
+			EndpointMeta: types.EndpointMeta{Namespace: "default", Service: "nginx"},
+			Subsets:      []types.Subset{{Addresses: []types.Address{{PodIP: "100.64.0.5"}}, Ports: []types.Port{{Name: "http", Port: 8080}}}},
+		}},
+	}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.253": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http", TargetPort: "8080"}},
+			"10.54.213.254": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+		},
+		VIPOptions: map[types.ServiceIP]*types.VIPOptions{"10.54.213.253": {ForwardingMethod: types.ForwardingNAT}},
+	}
+
+	// the hairpin rule of the pod once, and the nat VIP's masquerade
+	expects := []string{
+		`-A RAVEL-SNAT -p tcp -m conntrack --ctstate DNAT --ctorigdst 10.131.153.76/32 --ctorigdstport 8080 -m comment --comment "default/nginx:http" -j MASQUERADE`,
+		`-A RAVEL-SNAT -s 100.64.0.5/32 -d 100.64.0.5/32 -m comment --comment "default/nginx:http" -j MASQUERADE`,
+	}
+	if out := i.snatRules(node, config, config.Config, false); !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+
+	i.table = util.TableMangle
+	if out := i.snatRules(node, config, config.Config, false); len(out) != 0 {
+		t.Fatalf("expected no masquerade outside of the nat table. saw %v", out)
+	}
+}
+
+func TestSourceMatches(t *testing.T) {
+	service := &types.ServiceDef{}
+	if out := sourceMatches(service, false); !reflect.DeepEqual(out, []string{""}) {
+		t.Fatalf("expected a port without source ranges to match every client. saw %v", out)
+	}
+
+	service.SourceRanges = []string{"10.0.0.0/8", "172.16.4.1/24"}
+	if out := sourceMatches(service, false); !reflect.DeepEqual(out, []string{" -s 10.0.0.0/8", " -s 172.16.4.0/24"}) {
+		t.Fatalf("expected a match per network. saw %v", out)
+	}
+	if out := sourceMatches(service, true); len(out) != 0 {
+		t.Fatalf("expected no ipv6 matches for ipv4 ranges. saw %v", out)
+	}
+}
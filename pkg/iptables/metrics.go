@@ -13,6 +13,12 @@ type iptablesMetrics interface {
 
 	ChainRemoved(name, rule string)
 	ChainGauge(len int, kind string)
+
+	RuleGauge(len int, kind string)
+	RulesRemoved(count int, kind string)
+	RestoreFailure(operation string)
+	LockContention(operation string)
+	DriftGauge(count int, kind string)
 }
 
 type metrics struct {
@@ -24,6 +30,12 @@ type metrics struct {
 
 	chainRemoved *prometheus.CounterVec
 	chainGauge   *prometheus.GaugeVec
+
+	ruleGauge       *prometheus.GaugeVec
+	rulesRemoved    *prometheus.CounterVec
+	restoreFailures *prometheus.CounterVec
+	lockContention  *prometheus.CounterVec
+	drift           *prometheus.GaugeVec
 }
 
 func (m *metrics) IPTables(operation string, tries int, err error, d time.Duration) {
@@ -58,12 +70,55 @@ func (m *metrics) ChainGauge(l int, kind string) {
 	}).Set(float64(l))
 }
 
+// RuleGauge records the number of rules of the last generated or merged rule
+// set, by kind, e.g. generated or merged-ipv6.
+func (m *metrics) RuleGauge(l int, kind string) {
+	m.ruleGauge.With(prometheus.Labels{"lb": m.lbKind,
+		"seczone": m.configKey,
+		"kind":    kind,
+	}).Set(float64(l))
+}
+
+// RulesRemoved counts the chains and rules that a merge removed.
+func (m *metrics) RulesRemoved(count int, kind string) {
+	m.rulesRemoved.With(prometheus.Labels{"lb": m.lbKind,
+		"seczone": m.configKey,
+		"kind":    kind,
+	}).Add(float64(count))
+}
+
+func (m *metrics) RestoreFailure(operation string) {
+	m.restoreFailures.With(prometheus.Labels{"lb": m.lbKind,
+		"seczone":   m.configKey,
+		"operation": operation,
+	}).Add(1)
+}
+
+// LockContention counts the attempts of an operation that found the xtables
+// lock held by another agent.
+func (m *metrics) LockContention(operation string) {
+	m.lockContention.With(prometheus.Labels{"lb": m.lbKind,
+		"seczone":   m.configKey,
+		"operation": operation,
+	}).Add(1)
+}
+
+// DriftGauge records the number of rules of owned chains that the last drift
+// check found added or removed by another agent, by kind.
+func (m *metrics) DriftGauge(count int, kind string) {
+	m.drift.With(prometheus.Labels{"lb": m.lbKind,
+		"seczone": m.configKey,
+		"kind":    kind,
+	}).Set(float64(count))
+}
+
 func NewMetrics(lbKind, configKey string) *metrics {
 
 	defaultLabels := []string{"lb", "seczone"}
 	iptablesLabels := append(defaultLabels, []string{"operation", "attempts", "outcome"}...)
 	chainInfoLabels := append(defaultLabels, []string{"name", "rule"}...)
 	chainGaugeLabels := append(defaultLabels, []string{"kind"}...)
+	restoreLabels := append(defaultLabels, []string{"operation"}...)
 
 	// counter iptables_operation_count
 	iptablesCount := prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -90,10 +145,45 @@ func NewMetrics(lbKind, configKey string) *metrics {
 		Help: "is twi guages, one for the inbound/calculated chain size, and one for the configured size.",
 	}, chainGaugeLabels)
 
-	prometheus.MustRegister(iptablesCount)
-	prometheus.MustRegister(iptablesLatency)
-	prometheus.MustRegister(chainRemoved)
-	prometheus.MustRegister(chainGauge)
+	// gauge iptables_rule_count
+	ruleGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: stats.Prefix + "iptables_rule_count",
+		Help: "is the number of rules generated and merged by the last apply. labels for kind generated|merged, with an -ipv6 suffix for ip6tables",
+	}, chainGaugeLabels)
+
+	// counter iptables_rule_removal_count
+	rulesRemoved := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: stats.Prefix + "iptables_rule_removal_count",
+		Help: "is a count of the stale chains and orphaned rules that merges have removed",
+	}, chainGaugeLabels)
+
+	// counter iptables_restore_failure_count
+	restoreFailures := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: stats.Prefix + "iptables_restore_failure_count",
+		Help: "is a count of the restores of iptables rules and ipsets that failed. labels for operation restore|restore6|ipset-restore",
+	}, restoreLabels)
+
+	// counter iptables_lock_contention_count
+	lockContention := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: stats.Prefix + "iptables_lock_contention_count",
+		Help: "is a count of the iptables operations that were unable to take the xtables lock from another agent, such as kube-proxy, and were retried or failed",
+	}, restoreLabels)
+
+	// gauge iptables_drift_rule_count
+	drift := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: stats.Prefix + "iptables_drift_rule_count",
+		Help: "is the number of rules of ravel's chains that the last drift check found changed by another agent since ravel restored them. labels for kind added|removed, with an -ipv6 suffix for ip6tables",
+	}, chainGaugeLabels)
+
+	iptablesCount = stats.Register(iptablesCount).(*prometheus.CounterVec)
+	iptablesLatency = stats.Register(iptablesLatency).(*prometheus.HistogramVec)
+	chainRemoved = stats.Register(chainRemoved).(*prometheus.CounterVec)
+	chainGauge = stats.Register(chainGauge).(*prometheus.GaugeVec)
+	ruleGauge = stats.Register(ruleGauge).(*prometheus.GaugeVec)
+	rulesRemoved = stats.Register(rulesRemoved).(*prometheus.CounterVec)
+	restoreFailures = stats.Register(restoreFailures).(*prometheus.CounterVec)
+	lockContention = stats.Register(lockContention).(*prometheus.CounterVec)
+	drift = stats.Register(drift).(*prometheus.GaugeVec)
 
 	return &metrics{
 		lbKind:    lbKind,
@@ -104,5 +194,11 @@ func NewMetrics(lbKind, configKey string) *metrics {
 
 		chainRemoved: chainRemoved,
 		chainGauge:   chainGauge,
+
+		ruleGauge:       ruleGauge,
+		rulesRemoved:    rulesRemoved,
+		restoreFailures: restoreFailures,
+		lockContention:  lockContention,
+		drift:           drift,
 	}
 }
@@ -1,6 +1,9 @@
 package iptables
 
 import (
+	"bytes"
+	"fmt"
+	"strconv"
 	"strings"
 
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
@@ -11,59 +14,204 @@ type RuleSet struct {
 	Rules     []string // -A PREROUTING -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
 }
 
-// GetSaveLines parses the iptables-save as a string and puts it into a map[string]*kubeRules
-// Modifications were made from the Kube codebase to support iptables save/restore
-func GetSaveLines(table util.Table, save []byte) (map[string]*RuleSet, error) {
-	chainsMap := map[string]*RuleSet{}
-
-	tablePrefix := "*" + string(table)
-	readIndex := 0
-	// find beginning of table
-	for readIndex < len(save) {
-		line, n := ReadLine(readIndex, save)
-		readIndex = n
-		if strings.HasPrefix(line, tablePrefix) {
-			break
-		}
-	}
+// Rules is the parsed output of iptables-save, holding every table in it, e.g.
+// filter, mangle, raw and nat, with the policies and counters of their chains
+// and rules. Tables, chains and rules keep the order they were saved in, so
+// that Bytes writes back what was parsed, less its comments.
+type Rules struct {
+	Tables []*Table
+}
+
+// Table is a table of Rules, e.g. *nat.
+type Table struct {
+	Name   string
+	Chains []*Chain
+}
+
+// Chain is a chain of a Table. The Policy of a custom chain is "-".
+type Chain struct {
+	Name    string
+	Policy  string
+	Counter *Counter
+	Rules   []*Rule
+}
+
+// Rule is a rule of a Chain, e.g. -A PREROUTING -j KUBE-SERVICES. Its Counter
+// is set when it was saved with iptables-save -c.
+type Rule struct {
+	Counter *Counter
+	Spec    string
+}
+
+// Counter holds the packet and byte counts of a chain or rule, as in [7:420].
+type Counter struct {
+	Packets uint64
+	Bytes   uint64
+}
 
-	// parse table lines
-	for readIndex < len(save) {
+func (c *Counter) String() string {
+	return fmt.Sprintf("[%d:%d]", c.Packets, c.Bytes)
+}
+
+// ParseRules parses the output of iptables-save or ip6tables-save.
+func ParseRules(save []byte) (*Rules, error) {
+	rules := &Rules{}
+	var table *Table
+	chains := map[string]*Chain{}
 
-		line, n := ReadLine(readIndex, save)
-		readIndex = n
-		// Ignore empty lines with whitespace stripped
-		if len(strings.Join(strings.Fields(line), "")) == 0 {
+	for n, line := range strings.Split(string(save), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
 			continue
-		}
 
-		// Extract the chain identity from the line. Chains are identified by either
-		// a ':' prefix, indicating they are a chain, or by a '-' prefix, indicating a
-		// rule in a chain.
-		var chain string
-		if strings.HasPrefix(line, "COMMIT") || strings.HasPrefix(line, "*") {
-			break
-		} else if strings.HasPrefix(line, "#") {
+		case strings.HasPrefix(line, "*"):
+			if table != nil {
+				return nil, fmt.Errorf("table %s at line %d is missing its COMMIT", table.Name, n+1)
+			}
+			table = &Table{Name: line[1:]}
+			chains = map[string]*Chain{}
 			continue
-		} else if strings.HasPrefix(line, ":") {
-			chain = strings.SplitN(line[1:], " ", 2)[0]
-			// Get the ruleset if it exists in the map, otherwise create it
-			if _, ok := chainsMap[chain]; !ok {
-				chainsMap[chain] = &RuleSet{
-					ChainRule: line,
+
+		case table == nil:
+			return nil, fmt.Errorf("line %d is outside of a table. %s", n+1, line)
+
+		case line == "COMMIT":
+			rules.Tables = append(rules.Tables, table)
+			table = nil
+
+		case strings.HasPrefix(line, ":"):
+			fields := strings.Fields(line[1:])
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("unable to parse chain at line %d. %s", n+1, line)
+			}
+			if _, ok := chains[fields[0]]; ok {
+				continue
+			}
+			chain := &Chain{Name: fields[0], Policy: fields[1]}
+			if len(fields) > 2 {
+				counter, err := parseCounter(fields[2])
+				if err != nil {
+					return nil, fmt.Errorf("unable to parse chain at line %d. %v", n+1, err)
 				}
+				chain.Counter = counter
+			}
+			chains[chain.Name] = chain
+			table.Chains = append(table.Chains, chain)
+
+		default:
+			rule := &Rule{Spec: line}
+			if strings.HasPrefix(line, "[") {
+				fields := strings.SplitN(line, " ", 2)
+				counter, err := parseCounter(fields[0])
+				if err != nil || len(fields) < 2 {
+					return nil, fmt.Errorf("unable to parse rule at line %d. %s", n+1, line)
+				}
+				rule = &Rule{Counter: counter, Spec: fields[1]}
+			}
+			fields := strings.Fields(rule.Spec)
+			if len(fields) < 2 || fields[0] != "-A" {
+				return nil, fmt.Errorf("unable to parse rule at line %d. %s", n+1, line)
+			}
+			chain, ok := chains[fields[1]]
+			if !ok {
+				return nil, fmt.Errorf("rule at line %d is in undeclared chain %s", n+1, fields[1])
 			}
+			chain.Rules = append(chain.Rules, rule)
+		}
+	}
+	if table != nil {
+		return nil, fmt.Errorf("table %s is missing its COMMIT", table.Name)
+	}
+	return rules, nil
+}
 
-		} else if strings.HasPrefix(line, "-") {
-			chain = strings.SplitN(line[3:], " ", 2)[0]
+func parseCounter(s string) (*Counter, error) {
+	counts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), ":")
+	if len(counts) != 2 || !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("malformed counter %s", s)
+	}
+	packets, err := strconv.ParseUint(counts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed counter %s. %v", s, err)
+	}
+	bytes, err := strconv.ParseUint(counts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed counter %s. %v", s, err)
+	}
+	return &Counter{Packets: packets, Bytes: bytes}, nil
+}
+
+// Table returns the named table, or nil if there is none.
+func (r *Rules) Table(name string) *Table {
+	for _, table := range r.Tables {
+		if table.Name == name {
+			return table
+		}
+	}
+	return nil
+}
+
+// Bytes serializes r in the format of iptables-save, for iptables-restore.
+func (r *Rules) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, table := range r.Tables {
+		buf.WriteString("*" + table.Name + "\n")
+		for _, chain := range table.Chains {
+			buf.WriteString(chain.Line() + "\n")
+		}
+		for _, chain := range table.Chains {
+			for _, rule := range chain.Rules {
+				buf.WriteString(rule.Line() + "\n")
+			}
 		}
+		buf.WriteString("COMMIT\n")
+	}
+	return buf.Bytes()
+}
+
+// Line returns the declaration of the chain, e.g. :PREROUTING ACCEPT [7:420].
+func (c *Chain) Line() string {
+	if c.Counter == nil {
+		return fmt.Sprintf(":%s %s", c.Name, c.Policy)
+	}
+	return fmt.Sprintf(":%s %s %s", c.Name, c.Policy, c.Counter)
+}
+
+// Line returns the rule, preceded by its counter if it has one.
+func (r *Rule) Line() string {
+	if r.Counter == nil {
+		return r.Spec
+	}
+	return r.Counter.String() + " " + r.Spec
+}
 
-		// Capture the line
-		if strings.HasPrefix(line, "-") {
-			chainsMap[chain].Rules = append(chainsMap[chain].Rules, line)
+// RuleSets returns the chains of the table in the form that the iptables
+// interface merges and restores. Rule counters are left out.
+func (t *Table) RuleSets() map[string]*RuleSet {
+	out := map[string]*RuleSet{}
+	for _, chain := range t.Chains {
+		set := &RuleSet{ChainRule: chain.Line()}
+		for _, rule := range chain.Rules {
+			set.Rules = append(set.Rules, rule.Spec)
 		}
+		out[chain.Name] = set
+	}
+	return out
+}
+
+// GetSaveLines parses the iptables-save as a string and puts it into a map[string]*kubeRules
+// Modifications were made from the Kube codebase to support iptables save/restore
+func GetSaveLines(table util.Table, save []byte) (map[string]*RuleSet, error) {
+	rules, err := ParseRules(save)
+	if err != nil {
+		return nil, err
+	}
+	t := rules.Table(string(table))
+	if t == nil {
+		return map[string]*RuleSet{}, nil
 	}
-	return chainsMap, nil
+	return t.RuleSets(), nil
 }
 
 func ReadLine(readIndex int, byteArray []byte) (string, int) {
@@ -1,6 +1,10 @@
 package iptables
 
-import "testing"
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
 
 var testData []byte = []byte(`# Generated by iptables-save v1.4.21 on Wed Mar 22 00:38:34 2017
 *nat
@@ -40,3 +44,85 @@ func TestGetSaveLines(t *testing.T) {
 		t.Fatalf("expected five rules total. saw %d", sum)
 	}
 }
+
+var countersData = []byte(`# Generated by iptables-save v1.6.1 on Wed Mar 22 00:38:34 2017
+*raw
+:PREROUTING ACCEPT [120:8400]
+:OUTPUT ACCEPT [90:5400]
+[3:180] -A PREROUTING -p udp -m udp --dport 53 -j NOTRACK
+COMMIT
+*filter
+:INPUT DROP [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [90:5400]
+:KUBE-FIREWALL - [0:0]
+[0:0] -A INPUT -j KUBE-FIREWALL
+[12:720] -A KUBE-FIREWALL -m comment --comment "kubernetes firewall for dropping marked packets" -m mark --mark 0x8000/0x8000 -j DROP
+COMMIT
+*nat
+:PREROUTING ACCEPT [7:420]
+:RAVEL - [0:0]
+[7:420] -A PREROUTING -j RAVEL
+COMMIT
+# Completed on Wed Mar 22 00:38:34 2017
+`)
+
+func TestParseRules(t *testing.T) {
+	r, err := ParseRules(countersData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Tables) != 3 {
+		t.Fatalf("expected three tables. saw %d", len(r.Tables))
+	}
+
+	filter := r.Table("filter")
+	if filter == nil || len(filter.Chains) != 4 {
+		t.Fatalf("expected four chains in the filter table. saw %v", filter)
+	}
+	if filter.Chains[0].Policy != "DROP" {
+		t.Fatalf("expected the INPUT policy to be DROP. saw %s", filter.Chains[0].Policy)
+	}
+	if c := filter.Chains[3].Rules[0].Counter; c == nil || c.Packets != 12 || c.Bytes != 720 {
+		t.Fatalf("expected the KUBE-FIREWALL rule to have counted [12:720]. saw %v", c)
+	}
+
+	// the rule sets of a table leave out rule counters
+	sets := r.Table("nat").RuleSets()
+	expects := map[string]*RuleSet{
+		"PREROUTING": {ChainRule: ":PREROUTING ACCEPT [7:420]", Rules: []string{"-A PREROUTING -j RAVEL"}},
+		"RAVEL":      {ChainRule: ":RAVEL - [0:0]"},
+	}
+	if !reflect.DeepEqual(sets, expects) {
+		t.Fatalf("expected %v. saw %v", expects, sets)
+	}
+
+	// everything but the comments survives a round trip
+	out, err := ParseRules(r.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, out) {
+		t.Fatalf("expected rules to round trip. saw\n%s", out.Bytes())
+	}
+	saved := ""
+	for _, line := range strings.SplitAfter(string(countersData), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			saved += line
+		}
+	}
+	if string(r.Bytes()) != saved {
+		t.Fatalf("expected the saved rules to be serialized as they were. saw\n%s", r.Bytes())
+	}
+
+	for _, bad := range []string{
+		"*nat\n:PREROUTING ACCEPT [0:0]\n",
+		"*nat\n-A PREROUTING -j RAVEL\nCOMMIT\n",
+		"*nat\n:PREROUTING ACCEPT [0:x]\nCOMMIT\n",
+		"-A PREROUTING -j RAVEL\n",
+	} {
+		if _, err := ParseRules([]byte(bad)); err == nil {
+			t.Fatalf("expected an error parsing %q", bad)
+		}
+	}
+}
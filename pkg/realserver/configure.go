@@ -3,7 +3,7 @@ package realserver
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"reflect"
 	"sort"
 	"sync"
@@ -16,92 +16,507 @@ import (
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
 )
 
+// reconfigureDebounce is how long the realserver waits for updates from the
+// watcher to stop arriving before it reconfigures, so that a burst of node and
+// config updates results in a single reconfiguration.
+const reconfigureDebounce = 200 * time.Millisecond
+
+// reconfigureMaxWait bounds the debounce, so that updates arriving without a
+// pause, e.g. from endpoints that keep churning, still reconfigure at most
+// this long after the first of them.
+const reconfigureMaxWait = 2000 * time.Millisecond
+
+// reconfigureMaxBackoff caps the backoff between the retries of a failed
+// reconfiguration, which starts at reconfigureDebounce and doubles.
+const reconfigureMaxBackoff = 30 * time.Second
+
 type RealServer interface {
 	Start() error
 	Stop() error
+
+	// Drain takes the node out of service for maintenance without dropping
+	// established sessions. It removes the VIPs' iptables rules, so that no
+	// new connections are accepted, waits out the drain delay while the
+	// established ones finish on their conntrack entries, then removes the
+	// VIP addresses. Undrain restores both.
+	Drain() error
+	Undrain() error
+
+	// State returns the realserver's current view, for debugging.
+	State() types.WorkerState
+
+	// SetForcedReconfigure turns the forced reconfiguration on or off.
+	SetForcedReconfigure(enabled bool)
+
+	// Status summarizes the realserver's last applies and parity checks, and
+	// Health returns an error unless it is running with the node in parity.
+	Status() types.WorkerStatus
+	Health() error
+
+	// Ready returns nil once the realserver accepts traffic, after its first
+	// configuration has been applied and verified, or an error naming the
+	// stage it is in.
+	Ready() error
+}
+
+// lifecycle is the stage of a realserver between Start and Stop.
+type lifecycle int
+
+const (
+	lifecycleStopped lifecycle = iota
+	lifecycleStarting
+	lifecycleRunning
+	lifecycleStopping
+)
+
+// stopTimeout is how long Stop waits on the goroutines of the realserver
+// before it cleans up regardless.
+const stopTimeout = 5000 * time.Millisecond
+
+// readiness is the stage of a realserver on its way to accepting traffic.
+type readiness string
+
+const (
+	// readinessStopped and readinessStarting have no configuration applied.
+	readinessStopped  readiness = "stopped"
+	readinessStarting readiness = "starting"
+	// readinessConfiguring has the rules applied and its VIP addresses
+	// withheld, until the rules are verified.
+	readinessConfiguring readiness = "configuring"
+	readinessReady       readiness = "ready"
+)
+
+// drainState is how far a drain has progressed.
+type drainState int
+
+const (
+	drainNone drainState = iota
+	drainRules
+	drainAll
+)
+
+// drainRequest asks the periodic loop, which owns the configuration of the
+// node, to move it to a drain state.
+type drainRequest struct {
+	state drainState
+	reply chan error
 }
 
 type realserver struct {
 	sync.Mutex
 
 	watcher    system.Watcher
-	ipPrimary  system.IP
 	ipLoopback system.IP
-	ipvs       system.IPVS
 	iptables   iptables.IPTables
 
+	// ipPrimary and ipvs are nil when a director runs in the same process,
+	// which owns the addresses and sysctls of the primary interface, IPVS,
+	// its sync daemon and the dscp rules, so that the realserver does not
+	// tear them down from under it.
+	ipPrimary system.IP
+	ipvs      system.IPVS
+
+	// weighted rules only capture the node's share of each service's
+	// traffic, and leave the rest to the director's IPVS
+	weighted bool
+
+	// capture writes the rules of failed restores for debugging
+	capture *iptables.Capture
+
+	// ipTunnel is the IPIP tunnel device that VIPs forwarded in tunnel mode
+	// are bound on, or nil when the realserver is not in tunnel mode and
+	// leaves those VIPs unbound.
+	ipTunnel system.IP
+
 	nodeName string
 
-	doneChan chan struct{}
-	err      error
+	// lifecycle is guarded by the lock. running counts the goroutines of a
+	// started realserver, which Stop waits on.
+	lifecycle lifecycle
+	running   sync.WaitGroup
+	err       error
 
 	config     *types.ClusterConfig
 	configChan chan *types.ClusterConfig
 	node       types.Node
 	nodeChan   chan types.NodesList
+	updateChan chan struct{}
 	cxlWatch   context.CancelFunc
 	ctxWatch   context.Context
 
-	reconfiguring     bool
+	// ipv6Rules is set once ip6tables rules have been applied for ipv6 VIPs.
+	// Nodes that have never had ipv6 VIPs leave ip6tables alone.
+	ipv6Rules bool
+
 	lastInboundUpdate time.Time
 	lastReconfigure   time.Time
 	forcedReconfigure bool
 
+	// forcedReconfigureInterval is how often a forced reconfigure runs, and
+	// parityInterval how often configuration is reapplied regardless of
+	// inbound updates.
+	forcedReconfigureInterval time.Duration
+	parityInterval            time.Duration
+
+	// health evaluates the node's local health, or is nil to keep the VIPs
+	// regardless. unhealthy holds the reason the node failed it, and is
+	// empty while the node is healthy.
+	health    HealthEvaluator
+	unhealthy string
+
+	// drained is how far the node has been drained, and drainDelay how long
+	// established connections are given between the removal of the rules
+	// and the addresses. drained is only accessed by the periodic loop.
+	drained    drainState
+	drainDelay time.Duration
+	drainChan  chan drainRequest
+
+	// autoDrained is set while the node is drained because it is under
+	// maintenance, cordoned unless ignoreCordon is set or carrying one of
+	// drainTaints, and cleared by a Drain or Undrain. It is only accessed by
+	// the periodic loop.
+	autoDrained  bool
+	ignoreCordon bool
+	drainTaints  []string
+
+	// readiness is guarded by the lock, for the readiness probe. The VIP
+	// addresses are withheld until the node accepts traffic, which is only
+	// accessed by the periodic loop.
+	readiness readiness
+	accepting bool
+
+	// status is guarded by the lock
+	status types.WorkerStatus
+
 	ctx     context.Context
 	logger  logrus.FieldLogger
 	metrics *stats.WorkerStateMetrics
 }
 
-func NewRealServer(ctx context.Context, nodeName string, configKey string, watcher system.Watcher, ipPrimary system.IP, ipLoopback system.IP, ipvs system.IPVS, ipt iptables.IPTables, forcedReconfigure bool, logger logrus.FieldLogger) (RealServer, error) {
+// Options are the collaborators and settings of a realserver.
+type Options struct {
+	NodeName  string
+	ConfigKey string
+
+	Watcher    system.Watcher
+	IPLoopback system.IP
+	IPTables   iptables.IPTables
+	Capture    *iptables.Capture
+
+	// IPPrimary and IPVS are left nil when a director runs in the same
+	// process, and IPTunnel outside of tunnel mode.
+	IPPrimary system.IP
+	IPTunnel  system.IP
+	IPVS      system.IPVS
+
+	// Weighted generates rules that only capture the node's share of each
+	// service's traffic, with a statistic probability, and leave the rest to
+	// IPVS, rather than DNAT every packet to the local pods. It is set when
+	// the realserver runs beside a director, whose VIPs are bound on this
+	// node's primary interface.
+	Weighted bool
+
+	ForcedReconfigure         bool
+	ForcedReconfigureInterval time.Duration
+	ParityInterval            time.Duration
+	DrainDelay                time.Duration
+	IgnoreCordon              bool
+	DrainTaints               []string
+
+	// Health evaluates the node's local health, or is nil to keep the VIPs
+	// regardless.
+	Health HealthEvaluator
+}
+
+func NewRealServer(ctx context.Context, opts Options, logger logrus.FieldLogger) (RealServer, error) {
 	return &realserver{
-		watcher:    watcher,
-		ipPrimary:  ipPrimary,
-		ipLoopback: ipLoopback,
-		ipvs:       ipvs,
-		iptables:   ipt,
-		nodeName:   nodeName,
-
-		doneChan:   make(chan struct{}),
+		watcher:    opts.Watcher,
+		ipPrimary:  opts.IPPrimary,
+		ipLoopback: opts.IPLoopback,
+		ipTunnel:   opts.IPTunnel,
+		ipvs:       opts.IPVS,
+		weighted:   opts.Weighted,
+		iptables:   opts.IPTables,
+		capture:    opts.Capture,
+		nodeName:   opts.NodeName,
+
 		configChan: make(chan *types.ClusterConfig, 1),
 		nodeChan:   make(chan types.NodesList, 1),
+		updateChan: make(chan struct{}, 1),
+		drainChan:  make(chan drainRequest),
 
 		ctx:               ctx,
 		logger:            logger,
-		metrics:           stats.NewWorkerStateMetrics(stats.KindRealServer, configKey),
-		forcedReconfigure: forcedReconfigure,
+		metrics:           stats.NewWorkerStateMetrics(stats.KindRealServer, opts.ConfigKey),
+		forcedReconfigure: opts.ForcedReconfigure,
+
+		forcedReconfigureInterval: opts.ForcedReconfigureInterval,
+		parityInterval:            opts.ParityInterval,
+		health:                    opts.Health,
+		drainDelay:                opts.DrainDelay,
+		ignoreCordon:              opts.IgnoreCordon,
+		drainTaints:               opts.DrainTaints,
+		readiness:                 readinessStopped,
 	}, nil
 }
 
-// TODO: IN THIS CASE STOP CAN BE CALLED WITHOUT THE CANCEL FUNCTION. . WELP DAY
+// Stop is a no-op on a stopped realserver.
 func (r *realserver) Stop() error {
-	if r.reconfiguring {
-		return fmt.Errorf("unable to Stop. reconfiguration already in progress.")
+	r.Lock()
+	switch r.lifecycle {
+	case lifecycleStopped:
+		r.Unlock()
+		return nil
+	case lifecycleStarting, lifecycleStopping:
+		r.Unlock()
+		return fmt.Errorf("unable to Stop. realserver is starting or stopping")
 	}
-	r.setReconfiguring(true)
-	defer func() { r.setReconfiguring(false) }()
+	r.lifecycle = lifecycleStopping
+	r.Unlock()
+	defer r.setLifecycle(lifecycleStopped)
 
 	// This is a little different from the BGP approach. Because the load balancer
-	// can be stopped and restarted, we use the cxlWatch context to determine whether
-	// the periodic task is complete.
-	if r.cxlWatch != nil {
-		r.cxlWatch()
-	}
+	// can be stopped and restarted, we use the cxlWatch context to end the
+	// goroutines of this run.
+	r.cxlWatch()
+	r.setReadiness(readinessStopped)
 	r.logger.Info("blocking until periodic tasks complete")
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
 	select {
-	case <-r.doneChan:
-	case <-time.After(5000 * time.Millisecond):
+	case <-done:
+	case <-time.After(stopTimeout):
+		r.logger.Warnf("periodic tasks did not complete within %v", stopTimeout)
 	}
 
 	// remove config VIP addresses from the compute interface
-	ctxDestroy, cxl := context.WithTimeout(context.Background(), 5000*time.Millisecond)
+	ctxDestroy, cxl := context.WithTimeout(context.Background(), stopTimeout)
 	defer cxl()
 
 	r.logger.Info("starting cleanup")
 	err := r.cleanup(ctxDestroy)
 	r.logger.Infof("cleanup complete. error=%v", err)
+
+	// with the VIPs gone, the devices' sysctls go back to what they were
+	for _, device := range r.devices() {
+		if restoreErr := device.RestoreSysctls(); restoreErr != nil {
+			r.logger.Errorf("unable to restore the sysctls of %s. %v", device.Device(), restoreErr)
+		}
+	}
+	return err
+}
+
+// devices returns the IP helpers of the devices whose sysctls the realserver
+// sets.
+func (r *realserver) devices() []system.IP {
+	devices := []system.IP{r.ipLoopback}
+	if r.ipPrimary != nil {
+		devices = append(devices, r.ipPrimary)
+	}
+	if r.ipTunnel != nil {
+		devices = append(devices, r.ipTunnel)
+	}
+	return devices
+}
+
+func (r *realserver) State() types.WorkerState {
+	r.Lock()
+	defer r.Unlock()
+	state := types.WorkerState{
+		Config:            r.config.Copy(),
+		Nodes:             types.NodesList{},
+		LastInboundUpdate: r.lastInboundUpdate,
+		LastReconfigure:   r.lastReconfigure,
+		ForcedReconfigure: r.forcedReconfigure,
+		QueueDepths: map[string]int{
+			"config": len(r.configChan),
+			"nodes":  len(r.nodeChan),
+		},
+	}
+	if r.node.Name != "" {
+		state.Nodes = append(state.Nodes, r.node.Copy())
+	}
+	return state
+}
+
+func (r *realserver) Status() types.WorkerStatus {
+	r.Lock()
+	defer r.Unlock()
+	status := r.status
+	status.Running = r.lifecycle == lifecycleRunning
+	return status
+}
+
+func (r *realserver) Health() error {
+	return r.Status().Health()
+}
+
+// recordParity records a parity check that found the node in parity.
+func (r *realserver) recordParity() {
+	r.Lock()
+	r.status.Parity = true
+	r.Unlock()
+}
+
+// recordApplied records a successful apply of vips VIP addresses and rules
+// iptables rules.
+func (r *realserver) recordApplied(vips, rules int) {
+	r.Lock()
+	r.status.LastApply = time.Now()
+	r.status.Parity = true
+	r.status.VIPs = vips
+	r.status.Rules = rules
+	r.Unlock()
+}
+
+// recordError records a failed apply or parity check.
+func (r *realserver) recordError(err error) {
+	r.Lock()
+	r.status.LastError = err.Error()
+	r.status.LastErrorTime = time.Now()
+	r.status.Parity = false
+	r.Unlock()
+}
+
+func (r *realserver) SetForcedReconfigure(enabled bool) {
+	r.Lock()
+	r.forcedReconfigure = enabled
+	r.Unlock()
+	r.logger.Infof("forced reconfiguration set to %v", enabled)
+}
+
+func (r *realserver) Ready() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.readiness != readinessReady {
+		return fmt.Errorf("realserver is %s", r.readiness)
+	}
+	return nil
+}
+
+func (r *realserver) setReadiness(state readiness) {
+	r.Lock()
+	r.readiness = state
+	r.Unlock()
+	r.logger.Infof("realserver is %s", state)
+}
+
+func (r *realserver) isReady() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.readiness == readinessReady
+}
+
+// apply applies a snapshot of the config and node, bringing the node to
+// readiness first if it is not ready.
+func (r *realserver) apply(config *types.ClusterConfig, node types.Node, force bool) error {
+	var err error
+	if !r.isReady() {
+		err = r.becomeReady(config, node)
+	} else {
+		err, _ = r.configure(config, node, force)
+	}
+	if err != nil {
+		r.recordError(err)
+	}
 	return err
 }
 
+// becomeReady applies the first configuration in order, so that the node
+// accepts no traffic for its VIPs before the rules that serve it are in
+// place: the rules are applied with the VIP addresses withheld and verified,
+// then the addresses are bound and the whole configuration verified.
+func (r *realserver) becomeReady(config *types.ClusterConfig, node types.Node) error {
+	if config == nil || node.Name == "" {
+		return nil
+	}
+
+	r.setReadiness(readinessConfiguring)
+	r.accepting = false
+	if err := r.applyVerified(config, node); err != nil {
+		return fmt.Errorf("unable to apply the rules. %v", err)
+	}
+
+	r.accepting = true
+	if err := r.applyVerified(config, node); err != nil {
+		return fmt.Errorf("unable to bind the VIP addresses. %v", err)
+	}
+	r.setReadiness(readinessReady)
+	return nil
+}
+
+// applyVerified applies the config and node, then checks them for parity.
+func (r *realserver) applyVerified(config *types.ClusterConfig, node types.Node) error {
+	if err, _ := r.configure(config, node, true); err != nil {
+		return err
+	}
+	rules, vips := r.withdraw(config)
+	same, err := r.checkConfigParity(rules, vips, node)
+	if err != nil {
+		return err
+	}
+	if !same {
+		return fmt.Errorf("configuration does not have parity after it was applied")
+	}
+	return nil
+}
+
+func (r *realserver) Drain() error {
+	if err := r.requestDrain(drainRules); err != nil {
+		return err
+	}
+	r.logger.Infof("draining. waiting %v for established connections to finish", r.drainDelay)
+	select {
+	case <-time.After(r.drainDelay):
+	case <-r.ctx.Done():
+		return fmt.Errorf("realserver is stopping")
+	}
+	return r.requestDrain(drainAll)
+}
+
+func (r *realserver) Undrain() error {
+	return r.requestDrain(drainNone)
+}
+
+func (r *realserver) requestDrain(state drainState) error {
+	if r.ctxWatch == nil {
+		return fmt.Errorf("realserver is not started")
+	}
+	req := drainRequest{state: state, reply: make(chan error, 1)}
+	select {
+	case r.drainChan <- req:
+	case <-r.ctxWatch.Done():
+		return fmt.Errorf("realserver is stopping")
+	}
+	return <-req.reply
+}
+
+// setDrained moves the node to a drain state and applies it right away.
+func (r *realserver) setDrained(state drainState) error {
+	if state == drainAll && r.drained != drainRules {
+		return fmt.Errorf("drain was cancelled by an undrain")
+	}
+	r.drained = state
+	r.autoDrained = false
+	switch state {
+	case drainRules:
+		r.logger.Info("draining. removing the rules of the VIPs")
+	case drainAll:
+		r.logger.Info("draining. removing the addresses of the VIPs")
+	default:
+		r.logger.Info("undraining. restoring the VIPs")
+	}
+
+	config, node := r.snapshot()
+	if config == nil || node.Name == "" {
+		return nil
+	}
+	return r.apply(config, node, false)
+}
+
 func (r *realserver) cleanup(ctx context.Context) error {
 	errs := []string{}
 
@@ -110,10 +525,29 @@ func (r *realserver) cleanup(ctx context.Context) error {
 		errs = append(errs, fmt.Sprintf("cleanup - failed to remove ip addresses - %v", err))
 	}
 
+	// and from the tunnel device
+	if r.ipTunnel != nil {
+		if err := r.ipTunnel.Teardown(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("cleanup - failed to remove tunnel ip addresses - %v", err))
+		}
+	}
+
 	// flush iptables
 	if err := r.iptables.Flush(); err != nil {
 		errs = append(errs, fmt.Sprintf("cleanup - failed to flush iptables - %v", err))
 	}
+	if r.ipv6Rules {
+		if err := r.iptables.Flush6(); err != nil {
+			errs = append(errs, fmt.Sprintf("cleanup - failed to flush ip6tables - %v", err))
+		}
+	}
+
+	// stop receiving connections from the director, which may be starting here
+	if r.ipvs != nil {
+		if err := r.ipvs.StopSyncDaemon(system.SyncDaemonBackup); err != nil {
+			errs = append(errs, fmt.Sprintf("cleanup - failed to stop ipvs sync daemon - %v", err))
+		}
+	}
 
 	if len(errs) == 0 {
 		return nil
@@ -121,6 +555,66 @@ func (r *realserver) cleanup(ctx context.Context) error {
 	return fmt.Errorf("%v", errs)
 }
 
+// setTunnel brings up the tunnel device in tunnel mode, with the sysctls that
+// let it accept the VIPs' traffic and keep them from being announced.
+func (r *realserver) setTunnel() error {
+	if r.ipTunnel == nil {
+		return nil
+	}
+	// bring up the tunnel device before setting sysctls on it
+	if err := r.ipTunnel.SetTunnel(); err != nil {
+		return err
+	}
+	if err := r.ipTunnel.SetARP(); err != nil {
+		return err
+	}
+	return r.ipTunnel.SetRPFilter()
+}
+
+// setupIPVS clears ipvs and receives the director's connections, unless a
+// director in the same process owns them.
+func (r *realserver) setupIPVS() error {
+	if r.ipvs == nil {
+		return nil
+	}
+
+	// clear ipvs
+	// this isn't in cleanup because cleanup shouldn't clobber a master if it comes online on the same node
+	if err := r.ipvs.Teardown(r.ctx); err != nil {
+		return err
+	}
+
+	// receive the director's connections, so that they survive if it fails over to this node
+	if err := r.ipvs.StartSyncDaemon(system.SyncDaemonBackup); err != nil {
+		return err
+	}
+	return r.ipvs.EnsureSysctls()
+}
+
+// setupPrimary sets the arp rules of the primary interface and deletes the
+// k2i addresses a director left on it, unless a director in the same process
+// owns it.
+func (r *realserver) setupPrimary() error {
+	if r.ipPrimary == nil {
+		return nil
+	}
+	if err := r.ipPrimary.SetARP(); err != nil {
+		return err
+	}
+
+	// delete all k2i addresses from primary interface
+	addresses, err := r.ipPrimary.Get()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addresses {
+		if err := r.ipPrimary.Del(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (r *realserver) setup() error {
 	var err error
 
@@ -137,33 +631,15 @@ func (r *realserver) setup() error {
 	if err != nil {
 		return err
 	}
-	err = r.ipLoopback.SetRPFilter()
-	if err != nil {
+	if err = r.setTunnel(); err != nil {
 		return err
 	}
-	err = r.ipPrimary.SetARP()
-	if err != nil {
-		return err
-	}
-
-	// clear ipvs
-	// this isn't in cleanup because cleanup shouldn't clobber a master if it comes online on the same node
-	err = r.ipvs.Teardown(r.ctx)
-	if err != nil {
+	if err = r.setupIPVS(); err != nil {
 		return err
 	}
-
-	// delete all k2i addresses from primary interface
-	addresses, err := r.ipPrimary.Get()
-	if err != nil {
+	if err = r.setupPrimary(); err != nil {
 		return err
 	}
-	for _, addr := range addresses {
-		err := r.ipPrimary.Del(addr)
-		if err != nil {
-			return err
-		}
-	}
 
 	// load this watcher instance into self
 	ctxWatch, cxlWatch := context.WithCancel(r.ctx)
@@ -172,39 +648,59 @@ func (r *realserver) setup() error {
 
 	// register the watcher for both nodes and the configmap
 	r.watcher.ConfigMap(ctxWatch, "realserver", r.configChan)
-	r.watcher.Nodes(ctxWatch, "director-nodes", r.nodeChan)
+	r.watcher.Nodes(ctxWatch, "realserver-nodes", r.nodeChan)
 	return nil
 }
 
-func (r *realserver) setReconfiguring(v bool) {
+func (r *realserver) setLifecycle(state lifecycle) {
 	r.Lock()
-	r.reconfiguring = v
+	r.lifecycle = state
 	r.Unlock()
 }
 
+// Start is a no-op on a started realserver.
 func (r *realserver) Start() error {
 	r.logger.Info("Enter Start()")
 	defer r.logger.Info("Exit Start()")
-	if r.reconfiguring {
-		return fmt.Errorf("unable to Start. reconfiguration already in progress.")
+	r.Lock()
+	switch r.lifecycle {
+	case lifecycleRunning:
+		r.Unlock()
+		return nil
+	case lifecycleStarting, lifecycleStopping:
+		r.Unlock()
+		return fmt.Errorf("unable to Start. realserver is starting or stopping")
 	}
-	r.setReconfiguring(true)
-	defer func() { r.setReconfiguring(false) }()
+	r.lifecycle = lifecycleStarting
+	r.Unlock()
 
+	r.setReadiness(readinessStarting)
 	err := r.setup()
 	if err != nil {
+		r.setLifecycle(lifecycleStopped)
 		return err
 	}
 
-	go r.periodic()
-	go r.watches()
+	r.running.Add(2)
+	go func() {
+		defer r.running.Done()
+		r.periodic(r.ctxWatch)
+	}()
+	go func() {
+		defer r.running.Done()
+		r.watches(r.ctxWatch)
+	}()
+	r.setLifecycle(lifecycleRunning)
 	return nil
 }
 
-func (r *realserver) watches() {
+// watches records the updates of the config and nodes until ctx is done.
+func (r *realserver) watches(ctx context.Context) {
 
 	for {
 		select {
+		case <-ctx.Done():
+			return
 
 		case nodes := <-r.nodeChan:
 			r.logger.Debugf("recv on nodes, %d in list", len(nodes))
@@ -236,6 +732,7 @@ func (r *realserver) watches() {
 			r.node = node
 			r.lastInboundUpdate = time.Now()
 			r.Unlock()
+			r.notifyUpdate()
 
 		case config := <-r.configChan:
 			// every time a new config kicks in, check parity and apply
@@ -245,62 +742,143 @@ func (r *realserver) watches() {
 			r.lastInboundUpdate = time.Now()
 			r.Unlock()
 			r.metrics.ConfigUpdate()
+			r.notifyUpdate()
 
 		}
 	}
 
 }
 
+// notifyUpdate wakes the periodic loop without blocking. An update that is
+// already pending covers this one.
+func (r *realserver) notifyUpdate() {
+	select {
+	case r.updateChan <- struct{}{}:
+	default:
+	}
+}
+
 // This function is the meat of the realserver struct. ALL CHANGES MADE HERE MUST BE MIRRORED IN pkg/bgp/worker.go
-func (r *realserver) periodic() error {
+// periodic reconfigures the node until ctx is done.
+func (r *realserver) periodic(ctx context.Context) {
 
-	// every 60s, check parity and apply
-	t := time.NewTicker(60 * time.Second)
+	// every parityInterval, check parity and apply. this is a backstop that
+	// catches drift, as updates from the watcher trigger a reconfigure once
+	// they settle.
+	t := time.NewTicker(r.parityInterval)
 	defer t.Stop()
 
-	checkTicker := time.NewTicker(100 * time.Millisecond)
-	defer checkTicker.Stop()
+	// pending is when the first update that has not been applied arrived,
+	// and backoff how long the retry of a failed reconfiguration waits, while
+	// one is scheduled. Updates do not cut a backoff short.
+	debounce := time.NewTimer(reconfigureDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+	var pending time.Time
+	var backoff time.Duration
 
-	forcedReconfigureInterval := 10 * 60 * time.Second
-	forceReconfigure := time.NewTicker(forcedReconfigureInterval)
+	forceReconfigure := time.NewTicker(r.forcedReconfigureInterval)
 	defer forceReconfigure.Stop()
 
+	drift := time.NewTicker(iptables.DriftInterval)
+	defer drift.Stop()
+
+	sysctls := time.NewTicker(system.SysctlInterval)
+	defer sysctls.Stop()
+
+	// maintenance moves an automatic drain on to its addresses
+	maintenance := time.NewTimer(r.drainDelay)
+	maintenance.Stop()
+	defer maintenance.Stop()
+
+	// local health is only evaluated with an evaluator
+	var healthC <-chan time.Time
+	if r.health != nil {
+		healthTicker := time.NewTicker(healthInterval)
+		defer healthTicker.Stop()
+		healthC = healthTicker.C
+	}
+
 	for {
 
 		select {
 		case <-forceReconfigure.C:
-			if r.forcedReconfigure {
+			r.Lock()
+			forced := r.forcedReconfigure
+			r.Unlock()
+			if forced {
 				start := time.Now()
-				if err, _ := r.configure(true); err != nil {
+				config, node := r.snapshot()
+				if err := r.apply(config, node, true); err != nil {
 					r.metrics.Reconfigure("error", time.Now().Sub(start))
 					r.logger.Errorf("unable to apply ipv4 configuration, %v", err)
 				}
 			}
+		case <-sysctls.C:
+			if r.ipvs != nil {
+				if err := r.ipvs.EnsureSysctls(); err != nil {
+					r.logger.Warnf("unable to verify ipvs sysctls. %v", err)
+				}
+			}
+			for _, device := range r.devices() {
+				if err := device.EnsureSysctls(); err != nil {
+					r.logger.Warnf("unable to verify the sysctls of %s. %v", device.Device(), err)
+				}
+			}
+		case <-healthC:
+			r.checkHealth()
+		case req := <-r.drainChan:
+			req.reply <- r.setDrained(req.state)
+		case <-maintenance.C:
+			if r.autoDrained && r.drained == drainRules {
+				r.logger.Info("draining for maintenance. removing the addresses of the VIPs")
+				r.drained = drainAll
+				config, node := r.snapshot()
+				if err := r.apply(config, node, false); err != nil {
+					r.logger.Errorf("unable to apply the drain. %v", err)
+				}
+			}
+		case <-drift.C:
+			if _, err := r.iptables.CheckDrift(); err != nil {
+				r.logger.Warnf("unable to check iptables rules for drift. %v", err)
+			}
 		case <-t.C:
-			// every 60 seconds, JFDI
+			// every parityInterval, JFDI
 
 			start := time.Now()
 			r.logger.Infof("reconfig triggered due to periodic parity check")
-			if err, _ := r.configure(false); err != nil {
+			config, node := r.snapshot()
+			if err := r.apply(config, node, false); err != nil {
 				r.metrics.Reconfigure("error", time.Now().Sub(start))
 				r.logger.Errorf("unable to apply ipv4 configuration, %v", err)
 				continue
 			}
 
-		case <-checkTicker.C:
+		case <-r.updateChan:
+			now := time.Now()
+			if pending.IsZero() {
+				pending = now
+			}
+			// a failed reconfiguration is retried after its backoff, which
+			// takes this update along
+			if backoff > 0 {
+				continue
+			}
+			wait := reconfigureDebounce
+			if remaining := pending.Add(reconfigureMaxWait).Sub(now); remaining < wait {
+				wait = remaining
+			}
+			debounce.Reset(wait)
+
+		case <-debounce.C:
 			start := time.Now()
+			pending = time.Time{}
+			retried := backoff
+			backoff = 0
 			// TODO: add metrics back in!
-			// TODO: this has the same bug as the director! we MUST lock and deepcopy
-			// all of the nodes + config to pass into r.configure() or else risk iterating
-			// over a thing that's been replaced!
 
 			// If there's nothing to do, there's nothing to do.
-			r.logger.Debugf("reconfig math lastReconfigure=%v lastInboundUpdate=%v subtr=%v cond=%v",
-				r.lastReconfigure,
-				r.lastInboundUpdate,
-				r.lastReconfigure.Sub(r.lastInboundUpdate),
-				r.lastReconfigure.Sub(r.lastInboundUpdate) > 0)
-			if r.lastReconfigure.Sub(r.lastInboundUpdate) > 0 {
+			if r.updatesApplied() {
 				// No noop metric here - we only noop if a non-impactful config change makes it through
 				r.logger.Debugf("no changes to configs since last reconfiguration completed")
 				continue
@@ -308,46 +886,138 @@ func (r *realserver) periodic() error {
 
 			r.metrics.QueueDepth(len(r.configChan))
 
-			if r.config == nil || r.node.Name == "" {
-				r.logger.Infof("configs %p, node name %s. skipping apply", r.config, r.node.Name)
+			// the config and node are copied, so that watches() can replace
+			// them while they are applied
+			config, node := r.snapshot()
+			if config == nil || node.Name == "" {
+				r.logger.Infof("configs %p, node name %s. skipping apply", config, node.Name)
 				r.metrics.Reconfigure("noop", time.Now().Sub(start))
 				continue
 			}
+			r.checkMaintenance(node, maintenance)
 
 			r.logger.Infof("reconfiguring")
-			err, _ := r.configure(false)
+			err := r.apply(config, node, false)
 			if err != nil {
-				r.logger.Errorf("error applying configuration in realserver. %v", err)
+				// retry with backoff, as the updates that were not applied
+				// may be the last for a while
+				backoff = retried * 2
+				if backoff < reconfigureDebounce {
+					backoff = reconfigureDebounce
+				} else if backoff > reconfigureMaxBackoff {
+					backoff = reconfigureMaxBackoff
+				}
+				r.logger.Errorf("error applying configuration in realserver. retrying in %v. %v", backoff, err)
 				r.metrics.Reconfigure("error", time.Now().Sub(start))
+				debounce.Reset(backoff)
 				continue
 			}
 
 			now := time.Now()
 			r.logger.Infof("reconfiguration completed successfully in %v", now.Sub(start))
+			r.Lock()
 			r.lastReconfigure = start
+			r.Unlock()
 
 			r.metrics.Reconfigure("complete", time.Now().Sub(start))
 
-		case <-r.ctx.Done():
-			return nil
-		case <-r.ctxWatch.Done():
-			r.doneChan <- struct{}{}
-			return nil
+		case <-ctx.Done():
+			return
 		}
 
 	}
 }
 
-func (r *realserver) configure(force bool) (error, int) {
+// updatesApplied returns true if the last reconfiguration started after the
+// last inbound update arrived.
+func (r *realserver) updatesApplied() bool {
+	r.Lock()
+	defer r.Unlock()
+	r.logger.Debugf("reconfig math lastReconfigure=%v lastInboundUpdate=%v", r.lastReconfigure, r.lastInboundUpdate)
+	return r.lastReconfigure.Sub(r.lastInboundUpdate) > 0
+}
+
+// checkHealth evaluates the local health of the node, and reconfigures once it
+// changes, withdrawing or restoring the VIPs.
+func (r *realserver) checkHealth() {
+	r.Lock()
+	node := r.node.Copy()
+	r.Unlock()
+	if node.Name == "" {
+		return
+	}
+
+	reason := ""
+	if err := r.health.Evaluate(r.ctx, node); err != nil {
+		reason = err.Error()
+	}
+	if reason == r.unhealthy {
+		return
+	}
+	if reason != "" {
+		r.logger.Errorf("node is unhealthy. withdrawing its VIPs. %s", reason)
+	} else {
+		r.logger.Infof("node is healthy again. restoring its VIPs")
+	}
+	r.unhealthy = reason
+	r.metrics.LocalHealth(reason == "")
+
+	r.Lock()
+	r.lastInboundUpdate = time.Now()
+	r.Unlock()
+	r.notifyUpdate()
+}
+
+// checkMaintenance drains the node once it is under maintenance, removing the
+// rules of the VIPs now and their addresses when maintenance fires after the
+// drain delay, and undrains it once the maintenance is over. Drains requested
+// through Drain are left alone.
+func (r *realserver) checkMaintenance(node types.Node, maintenance *time.Timer) {
+	reason := node.Maintenance(r.ignoreCordon, r.drainTaints)
+	switch {
+	case reason != "" && r.drained == drainNone:
+		r.logger.Infof("node is under maintenance. draining. removing the rules of the VIPs. %s", reason)
+		r.drained = drainRules
+		r.autoDrained = true
+		maintenance.Reset(r.drainDelay)
+	case reason == "" && r.autoDrained:
+		r.logger.Info("node is out of maintenance. undraining. restoring the VIPs")
+		r.drained = drainNone
+		r.autoDrained = false
+		maintenance.Stop()
+	}
+}
+
+// snapshot returns deep copies of the config and node, which watches()
+// replaces as updates arrive, for a reconfiguration to work from.
+func (r *realserver) snapshot() (*types.ClusterConfig, types.Node) {
+	r.Lock()
+	defer r.Unlock()
+	return r.config.Copy(), r.node.Copy()
+}
+
+// configure applies config to node, a snapshot of the config and node.
+func (r *realserver) configure(config *types.ClusterConfig, node types.Node, force bool) (error, int) {
+	config, vipConfig := r.withdraw(config)
+
+	// the dscp rules are left alone by the parity check, and only rewritten
+	// when they change
+	if config != nil && r.ipvs != nil {
+		if err := r.ipvs.SetDSCP(config); err != nil {
+			return err, 0
+		}
+	}
+
 	if force {
 		r.logger.Info("forced reconfigure, not performing parity check")
 	} else {
-		same, err := r.checkConfigParity()
+		same, err := r.checkConfigParity(config, vipConfig, node)
 		if err != nil {
 			r.logger.Errorf("parity check failed. %v", err)
 			return err, 0
 		} else if same {
 			r.logger.Debugf("configuration has parity")
+			r.recordParity()
 			return nil, 0
 		}
 	}
@@ -355,7 +1025,7 @@ func (r *realserver) configure(force bool) (error, int) {
 	removals := 0
 	r.logger.Debugf("setting addresses")
 	// add vip addresses to loopback
-	if err := r.setAddresses(); err != nil {
+	if err := r.setAddresses(vipConfig); err != nil {
 		return err, removals
 	}
 
@@ -371,7 +1041,7 @@ func (r *realserver) configure(force bool) (error, int) {
 	// generate desired iptables configurations
 	// generated, err := r.iptables.GenerateRules(r.config)
 	// TODO: rename to the singular form
-	generated, err := r.iptables.GenerateRulesForNodes(r.node, r.config, false)
+	generated, err := r.iptables.GenerateRulesForNodes(node, config, r.weighted)
 	if err != nil {
 		return err, removals
 	}
@@ -388,23 +1058,126 @@ func (r *realserver) configure(force bool) (error, int) {
 	err = r.iptables.Restore(merged)
 	if err != nil {
 		// write erroneous rule set to file to capture later
-		r.logger.Errorf("error applying rules. writing erroneous rule change to /tmp/realserver-ruleset-err for debugging")
-		writeErr := ioutil.WriteFile("/tmp/realserver-ruleset-err", createErrorLog(err, iptables.BytesFromRules(merged)), 0644)
+		fields := map[string]string{"node": r.nodeName, "chains": fmt.Sprint(len(generated)), "removals": fmt.Sprint(removals)}
+		filename, writeErr := r.capture.Write(err, fields, r.iptables.Table(), existing, merged)
 		if writeErr != nil {
-			r.logger.Errorf("error writing to file; logging rules: %s", string(iptables.BytesFromRules(merged)))
+			r.logger.Errorf("error applying rules. error writing them for debugging. %v; logging rules: %s", writeErr, string(iptables.BytesFromRules(r.iptables.Table(), merged)))
+		} else if filename != "" {
+			r.logger.Errorf("error applying rules. wrote erroneous rule change to %s for debugging", filename)
 		}
 
 		return err, removals
 	}
+
+	r.logger.Debugf("applying ip6tables rules")
+	rules6, err := r.setIPTables6(config, node)
+	if err != nil {
+		return err, removals
+	}
+
+	loopback, tunnel := r.vips(vipConfig)
+	rules := rules6
+	for _, ruleSet := range generated {
+		rules += len(ruleSet.Rules)
+	}
+	r.recordApplied(len(loopback)+len(tunnel)+len(r.vips6(vipConfig)), rules)
 	return nil, removals
 }
 
-func (r *realserver) checkConfigParity() (bool, error) {
+// setIPTables6 applies the ip6tables rules of the ipv6 VIPs in Config6, and
+// returns how many were generated. Once there are none, the chain is flushed
+// of the rules applied before.
+func (r *realserver) setIPTables6(config *types.ClusterConfig, node types.Node) (int, error) {
+	if len(config.Config6) == 0 {
+		if !r.ipv6Rules {
+			return 0, nil
+		}
+		if err := r.iptables.Flush6(); err != nil {
+			return 0, fmt.Errorf("unable to flush ip6tables rules. %v", err)
+		}
+		r.ipv6Rules = false
+		return 0, nil
+	}
+
+	existing, err := r.iptables.Save6()
+	if err != nil {
+		return 0, err
+	}
+	generated, err := r.iptables.GenerateRulesForNodes6(node, config, r.weighted)
+	if err != nil {
+		return 0, err
+	}
+	merged, _, err := r.iptables.Merge6(generated, existing)
+	if err != nil {
+		return 0, err
+	}
+	if err := r.iptables.Restore6(merged); err != nil {
+		return 0, fmt.Errorf("unable to apply ip6tables rules. %v", err)
+	}
+	r.ipv6Rules = true
+
+	rules := 0
+	for _, ruleSet := range generated {
+		rules += len(ruleSet.Rules)
+	}
+	return rules, nil
+}
+
+// checkConfigParity6 reports whether the ip6tables base chain holds the rules
+// generated for the ipv6 VIPs.
+func (r *realserver) checkConfigParity6(config *types.ClusterConfig, node types.Node) (bool, error) {
+	if len(config.Config6) == 0 {
+		return !r.ipv6Rules, nil
+	}
+
+	existing, err := r.iptables.Save6()
+	if err != nil {
+		return false, err
+	}
+	existingRules := iptables.VIPChainRules(r.iptables.BaseChain(), existing)
+
+	generated, err := r.iptables.GenerateRulesForNodes6(node, config, r.weighted)
+	if err != nil {
+		return false, err
+	}
+	generatedRules := iptables.VIPChainRules(r.iptables.BaseChain(), generated)
+	if len(existingRules) == 0 && len(generatedRules) == 0 {
+		return true, nil
+	}
+	return reflect.DeepEqual(existingRules, generatedRules), nil
+}
+
+// withdraw returns the config whose rules are applied, and the config whose
+// VIP addresses are bound. An unhealthy node takes none of the VIPs, so that
+// their addresses and rules are removed. A draining node removes the rules
+// first, and the addresses once its connections have drained. A node that is
+// not ready withholds the addresses.
+func (r *realserver) withdraw(config *types.ClusterConfig) (*types.ClusterConfig, *types.ClusterConfig) {
+	if config == nil {
+		return nil, nil
+	}
+	empty := *config
+	empty.Config = map[types.ServiceIP]types.PortMap{}
+	empty.Config6 = map[types.ServiceIP]types.PortMap{}
+
+	rules, vips := config, config
+	if r.unhealthy != "" || r.drained != drainNone {
+		rules = &empty
+	}
+	if r.unhealthy != "" || r.drained == drainAll || !r.accepting {
+		vips = &empty
+	}
+	return rules, vips
+}
+
+// checkConfigParity checks the rules of config and the VIP addresses of
+// vipConfig against those applied to the node.
+func (r *realserver) checkConfigParity(config, vipConfig *types.ClusterConfig, node types.Node) (bool, error) {
 
 	// =======================================================
 	// == Perform check whether we're ready to start working
 	// =======================================================
-	if r.config == nil {
+	if config == nil {
 		return true, nil
 	}
 
@@ -416,13 +1189,21 @@ func (r *realserver) checkConfigParity() (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	addresses6, err := r.ipLoopback.Get6()
+	if err != nil {
+		return false, err
+	}
+	tunnelAddresses := []string{}
+	if r.ipTunnel != nil {
+		tunnelAddresses, err = r.ipTunnel.Get()
+		if err != nil {
+			return false, err
+		}
+	}
 
 	// get desired set of VIP addresses
-	vips := []string{}
-	for ip, _ := range r.config.Config {
-		vips = append(vips, string(ip))
-	}
-	sort.Sort(sort.StringSlice(vips))
+	vips, tunnelVIPs := r.vips(vipConfig)
+	vips6 := r.vips6(vipConfig)
 
 	// =======================================================
 	// == Perform check on iptables configuration
@@ -432,51 +1213,113 @@ func (r *realserver) checkConfigParity() (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	existingRules := []string{}
-	if k, found := existing[r.iptables.BaseChain()]; found { // XXX table name must be configurable
-		existingRules = k.Rules
-		sort.Sort(sort.StringSlice(existingRules))
+	existingRules := iptables.VIPChainRules(r.iptables.BaseChain(), existing)
+
+	// generate desired iptables configurations. the weighted rules carry the
+	// node's share of each service, so they are generated for the node.
+	generated, err := r.iptables.GenerateRules(config)
+	if r.weighted {
+		generated, err = r.iptables.GenerateRulesForNodes(node, config, true)
+	}
+	if err != nil {
+		return false, err
 	}
+	generatedRules := iptables.VIPChainRules(r.iptables.BaseChain(), generated)
 
-	// generate desired iptables configurations
-	generated, err := r.iptables.GenerateRules(r.config)
+	same6, err := r.checkConfigParity6(config, node)
 	if err != nil {
 		return false, err
 	}
-	generatedRules := generated[r.iptables.BaseChain()].Rules
-	sort.Sort(sort.StringSlice(generatedRules))
 
 	// compare and return
-	return (reflect.DeepEqual(vips, addresses) &&
+	return (same6 &&
+		reflect.DeepEqual(vips, addresses) &&
+		reflect.DeepEqual(vips6, addresses6) &&
+		reflect.DeepEqual(tunnelVIPs, tunnelAddresses) &&
 		reflect.DeepEqual(existingRules, generatedRules)), nil
 
 }
 
-func (r *realserver) setAddresses() error {
-	// pull existing
-	configured, err := r.ipLoopback.Get()
-	if err != nil {
+// vips returns the sorted VIP addresses to bind on loopback, and those to bind
+// on the tunnel device because they are forwarded in tunnel mode. Outside of
+// tunnel mode the latter are not bound at all.
+func (r *realserver) vips(config *types.ClusterConfig) ([]string, []string) {
+	loopback := []string{}
+	tunnel := []string{}
+	for ip := range config.Config {
+		if config.Tunneled(ip) {
+			if r.ipTunnel != nil {
+				tunnel = append(tunnel, string(ip))
+			}
+		} else {
+			loopback = append(loopback, string(ip))
+		}
+	}
+	sort.Sort(sort.StringSlice(loopback))
+	sort.Sort(sort.StringSlice(tunnel))
+	return loopback, tunnel
+}
+
+// vips6 returns the sorted ipv6 VIP addresses to bind on loopback, in the form
+// the ip command lists them in, so that they compare with those bound. The
+// IPIP tunnel device only carries ipv4, so ipv6 VIPs forwarded in tunnel mode
+// are not bound at all.
+func (r *realserver) vips6(config *types.ClusterConfig) []string {
+	loopback := []string{}
+	for ip := range config.Config6 {
+		if config.Tunneled(ip) {
+			continue
+		}
+		if parsed := net.ParseIP(string(ip)); parsed != nil {
+			loopback = append(loopback, parsed.String())
+		} else {
+			loopback = append(loopback, string(ip))
+		}
+	}
+	sort.Sort(sort.StringSlice(loopback))
+	return loopback
+}
+
+func (r *realserver) setAddresses(config *types.ClusterConfig) error {
+	loopback, tunnel := r.vips(config)
+	if err := setDeviceAddresses(r.ipLoopback, loopback, false, r.logger); err != nil {
 		return err
 	}
+	if err := setDeviceAddresses(r.ipLoopback, r.vips6(config), true, r.logger); err != nil {
+		return err
+	}
+	if r.ipTunnel == nil {
+		return nil
+	}
+	return setDeviceAddresses(r.ipTunnel, tunnel, false, r.logger)
+}
 
-	// get desired set VIP addresses
-	desired := []string{}
-	for ip, _ := range r.config.Config {
-		desired = append(desired, string(ip))
+// setDeviceAddresses brings the VIP addresses of one family bound on a device
+// in line with desired.
+func setDeviceAddresses(ip system.IP, desired []string, ipv6 bool, logger logrus.FieldLogger) error {
+	get, add, del := ip.Get, ip.Add, ip.Del
+	if ipv6 {
+		get, add, del = ip.Get6, ip.Add6, ip.Del6
 	}
 
-	removals, additions := r.ipLoopback.Compare(configured, desired)
+	// pull existing
+	configured, err := get()
+	if err != nil {
+		return err
+	}
+
+	removals, additions := ip.Compare(configured, desired)
 
 	for _, addr := range removals {
-		r.logger.WithFields(logrus.Fields{"device": r.ipLoopback.Device(), "addr": addr, "action": "deleting"}).Info()
-		err := r.ipLoopback.Del(addr)
+		logger.WithFields(logrus.Fields{"device": ip.Device(), "addr": addr, "action": "deleting"}).Info()
+		err := del(addr)
 		if err != nil {
 			return err
 		}
 	}
 	for _, addr := range additions {
-		r.logger.WithFields(logrus.Fields{"device": r.ipLoopback.Device(), "addr": addr, "action": "adding"}).Info()
-		err := r.ipLoopback.Add(addr)
+		logger.WithFields(logrus.Fields{"device": ip.Device(), "addr": addr, "action": "adding"}).Info()
+		err := add(addr)
 		if err != nil {
 			return err
 		}
@@ -484,12 +1327,3 @@ func (r *realserver) setAddresses() error {
 
 	return nil
 }
-
-func createErrorLog(err error, rules []byte) []byte {
-	if err == nil {
-		return rules
-	}
-
-	errBytes := []byte(fmt.Sprintf("ipvs restore error: %v\n", err.Error()))
-	return append(errBytes, rules...)
-}
@@ -0,0 +1,545 @@
+package realserver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/iptables"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+	"k8s.io/api/core/v1"
+)
+
+// fakeIPTables keeps the rules restored to it in memory. The rules generated
+// for a config are a jump per VIP, so that the VIPs with rules can be read
+// back from them.
+type fakeIPTables struct {
+	sync.Mutex
+	rules    map[string]*iptables.RuleSet
+	restores int
+	fail     error
+	ops      *opLog
+}
+
+func (f *fakeIPTables) generate(config *types.ClusterConfig) map[string]*iptables.RuleSet {
+	rules := []string{}
+	for vip := range config.Config {
+		rules = append(rules, fmt.Sprintf("-A RAVEL -d %s/32 -j RAVEL-VIP", vip))
+	}
+	sort.Strings(rules)
+	return map[string]*iptables.RuleSet{"RAVEL": {ChainRule: ":RAVEL - [0:0]", Rules: rules}}
+}
+
+func (f *fakeIPTables) Save() (map[string]*iptables.RuleSet, error) {
+	f.Lock()
+	defer f.Unlock()
+	out := map[string]*iptables.RuleSet{}
+	for chain, set := range f.rules {
+		out[chain] = &iptables.RuleSet{ChainRule: set.ChainRule, Rules: append([]string{}, set.Rules...)}
+	}
+	return out, nil
+}
+
+func (f *fakeIPTables) Restore(rules map[string]*iptables.RuleSet) error {
+	f.Lock()
+	defer f.Unlock()
+	f.restores++
+	if f.fail != nil {
+		return f.fail
+	}
+	f.rules = rules
+	f.ops.add(fmt.Sprintf("restore %d", len(rules["RAVEL"].Rules)))
+	return nil
+}
+
+func (f *fakeIPTables) Flush() error {
+	f.Lock()
+	defer f.Unlock()
+	f.rules = nil
+	return nil
+}
+
+func (f *fakeIPTables) GenerateRules(config *types.ClusterConfig) (map[string]*iptables.RuleSet, error) {
+	return f.generate(config), nil
+}
+
+func (f *fakeIPTables) GenerateRulesForNodes(node types.Node, config *types.ClusterConfig, useWeightedService bool) (map[string]*iptables.RuleSet, error) {
+	return f.generate(config), nil
+}
+
+func (f *fakeIPTables) Merge(subset, wholeset map[string]*iptables.RuleSet) (map[string]*iptables.RuleSet, int, error) {
+	return subset, 0, nil
+}
+
+func (f *fakeIPTables) Save6() (map[string]*iptables.RuleSet, error) { return nil, nil }
+func (f *fakeIPTables) Restore6(map[string]*iptables.RuleSet) error  { return nil }
+func (f *fakeIPTables) Flush6() error                                { return nil }
+func (f *fakeIPTables) BaseChain() string                            { return "RAVEL" }
+func (f *fakeIPTables) Table() string                                { return "nat" }
+func (f *fakeIPTables) CheckDrift() (int, error)                     { return 0, nil }
+func (f *fakeIPTables) GenerateRulesForNodes6(node types.Node, config *types.ClusterConfig, useWeightedService bool) (map[string]*iptables.RuleSet, error) {
+	return nil, nil
+}
+func (f *fakeIPTables) Merge6(subset, wholeset map[string]*iptables.RuleSet) (map[string]*iptables.RuleSet, int, error) {
+	return subset, 0, nil
+}
+
+// vips returns the VIPs that the restored rules jump for.
+func (f *fakeIPTables) vips() int {
+	f.Lock()
+	defer f.Unlock()
+	if f.rules == nil || f.rules["RAVEL"] == nil {
+		return 0
+	}
+	return len(f.rules["RAVEL"].Rules)
+}
+
+func (f *fakeIPTables) restoreCount() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.restores
+}
+
+// fakeIP keeps the addresses bound on a device in memory.
+type fakeIP struct {
+	sync.Mutex
+	addrs map[string]bool
+	ops   *opLog
+}
+
+func (f *fakeIP) Get() ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+	out := []string{}
+	for addr := range f.addrs {
+		out = append(out, addr)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (f *fakeIP) Add(addr string) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.addrs == nil {
+		f.addrs = map[string]bool{}
+	}
+	f.addrs[addr] = true
+	f.ops.add("add " + addr)
+	return nil
+}
+
+func (f *fakeIP) Del(addr string) error {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.addrs, addr)
+	f.ops.add("del " + addr)
+	return nil
+}
+
+func (f *fakeIP) Compare(have, want []string) ([]string, []string) {
+	removals, additions := []string{}, []string{}
+	for _, addr := range have {
+		if !contains(want, addr) {
+			removals = append(removals, addr)
+		}
+	}
+	for _, addr := range want {
+		if !contains(have, addr) {
+			additions = append(additions, addr)
+		}
+	}
+	return removals, additions
+}
+
+func (f *fakeIP) Teardown(context.Context) error {
+	f.Lock()
+	defer f.Unlock()
+	f.addrs = nil
+	return nil
+}
+
+func (f *fakeIP) SetARP() error                         { return nil }
+func (f *fakeIP) AdvertiseMacAddress(addr string) error { return nil }
+func (f *fakeIP) Add6(addr string) error                { return nil }
+func (f *fakeIP) Del6(addr string) error                { return nil }
+func (f *fakeIP) Get6() ([]string, error)               { return []string{}, nil }
+func (f *fakeIP) Device() string                        { return "lo" }
+func (f *fakeIP) SetRPFilter() error                    { return nil }
+func (f *fakeIP) SetTunnel() error                      { return nil }
+func (f *fakeIP) EnsureSysctls() error                  { return nil }
+func (f *fakeIP) RestoreSysctls() error                 { return nil }
+
+func (f *fakeIP) bound() []string {
+	addrs, _ := f.Get()
+	return addrs
+}
+
+// fakeWatcher hands the realserver's channels to the test, and records the
+// context of the last run that registered them.
+type fakeWatcher struct {
+	sync.Mutex
+	ctx context.Context
+}
+
+func (f *fakeWatcher) Services() map[string]*v1.Service { return nil }
+func (f *fakeWatcher) Nodes(ctx context.Context, watcherID string, nodeChan chan types.NodesList) {
+	f.Lock()
+	f.ctx = ctx
+	f.Unlock()
+}
+func (f *fakeWatcher) ConfigMap(ctx context.Context, watcherID string, cfgChan chan *types.ClusterConfig) {
+}
+func (f *fakeWatcher) Secrets(ctx context.Context, watcherID string, secretChan chan map[string]*v1.Secret) {
+}
+
+// opLog records the operations of the fakes in order.
+type opLog struct {
+	sync.Mutex
+	ops []string
+}
+
+func (o *opLog) add(op string) {
+	o.Lock()
+	o.ops = append(o.ops, op)
+	o.Unlock()
+}
+
+func (o *opLog) list() []string {
+	o.Lock()
+	defer o.Unlock()
+	return append([]string{}, o.ops...)
+}
+
+// healthFunc evaluates health with a function.
+type healthFunc func(types.Node) error
+
+func (h healthFunc) Evaluate(_ context.Context, node types.Node) error {
+	return h(node)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+const testVIP = "10.54.213.253"
+
+func testConfig() *types.ClusterConfig {
+	return &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			testVIP: {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+		},
+	}
+}
+
+func testNode() types.Node {
+	return types.Node{Name: "node-a", Ready: true, Addresses: []string{"10.131.153.76"}}
+}
+
+// newTestRealServer returns a realserver with fakes for its devices, rules and
+// watcher.
+func newTestRealServer(t *testing.T, health HealthEvaluator) (*realserver, *fakeIP, *fakeIPTables, *opLog) {
+	ops := &opLog{}
+	ip := &fakeIP{ops: ops}
+	ipt := &fakeIPTables{ops: ops}
+	logger := logrus.New()
+	logger.Level = logrus.ErrorLevel
+	r, err := NewRealServer(context.Background(), Options{
+		NodeName:                  "node-a",
+		ConfigKey:                 "test",
+		Watcher:                   &fakeWatcher{},
+		IPLoopback:                ip,
+		IPTables:                  ipt,
+		ForcedReconfigureInterval: time.Hour,
+		ParityInterval:            time.Hour,
+		DrainDelay:                50 * time.Millisecond,
+		Health:                    health,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.(*realserver), ip, ipt, ops
+}
+
+func TestWithdraw(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		unhealthy string
+		drained   drainState
+		accepting bool
+		rules     bool
+		vips      bool
+	}{
+		{name: "ready", accepting: true, rules: true, vips: true},
+		{name: "not yet accepting", rules: true},
+		{name: "draining rules", drained: drainRules, accepting: true, vips: true},
+		{name: "drained", drained: drainAll, accepting: true},
+		{name: "unhealthy", unhealthy: "node node-a is not ready", accepting: true},
+		{name: "unhealthy while draining", unhealthy: "node node-a is not ready", drained: drainRules, accepting: true},
+	} {
+		r := &realserver{unhealthy: tc.unhealthy, drained: tc.drained, accepting: tc.accepting}
+		rules, vips := r.withdraw(testConfig())
+		if (len(rules.Config) > 0) != tc.rules || (len(vips.Config) > 0) != tc.vips {
+			t.Fatalf("%s: expected rules=%v vips=%v. saw %d rules and %d vips", tc.name, tc.rules, tc.vips, len(rules.Config), len(vips.Config))
+		}
+	}
+}
+
+func TestApplyTransitions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// setup moves a ready realserver to the state under test
+		setup func(r *realserver)
+		rules int
+		vips  []string
+	}{
+		{name: "ready", setup: func(r *realserver) {}, rules: 1, vips: []string{testVIP}},
+		{name: "draining rules", setup: func(r *realserver) { r.drained = drainRules }, rules: 0, vips: []string{testVIP}},
+		{name: "drained", setup: func(r *realserver) { r.drained = drainAll }, rules: 0, vips: []string{}},
+		{name: "unhealthy", setup: func(r *realserver) { r.unhealthy = "node node-a is not ready" }, rules: 0, vips: []string{}},
+		{name: "maintenance", setup: func(r *realserver) {
+			node := testNode()
+			node.Unschedulable = true
+			maintenance := time.NewTimer(time.Hour)
+			defer maintenance.Stop()
+			r.checkMaintenance(node, maintenance)
+		}, rules: 0, vips: []string{testVIP}},
+		{name: "undrained", setup: func(r *realserver) { r.drained = drainAll; r.drained = drainNone }, rules: 1, vips: []string{testVIP}},
+	} {
+		r, ip, ipt, _ := newTestRealServer(t, nil)
+		if err := r.apply(testConfig(), testNode(), false); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		tc.setup(r)
+		if err := r.apply(testConfig(), testNode(), false); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if ipt.vips() != tc.rules || !reflect.DeepEqual(ip.bound(), tc.vips) {
+			t.Fatalf("%s: expected %d VIPs with rules and %v bound. saw %d and %v", tc.name, tc.rules, tc.vips, ipt.vips(), ip.bound())
+		}
+	}
+}
+
+func TestBecomeReady(t *testing.T) {
+	r, ip, ipt, ops := newTestRealServer(t, nil)
+
+	// nothing is applied, and the realserver is not ready, without a config
+	if err := r.apply(nil, testNode(), false); err != nil || r.Ready() == nil {
+		t.Fatalf("expected a realserver without config to not be ready. saw %v", err)
+	}
+
+	// the rules are in place before the addresses are bound
+	if err := r.apply(testConfig(), testNode(), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Ready(); err != nil {
+		t.Fatalf("expected the realserver to be ready. saw %v", err)
+	}
+	if list := ops.list(); len(list) < 2 || list[0] != "restore 1" || list[1] != "add "+testVIP {
+		t.Fatalf("expected the rules restored before %s was added. saw %v", testVIP, list)
+	}
+
+	// a first apply that fails withholds the addresses and readiness
+	r, ip, ipt, _ = newTestRealServer(t, nil)
+	ipt.fail = fmt.Errorf("iptables-restore failed")
+	if err := r.apply(testConfig(), testNode(), false); err == nil {
+		t.Fatal("expected the apply to fail")
+	}
+	if err := r.Ready(); err == nil || len(ip.bound()) != 0 {
+		t.Fatalf("expected the realserver not to be ready, with no VIPs bound. saw %v and %v", err, ip.bound())
+	}
+	if status := r.Status(); status.LastError == "" || status.Parity {
+		t.Fatalf("expected the failure in the status. saw %+v", status)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	var healthy error
+	r, ip, ipt, _ := newTestRealServer(t, healthFunc(func(types.Node) error { return healthy }))
+	r.node = testNode()
+	if err := r.apply(testConfig(), testNode(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failing evaluation withdraws both the rules and the addresses
+	healthy = fmt.Errorf("check failed")
+	r.checkHealth()
+	if r.unhealthy == "" || len(r.updateChan) != 1 {
+		t.Fatalf("expected the node to be unhealthy and an update. saw %q", r.unhealthy)
+	}
+	<-r.updateChan
+	if err := r.apply(testConfig(), testNode(), false); err != nil {
+		t.Fatal(err)
+	}
+	if ipt.vips() != 0 || len(ip.bound()) != 0 {
+		t.Fatalf("expected the VIPs withdrawn. saw %d rules and %v", ipt.vips(), ip.bound())
+	}
+
+	// an unchanged evaluation is not an update
+	r.checkHealth()
+	if len(r.updateChan) != 0 {
+		t.Fatal("expected no update while the health is unchanged")
+	}
+
+	// and a passing one restores them
+	healthy = nil
+	r.checkHealth()
+	if err := r.apply(testConfig(), testNode(), false); err != nil {
+		t.Fatal(err)
+	}
+	if ipt.vips() != 1 || !reflect.DeepEqual(ip.bound(), []string{testVIP}) {
+		t.Fatalf("expected the VIPs restored. saw %d rules and %v", ipt.vips(), ip.bound())
+	}
+}
+
+// startTestRealServer starts a realserver and brings it to readiness.
+func startTestRealServer(t *testing.T, r *realserver) {
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r.nodeChan <- types.NodesList{testNode()}
+	r.configChan <- testConfig()
+	waitFor(t, "readiness", func() bool { return r.Ready() == nil })
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDrainStages(t *testing.T) {
+	r, ip, ipt, _ := newTestRealServer(t, nil)
+	startTestRealServer(t, r)
+	defer r.Stop()
+
+	// the rules go first, and the addresses once the drain delay has passed
+	done := make(chan error)
+	go func() { done <- r.Drain() }()
+	waitFor(t, "the rules to be removed", func() bool { return ipt.vips() == 0 })
+	if !reflect.DeepEqual(ip.bound(), []string{testVIP}) {
+		t.Fatalf("expected the addresses to stay bound during the drain delay. saw %v", ip.bound())
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(ip.bound()) != 0 {
+		t.Fatalf("expected the addresses removed after the drain delay. saw %v", ip.bound())
+	}
+
+	if err := r.Undrain(); err != nil {
+		t.Fatal(err)
+	}
+	if ipt.vips() != 1 || !reflect.DeepEqual(ip.bound(), []string{testVIP}) {
+		t.Fatalf("expected the VIPs restored. saw %d rules and %v", ipt.vips(), ip.bound())
+	}
+
+	// an undrain during the drain delay cancels the drain
+	go func() { done <- r.Drain() }()
+	waitFor(t, "the rules to be removed", func() bool { return ipt.vips() == 0 })
+	if err := r.Undrain(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err == nil {
+		t.Fatal("expected the drain to be cancelled")
+	}
+	if !reflect.DeepEqual(ip.bound(), []string{testVIP}) {
+		t.Fatalf("expected the addresses to stay bound. saw %v", ip.bound())
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	r, _, _, _ := newTestRealServer(t, nil)
+	watcher := r.watcher.(*fakeWatcher)
+	if err := r.Drain(); err == nil {
+		t.Fatal("expected a drain of a realserver that was never started to fail")
+	}
+
+	for run := 0; run < 2; run++ {
+		startTestRealServer(t, r)
+		if err := r.Start(); err != nil {
+			t.Fatalf("expected Start of a started realserver to be a no-op. saw %v", err)
+		}
+		if !r.Status().Running {
+			t.Fatal("expected the realserver to be running")
+		}
+		watcher.Lock()
+		ctx := watcher.ctx
+		watcher.Unlock()
+
+		// Stop ends the goroutines and the watches of the run
+		if err := r.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-ctx.Done():
+		default:
+			t.Fatal("expected the watches of the run to end")
+		}
+		done := make(chan struct{})
+		go func() {
+			r.running.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("expected the goroutines of the run to end")
+		}
+		if r.Status().Running || r.Ready() == nil {
+			t.Fatal("expected a stopped realserver to be neither running nor ready")
+		}
+		if err := r.Stop(); err != nil {
+			t.Fatalf("expected Stop of a stopped realserver to be a no-op. saw %v", err)
+		}
+	}
+}
+
+func TestApplyBackoff(t *testing.T) {
+	r, _, ipt, _ := newTestRealServer(t, nil)
+	startTestRealServer(t, r)
+	defer r.Stop()
+
+	// a failing apply is retried after 200ms, then 400ms, then 800ms
+	ipt.Lock()
+	ipt.fail = fmt.Errorf("iptables-restore failed")
+	ipt.Unlock()
+	config := testConfig()
+	config.Config["10.54.213.254"] = config.Config[testVIP]
+	r.configChan <- config
+	restores := ipt.restoreCount()
+	waitFor(t, "the apply to fail", func() bool { return ipt.restoreCount() > restores })
+	restores = ipt.restoreCount()
+
+	// updates that arrive in the meantime neither cut the backoff short nor
+	// hold the retries off
+	deadline := time.Now().Add(1100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		r.notifyUpdate()
+		time.Sleep(20 * time.Millisecond)
+	}
+	if retries := ipt.restoreCount() - restores; retries < 2 || retries > 3 {
+		t.Fatalf("expected 2 retries after 200ms and 600ms within 1.1s. saw %d", retries)
+	}
+
+	// once the apply succeeds, updates are applied after the debounce again
+	ipt.Lock()
+	ipt.fail = nil
+	ipt.Unlock()
+	waitFor(t, "the retry to succeed", func() bool { return ipt.vips() == 2 })
+}
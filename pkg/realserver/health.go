@@ -0,0 +1,67 @@
+package realserver
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+)
+
+// healthInterval is how often the realserver evaluates its local health.
+const healthInterval = 5 * time.Second
+
+// HealthEvaluator judges whether this node is fit to take the traffic of its
+// VIPs. A realserver whose node is unhealthy withdraws its VIPs and rules, so
+// that DSR traffic is not accepted into a sick node, and restores them once
+// the node is healthy again.
+type HealthEvaluator interface {
+	// Evaluate returns an error naming the failure if node is unhealthy.
+	Evaluate(ctx context.Context, node types.Node) error
+}
+
+// NodeReady fails while kubelet reports the node NotReady. Directors stop
+// sending to a NotReady node on their own, but the node keeps accepting the
+// traffic already on its way until it withdraws.
+type NodeReady struct{}
+
+// Evaluate documented in HealthEvaluator interface
+func (NodeReady) Evaluate(_ context.Context, node types.Node) error {
+	if !node.Ready {
+		return fmt.Errorf("node %s is not ready", node.Name)
+	}
+	return nil
+}
+
+// CommandCheck is a critical local check, a shell command that fails the
+// node when it exits non-zero or runs longer than Timeout.
+type CommandCheck struct {
+	Command string
+	Timeout time.Duration
+}
+
+// Evaluate documented in HealthEvaluator interface
+func (c CommandCheck) Evaluate(ctx context.Context, _ types.Node) error {
+	ctx, cxl := context.WithTimeout(ctx, c.Timeout)
+	defer cxl()
+	out, err := exec.CommandContext(ctx, "sh", "-c", c.Command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("check %q failed. %v %s", c.Command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// HealthEvaluators fails the node when any one of them fails it.
+type HealthEvaluators []HealthEvaluator
+
+// Evaluate documented in HealthEvaluator interface
+func (h HealthEvaluators) Evaluate(ctx context.Context, node types.Node) error {
+	for _, evaluator := range h {
+		if err := evaluator.Evaluate(ctx, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
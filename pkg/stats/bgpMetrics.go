@@ -0,0 +1,123 @@
+package stats
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BGPSession is the state of a BGP session, as reported to BGPSessionMetrics.
+type BGPSession struct {
+	Peer       string
+	State      string
+	Advertised int
+}
+
+// sessionEstablished is the session state whose loss counts as a flap.
+const sessionEstablished = "established"
+
+// BGPSessionMetrics exposes the state of the BGP worker's sessions, so that
+// sessions stuck in Active or flapping can be alerted on.
+type BGPSessionMetrics struct {
+	sync.Mutex
+
+	kind    string
+	secZone string
+	states  []string
+
+	// last is the state of each peer at the previous report
+	last map[string]string
+
+	sessionState *prometheus.GaugeVec
+	flaps        *prometheus.CounterVec
+	advertised   *prometheus.GaugeVec
+}
+
+// Sessions records the state of every session. Peers that are no longer
+// reported are removed from the metrics.
+// gauge bgp_session_state
+// counter bgp_session_flaps
+// gauge bgp_advertised_prefixes
+func (m *BGPSessionMetrics) Sessions(sessions []BGPSession) {
+	m.Lock()
+	defer m.Unlock()
+
+	current := map[string]string{}
+	for _, s := range sessions {
+		current[s.Peer] = s.State
+		for _, state := range m.states {
+			value := 0.0
+			if state == s.State {
+				value = 1
+			}
+			m.sessionState.With(m.labels(s.Peer, "state", state)).Set(value)
+		}
+		m.advertised.With(m.labels(s.Peer)).Set(float64(s.Advertised))
+
+		flaps := m.flaps.With(m.labels(s.Peer))
+		if m.last[s.Peer] == sessionEstablished && s.State != sessionEstablished {
+			flaps.Add(1)
+		}
+	}
+
+	for peer := range m.last {
+		if _, ok := current[peer]; ok {
+			continue
+		}
+		for _, state := range m.states {
+			m.sessionState.Delete(m.labels(peer, "state", state))
+		}
+		m.advertised.Delete(m.labels(peer))
+		m.flaps.Delete(m.labels(peer))
+	}
+	m.last = current
+}
+
+// labels returns the labels of a peer's series, followed by the extra key
+// value pairs in kv.
+func (m *BGPSessionMetrics) labels(peer string, kv ...string) prometheus.Labels {
+	l := prometheus.Labels{"lb": m.kind, "seczone": m.secZone, "peer": peer}
+	for i := 0; i+1 < len(kv); i += 2 {
+		l[kv[i]] = kv[i+1]
+	}
+	return l
+}
+
+// NewBGPSessionMetrics registers the session metrics. states are the session
+// states that the state gauge is reported for.
+func NewBGPSessionMetrics(kind, secZone string, states []string) *BGPSessionMetrics {
+	peerLabels := []string{"lb", "seczone", "peer"}
+
+	// gauge bgp_session_state
+	session_state := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "bgp_session_state",
+		Help: "is a gauge set to 1 for the current state of each bgp session, and 0 for every other state",
+	}, append(peerLabels, "state"))
+
+	// counter bgp_session_flaps
+	session_flaps := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "bgp_session_flaps",
+		Help: "is a count of the times a bgp session was seen to leave the established state",
+	}, peerLabels)
+
+	// gauge bgp_advertised_prefixes
+	advertised_prefixes := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "bgp_advertised_prefixes",
+		Help: "is a gauge of the number of prefixes advertised to each established bgp peer",
+	}, peerLabels)
+
+	prometheus.MustRegister(session_state)
+	prometheus.MustRegister(session_flaps)
+	prometheus.MustRegister(advertised_prefixes)
+
+	return &BGPSessionMetrics{
+		kind:    kind,
+		secZone: secZone,
+		states:  states,
+		last:    map[string]string{},
+
+		sessionState: session_state,
+		flaps:        session_flaps,
+		advertised:   advertised_prefixes,
+	}
+}
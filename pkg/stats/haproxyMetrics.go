@@ -0,0 +1,71 @@
+package stats
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HAProxyMetrics exposes the supervision of the bgp worker's haproxy
+// instances, so that an instance that keeps crashing, or that has been given
+// up on, can be alerted on.
+type HAProxyMetrics struct {
+	kind    string
+	secZone string
+
+	restarts *prometheus.CounterVec
+	failed   *prometheus.GaugeVec
+}
+
+// Restart counts a restart of the instance serving vip after it failed.
+// counter haproxy_restart_count
+func (m *HAProxyMetrics) Restart(vip string) {
+	m.restarts.With(m.labels(vip)).Add(1)
+}
+
+// Failed records whether the instance serving vip has failed too many times
+// in a row to be restarted again.
+// gauge haproxy_instance_failed
+func (m *HAProxyMetrics) Failed(vip string, failed bool) {
+	value := 0.0
+	if failed {
+		value = 1
+	}
+	m.failed.With(m.labels(vip)).Set(value)
+}
+
+// Remove removes the series of an instance that is no longer configured.
+func (m *HAProxyMetrics) Remove(vip string) {
+	m.restarts.Delete(m.labels(vip))
+	m.failed.Delete(m.labels(vip))
+}
+
+func (m *HAProxyMetrics) labels(vip string) prometheus.Labels {
+	return prometheus.Labels{"lb": m.kind, "seczone": m.secZone, "vip": vip}
+}
+
+// NewHAProxyMetrics registers the haproxy supervision metrics.
+func NewHAProxyMetrics(kind, secZone string) *HAProxyMetrics {
+	vipLabels := []string{"lb", "seczone", "vip"}
+
+	// counter haproxy_restart_count
+	restarts := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "haproxy_restart_count",
+		Help: "is a count of the restarts of each haproxy instance after it exited with an error or could not start",
+	}, vipLabels)
+
+	// gauge haproxy_instance_failed
+	failed := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "haproxy_instance_failed",
+		Help: "is a gauge set to 1 for each haproxy instance that failed too many times in a row to be restarted, until it is configured differently",
+	}, vipLabels)
+
+	prometheus.MustRegister(restarts)
+	prometheus.MustRegister(failed)
+
+	return &HAProxyMetrics{
+		kind:    kind,
+		secZone: secZone,
+
+		restarts: restarts,
+		failed:   failed,
+	}
+}
@@ -0,0 +1,165 @@
+package stats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IPVSStatsInterval is how often the workers that program IPVS report its
+// counters.
+const IPVSStatsInterval = 10 * time.Second
+
+// IPVSStats holds the kernel's counters for an IPVS virtual service, or for one
+// of its realservers when RealServer is set. Protocol is tcp, udp or fwmark.
+// For fwmark services VIP holds the mark, and Port is empty.
+// Weight and ActiveConnections are only set for realservers.
+type IPVSStats struct {
+	Protocol   string
+	VIP        string
+	Port       string
+	RealServer string
+
+	Weight            int
+	ActiveConnections uint64
+
+	Connections uint64
+	InPackets   uint64
+	OutPackets  uint64
+	InBytes     uint64
+	OutBytes    uint64
+}
+
+// IPVSMetrics exposes the traffic of each virtual service and realserver, so
+// that skew in how traffic is spread across realservers is visible.
+type IPVSMetrics struct {
+	sync.Mutex
+
+	kind    string
+	secZone string
+
+	// last holds the labels of the series set at the previous report
+	last map[string]prometheus.Labels
+
+	serviceConnections    *prometheus.GaugeVec
+	servicePackets        *prometheus.GaugeVec
+	serviceBytes          *prometheus.GaugeVec
+	realserverConnections *prometheus.GaugeVec
+	realserverPackets     *prometheus.GaugeVec
+	realserverBytes       *prometheus.GaugeVec
+}
+
+// Stats records the counters of every virtual service and realserver. Those
+// that are no longer reported are removed from the metrics.
+// gauge ipvs_service_connections, ipvs_realserver_connections
+// gauge ipvs_service_packets, ipvs_realserver_packets
+// gauge ipvs_service_bytes, ipvs_realserver_bytes
+func (m *IPVSMetrics) Stats(stats []IPVSStats) {
+	m.Lock()
+	defer m.Unlock()
+
+	current := map[string]prometheus.Labels{}
+	for _, s := range stats {
+		connections, packets, bytes := m.serviceConnections, m.servicePackets, m.serviceBytes
+		labels := prometheus.Labels{"lb": m.kind, "seczone": m.secZone, "protocol": s.Protocol, "vip": s.VIP, "port": s.Port}
+		if s.RealServer != "" {
+			connections, packets, bytes = m.realserverConnections, m.realserverPackets, m.realserverBytes
+			labels["realserver"] = s.RealServer
+		}
+		current[s.Protocol+" "+s.VIP+" "+s.Port+" "+s.RealServer] = labels
+
+		connections.With(labels).Set(float64(s.Connections))
+		packets.With(withDirection(labels, "in")).Set(float64(s.InPackets))
+		packets.With(withDirection(labels, "out")).Set(float64(s.OutPackets))
+		bytes.With(withDirection(labels, "in")).Set(float64(s.InBytes))
+		bytes.With(withDirection(labels, "out")).Set(float64(s.OutBytes))
+	}
+
+	for key, labels := range m.last {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		connections, packets, bytes := m.serviceConnections, m.servicePackets, m.serviceBytes
+		if _, ok := labels["realserver"]; ok {
+			connections, packets, bytes = m.realserverConnections, m.realserverPackets, m.realserverBytes
+		}
+		connections.Delete(labels)
+		for _, direction := range []string{"in", "out"} {
+			packets.Delete(withDirection(labels, direction))
+			bytes.Delete(withDirection(labels, direction))
+		}
+	}
+	m.last = current
+}
+
+// withDirection returns a copy of labels with the traffic direction added.
+func withDirection(labels prometheus.Labels, direction string) prometheus.Labels {
+	l := prometheus.Labels{"direction": direction}
+	for k, v := range labels {
+		l[k] = v
+	}
+	return l
+}
+
+// NewIPVSMetrics registers the IPVS traffic metrics.
+func NewIPVSMetrics(kind, secZone string) *IPVSMetrics {
+	serviceLabels := []string{"lb", "seczone", "protocol", "vip", "port"}
+	realserverLabels := append(append([]string{}, serviceLabels...), "realserver")
+
+	// gauge ipvs_service_connections
+	service_connections := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "ipvs_service_connections",
+		Help: "is the kernel's count of connections scheduled by each ipvs virtual service",
+	}, serviceLabels)
+
+	// gauge ipvs_service_packets
+	service_packets := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "ipvs_service_packets",
+		Help: "is the kernel's count of packets forwarded by each ipvs virtual service, in each direction",
+	}, append(serviceLabels, "direction"))
+
+	// gauge ipvs_service_bytes
+	service_bytes := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "ipvs_service_bytes",
+		Help: "is the kernel's count of bytes forwarded by each ipvs virtual service, in each direction",
+	}, append(serviceLabels, "direction"))
+
+	// gauge ipvs_realserver_connections
+	realserver_connections := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "ipvs_realserver_connections",
+		Help: "is the kernel's count of connections scheduled to each realserver of an ipvs virtual service",
+	}, realserverLabels)
+
+	// gauge ipvs_realserver_packets
+	realserver_packets := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "ipvs_realserver_packets",
+		Help: "is the kernel's count of packets forwarded to and from each realserver of an ipvs virtual service",
+	}, append(realserverLabels, "direction"))
+
+	// gauge ipvs_realserver_bytes
+	realserver_bytes := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "ipvs_realserver_bytes",
+		Help: "is the kernel's count of bytes forwarded to and from each realserver of an ipvs virtual service",
+	}, append(realserverLabels, "direction"))
+
+	prometheus.MustRegister(service_connections)
+	prometheus.MustRegister(service_packets)
+	prometheus.MustRegister(service_bytes)
+	prometheus.MustRegister(realserver_connections)
+	prometheus.MustRegister(realserver_packets)
+	prometheus.MustRegister(realserver_bytes)
+
+	return &IPVSMetrics{
+		kind:    kind,
+		secZone: secZone,
+		last:    map[string]prometheus.Labels{},
+
+		serviceConnections:    service_connections,
+		servicePackets:        service_packets,
+		serviceBytes:          service_bytes,
+		realserverConnections: realserver_connections,
+		realserverPackets:     realserver_packets,
+		realserverBytes:       realserver_bytes,
+	}
+}
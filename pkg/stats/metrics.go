@@ -7,6 +7,7 @@ type LBKind string
 const KindBGP = "bgp"
 const KindDirector = "director"
 const KindRealServer = "realserver"
+const KindColocated = "colocated"
 const Prefix = "rdei_lb_"
 
 // consts for prometheus initialization
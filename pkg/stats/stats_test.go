@@ -39,3 +39,14 @@ func BenchmarkCounters(b *testing.B) {
 		c.AddTCPRx(1) // without the fn call this only takes 2ns
 	}
 }
+
+func TestWorkerStateMetricsShared(t *testing.T) {
+	director := NewWorkerStateMetrics(KindDirector, "test")
+	realserver := NewWorkerStateMetrics(KindRealServer, "test")
+	if director.reconfigure != realserver.reconfigure {
+		t.Fatal("expected workers in one process to share their collectors")
+	}
+	if director.kind == realserver.kind {
+		t.Fatalf("expected workers to keep their own lb label. saw %s", realserver.kind)
+	}
+}
@@ -27,6 +27,9 @@ type WorkerStateMetrics struct {
 	loopbackRemovalErr      *prometheus.CounterVec
 	loopbackTotalConfigured *prometheus.GaugeVec
 	loopbackConfigHealthy   *prometheus.GaugeVec
+
+	haproxyFailures *prometheus.CounterVec
+	localHealth     *prometheus.GaugeVec
 }
 
 // Reconfigure is the end-to-end reconfiguration event.
@@ -76,6 +79,24 @@ func (w *WorkerStateMetrics) LoopbackConfigHealthy(up int) {
 	w.loopbackConfigHealthy.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Set(float64(up))
 }
 
+// HAProxyFailure counts a failure of one of the worker's haproxy instances,
+// by outcome, restart or failed once the instance is given up on.
+// counter haproxy_failure_count
+func (w *WorkerStateMetrics) HAProxyFailure(outcome string) {
+	w.haproxyFailures.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "outcome": outcome}).Add(1)
+}
+
+// LocalHealth records whether the realserver's node passes its local health
+// evaluation, 0 while its VIPs are withdrawn.
+// gauge local_health
+func (w *WorkerStateMetrics) LocalHealth(healthy bool) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	w.localHealth.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Set(value)
+}
+
 // ArpingFailure switch on what type of metric we should increment
 func (w *WorkerStateMetrics) ArpingFailure(err error) {
 	switch {
@@ -106,6 +127,19 @@ func (w *WorkerStateMetrics) arpingUnknownFail() {
 	w.arpingFailUnknown.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Add(float64(1))
 }
 
+// Register registers c, or returns the collector of the same name that is
+// already registered, so that the workers run in one process share their
+// metrics, told apart by the lb label.
+func Register(c prometheus.Collector) prometheus.Collector {
+	if err := prometheus.Register(c); err != nil {
+		if registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return registered.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
 func NewWorkerStateMetrics(kind, secZone string) *WorkerStateMetrics {
 
 	defaultLabels := []string{"lb", "seczone"}
@@ -196,20 +230,34 @@ func NewWorkerStateMetrics(kind, secZone string) *WorkerStateMetrics {
 		Help: "is a counter indicator that there are no errors in loopback if configuration",
 	}, defaultLabels)
 
-	prometheus.MustRegister(reconfig_count)
-	prometheus.MustRegister(channel_depth)
-	prometheus.MustRegister(reconfig_bucket)
-	prometheus.MustRegister(node_update_count)
-	prometheus.MustRegister(config_update_count)
-	prometheus.MustRegister(arping_dup_ip)
-	prometheus.MustRegister(arping_if_down)
-	prometheus.MustRegister(arping_unknown)
-	prometheus.MustRegister(loopback_addition)
-	prometheus.MustRegister(loopback_addition_err)
-	prometheus.MustRegister(loopback_removal)
-	prometheus.MustRegister(loopback_removal_err)
-	prometheus.MustRegister(loopback_total_configured)
-	prometheus.MustRegister(loopback_configuration_healthy)
+	// counter haproxy_failure_count
+	haproxy_failure_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "haproxy_failure_count",
+		Help: "is a count of the haproxy instances of the worker that exited with an error or could not start, with labels for the outcome restart|failed",
+	}, reconfigLabels)
+
+	// gauge local_health
+	local_health := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "local_health",
+		Help: "is a gauge set to 1 while the node passes the realserver's local health evaluation and 0 while its VIPs are withdrawn for failing it",
+	}, defaultLabels)
+
+	reconfig_count = Register(reconfig_count).(*prometheus.CounterVec)
+	channel_depth = Register(channel_depth).(*prometheus.GaugeVec)
+	reconfig_bucket = Register(reconfig_bucket).(*prometheus.HistogramVec)
+	node_update_count = Register(node_update_count).(*prometheus.CounterVec)
+	config_update_count = Register(config_update_count).(*prometheus.CounterVec)
+	arping_dup_ip = Register(arping_dup_ip).(*prometheus.CounterVec)
+	arping_if_down = Register(arping_if_down).(*prometheus.CounterVec)
+	arping_unknown = Register(arping_unknown).(*prometheus.CounterVec)
+	loopback_addition = Register(loopback_addition).(*prometheus.CounterVec)
+	loopback_addition_err = Register(loopback_addition_err).(*prometheus.CounterVec)
+	loopback_removal = Register(loopback_removal).(*prometheus.CounterVec)
+	loopback_removal_err = Register(loopback_removal_err).(*prometheus.CounterVec)
+	loopback_total_configured = Register(loopback_total_configured).(*prometheus.GaugeVec)
+	loopback_configuration_healthy = Register(loopback_configuration_healthy).(*prometheus.GaugeVec)
+	haproxy_failure_count = Register(haproxy_failure_count).(*prometheus.CounterVec)
+	local_health = Register(local_health).(*prometheus.GaugeVec)
 
 	// init error counters to 0
 	arping_dup_ip.With(prometheus.Labels{"lb": kind, "seczone": secZone})
@@ -234,5 +282,8 @@ func NewWorkerStateMetrics(kind, secZone string) *WorkerStateMetrics {
 		loopbackRemovalErr:      loopback_removal_err,
 		loopbackTotalConfigured: loopback_total_configured,
 		loopbackConfigHealthy:   loopback_configuration_healthy,
+
+		haproxyFailures: haproxy_failure_count,
+		localHealth:     local_health,
 	}
 }
@@ -0,0 +1,155 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+// Announcer tells the neighbors of a device that an address has moved onto it,
+// with gratuitous ARPs for ipv4 addresses and unsolicited neighbor
+// advertisements for ipv6 ones, so that they update the stale entries of the
+// address right away rather than once those expire.
+type Announcer interface {
+	// Announce sends the first announcement of addr, and repeats it in the
+	// background.
+	Announce(addr string) error
+}
+
+type announcer struct {
+	device string
+
+	// count is how many announcements are sent of each address, interval
+	// apart, as the first may be lost or arrive before the switch learns
+	// the device's port.
+	count    int
+	interval time.Duration
+
+	ctx    context.Context
+	logger logrus.FieldLogger
+}
+
+// NewAnnouncer returns an Announcer that sends count announcements of each
+// address out of device, interval apart.
+func NewAnnouncer(ctx context.Context, device string, count int, interval time.Duration, logger logrus.FieldLogger) Announcer {
+	return &announcer{
+		device:   device,
+		count:    count,
+		interval: interval,
+		ctx:      ctx,
+		logger:   logger,
+	}
+}
+
+// Announce documented in Announcer interface
+func (a *announcer) Announce(addr string) error {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("unable to announce %s. not an ip address", addr)
+	}
+	iface, err := net.InterfaceByName(a.device)
+	if err != nil {
+		return fmt.Errorf("unable to announce %s on %s. %v", addr, a.device, err)
+	}
+	frame, err := announcement(ip, iface.HardwareAddr)
+	if err != nil {
+		return fmt.Errorf("unable to announce %s on %s. %v", addr, a.device, err)
+	}
+
+	if err := a.send(iface, frame); err != nil {
+		return fmt.Errorf("unable to announce %s on %s. %v", addr, a.device, err)
+	}
+	a.logger.WithFields(logrus.Fields{"device": a.device, "addr": addr, "action": "announcing"}).Info()
+	go func() {
+		for n := 1; n < a.count; n++ {
+			select {
+			case <-time.After(a.interval):
+			case <-a.ctx.Done():
+				return
+			}
+			if err := a.send(iface, frame); err != nil {
+				a.logger.Warnf("unable to repeat the announcement of %s on %s. %v", addr, a.device, err)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// send writes an ethernet frame out of iface.
+func (a *announcer) send(iface *net.Interface, frame []byte) error {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	to := &unix.SockaddrLinklayer{Ifindex: iface.Index, Halen: 6}
+	copy(to.Addr[:], frame[:6])
+	return unix.Sendto(fd, frame, 0, to)
+}
+
+// announcement returns the ethernet frame that announces ip at mac: a
+// gratuitous ARP request for an ipv4 address, broadcast, or an unsolicited
+// neighbor advertisement overriding the entries of an ipv6 address, sent to
+// all nodes.
+func announcement(ip net.IP, mac net.HardwareAddr) ([]byte, error) {
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("device has no ethernet address")
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		eth := &layers.Ethernet{
+			SrcMAC:       mac,
+			DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			EthernetType: layers.EthernetTypeARP,
+		}
+		arp := &layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   mac,
+			SourceProtAddress: ip4,
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    ip4,
+		}
+		err := gopacket.SerializeLayers(buf, opts, eth, arp)
+		return buf.Bytes(), err
+	}
+
+	allNodes := net.ParseIP("ff02::1")
+	eth := &layers.Ethernet{
+		SrcMAC:       mac,
+		DstMAC:       net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+		SrcIP:      ip,
+		DstIP:      allNodes,
+	}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0)}
+	if err := icmp.SetNetworkLayerForChecksum(ip6); err != nil {
+		return nil, err
+	}
+	na := &layers.ICMPv6NeighborAdvertisement{
+		// the override flag replaces the existing entries of the address
+		Flags:         0x20,
+		TargetAddress: ip,
+		Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: mac}},
+	}
+	err := gopacket.SerializeLayers(buf, opts, eth, ip6, icmp, na)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,53 @@
+package system
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestAnnouncement(t *testing.T) {
+	mac := net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56}
+
+	frame, err := announcement(net.ParseIP("10.54.213.253"), mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok {
+		t.Fatalf("expected an arp packet. saw %v", packet)
+	}
+	if arp.Operation != layers.ARPRequest || !net.IP(arp.SourceProtAddress).Equal(net.ParseIP("10.54.213.253")) || !net.IP(arp.DstProtAddress).Equal(net.ParseIP("10.54.213.253")) {
+		t.Fatalf("expected a gratuitous arp request for 10.54.213.253. saw %+v", arp)
+	}
+	if net.HardwareAddr(arp.SourceHwAddress).String() != mac.String() {
+		t.Fatalf("expected the arp to be from %s. saw %s", mac, net.HardwareAddr(arp.SourceHwAddress))
+	}
+
+	frame, err = announcement(net.ParseIP("2001:db8::fe"), mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet = gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	ip6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ok || ip6.HopLimit != 255 || ip6.DstIP.String() != "ff02::1" {
+		t.Fatalf("expected an ipv6 packet to all nodes with a hop limit of 255. saw %v", packet)
+	}
+	na, ok := packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement)
+	if !ok {
+		t.Fatalf("expected a neighbor advertisement. saw %v", packet)
+	}
+	if !na.Override() || na.Solicited() || na.TargetAddress.String() != "2001:db8::fe" {
+		t.Fatalf("expected an unsolicited override for 2001:db8::fe. saw %+v", na)
+	}
+	if len(na.Options) != 1 || net.HardwareAddr(na.Options[0].Data).String() != mac.String() {
+		t.Fatalf("expected the target link-layer address %s. saw %+v", mac, na.Options)
+	}
+
+	if _, err := announcement(net.ParseIP("10.54.213.253"), nil); err == nil {
+		t.Fatalf("expected an error for a device without an ethernet address")
+	}
+}
@@ -0,0 +1,109 @@
+package system
+
+import (
+	"fmt"
+	"sort"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
+)
+
+// connlimitChain is the filter chain, jumped to from the top of INPUT, that
+// rejects new connections to VIP:ports beyond their maxConnections. IPVS takes
+// the traffic of VIPs after the filter INPUT chain has seen it, and haproxy
+// once it has been accepted.
+const connlimitChain = "RAVEL-CONNLIMIT"
+
+// connlimitRules returns the filter rules that reset new tcp connections to
+// the ports with maxConnections once that many are open, sorted. The limit is
+// of all of a port's connections together, from every client. With ipv6, the
+// rules are those of the ipv6 VIPs and of the ipv6 addresses of ipv4 VIPs.
+func connlimitRules(config *types.ClusterConfig, ipv6 bool) []string {
+	rules := []string{}
+	for _, limited := range limitedAddresses(config, ipv6) {
+		for port, service := range limited.ports {
+			if service == nil || service.MaxConnections == 0 {
+				continue
+			}
+			ident := types.MakeIdent(service.Namespace, service.Service, service.PortName)
+			// -A RAVEL-CONNLIMIT -d 10.54.213.253/32 -p tcp -m tcp --dport 80 --tcp-flags FIN,SYN,RST,ACK SYN -m connlimit --connlimit-above 1000 --connlimit-mask 0 -m comment --comment "default/nginx:http" -j REJECT --reject-with tcp-reset
+			rules = append(rules, fmt.Sprintf(`-A %s -d %s -p tcp -m tcp --dport %s --tcp-flags FIN,SYN,RST,ACK SYN -m connlimit --connlimit-above %d --connlimit-mask 0 -m comment --comment "%s" -j REJECT --reject-with tcp-reset`,
+				connlimitChain, hostPrefix(limited.addr, ipv6), port, service.MaxConnections, ident))
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// setConnLimits brings the filter rules of ports with maxConnections in line
+// with config, in iptables and ip6tables.
+func (i *ipvs) setConnLimits(config *types.ClusterConfig) error {
+	applied, err := i.applyChainAt(false, util.Prepend, util.TableFilter, connlimitChain, util.ChainInput, connlimitRules(config, false), i.connlimits)
+	if err != nil {
+		return fmt.Errorf("applying connlimit rules. %v", err)
+	}
+	i.connlimits = applied
+	applied, err = i.applyChainAt(true, util.Prepend, util.TableFilter, connlimitChain, util.ChainInput, connlimitRules(config, true), i.connlimits6)
+	if err != nil {
+		return fmt.Errorf("applying ipv6 connlimit rules. %v", err)
+	}
+	i.connlimits6 = applied
+	return nil
+}
+
+// teardownConnLimits removes the filter rules of ports with maxConnections, if
+// any were applied.
+func (i *ipvs) teardownConnLimits() error {
+	if len(i.connlimits) != 0 {
+		if err := i.iptables.FlushChain(util.TableFilter, connlimitChain); err != nil {
+			return err
+		}
+		i.connlimits = nil
+	}
+	if len(i.connlimits6) != 0 {
+		if err := i.iptables6.FlushChain(util.TableFilter, connlimitChain); err != nil {
+			return err
+		}
+		i.connlimits6 = nil
+	}
+	return nil
+}
+
+// limitedAddress is an address that connection and syn limits apply to, with
+// the VIP whose options and ports it takes.
+type limitedAddress struct {
+	addr  types.ServiceIP
+	vip   types.ServiceIP
+	ports types.PortMap
+}
+
+// limitedAddresses returns the addresses of one family that connection and
+// syn limits apply to. Those of ipv4 are the ipv4 VIPs, haproxy frontends
+// included. Those of ipv6 are the ipv6 VIPs, and the ipv6 addresses that
+// haproxy serves ipv4 VIPs on.
+func limitedAddresses(config *types.ClusterConfig, ipv6 bool) []limitedAddress {
+	out := []limitedAddress{}
+	if !ipv6 {
+		for vip, ports := range config.Config {
+			out = append(out, limitedAddress{addr: vip, vip: vip, ports: ports})
+		}
+		return out
+	}
+	for vip, ports := range config.Config6 {
+		out = append(out, limitedAddress{addr: vip, vip: vip, ports: ports})
+	}
+	for vip, ports := range config.Config {
+		if addr := config.IPV6[vip]; addr != "" {
+			out = append(out, limitedAddress{addr: types.ServiceIP(addr), vip: vip, ports: ports})
+		}
+	}
+	return out
+}
+
+// hostPrefix returns addr as a single-address prefix of its family.
+func hostPrefix(addr types.ServiceIP, ipv6 bool) string {
+	if ipv6 {
+		return string(addr) + "/128"
+	}
+	return string(addr) + "/32"
+}
@@ -0,0 +1,73 @@
+package system
+
+import (
+	"fmt"
+	"sort"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
+)
+
+// dscpChain is the mangle chain, jumped to from POSTROUTING, that marks the
+// egress traffic of VIPs with a DSCP value.
+const dscpChain = "RAVEL-DSCP"
+
+// dscpRules returns the mangle rules that set the DSCP value of the replies to
+// the ports of VIPs with one, sorted. Replies are matched on the VIP:port that
+// their connection was made to, so that they are marked whether they leave a
+// realserver's pods through its DNAT or a director through its masquerade.
+func dscpRules(config *types.ClusterConfig) []string {
+	rules := []string{}
+	for vip, ports := range config.Config {
+		dscp := config.DSCP(vip)
+		if dscp == 0 {
+			continue
+		}
+		for port, service := range ports {
+			if service == nil {
+				continue
+			}
+			protocols := []string{"tcp"}
+			if service.UDPEnabled {
+				protocols = append(protocols, "udp")
+			}
+			ident := types.MakeIdent(service.Namespace, service.Service, service.PortName)
+			for _, protocol := range protocols {
+				// -A RAVEL-DSCP -p tcp -m conntrack --ctorigdst 10.54.213.253/32 --ctorigdstport 80 --ctdir REPLY -m comment --comment "default/nginx:http" -j DSCP --set-dscp 0x2e
+				rules = append(rules, fmt.Sprintf(`-A %s -p %s -m conntrack --ctorigdst %s/32 --ctorigdstport %s --ctdir REPLY -m comment --comment "%s" -j DSCP --set-dscp 0x%02x`,
+					dscpChain, protocol, vip, port, ident, dscp))
+			}
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// SetDSCP brings the mangle rules that mark the egress traffic of VIPs in line
+// with config. Directors set them with their IPVS services, and realservers,
+// whose pods answer direct routed traffic themselves, on their own.
+func (i *ipvs) SetDSCP(config *types.ClusterConfig) error {
+	if i.dryRun {
+		i.logger.Infof("ipvs dry run. not applying %d dscp rules", len(dscpRules(config)))
+		return nil
+	}
+	applied, err := i.applyChain(util.TableMangle, dscpChain, util.ChainPostrouting, dscpRules(config), i.dscps)
+	if err != nil {
+		return fmt.Errorf("applying dscp rules. %v", err)
+	}
+	i.dscps = applied
+	return nil
+}
+
+// teardownDSCP removes the mangle rules of VIPs with a DSCP value, if any were
+// applied.
+func (i *ipvs) teardownDSCP() error {
+	if len(i.dscps) == 0 {
+		return nil
+	}
+	if err := i.iptables.FlushChain(util.TableMangle, dscpChain); err != nil {
+		return err
+	}
+	i.dscps = nil
+	return nil
+}
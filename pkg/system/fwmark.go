@@ -0,0 +1,113 @@
+package system
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
+	utildbus "github.comcast.com/viper-sde/kube2ipvs/pkg/util/dbus"
+	utilexec "github.comcast.com/viper-sde/kube2ipvs/pkg/util/exec"
+)
+
+// fwmarkChain is the mangle chain, jumped to from PREROUTING, that marks the
+// traffic of fwmark VIPs for their IPVS virtual services.
+const fwmarkChain = "RAVEL-FWMARK"
+
+// fwmarkService returns the service definition that configures the virtual
+// service of a fwmark VIP, that of its lowest port. The ports of a fwmark VIP
+// all lead to the same service.
+func fwmarkService(ports types.PortMap) *types.ServiceDef {
+	keys := []string{}
+	for port := range ports {
+		keys = append(keys, port)
+	}
+	sort.Strings(keys)
+	return ports[keys[0]]
+}
+
+// fwmarkRules returns the mangle rules that mark traffic to the ports of
+// fwmark VIPs, sorted.
+func fwmarkRules(config *types.ClusterConfig) []string {
+	rules := []string{}
+	for vip, ports := range config.Config {
+		mark := config.Fwmark(vip)
+		if mark == 0 {
+			continue
+		}
+		for port, service := range ports {
+			protocols := []string{"tcp"}
+			if service.UDPEnabled {
+				protocols = append(protocols, "udp")
+			}
+			ident := types.MakeIdent(service.Namespace, service.Service, service.PortName)
+			for _, protocol := range protocols {
+				// -A RAVEL-FWMARK -d 10.54.213.253/32 -p tcp -m tcp --dport 20000:21000 -m comment --comment "ftp/ftp:passive" -j MARK --set-xmark 0x7/0xffffffff
+				rules = append(rules, fmt.Sprintf(`-A %s -d %s/32 -p %s -m %s --dport %s -m comment --comment "%s" -j MARK --set-xmark 0x%x/0xffffffff`,
+					fwmarkChain, vip, protocol, protocol, port, ident, mark))
+			}
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// setFwmarks brings the mangle rules of fwmark VIPs in line with config.
+func (i *ipvs) setFwmarks(config *types.ClusterConfig) error {
+	applied, err := i.applyChain(util.TableMangle, fwmarkChain, util.ChainPrerouting, fwmarkRules(config), i.fwmarks)
+	if err != nil {
+		return fmt.Errorf("applying fwmark rules. %v", err)
+	}
+	i.fwmarks = applied
+	return nil
+}
+
+// applyChain replaces the rules of chain in table with rules, and jumps to it
+// from the builtin chain jumpFrom. The chain is only created once it has rules,
+// and only rewritten when they differ from those applied before. It returns
+// the rules now applied.
+func (i *ipvs) applyChain(table util.Table, chain string, jumpFrom util.Chain, rules, applied []string) ([]string, error) {
+	return i.applyChainAt(false, util.Append, table, chain, jumpFrom, rules, applied)
+}
+
+// applyChainAt is applyChain in iptables, or ip6tables with ipv6, with the
+// jump to chain inserted at position in jumpFrom.
+func (i *ipvs) applyChainAt(ipv6 bool, position util.RulePosition, table util.Table, chain string, jumpFrom util.Chain, rules, applied []string) ([]string, error) {
+	if len(rules) == 0 && len(applied) == 0 || reflect.DeepEqual(rules, applied) {
+		return applied, nil
+	}
+	if ipv6 && i.iptables6 == nil {
+		i.iptables6 = util.New(utilexec.New(), utildbus.New(), util.ProtocolIpv6)
+	} else if !ipv6 && i.iptables == nil {
+		i.iptables = util.NewDefault()
+	}
+	ipt := i.iptables
+	if ipv6 {
+		ipt = i.iptables6
+	}
+
+	// restoring the chain without flushing the table replaces the chain's rules only
+	lines := append([]string{"*" + string(table), ":" + chain + " - [0:0]"}, rules...)
+	lines = append(lines, "COMMIT\n")
+	if err := ipt.Restore(table, []byte(strings.Join(lines, "\n")), util.NoFlushTables, util.NoRestoreCounters); err != nil {
+		return applied, err
+	}
+	if _, err := ipt.EnsureRule(position, table, jumpFrom, "-j", chain); err != nil {
+		return applied, fmt.Errorf("jumping to %s from %s. %v", chain, jumpFrom, err)
+	}
+	return rules, nil
+}
+
+// teardownFwmarks removes the mangle rules of fwmark VIPs, if any were applied.
+func (i *ipvs) teardownFwmarks() error {
+	if len(i.fwmarks) == 0 {
+		return nil
+	}
+	if err := i.iptables.FlushChain(util.TableMangle, fwmarkChain); err != nil {
+		return err
+	}
+	i.fwmarks = nil
+	return nil
+}
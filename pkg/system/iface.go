@@ -0,0 +1,103 @@
+package system
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// iface is what SelectInterface knows of a network interface of the node.
+type iface struct {
+	name  string
+	up    bool
+	addrs []*net.IPNet
+}
+
+// SelectInterface returns the name of the interface of the node that selector
+// picks, so that one configuration serves nodes whose interfaces are named
+// differently. selector is one of
+//
+//	eth0            the interface of that name, as is
+//	en*             the first interface that is up, with an address of the
+//	                family, whose name matches the glob
+//	10.0.0.0/8      the first interface that is up with an address in the CIDR
+//
+// where the family is ipv6 or ipv4. An empty selector is returned as is.
+func SelectInterface(selector string, ipv6 bool) (string, error) {
+	if selector == "" || !isSelector(selector) {
+		return selector, nil
+	}
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return "", fmt.Errorf("unable to list the interfaces for %s. %v", selector, err)
+	}
+	return selectInterface(selector, ipv6, ifaces)
+}
+
+// isSelector is true for a selector that is not a plain interface name.
+func isSelector(selector string) bool {
+	return strings.ContainsAny(selector, "/*?[")
+}
+
+func selectInterface(selector string, ipv6 bool, ifaces []iface) (string, error) {
+	if strings.Contains(selector, "/") {
+		_, cidr, err := net.ParseCIDR(selector)
+		if err != nil {
+			return "", fmt.Errorf("unable to parse the interface selector %s. %v", selector, err)
+		}
+		for _, i := range ifaces {
+			if !i.up {
+				continue
+			}
+			for _, addr := range i.addrs {
+				if cidr.Contains(addr.IP) {
+					return i.name, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("no interface that is up has an address in %s", selector)
+	}
+
+	if _, err := path.Match(selector, ""); err != nil {
+		return "", fmt.Errorf("unable to parse the interface selector %s. %v", selector, err)
+	}
+	for _, i := range ifaces {
+		if matched, _ := path.Match(selector, i.name); !matched || !i.up {
+			continue
+		}
+		for _, addr := range i.addrs {
+			if (addr.IP.To4() == nil) == ipv6 {
+				return i.name, nil
+			}
+		}
+	}
+	family := "ipv4"
+	if ipv6 {
+		family = "ipv6"
+	}
+	return "", fmt.Errorf("no interface that is up matches %s with an %s address", selector, family)
+}
+
+// listInterfaces returns the interfaces of the node in index order.
+func listInterfaces() ([]iface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	ifaces := make([]iface, 0, len(interfaces))
+	for _, i := range interfaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the addresses of %s. %v", i.Name, err)
+		}
+		candidate := iface{name: i.Name, up: i.Flags&net.FlagUp != 0}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				candidate.addrs = append(candidate.addrs, ipNet)
+			}
+		}
+		ifaces = append(ifaces, candidate)
+	}
+	return ifaces, nil
+}
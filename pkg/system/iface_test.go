@@ -0,0 +1,52 @@
+package system
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSelectInterface(t *testing.T) {
+	addrs := func(cidrs ...string) []*net.IPNet {
+		out := []*net.IPNet{}
+		for _, cidr := range cidrs {
+			ip, ipNet, _ := net.ParseCIDR(cidr)
+			ipNet.IP = ip
+			out = append(out, ipNet)
+		}
+		return out
+	}
+	ifaces := []iface{
+		{name: "lo", up: true, addrs: addrs("127.0.0.1/8", "::1/128")},
+		{name: "eno1", up: false, addrs: addrs("10.1.0.5/24")},
+		{name: "eno2", up: true, addrs: addrs("10.1.0.6/24")},
+		{name: "ens3", up: true, addrs: addrs("2001:db8::6/64")},
+	}
+
+	tests := []struct {
+		selector string
+		ipv6     bool
+		want     string
+	}{
+		{"en*", false, "eno2"},
+		{"en*", true, "ens3"},
+		{"10.1.0.0/16", false, "eno2"},
+		{"2001:db8::/32", true, "ens3"},
+		{"eno[13]", true, ""},
+		{"192.168.0.0/16", false, ""},
+		{"10.1.0.0/33", false, ""},
+		{"en[", false, ""},
+	}
+	for _, test := range tests {
+		got, err := selectInterface(test.selector, test.ipv6, ifaces)
+		if test.want == "" && err == nil {
+			t.Fatalf("expected %s to select no interface. saw %s", test.selector, got)
+		}
+		if test.want != "" && (err != nil || got != test.want) {
+			t.Fatalf("expected %s to select %s. saw %s %v", test.selector, test.want, got, err)
+		}
+	}
+
+	if got, err := SelectInterface("bond0", false); err != nil || got != "bond0" {
+		t.Fatalf("expected a plain name to be selected as is. saw %s %v", got, err)
+	}
+}
@@ -33,6 +33,13 @@ type IP interface {
 
 	Device() string
 	SetRPFilter() error
+	SetTunnel() error
+
+	// EnsureSysctls puts back the sysctls set by SetARP and SetRPFilter that
+	// have been changed since, and RestoreSysctls writes back the values they
+	// held before they were first set.
+	EnsureSysctls() error
+	RestoreSysctls() error
 
 	Teardown(ctx context.Context) error
 }
@@ -44,6 +51,8 @@ type ipManager struct {
 	announce int
 	ignore   int
 
+	sysctls *sysctlManager
+
 	ctx    context.Context
 	logger logrus.FieldLogger
 }
@@ -54,6 +63,7 @@ func NewIP(ctx context.Context, device string, gateway string, announce, ignore
 		gateway:  gateway,
 		announce: announce,
 		ignore:   ignore,
+		sysctls:  newSysctlManager(logger),
 		ctx:      ctx,
 		logger:   logger,
 	}, nil
@@ -100,34 +110,33 @@ func (i *ipManager) AdvertiseMacAddress(addr string) error {
 	return nil
 }
 
+// SetRPFilter turns off reverse path filtering for the device and 'all', as
+// the kernel applies the stricter of the two. Packets decapsulated by a tunnel
+// device carry the client's source address, which is not routed through it.
 func (i *ipManager) SetRPFilter() error {
-	tunl0File := "/netconf/tunl0/rp_filter"
+	deviceFile := fmt.Sprintf("/netconf/%s/rp_filter", i.device)
 	allFile := "/netconf/all/rp_filter"
-	i.logger.Debugf("seting rp_filter for 'all' and 'tunl0'")
-
-	fAll, err := os.OpenFile(allFile, os.O_RDWR, 0666)
-	if err != nil {
-		return err
-	}
-	defer fAll.Close()
+	i.logger.Debugf("seting rp_filter for 'all' and '%s'", i.device)
 
-	fTunl, err := os.OpenFile(tunl0File, os.O_RDWR, 0666)
-	if err != nil {
+	if err := i.sysctls.set(allFile, "0"); err != nil {
 		return err
 	}
-	defer fAll.Close()
+	return i.sysctls.set(deviceFile, "0")
+}
 
-	_, err = fAll.Write([]byte("0"))
-	if err != nil {
-		return err
+// SetTunnel brings up the device as the IPIP tunnel that decapsulates traffic
+// sent by a director in tunnel mode. tunl0 is created by loading the ipip module.
+func (i *ipManager) SetTunnel() error {
+	if _, err := os.Stat("/sys/class/net/" + i.device); os.IsNotExist(err) {
+		i.logger.Debugf("loading ipip module for %s", i.device)
+		if out, err := exec.CommandContext(i.ctx, "modprobe", "ipip").CombinedOutput(); err != nil {
+			return fmt.Errorf("unable to load ipip module for device='%s'. %s %v", i.device, strings.TrimSpace(string(out)), err)
+		}
 	}
-	_, err = fTunl.Write([]byte("0"))
-	if err != nil {
-		return err
+	if out, err := exec.CommandContext(i.ctx, "ip", "link", "set", "dev", i.device, "up").CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to bring up device='%s'. %s %v", i.device, strings.TrimSpace(string(out)), err)
 	}
-
 	return nil
-
 }
 
 func (i *ipManager) SetARP() error {
@@ -136,31 +145,15 @@ func (i *ipManager) SetARP() error {
 	i.logger.Debugf("seting arp_announce for %s to %d", i.device, i.announce)
 	i.logger.Debugf("seting arp_ignore for %s to %d", i.device, i.ignore)
 
-	fAnnounce, err := os.OpenFile(announceFile, os.O_RDWR, 0666)
-	if err != nil {
+	if err := i.sysctls.set(announceFile, strconv.Itoa(i.announce)); err != nil {
 		return err
 	}
-	defer fAnnounce.Close()
-
-	fIgnore, err := os.OpenFile(ignoreFile, os.O_RDWR, 0666)
-	if err != nil {
-		return err
-	}
-	defer fIgnore.Close()
-
-	_, err = fAnnounce.Write([]byte(strconv.Itoa(i.announce)))
-	if err != nil {
-		return err
-	}
-
-	_, err = fIgnore.Write([]byte(strconv.Itoa(i.ignore)))
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return i.sysctls.set(ignoreFile, strconv.Itoa(i.ignore))
 }
 
+func (i *ipManager) EnsureSysctls() error  { return i.sysctls.ensure() }
+func (i *ipManager) RestoreSysctls() error { return i.sysctls.restore() }
+
 func (i *ipManager) Compare(configured, desired []string) ([]string, []string) {
 	removals := []string{}
 	additions := []string{}
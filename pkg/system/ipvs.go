@@ -4,19 +4,30 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"net"
+	"os"
 	"os/exec"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
 
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
 )
 
+// schedulerMaglev is the maglev hashing scheduler, in kernels 4.18 and later
+const schedulerMaglev = "mh"
+
 const (
 	colocationModeDisabled = "disabled"
 	colocationModeIPTables = "iptables"
@@ -31,6 +42,44 @@ type IPVS interface {
 
 	SetIPVS(nodes types.NodesList, config *types.ClusterConfig, logger logrus.FieldLogger) error
 	CheckConfigParity(nodes types.NodesList, config *types.ClusterConfig, addresses []string, configReady bool) (bool, error)
+	SetIPVS6(nodes types.NodesList, config *types.ClusterConfig, logger logrus.FieldLogger) error
+	CheckConfigParity6(nodes types.NodesList, config *types.ClusterConfig) (bool, error)
+	DiffIPVS(nodes types.NodesList, config *types.ClusterConfig) ([]string, error)
+
+	StartSyncDaemon(state string) error
+	StopSyncDaemon(state string) error
+
+	Stats() ([]stats.IPVSStats, error)
+	EnsureSysctls() error
+	BalanceWeights() (bool, error)
+	SetDSCP(config *types.ClusterConfig) error
+	SetLimits(config *types.ClusterConfig) error
+}
+
+// States of the IPVS connection synchronization daemon. Directors sync their
+// connections as master, and the nodes that stand by to take over receive
+// them as backup, so that established connections survive a failover.
+const (
+	SyncDaemonMaster = "master"
+	SyncDaemonBackup = "backup"
+)
+
+// IPVS backends. ipvsadm execs the ipvsadm binary, netlink talks to the
+// kernel directly over the IPVS generic netlink family.
+const (
+	IPVSBackendIPVSAdm = "ipvsadm"
+	IPVSBackendNetlink = "netlink"
+)
+
+// ipvsClient reads and writes the kernel's IPVS table. Rules are exchanged in
+// the format of ipvsadm -Sn and ipvsadm -R, whichever backend is in use.
+type ipvsClient interface {
+	get(ctx context.Context) ([]string, error)
+	set(ctx context.Context, rules []string) ([]byte, error)
+	startDaemon(ctx context.Context, state, iface string, syncID int) error
+	stopDaemon(ctx context.Context, state string) error
+	stats(ctx context.Context) ([]stats.IPVSStats, error)
+	teardown(ctx context.Context) error
 }
 
 type ipvs struct {
@@ -38,32 +87,234 @@ type ipvs struct {
 
 	ignoreCordon   bool
 	weightOverride bool
-	defaultWeight  int
+
+	// drainTaints are the taints that take a node out of service, as a
+	// cordon does
+	drainTaints   []string
+	defaultWeight int
+
+	// drainGracePeriod is how long a realserver that is no longer desired
+	// keeps its established connections. draining holds the time at which each
+	// draining realserver, by "-t vip:port -r rs:port", was set to weight 0.
+	drainGracePeriod time.Duration
+	draining         map[string]time.Time
+
+	// fwmarks, masquerades, notracks, dscps, connlimits and synlimits hold
+	// the mangle, nat, raw, mangle, filter and filter rules last applied for
+	// fwmark, nat, noTrack and dscp VIPs, ports with maxConnections and VIPs
+	// with a synRateLimit. iptables is created once there are any.
+	// connlimits6 and synlimits6 hold the ipv6 limits, applied with
+	// iptables6.
+	fwmarks     []string
+	masquerades []string
+	notracks    []string
+	dscps       []string
+	connlimits  []string
+	synlimits   []string
+	connlimits6 []string
+	synlimits6  []string
+	iptables    util.Interface
+	iptables6   util.Interface
+
+	// syncInterface is the interface the sync daemon multicasts connections
+	// on, and syncID tells apart the director pairs sharing a network. The
+	// daemon is disabled without an interface.
+	syncInterface string
+	syncID        int
+
+	// parity and parity6 hash the inputs of the last ipv4 and ipv6 parity
+	// checks that found parity. They are cleared when rules are applied.
+	parity  uint64
+	parity6 uint64
+
+	// dryRun logs the rules that SetIPVS and SetIPVS6 would apply, rather than
+	// applying them
+	dryRun bool
+
+	// sysctls holds the values of the ManagedIPVSSysctls, by name, kept in
+	// place by EnsureSysctls. sysctlDir is where they are found.
+	sysctls   map[string]string
+	sysctlDir string
+
+	// balancer adjusts realserver weights from their active connections. It
+	// is nil unless weight balancing is enabled.
+	balancer *weightBalancer
+
+	// schedulers holds the outcome of loading each scheduler's kernel module
+	schedulers map[string]error
+
+	client ipvsClient
 
 	ctx    context.Context
 	logger logrus.FieldLogger
 }
 
-func NewIPVS(ctx context.Context, primaryIP string, weightOverride bool, ignoreCordon bool, logger logrus.FieldLogger) (IPVS, error) {
-	return &ipvs{
+// IPVSOptions are the settings of an IPVS manager.
+type IPVSOptions struct {
+	PrimaryIP      string
+	WeightOverride bool
+	IgnoreCordon   bool
+	DrainTaints    []string
+
+	// Backend selects the client that programs IPVS, ipvsadm or netlink.
+	Backend          string
+	DrainGracePeriod time.Duration
+
+	// SyncInterface and SyncID configure the connection sync daemon, which
+	// is not run when SyncInterface is empty.
+	SyncInterface string
+	SyncID        int
+
+	DryRun        bool
+	Sysctls       map[string]string
+	WeightBalance WeightBalance
+}
+
+func NewIPVS(ctx context.Context, opts IPVSOptions, logger logrus.FieldLogger) (IPVS, error) {
+	var client ipvsClient
+	switch opts.Backend {
+	case IPVSBackendIPVSAdm:
+		client = &ipvsadmClient{}
+	case IPVSBackendNetlink:
+		client = newNetlinkClient()
+	default:
+		return nil, fmt.Errorf("unknown ipvs backend %q. must be %s or %s", opts.Backend, IPVSBackendIPVSAdm, IPVSBackendNetlink)
+	}
+
+	i := &ipvs{
 		ctx:            ctx,
-		nodeIP:         primaryIP,
+		nodeIP:         opts.PrimaryIP,
 		logger:         logger,
-		weightOverride: weightOverride,
-		ignoreCordon:   ignoreCordon,
+		weightOverride: opts.WeightOverride,
+		ignoreCordon:   opts.IgnoreCordon,
+		drainTaints:    opts.DrainTaints,
 		defaultWeight:  1, // just so there's no magic numbers to hunt down
-	}, nil
+		client:         client,
+
+		drainGracePeriod: opts.DrainGracePeriod,
+		draining:         map[string]time.Time{},
+		syncInterface:    opts.SyncInterface,
+		syncID:           opts.SyncID,
+		dryRun:           opts.DryRun,
+		sysctls:          opts.Sysctls,
+		sysctlDir:        ipvsSysctlDir,
+		balancer:         newWeightBalancer(opts.WeightBalance),
+		schedulers:       map[string]error{},
+	}
+
+	// ip_vs_mh is missing from older kernels. configurations that use it fail
+	// until the module is available.
+	if err := i.schedulerAvailable(schedulerMaglev); err != nil {
+		logger.Warnf("%v. services using the %s scheduler will not be configured", err, schedulerMaglev)
+	}
+	return i, nil
+}
+
+// schedulerAvailable loads the kernel module of an IPVS scheduler. IPVS would
+// load it on demand, but not from a container without /lib/modules, so the
+// module is loaded with modprobe ahead of its first use. An error is
+// remembered, rather than retried on every reconfigure.
+func (i *ipvs) schedulerAvailable(scheduler string) error {
+	if i.schedulers == nil {
+		i.schedulers = map[string]error{}
+	}
+	if err, ok := i.schedulers[scheduler]; ok {
+		return err
+	}
+
+	module := "ip_vs_" + scheduler
+	var err error
+	if _, statErr := os.Stat("/sys/module/" + module); statErr != nil {
+		out, modprobeErr := exec.CommandContext(i.ctx, "modprobe", module).CombinedOutput()
+		if modprobeErr != nil {
+			err = fmt.Errorf("the %s scheduler requires the %s kernel module, which could not be loaded. %v %s", scheduler, module, modprobeErr, strings.TrimSpace(string(out)))
+		}
+	}
+	i.schedulers[scheduler] = err
+	return err
 }
 
 // =====================================================================================================
 
-// getConfiguredIPVS returns the output of `ipvsadm -Sn`
-// That IPVS command returns a list of director VIP addresses sorted in lexicographic order by address:port,
-// with backends sorted by realserver address:port.
+// Get returns the configured rules in the format of `ipvsadm -Sn`, a list of
+// director VIP addresses sorted in lexicographic order by address:port, with
+// backends sorted by realserver address:port.
 func (i *ipvs) Get() ([]string, error) {
+	return i.client.get(i.ctx)
+}
+
+func (i *ipvs) Set(rules []string) ([]byte, error) {
+	i.logger.Infof("got %d ipvs rules to set", len(rules))
+	return i.client.set(i.ctx, rules)
+}
+
+func (i *ipvs) Teardown(ctx context.Context) error {
+	if i.dryRun {
+		i.logger.Info("ipvs dry run. not tearing down ipvs")
+		return nil
+	}
+	i.parity, i.parity6 = 0, 0
+	if err := i.teardownFwmarks(); err != nil {
+		i.logger.Errorf("flushing fwmark rules. %v", err)
+	}
+	if err := i.teardownMasquerades(); err != nil {
+		i.logger.Errorf("flushing masquerade rules. %v", err)
+	}
+	if err := i.teardownNoTracks(); err != nil {
+		i.logger.Errorf("flushing notrack rules. %v", err)
+	}
+	if err := i.teardownDSCP(); err != nil {
+		i.logger.Errorf("flushing dscp rules. %v", err)
+	}
+	if err := i.teardownConnLimits(); err != nil {
+		i.logger.Errorf("flushing connlimit rules. %v", err)
+	}
+	if err := i.teardownSynLimits(); err != nil {
+		i.logger.Errorf("flushing synlimit rules. %v", err)
+	}
+	return i.client.teardown(ctx)
+}
+
+// StartSyncDaemon starts the connection sync daemon in state, master or
+// backup. It does nothing when no sync interface is configured, or when the
+// daemon is already running.
+func (i *ipvs) StartSyncDaemon(state string) error {
+	if i.syncInterface == "" {
+		return nil
+	}
+	i.logger.Infof("starting ipvs sync daemon. state=%s interface=%s syncid=%d", state, i.syncInterface, i.syncID)
+	if err := i.client.startDaemon(i.ctx, state, i.syncInterface, i.syncID); err != nil {
+		return fmt.Errorf("unable to start ipvs %s sync daemon. %v", state, err)
+	}
+	return nil
+}
+
+// Stats returns the kernel's traffic counters for every virtual service and
+// its realservers.
+func (i *ipvs) Stats() ([]stats.IPVSStats, error) {
+	return i.client.stats(i.ctx)
+}
+
+// StopSyncDaemon stops the connection sync daemon in state. Connections that
+// were synced remain in the connection table.
+func (i *ipvs) StopSyncDaemon(state string) error {
+	if i.syncInterface == "" {
+		return nil
+	}
+	i.logger.Infof("stopping ipvs sync daemon. state=%s", state)
+	if err := i.client.stopDaemon(i.ctx, state); err != nil {
+		return fmt.Errorf("unable to stop ipvs %s sync daemon. %v", state, err)
+	}
+	return nil
+}
+
+// ipvsadmClient execs ipvsadm.
+type ipvsadmClient struct{}
+
+func (c *ipvsadmClient) get(ctx context.Context) ([]string, error) {
 
 	// run the ipvsadm command
-	cmd := exec.CommandContext(i.ctx, "ipvsadm", "-Sn")
+	cmd := exec.CommandContext(ctx, "ipvsadm", "-Sn")
 	stdout, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("ipvsadm -Sn failed with %v", err)
@@ -79,12 +330,10 @@ func (i *ipvs) Get() ([]string, error) {
 	return out, nil
 }
 
-func (i *ipvs) Set(rules []string) ([]byte, error) {
-
-	i.logger.Infof("got %d ipvs rules to set", len(rules))
+func (c *ipvsadmClient) set(ctx context.Context, rules []string) ([]byte, error) {
 
 	// run the ipvsadm command
-	cmd := exec.CommandContext(i.ctx, "ipvsadm", "-R")
+	cmd := exec.CommandContext(ctx, "ipvsadm", "-R")
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, fmt.Errorf("ipvsadm -R failed with %v", err)
@@ -105,17 +354,109 @@ func (i *ipvs) Set(rules []string) ([]byte, error) {
 	return b.Bytes(), cmd.Wait()
 }
 
-func (i *ipvs) Teardown(ctx context.Context) error {
+func (c *ipvsadmClient) teardown(ctx context.Context) error {
 	cmd := exec.CommandContext(ctx, "ipvsadm", "-C")
 	return cmd.Run()
 }
 
-// XXX this thing needs not only the list of nodes, but also the list of
-// endpoints for each service in each node.
+func (c *ipvsadmClient) startDaemon(ctx context.Context, state, iface string, syncID int) error {
+	// ipvsadm --start-daemon master --mcast-interface eth0 --syncid 1
+	start := func() ([]byte, error) {
+		return exec.CommandContext(ctx, "ipvsadm", "--start-daemon", state, "--mcast-interface", iface, "--syncid", strconv.Itoa(syncID)).CombinedOutput()
+	}
+	out, err := start()
+	if err != nil && strings.Contains(string(out), "File exists") {
+		// already running. restart it if it syncs on another interface or id
+		listed, err := exec.CommandContext(ctx, "ipvsadm", "-L", "--daemon").Output()
+		if err != nil {
+			return fmt.Errorf("ipvsadm -L --daemon failed with %v", err)
+		}
+		if d, ok := parseIPVSAdmDaemons(listed)[state]; ok && d.iface == iface && d.syncID == syncID {
+			return nil
+		}
+		if err := c.stopDaemon(ctx, state); err != nil {
+			return err
+		}
+		out, err = start()
+	}
+	if err != nil {
+		return fmt.Errorf("ipvsadm --start-daemon failed with %v. %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// parseIPVSAdmDaemons returns the running sync daemons listed by
+// `ipvsadm -L --daemon`, by state:
 //
+//	master sync daemon (mcast=eth0, syncid=1)
+//	backup sync daemon (mcast=eth0, syncid=1, maxlen=1472)
+func parseIPVSAdmDaemons(out []byte) map[string]syncDaemon {
+	daemons := map[string]syncDaemon{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		begin, end := strings.Index(line, "("), strings.LastIndex(line, ")")
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "sync" || begin < 0 || end < begin {
+			continue
+		}
+		d := syncDaemon{}
+		for _, option := range strings.Split(line[begin+1:end], ",") {
+			kv := strings.SplitN(strings.TrimSpace(option), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "mcast":
+				d.iface = kv[1]
+			case "syncid":
+				d.syncID, _ = strconv.Atoi(kv[1])
+			}
+		}
+		daemons[fields[0]] = d
+	}
+	return daemons
+}
 
-// TODO: by passing in a list of endpoints, this function can generate weights in
-// accordance with the # of pods running on a given node
+func (c *ipvsadmClient) stopDaemon(ctx context.Context, state string) error {
+	cmd := exec.CommandContext(ctx, "ipvsadm", "--stop-daemon", state)
+	out, err := cmd.CombinedOutput()
+	if err != nil && strings.Contains(string(out), "No such process") {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("ipvsadm --stop-daemon failed with %v. %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (c *ipvsadmClient) stats(ctx context.Context) ([]stats.IPVSStats, error) {
+	cmd := exec.CommandContext(ctx, "ipvsadm", "-Ln", "--stats", "--exact")
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ipvsadm -Ln --stats failed with %v", err)
+	}
+	out, err := parseIPVSAdmStats(stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	// the weights and active connections are only listed without --stats
+	cmd = exec.CommandContext(ctx, "ipvsadm", "-Ln", "--exact")
+	stdout, err = cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ipvsadm -Ln failed with %v", err)
+	}
+	conns, err := parseIPVSAdmConns(stdout)
+	if err != nil {
+		return nil, err
+	}
+	for n, s := range out {
+		if rs, ok := conns[ipvsStatsKey(s)]; ok && s.RealServer != "" {
+			out[n].Weight, out[n].ActiveConnections = rs.Weight, rs.ActiveConnections
+		}
+	}
+	return out, nil
+}
 
 // generateRules takes a list of nodes and a clusterconfig and creates a complete
 // set of IPVS rules for application.
@@ -125,24 +466,31 @@ func (i *ipvs) generateRules(nodes types.NodesList, config *types.ClusterConfig)
 	rules := []string{}
 
 	for vip, ports := range config.Config {
+		// a fwmark vip is served by a single virtual service
+		if mark := config.Fwmark(vip); mark != 0 {
+			rule, err := i.serviceRule(fmt.Sprintf("-f %d", mark), fwmarkService(ports))
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %v", vip, err)
+			}
+			rules = append(rules, rule)
+			continue
+		}
+
 		// Add rules for Frontend ipvsadm
 		for port, serviceConfig := range ports {
-			rule := fmt.Sprintf(
-				"-A -t %s:%s -s %s",
-				vip,
-				port,
-				serviceConfig.IPVSOptions.Scheduler(),
-			)
+			rule, err := i.serviceRule(fmt.Sprintf("-t %s:%s", vip, port), serviceConfig)
+			if err != nil {
+				return nil, fmt.Errorf("service %s:%s: %v", vip, port, err)
+			}
 			rules = append(rules, rule)
 		}
 	}
 
-	// filter to just eligible nodes. right now this can be done at the
-	// outer scope, but if nodes are to be filtered on the basis of endpoints,
-	// this functionality may need to move to the inner loop.
+	// filter to just eligible nodes. services with the Local traffic policy
+	// are narrowed further to the nodes running their pods in realServerRules.
 	eligibleNodes := types.NodesList{}
 	for _, node := range nodes {
-		eligible, reason := node.IsEligibleBackend(config.NodeLabels, i.nodeIP, i.ignoreCordon)
+		eligible, reason := node.IsEligibleBackend(config.NodeLabels, i.nodeIP, i.ignoreCordon, i.drainTaints)
 		if !eligible {
 			i.logger.Debugf("node %s deemed inelibile. %v", i.nodeIP, reason)
 			continue
@@ -152,46 +500,292 @@ func (i *ipvs) generateRules(nodes types.NodesList, config *types.ClusterConfig)
 
 	// Next, we iterate over vips, ports, _and_ nodes to create the backend definitions
 	for vip, ports := range config.Config {
+		if mark := config.Fwmark(vip); mark != 0 {
+			// ipvsadm -a -f <mark> -r $backend:0 -g -w 1 -x 0 -y 0
+			// port 0 leaves the destination port of each packet alone
+			service := fwmarkService(ports)
+			rules = append(rules, realServerRules(fmt.Sprintf("-f %d", mark), "0", config.ForwardingMethod(vip, service), servingNodes(eligibleNodes, vip, service), service, i.weightOverride, i.defaultWeight, false)...)
+			continue
+		}
 
 		// Now iterate over the whole set of services and all of the nodes for each
 		// service writing ipvsadm rules for each element of the full set
 		for port, serviceConfig := range ports {
-			nodeSettings := getNodeWeightsAndLimits(eligibleNodes, serviceConfig, i.weightOverride, i.defaultWeight)
-			for _, n := range eligibleNodes {
-				// ipvsadm -a -t $VIP_ADDR:<port> -r $backend:<port> -g -w 1 -x 0 -y 0
-				rule := fmt.Sprintf(
-					"-a -t %s:%s -r %s:%s -%s -w %d -x %d -y %d",
-					vip, port,
-					n.IPV4(), port,
-					nodeSettings[n.IPV4()].forwardingMethod,
-					nodeSettings[n.IPV4()].weight,
-					nodeSettings[n.IPV4()].uThreshold,
-					nodeSettings[n.IPV4()].lThreshold,
-				)
-				rules = append(rules, rule)
+			rules = append(rules, realServerRules(fmt.Sprintf("-t %s:%s", vip, port), port, config.ForwardingMethod(vip, serviceConfig), servingNodes(eligibleNodes, vip, serviceConfig), serviceConfig, i.weightOverride, i.defaultWeight, false)...)
+		}
+	}
+	if i.balancer != nil {
+		rules = i.balancer.weights(rules)
+	}
+	sort.Sort(ipvsRules(rules))
+	return rules, nil
+}
+
+// generateRules6 creates the complete set of IPVS rules for the ipv6 VIPs in
+// config.Config6, balanced across the ipv6 addresses of the nodes. Nodes
+// without an ipv6 address are left out.
+func (i *ipvs) generateRules6(nodes types.NodesList, config *types.ClusterConfig) ([]string, error) {
+	rules := []string{}
+
+	eligibleNodes := types.NodesList{}
+	for _, node := range nodes {
+		eligible, reason := node.IsEligibleBackend(config.NodeLabels, i.nodeIP, i.ignoreCordon, i.drainTaints)
+		if !eligible {
+			i.logger.Debugf("node %s deemed inelibile. %v", i.nodeIP, reason)
+			continue
+		}
+		if node.IPV6() == "" {
+			i.logger.Debugf("node %s has no ipv6 address", node.IPV4())
+			continue
+		}
+		eligibleNodes = append(eligibleNodes, node)
+	}
+
+	for vip, ports := range config.Config6 {
+		for port, serviceConfig := range ports {
+			// ipvsadm -A -t [$VIP_ADDR]:<port> -s wrr
+			target := "-t " + net.JoinHostPort(string(vip), port)
+			rule, err := i.serviceRule(target, serviceConfig)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %v", target, err)
 			}
+			rules = append(rules, rule)
+			rules = append(rules, realServerRules(target, port, config.ForwardingMethod(vip, serviceConfig), servingNodes(eligibleNodes, vip, serviceConfig), serviceConfig, i.weightOverride, i.defaultWeight, true)...)
 		}
 	}
+	if i.balancer != nil {
+		rules = i.balancer.weights(rules)
+	}
 	sort.Sort(ipvsRules(rules))
 	return rules, nil
 }
 
+// familyRules returns the rules, of those read from the kernel, that belong to
+// one address family. Each family is reconciled on its own, so that neither
+// deletes the other's services. Rules that cannot be parsed go with ipv4.
+func familyRules(rules []string, ipv6 bool) []string {
+	out := []string{}
+	for _, rule := range rules {
+		r, err := parseIPVSRule(rule)
+		if (err == nil && r.service.af == unix.AF_INET6) == ipv6 {
+			out = append(out, rule)
+		}
+	}
+	return out
+}
+
+// serviceRule returns the rule for the virtual service named by target, e.g.
+// "-t 10.54.213.253:5678".
+func (i *ipvs) serviceRule(target string, serviceConfig *types.ServiceDef) (string, error) {
+	rule := fmt.Sprintf(
+		"-A %s -s %s",
+		target,
+		serviceConfig.IPVSOptions.Scheduler(),
+	)
+	if serviceConfig.IPVSOptions.Scheduler() == schedulerMaglev {
+		if err := i.schedulerAvailable(schedulerMaglev); err != nil {
+			return "", err
+		}
+	}
+	// ipvsadm -A -t $VIP_ADDR:<port> -s mh -b mh-fallback,mh-port
+	if flags := serviceConfig.IPVSOptions.SchedulerFlags(); flags != "" {
+		rule += " -b " + flags
+	}
+	// ipvsadm -A -t $VIP_ADDR:<port> -s wrr -p 300 -M 255.255.255.0
+	if persistence := serviceConfig.IPVSOptions.Persistence(); persistence > 0 {
+		rule += fmt.Sprintf(" -p %d", persistence)
+		if netmask := serviceConfig.IPVSOptions.PersistenceNetmask(); netmask != "" {
+			rule += " -M " + netmask
+		}
+	}
+	// ipvsadm -A -f <mark> -s wrr -o
+	// one-packet scheduling only applies to udp, which only fwmark services carry
+	if serviceConfig.IPVSOptions.OnePacket() && serviceConfig.UDPEnabled && strings.HasPrefix(target, "-f ") {
+		rule += " -o"
+	}
+	return rule, nil
+}
+
+// realServerRules returns a rule for each node, as a realserver of the virtual
+// service named by target, forwarded to with method. The nodes' ipv6 addresses
+// are used for ipv6 services. Services with the Local traffic policy only get
+// the nodes that run their pods.
+//
+// Only nat rewrites the destination port, so the service's target port is
+// used for nat realservers alone. Direct routed and tunneled traffic arrives
+// on the VIP's port, and nodes translate it when they DNAT to pods.
+func realServerRules(target, port, method string, nodes types.NodesList, serviceConfig *types.ServiceDef, weightOverride bool, defaultWeight int, ipv6 bool) []string {
+	rules := []string{}
+	if method == "m" && serviceConfig.TargetPort != "" {
+		port = serviceConfig.TargetPort
+	}
+	if serviceConfig.IPVSOptions.ExternalTrafficPolicy() == types.TrafficPolicyLocal {
+		nodes = localNodes(nodes, serviceConfig)
+	}
+	nodeSettings := getNodeWeightsAndLimits(nodes, serviceConfig, weightOverride, defaultWeight)
+	for _, n := range nodes {
+		address := n.IPV4()
+		if ipv6 {
+			address = "[" + n.IPV6() + "]"
+		}
+		// ipvsadm -a -t $VIP_ADDR:<port> -r $backend:<port> -g -w 1 -x 0 -y 0
+		rule := fmt.Sprintf(
+			"-a %s -r %s:%s -%s -w %d -x %d -y %d",
+			target,
+			address, port,
+			method,
+			nodeSettings[n.IPV4()].weight,
+			nodeSettings[n.IPV4()].uThreshold,
+			nodeSettings[n.IPV4()].lThreshold,
+		)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// servingNodes returns the nodes that do not exclude the service on vip.
+func servingNodes(nodes types.NodesList, vip types.ServiceIP, serviceConfig *types.ServiceDef) types.NodesList {
+	serving := types.NodesList{}
+	for _, node := range nodes {
+		if !node.Excludes(vip, serviceConfig) {
+			serving = append(serving, node)
+		}
+	}
+	return serving
+}
+
+// localNodes returns the nodes that run at least one of the service's pods.
+func localNodes(nodes types.NodesList, serviceConfig *types.ServiceDef) types.NodesList {
+	local := types.NodesList{}
+	for _, node := range nodes {
+		if getWeightForNode(node, serviceConfig) > 0 {
+			local = append(local, node)
+		}
+	}
+	return local
+}
+
 func (i *ipvs) SetIPVS(nodes types.NodesList, config *types.ClusterConfig, logger logrus.FieldLogger) error {
+	// generate a set of deletions + creations
+	if i.dryRun {
+		rules, err := i.preview(nodes, config, false)
+		if err != nil {
+			return err
+		}
+		i.logDryRun(rules, logger)
+		return nil
+	}
+	rules, err := i.diff(nodes, config, false)
+	if err != nil {
+		return err
+	}
+
+	// mark the traffic of fwmark vips before their services exist
+	if err := i.setFwmarks(config); err != nil {
+		return err
+	}
+	if err := i.setMasquerades(config); err != nil {
+		return err
+	}
+	if err := i.setNoTracks(config); err != nil {
+		return err
+	}
+	if err := i.SetDSCP(config); err != nil {
+		return err
+	}
+	return i.apply(rules, logger)
+}
+
+// SetLimits brings the filter rules of ports with maxConnections and VIPs with
+// a synRateLimit in line with config, for ipv4 and ipv6. Unlike SetIPVS, it
+// takes the VIPs that haproxy serves too.
+func (i *ipvs) SetLimits(config *types.ClusterConfig) error {
+	if i.dryRun {
+		return nil
+	}
+	if err := i.setConnLimits(config); err != nil {
+		return err
+	}
+	return i.setSynLimits(config)
+}
+
+// SetIPVS6 configures the virtual services of the ipv6 VIPs in config.Config6,
+// leaving ipv4 services alone.
+func (i *ipvs) SetIPVS6(nodes types.NodesList, config *types.ClusterConfig, logger logrus.FieldLogger) error {
+	if i.dryRun {
+		rules, err := i.preview(nodes, config, true)
+		if err != nil {
+			return err
+		}
+		i.logDryRun(rules, logger)
+		return nil
+	}
+	rules, err := i.diff(nodes, config, true)
+	if err != nil {
+		return err
+	}
+	return i.apply(rules, logger)
+}
+
+// DiffIPVS returns the rules that SetIPVS and SetIPVS6 would apply to bring
+// the live table in line with nodes and config, without applying them.
+func (i *ipvs) DiffIPVS(nodes types.NodesList, config *types.ClusterConfig) ([]string, error) {
+	rules, err := i.preview(nodes, config, false)
+	if err != nil {
+		return nil, err
+	}
+	rules6, err := i.preview(nodes, config, true)
+	if err != nil {
+		return nil, err
+	}
+	return append(rules, rules6...), nil
+}
+
+// preview is diff without side effects. merge starts draining the realservers
+// it would delete, and a preview must not, or the merge that applies the
+// rules would skip the drain.
+func (i *ipvs) preview(nodes types.NodesList, config *types.ClusterConfig, ipv6 bool) ([]string, error) {
+	draining := i.draining
+	defer func() { i.draining = draining }()
+	return i.diff(nodes, config, ipv6)
+}
+
+// diff merges the live rules of one address family with those generated.
+func (i *ipvs) diff(nodes types.NodesList, config *types.ClusterConfig, ipv6 bool) ([]string, error) {
 	// get existing rules
 	ipvsConfigured, err := i.Get()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// get config-generated rules
-	ipvsGenerated, err := i.generateRules(nodes, config)
+	generate := i.generateRules
+	if ipv6 {
+		generate = i.generateRules6
+	}
+	ipvsGenerated, err := generate(nodes, config)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return i.merge(familyRules(ipvsConfigured, ipv6), ipvsGenerated), nil
+}
 
-	// generate a set of deletions + creations
-	rules := i.merge(ipvsConfigured, ipvsGenerated)
+// logDryRun logs the rules that a dry run leaves unapplied.
+func (i *ipvs) logDryRun(rules []string, logger logrus.FieldLogger) {
+	if len(rules) == 0 {
+		logger.Info("ipvs dry run. no changes")
+		return
+	}
+	logger.Infof("ipvs dry run. %d rules not applied", len(rules))
+	for _, rule := range rules {
+		logger.Infof("dry run rule :%s:", rule)
+	}
+}
+
+func (i *ipvs) apply(rules []string, logger logrus.FieldLogger) error {
 	if len(rules) > 0 {
+		i.parity, i.parity6 = 0, 0
+		start := time.Now()
 		setBytes, err := i.Set(rules)
 		if err != nil {
 			logger.Errorf("error calling ipvs.Set. %v/%v", string(setBytes), err)
@@ -200,6 +794,7 @@ func (i *ipvs) SetIPVS(nodes types.NodesList, config *types.ClusterConfig, logge
 			}
 			return err
 		}
+		logger.Infof("applied %d ipvs rules in %v", len(rules), time.Since(start))
 	}
 	return nil
 }
@@ -213,29 +808,42 @@ type nodeConfig struct {
 	lThreshold       int
 }
 
-// getNodeWeights returns the relative weighting for each node, and computes
-// connection limits based on those weights. currently all nodes have an equal
-// weight, so the computation is easy. In the future, when endpoints are considered
-// here, perNodeX and perNodeY will be adjusted on the basis of relative weight
+// getNodeWeightsAndLimits returns the relative weighting for each node, and
+// computes connection limits on the basis of those weights. A node's weight is
+// the number of the service's pods that it runs, so that a node running three
+// pods receives three times the traffic of a node running one, and the
+// service's thresholds are divided across the nodes in the same proportion.
+// With weightOverride set, every node has defaultWeight.
 func getNodeWeightsAndLimits(nodes types.NodesList, serviceConfig *types.ServiceDef, weightOverride bool, defaultWeight int) map[string]nodeConfig {
 	nodeWeights := map[string]nodeConfig{}
 	if len(nodes) == 0 {
 		return nodeWeights
 	}
 
-	perNodeX := serviceConfig.IPVSOptions.UThreshold() / len(nodes)
-	perNodeY := serviceConfig.IPVSOptions.LThreshold() / len(nodes)
-
-	// if either of the per-node calcs exceed the limits for ipvs, nuke em both
-	if perNodeX > 65535 || perNodeY > 65535 {
-		perNodeX, perNodeY = 0, 0
-	}
-
+	weights := map[string]int{}
+	totalWeight := 0
 	for _, node := range nodes {
 		weight := defaultWeight
 		if !weightOverride {
 			weight = getWeightForNode(node, serviceConfig)
 		}
+		weights[node.IPV4()] = weight
+		totalWeight += weight
+	}
+
+	for _, node := range nodes {
+		weight := weights[node.IPV4()]
+		perNodeX, perNodeY := 0, 0
+		if totalWeight > 0 {
+			perNodeX = scaleThreshold(serviceConfig.IPVSOptions.UThreshold(), weight, totalWeight)
+			perNodeY = scaleThreshold(serviceConfig.IPVSOptions.LThreshold(), weight, totalWeight)
+		}
+
+		// if either of the per-node calcs exceed the limits for ipvs, nuke em both
+		if perNodeX > 65535 || perNodeY > 65535 {
+			perNodeX, perNodeY = 0, 0
+		}
+
 		cfg := nodeConfig{
 			forwardingMethod: serviceConfig.IPVSOptions.ForwardingMethod(),
 			weight:           weight,
@@ -248,6 +856,19 @@ func getNodeWeightsAndLimits(nodes types.NodesList, serviceConfig *types.Service
 	return nodeWeights
 }
 
+// scaleThreshold returns the share of threshold for a node of weight. A
+// positive threshold stays positive for a node that takes traffic, as a
+// threshold of 0 is no limit at all.
+func scaleThreshold(threshold, weight, totalWeight int) int {
+	scaled := threshold * weight / totalWeight
+	if threshold > 0 && weight > 0 && scaled == 0 {
+		return 1
+	}
+	return scaled
+}
+
+// getWeightForNode counts the pods of the service's port that run on node,
+// times the weight of the node.
 func getWeightForNode(node types.Node, serviceConfig *types.ServiceDef) int {
 	weight := 0
 	for _, ep := range node.Endpoints {
@@ -264,98 +885,158 @@ func getWeightForNode(node types.Node, serviceConfig *types.ServiceDef) int {
 			if !found {
 				continue
 			}
-			weight += len(subset.Addresses)
+			weight += len(subset.Addresses) * node.Weight()
 		}
 	}
 	return weight
 }
 
-// merge takes a set of configured rules and a set of generated rules then
-// creates a derived set of rules. The derived rules should only:
-// (a) Edit existing "-a" (add a real server) rules if a weight changes
-// (b) Delete ("-D") a previous existing virtual service that we no long desire
-// (c) Add ("-A") a virtual service that didn't exist before
-// (d) Delete ("-d") a realserver that we no longer desire
-// (e) Add ("-a") a realserver that didn't previously exist
-// The rules-to-apply shouldn't include any rules that don't change,
-// which means "appear in both configured and generated rules unchanged".
-// This function can modify the array named "generated" - it splices rules out of it
-// that already exist (appear in array named "configured")
+// ipvsTable holds a set of rules by service, "-t vip:port", and by
+// realserver, "-t vip:port -r rs:port", along with the text of each rule.
+type ipvsTable struct {
+	rules map[string]ipvsRule
+	text  map[string]string
+
+	// order holds the keys in the order the rules were listed
+	order []string
+
+	// invalid holds the rules that could not be parsed
+	invalid []string
+}
+
+func parseIPVSTable(rules []string) ipvsTable {
+	t := ipvsTable{rules: map[string]ipvsRule{}, text: map[string]string{}}
+	for _, rule := range rules {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		r, err := parseIPVSRule(rule)
+		if err != nil {
+			t.invalid = append(t.invalid, rule)
+			continue
+		}
+		key := r.key()
+		if _, ok := t.rules[key]; !ok {
+			t.order = append(t.order, key)
+		}
+		t.rules[key] = r
+		t.text[key] = rule
+	}
+	return t
+}
+
+// ipvsRuleEqual reports whether two rules configure a service or realserver
+// the same way. ipvsadm -Sn leaves out thresholds of 0, which generated rules
+// carry, so rules are compared parsed rather than as text.
+func ipvsRuleEqual(a, b ipvsRule, ignoreWeight bool) bool {
+	if a.isDest() {
+		return a.dest.fwdMethod == b.dest.fwdMethod &&
+			(ignoreWeight || a.dest.weight == b.dest.weight) &&
+			a.dest.uThresh == b.dest.uThresh &&
+			a.dest.lThresh == b.dest.lThresh
+	}
+	return a.service.scheduler == b.service.scheduler &&
+		a.service.flags == b.service.flags &&
+		a.service.timeout == b.service.timeout &&
+		a.service.netmask == b.service.netmask
+}
+
+// merge takes a set of configured rules and a set of generated rules, and
+// derives the rules that bring the configuration in line with the generated
+// one, leaving everything that is unchanged alone so that no connection is
+// disturbed. The derived rules:
+// (a) Edit ("-e") realservers whose weight, thresholds or forwarding method change
+// (b) Edit ("-E") virtual services whose scheduler or persistence changes
+// (c) Delete ("-d") realservers that we no longer desire. With a drain grace
+// period, the realserver is first edited to a weight of 0, so that it takes no
+// new connections, and is deleted by the first merge after the period passes.
+// (d) Delete ("-D") virtual services that we no longer desire
+// (e) Add ("-A") virtual services, and then ("-a") realservers, that didn't exist before
 func (i *ipvs) merge(configured, generated []string) []string {
-	// generate full set of rules to apply including deletions
-	rules := []string{}
-	vsDeletes := []string{}
-	rsDeletes := []string{}
+	current := parseIPVSTable(configured)
+	desired := parseIPVSTable(generated)
+	for _, rule := range current.invalid {
+		i.logger.Warnf("ignoring ipvs rule that could not be parsed :%s:", rule)
+	}
 
-	// Check if any existing rules don't have matching generated rules.  If
-	// they don't, maybe change the "add" to an "edit" or generate an
-	// appropriate delete rule.
-	for _, existing := range configured {
-		found := false
-		for idx, gen := range generated {
-			// A generated rule has a "-x N -y M" suffix, which won't appear on
-			// a configured rule, at least if N == 0 and M == 0, the defaults.
-			// Nevertheless, that generated rule is still equivalent to the
-			// configured rule for our purposes. Check for prefix instead of
-			// lexical equality.
-			if strings.HasPrefix(gen, existing) {
-				// While we're here, splice the new rule out of generated[], it already exists.
-				generated = append(generated[:idx], generated[idx+1:]...)
-				found = true
-				break
-			} else if strings.HasPrefix(gen, "-a") {
-				// This just might be a weight changing: "-a -t 10.54.213.253:5678 -r 10.54.213.246:5678 -i -w X"
-				// where the "X" is different between configured and generated.
-				// This is pretty brittle, depends heavily on format of output
-				// of "ipvsadm -Sn"
-				genAry := strings.Split(gen, "-w ")
-				existingAry := strings.Split(existing, "-w ")
-				if len(genAry) == 2 && len(existingAry) == 2 {
-					if genAry[0] == existingAry[0] && genAry[1] != existingAry[1] {
-						// Weights are different. Make a "-e" for edit command
-						edit := strings.Replace(gen, "-a", "-e", 1)
-						i.logger.Debugf("Made -a command into -e command :%s:\n", edit)
-						// Remove the "-a" rule from array "generated", on to array "rules"
-						generated = append(generated[:idx], generated[idx+1:]...)
-						rules = append(rules, edit)
-						found = true // don't need to generate a "-d" for this
-					}
-				}
+	edits := []string{}
+	adds := []string{}
+	for _, key := range desired.order {
+		want := desired.rules[key]
+		have, ok := current.rules[key]
+		if !ok {
+			adds = append(adds, desired.text[key])
+			continue
+		}
+		if !ipvsRuleEqual(have, want, false) {
+			// "-A" becomes "-E" and "-a" becomes "-e"
+			edit := "-E" + desired.text[key][2:]
+			if want.isDest() {
+				edit = "-e" + desired.text[key][2:]
 			}
+			i.logger.Debugf("Made %s command into %s command :%s:\n", desired.text[key][:2], edit[:2], edit)
+			edits = append(edits, edit)
 		}
-		if found {
-			// existing rule is idential to some generated rule
-			// in all relevant (IP:port) aspects, or it ended up as
-			// an edit, so don't bother doing anything
+	}
+
+	rsDeletes := []string{}
+	vsDeletes := []string{}
+	draining := map[string]time.Time{}
+	for _, key := range current.order {
+		if _, ok := desired.rules[key]; ok {
 			continue
 		}
-		// Need a deletion rule, as existing rule no longer has a virtual or real
-		// server that should get packets routed to it.
-		existing = strings.Replace(existing, "-A", "-D", -1)
-		existing = strings.Replace(existing, "-a", "-d", -1)
-		if strings.HasPrefix(existing, "-D") {
-			vsDeletes = append(vsDeletes, strings.Join(strings.Split(existing, " ")[:3], " "))
-		} else if strings.HasPrefix(existing, "-d") {
-			rsDeletes = append(rsDeletes, strings.Join(strings.Split(existing, " ")[:5], " "))
+		have := current.rules[key]
+		if !have.isDest() {
+			vsDeletes = append(vsDeletes, "-D "+key)
+			continue
 		}
+
+		// realservers are drained, rather than deleted, from services that remain
+		if _, ok := desired.rules[have.service.target()]; ok && i.drainGracePeriod > 0 {
+			started, ok := i.draining[key]
+			if !ok {
+				// ipvsadm -e -t $VIP_ADDR:<port> -r $backend:<port> -g -w 0
+				started = time.Now()
+				drain := have.dest
+				drain.weight = 0
+				i.logger.Infof("draining realserver :%s:", key)
+				edits = append(edits, "-e"+drain.rule(have.service)[2:])
+			}
+			if time.Since(started) < i.drainGracePeriod {
+				draining[key] = started
+				continue
+			}
+		}
+		rsDeletes = append(rsDeletes, "-d "+key)
 	}
-	// Array "rules" might have "-e" edit commands in it already.
-	// Do all the "-d" rules before the "-D" rules, otherwise
-	// ipvadm -R says there's a problem.
-	if len(rsDeletes) > 0 {
-		rules = append(rules, rsDeletes...)
-	}
-	if len(vsDeletes) > 0 {
-		rules = append(rules, vsDeletes...)
+	// realservers that are no longer draining were deleted, or came back. those
+	// of the other address family, which were not merged here, are kept until
+	// their grace period would have passed.
+	for key, started := range i.draining {
+		if _, ok := current.rules[key]; !ok && time.Since(started) < i.drainGracePeriod {
+			draining[key] = started
+		}
 	}
-	// if any generated rules remain ("-a" or "-A"), append them
-	return append(rules, generated...)
+	i.draining = draining
+
+	// Do all the "-d" rules before the "-D" rules, otherwise
+	// ipvadm -R says there's a problem. The generated rules list
+	// services ahead of their realservers.
+	rules := append(edits, rsDeletes...)
+	rules = append(rules, vsDeletes...)
+	return append(rules, adds...)
 }
 
 // returns an error if the configurations generated from d.Nodes and d.ConfigMap
 // are different than the configurations that are applied in IPVS. This enables for
 // nodes and configmaps to be stored declaratively, and for configuration to be
 // reconciled outside of a typical event loop.
+//
+// Once the comparison finds parity, it is skipped for as long as the nodes,
+// config and addresses hash the same and nothing has been applied since. Changes
+// made to the table by anything else are then only caught by a forced
+// reconfigure.
 func (i *ipvs) CheckConfigParity(nodes types.NodesList, config *types.ClusterConfig, addresses []string, newConfig bool) (bool, error) {
 
 	// =======================================================
@@ -365,6 +1046,20 @@ func (i *ipvs) CheckConfigParity(nodes types.NodesList, config *types.ClusterCon
 		return true, nil
 	}
 
+	hash := parityHash(nodes, config, addresses, newConfig)
+	if hash != 0 && hash == i.parity {
+		return true, nil
+	}
+	same, err := i.checkConfigParity(nodes, config, addresses, newConfig)
+	if same && err == nil {
+		i.parity = hash
+	} else {
+		i.parity = 0
+	}
+	return same, err
+}
+
+func (i *ipvs) checkConfigParity(nodes types.NodesList, config *types.ClusterConfig, addresses []string, newConfig bool) (bool, error) {
 	// get desired set of VIP addresses
 	vips := []string{}
 	for ip, _ := range config.Config {
@@ -380,6 +1075,7 @@ func (i *ipvs) CheckConfigParity(nodes types.NodesList, config *types.ClusterCon
 	if err != nil {
 		return false, err
 	}
+	ipvsConfigured = familyRules(ipvsConfigured, false)
 
 	// generate desired ipvs configurations
 	ipvsGenerated, err := i.generateRules(nodes, config)
@@ -396,45 +1092,69 @@ func (i *ipvs) CheckConfigParity(nodes types.NodesList, config *types.ClusterCon
 	return ipvsEquality(ipvsConfigured, ipvsGenerated, newConfig), nil
 }
 
-// Equality for the IPVS IP addresses currently existing (ipvsConfigured)
-// and the IP addresses we want to be configured (ipvsGenerated) means that
-// all addresses in ipvsConfigured have to exist in ipvsGenerated,
-// and all addresses in ipvsGenerated have to exist in ipvsConfigured.
-// This is like Set Theory's set equality: (A subset of B) and (B subset of A)
-// Unfortunately, we have 2 arrays to determine "subset of", and the IP addresses
-// don't appear the same way in each array.
+// CheckConfigParity6 returns true if the ipv6 virtual services match those
+// generated from nodes and config.
+// Like CheckConfigParity, the comparison is skipped while the inputs hash the
+// same as when it last found parity.
+func (i *ipvs) CheckConfigParity6(nodes types.NodesList, config *types.ClusterConfig) (bool, error) {
+	if nodes == nil || config == nil {
+		return true, nil
+	}
+
+	hash := parityHash(nodes, config, nil, false)
+	if hash != 0 && hash == i.parity6 {
+		return true, nil
+	}
+	i.parity6 = 0
+	ipvsConfigured, err := i.Get()
+	if err != nil {
+		return false, err
+	}
+	ipvsGenerated, err := i.generateRules6(nodes, config)
+	if err != nil {
+		return false, fmt.Errorf("generating IPVS rules: %v", err)
+	}
+	same := ipvsEquality(familyRules(ipvsConfigured, true), ipvsGenerated, false)
+	if same {
+		i.parity6 = hash
+	}
+	return same, nil
+}
+
+// parityHash returns a hash of the inputs to a parity check, or 0 if they
+// cannot be hashed. encoding/json writes map keys in sorted order, so equal
+// inputs hash the same.
+func parityHash(nodes types.NodesList, config *types.ClusterConfig, addresses []string, newConfig bool) uint64 {
+	b, err := json.Marshal(struct {
+		Nodes     types.NodesList
+		Config    *types.ClusterConfig
+		Addresses []string
+		NewConfig bool
+	}{nodes, config, addresses, newConfig})
+	if err != nil {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// ipvsEquality reports whether the rules currently configured
+// (ipvsConfigured) are the ones we want to be configured (ipvsGenerated): the
+// same services and realservers, with the same options. If it's a brand new
+// configuration, weights don't matter.
 func ipvsEquality(ipvsConfigured []string, ipvsGenerated []string, newConfig bool) bool {
-	if len(ipvsConfigured) != len(ipvsGenerated) {
+	current := parseIPVSTable(ipvsConfigured)
+	desired := parseIPVSTable(ipvsGenerated)
+	if len(current.rules) != len(desired.rules) {
 		return false
 	}
-	for _, existing := range ipvsConfigured {
-		found := false
-		for i, desired := range ipvsGenerated {
-			// If it's a brand new configuration, weight don't matter, otherwise, they do
-			// weights only appear on "-a" rules
-			if newConfig && strings.HasPrefix(desired, "-a") {
-				desiredAry := strings.Split(desired, "-w ")
-				existingAry := strings.Split(existing, "-w ")
-				if desiredAry[0] == existingAry[0] {
-					ipvsGenerated = append(ipvsGenerated[:i], ipvsGenerated[i+1:]...)
-					found = true
-					break
-				}
-			} else if strings.HasPrefix(desired, existing) { // desired will have "-x 0 -y 0" suffix
-				ipvsGenerated = append(ipvsGenerated[:i], ipvsGenerated[i+1:]...)
-				found = true
-				break
-			}
-		}
-		if !found {
-			// the IP address represented by value of "existing" isn't in desired IPs
+	for key, want := range desired.rules {
+		have, ok := current.rules[key]
+		if !ok || !ipvsRuleEqual(have, want, newConfig) {
 			return false
 		}
 	}
-	if len(ipvsGenerated) > 0 {
-		// There's a new IP address desired that isn't configured
-		return false
-	}
 	return true
 }
 
@@ -0,0 +1,880 @@
+package system
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
+)
+
+// The IPVS generic netlink family, from include/uapi/linux/ip_vs.h.
+const (
+	ipvsGenlName    = "IPVS"
+	ipvsGenlVersion = 1
+
+	ipvsCmdNewService = 1
+	ipvsCmdSetService = 2
+	ipvsCmdDelService = 3
+	ipvsCmdGetService = 4
+	ipvsCmdNewDest    = 5
+	ipvsCmdSetDest    = 6
+	ipvsCmdDelDest    = 7
+	ipvsCmdGetDest    = 8
+	ipvsCmdNewDaemon  = 9
+	ipvsCmdDelDaemon  = 10
+	ipvsCmdGetDaemon  = 11
+	ipvsCmdFlush      = 17
+
+	ipvsCmdAttrService = 1
+	ipvsCmdAttrDest    = 2
+	ipvsCmdAttrDaemon  = 3
+
+	ipvsSvcAttrAF        = 1
+	ipvsSvcAttrProtocol  = 2
+	ipvsSvcAttrAddr      = 3
+	ipvsSvcAttrPort      = 4
+	ipvsSvcAttrFwmark    = 5
+	ipvsSvcAttrSchedName = 6
+	ipvsSvcAttrFlags     = 7
+	ipvsSvcAttrTimeout   = 8
+	ipvsSvcAttrNetmask   = 9
+	ipvsSvcAttrStats     = 10
+	ipvsSvcAttrStats64   = 12
+
+	ipvsDestAttrAddr      = 1
+	ipvsDestAttrPort      = 2
+	ipvsDestAttrFwdMethod = 3
+	ipvsDestAttrWeight    = 4
+	ipvsDestAttrUThresh   = 5
+	ipvsDestAttrLThresh   = 6
+	ipvsDestAttrActive    = 7
+	ipvsDestAttrStats     = 10
+	ipvsDestAttrStats64   = 12
+
+	ipvsStatsAttrConns    = 1
+	ipvsStatsAttrInPkts   = 2
+	ipvsStatsAttrOutPkts  = 3
+	ipvsStatsAttrInBytes  = 4
+	ipvsStatsAttrOutBytes = 5
+
+	ipvsDaemonAttrState   = 1
+	ipvsDaemonAttrMcastIf = 2
+	ipvsDaemonAttrSyncID  = 3
+
+	ipvsStateMaster = 1
+	ipvsStateBackup = 2
+
+	netlinkReceiveBuffer = 1 << 16
+
+	// netlinkReceiveTimeout bounds the wait for each reply from the kernel,
+	// so that a lost reply fails the call rather than blocking the worker.
+	netlinkReceiveTimeout = 10 * time.Second
+
+	// netlinkBatchSize bounds the bytes of requests written at once. The
+	// kernel acknowledges each request of a batch before the next batch is
+	// written, and the acknowledgements must fit the socket's receive buffer.
+	netlinkBatchSize = 1 << 15
+)
+
+// nativeEndian is the byte order of netlink headers and of most attributes.
+var nativeEndian binary.ByteOrder
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// netlinkCommand returns the IPVS command and attributes that carry out the rule.
+func (r ipvsRule) netlinkCommand() (uint8, netlinkAttrs) {
+	attrs := netlinkAttrs{}
+	var cmd uint8
+	switch r.command {
+	case "-A":
+		cmd = ipvsCmdNewService
+	case "-E":
+		cmd = ipvsCmdSetService
+	case "-D":
+		cmd = ipvsCmdDelService
+	case "-a":
+		cmd = ipvsCmdNewDest
+	case "-e":
+		cmd = ipvsCmdSetDest
+	case "-d":
+		cmd = ipvsCmdDelDest
+	}
+
+	// deletions only identify the service or realserver
+	full := r.command != "-D" && r.command != "-d"
+	if !r.isDest() {
+		attrs.addNested(ipvsCmdAttrService, r.service.attrs(full))
+		return cmd, attrs
+	}
+	attrs.addNested(ipvsCmdAttrService, r.service.attrs(false))
+	attrs.addNested(ipvsCmdAttrDest, r.dest.attrs(r.service.af, full))
+	return cmd, attrs
+}
+
+// ipvsAddressBytes returns the 16 byte nf_inet_addr form of ip.
+func ipvsAddressBytes(ip net.IP, af uint16) []byte {
+	b := make([]byte, 16)
+	if af == unix.AF_INET {
+		copy(b, ip.To4())
+	} else {
+		copy(b, ip.To16())
+	}
+	return b
+}
+
+func ipvsAddressFromBytes(b []byte, af uint16) net.IP {
+	if af == unix.AF_INET && len(b) >= 4 {
+		return net.IP(append([]byte{}, b[:4]...))
+	}
+	if len(b) >= 16 {
+		return net.IP(append([]byte{}, b[:16]...))
+	}
+	return nil
+}
+
+// attrs encodes the service. The identifying attributes are always present,
+// the rest only when full is set, as required by the NEW and SET commands.
+func (s ipvsService) attrs(full bool) netlinkAttrs {
+	a := netlinkAttrs{}
+	a.addUint16(ipvsSvcAttrAF, s.af)
+	if s.fwmark != 0 {
+		a.addUint32(ipvsSvcAttrFwmark, s.fwmark)
+	} else {
+		a.addUint16(ipvsSvcAttrProtocol, s.protocol)
+		a.add(ipvsSvcAttrAddr, ipvsAddressBytes(s.addr, s.af))
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, s.port)
+		a.add(ipvsSvcAttrPort, port)
+	}
+	if !full {
+		return a
+	}
+
+	a.addString(ipvsSvcAttrSchedName, s.scheduler)
+	flags := make([]byte, 8)
+	nativeEndian.PutUint32(flags[0:4], s.flags)
+	nativeEndian.PutUint32(flags[4:8], 0xffffffff)
+	a.add(ipvsSvcAttrFlags, flags)
+	a.addUint32(ipvsSvcAttrTimeout, s.timeout)
+	// the kernel keeps an ipv4 netmask in network byte order, and an ipv6
+	// prefix length as it is given
+	netmask := make([]byte, 4)
+	if s.af == unix.AF_INET {
+		binary.BigEndian.PutUint32(netmask, s.netmask)
+	} else {
+		nativeEndian.PutUint32(netmask, s.netmask)
+	}
+	a.add(ipvsSvcAttrNetmask, netmask)
+	return a
+}
+
+func parseIPVSService(b []byte) (ipvsService, error) {
+	s := ipvsService{}
+	attrs, err := parseNetlinkAttrs(b)
+	if err != nil {
+		return s, err
+	}
+	s.af = attrs.uint16(ipvsSvcAttrAF)
+	s.protocol = attrs.uint16(ipvsSvcAttrProtocol)
+	s.addr = ipvsAddressFromBytes(attrs[ipvsSvcAttrAddr], s.af)
+	if port := attrs[ipvsSvcAttrPort]; len(port) >= 2 {
+		s.port = binary.BigEndian.Uint16(port)
+	}
+	s.fwmark = attrs.uint32(ipvsSvcAttrFwmark)
+	s.scheduler = strings.TrimRight(string(attrs[ipvsSvcAttrSchedName]), "\x00")
+	s.flags = attrs.uint32(ipvsSvcAttrFlags)
+	s.timeout = attrs.uint32(ipvsSvcAttrTimeout)
+	if netmask := attrs[ipvsSvcAttrNetmask]; len(netmask) >= 4 {
+		if s.af == unix.AF_INET {
+			s.netmask = binary.BigEndian.Uint32(netmask)
+		} else {
+			s.netmask = nativeEndian.Uint32(netmask)
+		}
+	}
+	return s, nil
+}
+
+func (d ipvsDest) attrs(af uint16, full bool) netlinkAttrs {
+	a := netlinkAttrs{}
+	a.add(ipvsDestAttrAddr, ipvsAddressBytes(d.addr, af))
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, d.port)
+	a.add(ipvsDestAttrPort, port)
+	if !full {
+		return a
+	}
+	a.addUint32(ipvsDestAttrFwdMethod, d.fwdMethod)
+	a.addUint32(ipvsDestAttrWeight, d.weight)
+	a.addUint32(ipvsDestAttrUThresh, d.uThresh)
+	a.addUint32(ipvsDestAttrLThresh, d.lThresh)
+	return a
+}
+
+func parseIPVSDest(b []byte, af uint16) (ipvsDest, error) {
+	d := ipvsDest{}
+	attrs, err := parseNetlinkAttrs(b)
+	if err != nil {
+		return d, err
+	}
+	d.addr = ipvsAddressFromBytes(attrs[ipvsDestAttrAddr], af)
+	if port := attrs[ipvsDestAttrPort]; len(port) >= 2 {
+		d.port = binary.BigEndian.Uint16(port)
+	}
+	d.fwdMethod = attrs.uint32(ipvsDestAttrFwdMethod)
+	d.weight = attrs.uint32(ipvsDestAttrWeight)
+	d.uThresh = attrs.uint32(ipvsDestAttrUThresh)
+	d.lThresh = attrs.uint32(ipvsDestAttrLThresh)
+	return d, nil
+}
+
+// =====================================================================================================
+
+// netlinkAttrs is a sequence of encoded netlink attributes.
+type netlinkAttrs []byte
+
+func (a *netlinkAttrs) add(typ uint16, data []byte) {
+	hdr := make([]byte, unix.SizeofNlAttr)
+	nativeEndian.PutUint16(hdr[0:2], uint16(unix.SizeofNlAttr+len(data)))
+	nativeEndian.PutUint16(hdr[2:4], typ)
+	*a = append(*a, hdr...)
+	*a = append(*a, data...)
+	for len(*a)%unix.NLA_ALIGNTO != 0 {
+		*a = append(*a, 0)
+	}
+}
+
+func (a *netlinkAttrs) addUint16(typ uint16, v uint16) {
+	b := make([]byte, 2)
+	nativeEndian.PutUint16(b, v)
+	a.add(typ, b)
+}
+
+func (a *netlinkAttrs) addUint32(typ uint16, v uint32) {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	a.add(typ, b)
+}
+
+func (a *netlinkAttrs) addString(typ uint16, v string) {
+	a.add(typ, append([]byte(v), 0))
+}
+
+func (a *netlinkAttrs) addNested(typ uint16, nested netlinkAttrs) {
+	a.add(typ|unix.NLA_F_NESTED, nested)
+}
+
+// parsedAttrs holds attribute payloads by type.
+type parsedAttrs map[uint16][]byte
+
+func parseNetlinkAttrs(b []byte) (parsedAttrs, error) {
+	attrs := parsedAttrs{}
+	for len(b) >= unix.SizeofNlAttr {
+		l := int(nativeEndian.Uint16(b[0:2]))
+		typ := nativeEndian.Uint16(b[2:4]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		if l < unix.SizeofNlAttr || l > len(b) {
+			return nil, fmt.Errorf("malformed netlink attribute")
+		}
+		attrs[typ] = b[unix.SizeofNlAttr:l]
+		aligned := (l + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return attrs, nil
+}
+
+func (a parsedAttrs) uint16(typ uint16) uint16 {
+	if b := a[typ]; len(b) >= 2 {
+		return nativeEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (a parsedAttrs) uint32(typ uint16) uint32 {
+	if b := a[typ]; len(b) >= 4 {
+		return nativeEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (a parsedAttrs) uint64(typ uint16) uint64 {
+	if b := a[typ]; len(b) >= 8 {
+		return nativeEndian.Uint64(b)
+	}
+	return 0
+}
+
+// =====================================================================================================
+
+// netlinkClient programs IPVS over generic netlink, without the cost of
+// starting ipvsadm and having it parse and resolve the whole rule set on every
+// reconfigure.
+type netlinkClient struct {
+	sync.Mutex
+
+	// family is the id of the IPVS generic netlink family, once resolved
+	family uint16
+}
+
+func newNetlinkClient() *netlinkClient {
+	return &netlinkClient{}
+}
+
+// netlinkConn is a generic netlink socket, used for the span of one call.
+type netlinkConn struct {
+	fd  int
+	seq uint32
+}
+
+func dialNetlink() (*netlinkConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_GENERIC)
+	if err != nil {
+		return nil, fmt.Errorf("opening netlink socket: %v", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("binding netlink socket: %v", err)
+	}
+	if err := setReceiveTimeout(fd, netlinkReceiveTimeout); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("setting netlink receive timeout: %v", err)
+	}
+	return &netlinkConn{fd: fd}, nil
+}
+
+func setReceiveTimeout(fd int, timeout time.Duration) error {
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	return unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+}
+
+// receive reads the next datagram from the kernel into buf.
+func (c *netlinkConn) receive(buf []byte) (int, error) {
+	n, _, err := unix.Recvfrom(c.fd, buf, 0)
+	if err == unix.EAGAIN {
+		return 0, fmt.Errorf("no reply from netlink within %v", netlinkReceiveTimeout)
+	}
+	return n, err
+}
+
+func (c *netlinkConn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// request sends a generic netlink message and returns the attributes of each
+// message in the reply. Requests that are not dumps wait for the kernel's
+// acknowledgement, so that errors are returned.
+func (c *netlinkConn) request(family uint16, cmd uint8, dump bool, attrs netlinkAttrs) ([][]byte, error) {
+	flags := uint16(unix.NLM_F_REQUEST)
+	if dump {
+		flags |= unix.NLM_F_DUMP
+	} else {
+		flags |= unix.NLM_F_ACK
+	}
+
+	msg := c.message(family, cmd, flags, attrs)
+	if err := unix.Sendto(c.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	replies := [][]byte{}
+	buf := make([]byte, netlinkReceiveBuffer)
+	for {
+		n, err := c.receive(buf)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_DONE, unix.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if code := int32(nativeEndian.Uint32(m.Data[0:4])); code < 0 {
+						return nil, syscall.Errno(-code)
+					}
+				}
+				return replies, nil
+			default:
+				if len(m.Data) < unix.GENL_HDRLEN {
+					continue
+				}
+				// copied, buf is reused by the next receive
+				replies = append(replies, append([]byte{}, m.Data[unix.GENL_HDRLEN:]...))
+			}
+		}
+	}
+}
+
+// message formats a generic netlink message with the next sequence number.
+func (c *netlinkConn) message(family uint16, cmd uint8, flags uint16, attrs netlinkAttrs) []byte {
+	c.seq++
+	msg := make([]byte, unix.NLMSG_HDRLEN+unix.GENL_HDRLEN, unix.NLMSG_HDRLEN+unix.GENL_HDRLEN+len(attrs))
+	msg = append(msg, attrs...)
+	nativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:6], family)
+	nativeEndian.PutUint16(msg[6:8], flags)
+	nativeEndian.PutUint32(msg[8:12], c.seq)
+	msg[unix.NLMSG_HDRLEN] = cmd
+	msg[unix.NLMSG_HDRLEN+1] = ipvsGenlVersion
+	return msg
+}
+
+// netlinkRequest is a command and its attributes, one of a batch.
+type netlinkRequest struct {
+	cmd   uint8
+	attrs netlinkAttrs
+}
+
+// batch sends requests several to a write, rather than waiting for the
+// acknowledgement of each before sending the next. The kernel carries on past
+// a request that fails within a write, so the error of the first request to
+// fail is returned along with its index, once the write's requests have all
+// been acknowledged. No further writes are made after a failure.
+func (c *netlinkConn) batch(ctx context.Context, family uint16, requests []netlinkRequest) (int, error) {
+	for start := 0; start < len(requests); {
+		if err := ctx.Err(); err != nil {
+			return start, err
+		}
+
+		first := c.seq + 1
+		buf := []byte{}
+		end := start
+		for ; end < len(requests); end++ {
+			msg := c.message(family, requests[end].cmd, unix.NLM_F_REQUEST|unix.NLM_F_ACK, requests[end].attrs)
+			buf = append(buf, msg...)
+			if len(buf) >= netlinkBatchSize {
+				end++
+				break
+			}
+		}
+		if err := unix.Sendto(c.fd, buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+			return start, err
+		}
+
+		failed, err := c.acks(first, c.seq)
+		if err != nil {
+			return start + int(failed-first), err
+		}
+		start = end
+	}
+	return len(requests), nil
+}
+
+// acks waits for the acknowledgements of the requests numbered first to last,
+// and returns the first of them to fail.
+func (c *netlinkConn) acks(first, last uint32) (uint32, error) {
+	pending := last - first + 1
+	failed, failure := last+1, error(nil)
+
+	buf := make([]byte, netlinkReceiveBuffer)
+	for pending > 0 {
+		n, err := c.receive(buf)
+		if err != nil {
+			return first, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return first, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq < first || m.Header.Seq > last || m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			pending--
+			if len(m.Data) < 4 {
+				continue
+			}
+			if code := int32(nativeEndian.Uint32(m.Data[0:4])); code < 0 && m.Header.Seq < failed {
+				failed, failure = m.Header.Seq, syscall.Errno(-code)
+			}
+		}
+	}
+	return failed, failure
+}
+
+// dial opens a connection and resolves the IPVS family on first use.
+func (n *netlinkClient) dial() (*netlinkConn, error) {
+	c, err := dialNetlink()
+	if err != nil {
+		return nil, err
+	}
+	if n.family != 0 {
+		return c, nil
+	}
+
+	attrs := netlinkAttrs{}
+	attrs.addString(unix.CTRL_ATTR_FAMILY_NAME, ipvsGenlName)
+	replies, err := c.request(unix.GENL_ID_CTRL, unix.CTRL_CMD_GETFAMILY, false, attrs)
+	if err == syscall.ENOENT {
+		err = fmt.Errorf("the %s generic netlink family is not registered. is the ip_vs module loaded?", ipvsGenlName)
+	}
+	for _, reply := range replies {
+		parsed, perr := parseNetlinkAttrs(reply)
+		if perr == nil && parsed.uint16(unix.CTRL_ATTR_FAMILY_ID) != 0 {
+			n.family = parsed.uint16(unix.CTRL_ATTR_FAMILY_ID)
+		}
+	}
+	if err == nil && n.family == 0 {
+		err = fmt.Errorf("no family id for %s in the netlink reply", ipvsGenlName)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("resolving the IPVS netlink family: %v", err)
+	}
+	return c, nil
+}
+
+func (n *netlinkClient) get(ctx context.Context) ([]string, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	c, err := n.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	services, err := n.list(c)
+	if err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for _, s := range services {
+		out = append(out, s.rule())
+		for _, d := range s.dests {
+			out = append(out, d.rule(s.ipvsService))
+		}
+	}
+	return out, nil
+}
+
+func (n *netlinkClient) stats(ctx context.Context) ([]stats.IPVSStats, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	c, err := n.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	services, err := n.list(c)
+	if err != nil {
+		return nil, err
+	}
+	out := []stats.IPVSStats{}
+	for _, s := range services {
+		out = append(out, s.counters.stats(s.ipvsService, ""))
+		for _, d := range s.dests {
+			rs := d.counters.stats(s.ipvsService, formatIPVSAddress(d.addr, d.port))
+			rs.Weight = int(d.weight)
+			out = append(out, rs)
+		}
+	}
+	return out, nil
+}
+
+// listedService is a virtual service as dumped by the kernel, with its
+// realservers and the counters of each.
+type listedService struct {
+	ipvsService
+	counters ipvsCounters
+	dests    []listedDest
+}
+
+type listedDest struct {
+	ipvsDest
+	counters ipvsCounters
+}
+
+// list dumps the virtual services and their realservers, sorted.
+func (n *netlinkClient) list(c *netlinkConn) ([]listedService, error) {
+	replies, err := c.request(n.family, ipvsCmdGetService, true, nil)
+	if err != nil {
+		return nil, fmt.Errorf("listing IPVS services: %v", err)
+	}
+	services := ipvsServices{}
+	counters := map[string]ipvsCounters{}
+	for _, reply := range replies {
+		attrs, err := parseNetlinkAttrs(reply)
+		if err != nil {
+			return nil, err
+		}
+		s, err := parseIPVSService(attrs[ipvsCmdAttrService])
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+		counters[s.target()] = parseIPVSCounters(attrs[ipvsCmdAttrService], ipvsSvcAttrStats64, ipvsSvcAttrStats)
+	}
+	sort.Sort(services)
+
+	out := []listedService{}
+	for _, s := range services {
+		listed := listedService{ipvsService: s, counters: counters[s.target()]}
+
+		req := netlinkAttrs{}
+		req.addNested(ipvsCmdAttrService, s.attrs(false))
+		replies, err := c.request(n.family, ipvsCmdGetDest, true, req)
+		if err != nil {
+			return nil, fmt.Errorf("listing realservers of %s: %v", s.target(), err)
+		}
+		dests := ipvsDests{}
+		destCounters := map[string]ipvsCounters{}
+		for _, reply := range replies {
+			attrs, err := parseNetlinkAttrs(reply)
+			if err != nil {
+				return nil, err
+			}
+			d, err := parseIPVSDest(attrs[ipvsCmdAttrDest], s.af)
+			if err != nil {
+				return nil, err
+			}
+			dests = append(dests, d)
+			counters := parseIPVSCounters(attrs[ipvsCmdAttrDest], ipvsDestAttrStats64, ipvsDestAttrStats)
+			if destAttrs, err := parseNetlinkAttrs(attrs[ipvsCmdAttrDest]); err == nil {
+				counters.activeConns = uint64(destAttrs.uint32(ipvsDestAttrActive))
+			}
+			destCounters[formatIPVSAddress(d.addr, d.port)] = counters
+		}
+		sort.Sort(dests)
+		for _, d := range dests {
+			listed.dests = append(listed.dests, listedDest{ipvsDest: d, counters: destCounters[formatIPVSAddress(d.addr, d.port)]})
+		}
+		out = append(out, listed)
+	}
+	return out, nil
+}
+
+// parseIPVSCounters reads the counters nested in service or realserver
+// attributes. Kernels since 4.1 send 64 bit counters. Older ones send
+// connections and packets as 32 bits.
+func parseIPVSCounters(b []byte, stats64, stats32 uint16) ipvsCounters {
+	attrs, err := parseNetlinkAttrs(b)
+	if err != nil {
+		return ipvsCounters{}
+	}
+	if nested, ok := attrs[stats64]; ok {
+		counters, err := parseNetlinkAttrs(nested)
+		if err != nil {
+			return ipvsCounters{}
+		}
+		return ipvsCounters{
+			conns:    counters.uint64(ipvsStatsAttrConns),
+			inPkts:   counters.uint64(ipvsStatsAttrInPkts),
+			outPkts:  counters.uint64(ipvsStatsAttrOutPkts),
+			inBytes:  counters.uint64(ipvsStatsAttrInBytes),
+			outBytes: counters.uint64(ipvsStatsAttrOutBytes),
+		}
+	}
+	counters, err := parseNetlinkAttrs(attrs[stats32])
+	if err != nil {
+		return ipvsCounters{}
+	}
+	return ipvsCounters{
+		conns:    uint64(counters.uint32(ipvsStatsAttrConns)),
+		inPkts:   uint64(counters.uint32(ipvsStatsAttrInPkts)),
+		outPkts:  uint64(counters.uint32(ipvsStatsAttrOutPkts)),
+		inBytes:  counters.uint64(ipvsStatsAttrInBytes),
+		outBytes: counters.uint64(ipvsStatsAttrOutBytes),
+	}
+}
+
+// set applies rules in order, stopping at the first that fails, the way
+// ipvsadm -R does. Rules are written to the kernel in batches, so the rules
+// that follow a failed one in its batch are still applied. No output is
+// produced.
+func (n *netlinkClient) set(ctx context.Context, rules []string) ([]byte, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	c, err := n.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	applied := []string{}
+	requests := []netlinkRequest{}
+	for _, rule := range rules {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		r, err := parseIPVSRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		cmd, attrs := r.netlinkCommand()
+		applied = append(applied, rule)
+		requests = append(requests, netlinkRequest{cmd: cmd, attrs: attrs})
+	}
+
+	if failed, err := c.batch(ctx, n.family, requests); err != nil {
+		if failed < len(applied) {
+			return nil, fmt.Errorf("applying rule %q: %v", applied[failed], err)
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (n *netlinkClient) teardown(ctx context.Context) error {
+	n.Lock()
+	defer n.Unlock()
+
+	c, err := n.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if _, err := c.request(n.family, ipvsCmdFlush, false, nil); err != nil {
+		return fmt.Errorf("flushing IPVS: %v", err)
+	}
+	return nil
+}
+
+// daemonState returns the kernel's value for a sync daemon state.
+func daemonState(state string) (uint32, error) {
+	switch state {
+	case SyncDaemonMaster:
+		return ipvsStateMaster, nil
+	case SyncDaemonBackup:
+		return ipvsStateBackup, nil
+	}
+	return 0, fmt.Errorf("unknown sync daemon state %q", state)
+}
+
+// startDaemon starts a sync daemon. A daemon that is already running on iface
+// with syncID is left alone, and one running with other settings is
+// restarted.
+func (n *netlinkClient) startDaemon(ctx context.Context, state, iface string, syncID int) error {
+	err := n.daemon(ipvsCmdNewDaemon, state, iface, syncID)
+	if err != syscall.EEXIST {
+		return err
+	}
+	running, err := n.daemons()
+	if err != nil {
+		return err
+	}
+	if d, ok := running[state]; ok && d.iface == iface && d.syncID == syncID {
+		return nil
+	}
+	if err := n.stopDaemon(ctx, state); err != nil {
+		return err
+	}
+	return n.daemon(ipvsCmdNewDaemon, state, iface, syncID)
+}
+
+// stopDaemon stops a sync daemon. Stopping a stopped one succeeds, as with
+// ipvsadm.
+func (n *netlinkClient) stopDaemon(ctx context.Context, state string) error {
+	if err := n.daemon(ipvsCmdDelDaemon, state, "", 0); err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// syncDaemon is the settings of a running sync daemon
+type syncDaemon struct {
+	iface  string
+	syncID int
+}
+
+// daemons returns the running sync daemons by state.
+func (n *netlinkClient) daemons() (map[string]syncDaemon, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	c, err := n.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	replies, err := c.request(n.family, ipvsCmdGetDaemon, true, nil)
+	if err != nil {
+		return nil, fmt.Errorf("listing sync daemons: %v", err)
+	}
+	return parseIPVSDaemons(replies)
+}
+
+// parseIPVSDaemons parses the replies to a sync daemon dump.
+func parseIPVSDaemons(replies [][]byte) (map[string]syncDaemon, error) {
+	daemons := map[string]syncDaemon{}
+	for _, reply := range replies {
+		attrs, err := parseNetlinkAttrs(reply)
+		if err != nil {
+			return nil, err
+		}
+		daemon, err := parseNetlinkAttrs(attrs[ipvsCmdAttrDaemon])
+		if err != nil {
+			return nil, err
+		}
+		state := ""
+		switch daemon.uint32(ipvsDaemonAttrState) {
+		case ipvsStateMaster:
+			state = SyncDaemonMaster
+		case ipvsStateBackup:
+			state = SyncDaemonBackup
+		default:
+			continue
+		}
+		daemons[state] = syncDaemon{
+			iface:  strings.TrimRight(string(daemon[ipvsDaemonAttrMcastIf]), "\x00"),
+			syncID: int(daemon.uint32(ipvsDaemonAttrSyncID)),
+		}
+	}
+	return daemons, nil
+}
+
+// daemon starts or stops a sync daemon.
+func (n *netlinkClient) daemon(cmd uint8, state, iface string, syncID int) error {
+	n.Lock()
+	defer n.Unlock()
+
+	value, err := daemonState(state)
+	if err != nil {
+		return err
+	}
+	c, err := n.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	daemon := netlinkAttrs{}
+	daemon.addUint32(ipvsDaemonAttrState, value)
+	if cmd == ipvsCmdNewDaemon {
+		daemon.addString(ipvsDaemonAttrMcastIf, iface)
+		daemon.addUint32(ipvsDaemonAttrSyncID, uint32(syncID))
+	}
+	attrs := netlinkAttrs{}
+	attrs.addNested(ipvsCmdAttrDaemon, daemon)
+
+	_, err = c.request(n.family, cmd, false, attrs)
+	return err
+}
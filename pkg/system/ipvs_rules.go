@@ -0,0 +1,376 @@
+package system
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Rules are exchanged with the IPVS backends as ipvsadm -R input lines, and
+// read back as ipvsadm -Sn output lines. These types hold a parsed rule, with
+// values as the kernel represents them.
+
+const (
+	ipvsSvcFlagPersistent = 0x1
+	ipvsSvcFlagOnePacket  = 0x4
+	ipvsSvcFlagSched1     = 0x8
+	ipvsSvcFlagSched2     = 0x10
+	ipvsSvcFlagSched3     = 0x20
+
+	ipvsFwdMask   = 0x7
+	ipvsFwdMasq   = 0
+	ipvsFwdTunnel = 2
+	ipvsFwdRoute  = 3
+
+	// ipvsadm's defaults for -s and -p
+	ipvsDefaultScheduler = "wlc"
+	ipvsDefaultTimeout   = 300
+)
+
+// ipvsService is a virtual service, identified either by protocol, address
+// and port, or by firewall mark.
+type ipvsService struct {
+	af       uint16
+	protocol uint16
+	addr     net.IP
+	port     uint16
+	fwmark   uint32
+
+	scheduler string
+	flags     uint32
+	timeout   uint32
+
+	// netmask is the persistence mask. an ipv4 mask for ipv4 services, or a
+	// prefix length for ipv6 ones.
+	netmask uint32
+}
+
+// ipvsDest is a realserver of a virtual service.
+type ipvsDest struct {
+	addr      net.IP
+	port      uint16
+	fwdMethod uint32
+	weight    uint32
+	uThresh   uint32
+	lThresh   uint32
+}
+
+// ipvsRule is a single line of ipvsadm -R input.
+type ipvsRule struct {
+	command string
+	service ipvsService
+	dest    ipvsDest
+}
+
+// isDest reports whether the rule manipulates a realserver rather than a
+// virtual service.
+func (r ipvsRule) isDest() bool {
+	return r.command == "-a" || r.command == "-e" || r.command == "-d"
+}
+
+// key identifies the service, e.g. "-t 10.54.213.253:5678", or the realserver,
+// e.g. "-t 10.54.213.253:5678 -r 10.54.213.246:5678", of the rule.
+func (r ipvsRule) key() string {
+	if r.isDest() {
+		return r.service.target() + " -r " + formatIPVSAddress(r.dest.addr, r.dest.port)
+	}
+	return r.service.target()
+}
+
+// parseIPVSRule parses the subset of ipvsadm's rule syntax that Ravel
+// generates and that ipvsadm -Sn emits.
+func parseIPVSRule(s string) (ipvsRule, error) {
+	r := ipvsRule{}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return r, fmt.Errorf("empty rule")
+	}
+
+	r.command = fields[0]
+	switch r.command {
+	case "-A", "-E", "-D", "-a", "-e", "-d":
+	default:
+		return r, fmt.Errorf("rule %q: unsupported command %s", s, r.command)
+	}
+
+	r.service.af = unix.AF_INET
+	r.service.scheduler = ipvsDefaultScheduler
+	r.dest.fwdMethod = ipvsFwdRoute
+	r.dest.weight = 1
+	netmask := ""
+	dest := ""
+
+	// value returns the argument of the option at fields[n]
+	value := func(n int) (string, error) {
+		if n+1 >= len(fields) {
+			return "", fmt.Errorf("rule %q: %s requires a value", s, fields[n])
+		}
+		return fields[n+1], nil
+	}
+	uint32Value := func(n int) (uint32, error) {
+		v, err := value(n)
+		if err != nil {
+			return 0, err
+		}
+		u, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("rule %q: invalid %s %q", s, fields[n], v)
+		}
+		return uint32(u), nil
+	}
+
+	for n := 1; n < len(fields); n++ {
+		var err error
+		switch fields[n] {
+		case "-t", "-u":
+			r.service.protocol = unix.IPPROTO_TCP
+			if fields[n] == "-u" {
+				r.service.protocol = unix.IPPROTO_UDP
+			}
+			var v string
+			if v, err = value(n); err == nil {
+				r.service.addr, r.service.port, err = parseIPVSAddress(v, 0)
+				if r.service.addr != nil && r.service.addr.To4() == nil {
+					r.service.af = unix.AF_INET6
+				}
+			}
+			n++
+		case "-f":
+			r.service.fwmark, err = uint32Value(n)
+			n++
+		case "-6":
+			r.service.af = unix.AF_INET6
+		case "-s":
+			r.service.scheduler, err = value(n)
+			n++
+		case "-b":
+			var v string
+			if v, err = value(n); err == nil {
+				for _, flag := range strings.Split(v, ",") {
+					bit, ok := ipvsSchedulerFlag(flag)
+					if !ok {
+						err = fmt.Errorf("rule %q: unsupported scheduler flag %s", s, flag)
+						break
+					}
+					r.service.flags |= bit
+				}
+			}
+			n++
+		case "-p":
+			r.service.flags |= ipvsSvcFlagPersistent
+			r.service.timeout = ipvsDefaultTimeout
+			// the timeout is optional
+			if n+1 < len(fields) && !strings.HasPrefix(fields[n+1], "-") {
+				r.service.timeout, err = uint32Value(n)
+				n++
+			}
+		case "-M":
+			netmask, err = value(n)
+			n++
+		case "-o", "--ops":
+			r.service.flags |= ipvsSvcFlagOnePacket
+		case "-r":
+			dest, err = value(n)
+			n++
+		case "-g":
+			r.dest.fwdMethod = ipvsFwdRoute
+		case "-i":
+			r.dest.fwdMethod = ipvsFwdTunnel
+		case "-m":
+			r.dest.fwdMethod = ipvsFwdMasq
+		case "-w":
+			r.dest.weight, err = uint32Value(n)
+			n++
+		case "-x":
+			r.dest.uThresh, err = uint32Value(n)
+			n++
+		case "-y":
+			r.dest.lThresh, err = uint32Value(n)
+			n++
+		default:
+			err = fmt.Errorf("rule %q: unsupported option %s", s, fields[n])
+		}
+		if err != nil {
+			return r, err
+		}
+	}
+
+	if r.service.addr == nil && r.service.fwmark == 0 {
+		return r, fmt.Errorf("rule %q: a virtual service is required", s)
+	}
+
+	r.service.netmask = 0xffffffff
+	if r.service.af == unix.AF_INET6 {
+		r.service.netmask = 128
+	}
+	if netmask != "" {
+		if r.service.af == unix.AF_INET6 {
+			plen, err := strconv.ParseUint(netmask, 10, 8)
+			if err != nil || plen > 128 {
+				return r, fmt.Errorf("rule %q: invalid netmask %q", s, netmask)
+			}
+			r.service.netmask = uint32(plen)
+		} else {
+			mask := net.ParseIP(netmask).To4()
+			if mask == nil {
+				return r, fmt.Errorf("rule %q: invalid netmask %q", s, netmask)
+			}
+			r.service.netmask = binary.BigEndian.Uint32(mask)
+		}
+	}
+
+	if !r.isDest() {
+		return r, nil
+	}
+	if dest == "" {
+		return r, fmt.Errorf("rule %q: a realserver is required", s)
+	}
+	var err error
+	r.dest.addr, r.dest.port, err = parseIPVSAddress(dest, r.service.port)
+	return r, err
+}
+
+// parseIPVSAddress parses addr:port, or [addr]:port for ipv6. When the port
+// is omitted, defaultPort is returned in its place.
+func parseIPVSAddress(s string, defaultPort uint16) (net.IP, uint16, error) {
+	host, portString, err := net.SplitHostPort(s)
+	if err != nil {
+		host, portString = strings.Trim(s, "[]"), ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	if portString == "" {
+		return ip, defaultPort, nil
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port in %q", s)
+	}
+	return ip, uint16(port), nil
+}
+
+func formatIPVSAddress(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// target returns the options naming the virtual service, e.g. -t 10.1.1.1:80
+func (s ipvsService) target() string {
+	if s.fwmark != 0 {
+		if s.af == unix.AF_INET6 {
+			return fmt.Sprintf("-f %d -6", s.fwmark)
+		}
+		return fmt.Sprintf("-f %d", s.fwmark)
+	}
+	protocol := "-t"
+	if s.protocol == unix.IPPROTO_UDP {
+		protocol = "-u"
+	}
+	return protocol + " " + formatIPVSAddress(s.addr, s.port)
+}
+
+// ipvsSchedulerFlag returns the flag bit of a scheduler flag named as ipvsadm
+// -b accepts it. The sh and mh schedulers give the first two their own names.
+func ipvsSchedulerFlag(name string) (uint32, bool) {
+	switch name {
+	case "flag-1", "sh-fallback", "mh-fallback":
+		return ipvsSvcFlagSched1, true
+	case "flag-2", "sh-port", "mh-port":
+		return ipvsSvcFlagSched2, true
+	case "flag-3":
+		return ipvsSvcFlagSched3, true
+	}
+	return 0, false
+}
+
+// schedulerFlags names the service's scheduler flags the way ipvsadm does.
+func (s ipvsService) schedulerFlags() string {
+	names := []string{"flag-1", "flag-2", "flag-3"}
+	if s.scheduler == "sh" || s.scheduler == "mh" {
+		names[0], names[1] = s.scheduler+"-fallback", s.scheduler+"-port"
+	}
+	flags := []string{}
+	for n, bit := range []uint32{ipvsSvcFlagSched1, ipvsSvcFlagSched2, ipvsSvcFlagSched3} {
+		if s.flags&bit != 0 {
+			flags = append(flags, names[n])
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// rule formats the service the way ipvsadm -Sn does.
+func (s ipvsService) rule() string {
+	rule := fmt.Sprintf("-A %s -s %s", s.target(), s.scheduler)
+	if flags := s.schedulerFlags(); flags != "" {
+		rule += " -b " + flags
+	}
+	if s.flags&ipvsSvcFlagPersistent != 0 {
+		rule += fmt.Sprintf(" -p %d", s.timeout)
+		if s.af == unix.AF_INET6 && s.netmask != 128 {
+			rule += fmt.Sprintf(" -M %d", s.netmask)
+		} else if s.af == unix.AF_INET && s.netmask != 0xffffffff {
+			mask := make(net.IP, 4)
+			binary.BigEndian.PutUint32(mask, s.netmask)
+			rule += " -M " + mask.String()
+		}
+	}
+	if s.flags&ipvsSvcFlagOnePacket != 0 {
+		rule += " -o"
+	}
+	return rule
+}
+
+// rule formats the realserver of s the way ipvsadm -Sn does.
+func (d ipvsDest) rule(s ipvsService) string {
+	method := "-g"
+	switch d.fwdMethod & ipvsFwdMask {
+	case ipvsFwdTunnel:
+		method = "-i"
+	case ipvsFwdMasq:
+		method = "-m"
+	}
+	rule := fmt.Sprintf("-a %s -r %s %s -w %d", s.target(), formatIPVSAddress(d.addr, d.port), method, d.weight)
+	if d.uThresh != 0 {
+		rule += fmt.Sprintf(" -x %d", d.uThresh)
+	}
+	if d.lThresh != 0 {
+		rule += fmt.Sprintf(" -y %d", d.lThresh)
+	}
+	return rule
+}
+
+// ipvsServices sorts services the way ipvsadm lists them.
+type ipvsServices []ipvsService
+
+func (s ipvsServices) Len() int      { return len(s) }
+func (s ipvsServices) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s ipvsServices) Less(i, j int) bool {
+	if s[i].fwmark != s[j].fwmark {
+		return s[i].fwmark < s[j].fwmark
+	}
+	if s[i].protocol != s[j].protocol {
+		return s[i].protocol < s[j].protocol
+	}
+	if c := bytes.Compare(s[i].addr.To16(), s[j].addr.To16()); c != 0 {
+		return c < 0
+	}
+	return s[i].port < s[j].port
+}
+
+// ipvsDests sorts realservers by address and port.
+type ipvsDests []ipvsDest
+
+func (d ipvsDests) Len() int      { return len(d) }
+func (d ipvsDests) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d ipvsDests) Less(i, j int) bool {
+	if c := bytes.Compare(d[i].addr.To16(), d[j].addr.To16()); c != 0 {
+		return c < 0
+	}
+	return d[i].port < d[j].port
+}
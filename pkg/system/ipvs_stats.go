@@ -0,0 +1,178 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
+)
+
+// ipvsCounters are the kernel's traffic counters of a virtual service or
+// realserver, since it was added. activeConns is a realserver's count of
+// established connections at the time it was read.
+type ipvsCounters struct {
+	conns    uint64
+	inPkts   uint64
+	outPkts  uint64
+	inBytes  uint64
+	outBytes uint64
+
+	activeConns uint64
+}
+
+// stats labels the counters with the service s, and with the realserver
+// address when they are a realserver's.
+func (c ipvsCounters) stats(s ipvsService, realServer string) stats.IPVSStats {
+	out := stats.IPVSStats{
+		RealServer:  realServer,
+		Connections: c.conns,
+		InPackets:   c.inPkts,
+		OutPackets:  c.outPkts,
+		InBytes:     c.inBytes,
+		OutBytes:    c.outBytes,
+
+		ActiveConnections: c.activeConns,
+	}
+	switch {
+	case s.fwmark != 0:
+		out.Protocol = "fwmark"
+		out.VIP = strconv.FormatUint(uint64(s.fwmark), 10)
+	case s.protocol == unix.IPPROTO_UDP:
+		out.Protocol = "udp"
+	default:
+		out.Protocol = "tcp"
+	}
+	if s.fwmark == 0 {
+		out.VIP = s.addr.String()
+		out.Port = strconv.Itoa(int(s.port))
+	}
+	return out
+}
+
+// parseIPVSAdmStats parses the output of ipvsadm -Ln --stats --exact, e.g.
+//
+//    IP Virtual Server version 1.2.1 (size=4096)
+//    Prot LocalAddress:Port               Conns   InPkts  OutPkts  InBytes OutBytes
+//      -> RemoteAddress:Port
+//    TCP  10.54.213.253:5678                 12      345        0    23456        0
+//      -> 10.54.213.246:5678                  6      170        0    11000        0
+//    FWM  3                                   0        0        0        0        0
+func parseIPVSAdmStats(b []byte) ([]stats.IPVSStats, error) {
+	out := []stats.IPVSStats{}
+	service := stats.IPVSStats{}
+
+	scanner := bufio.NewScanner(bytes.NewBuffer(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			// the version line and the realserver header
+			continue
+		}
+		switch fields[0] {
+		case "->", "FWM", "TCP", "UDP":
+		default:
+			continue
+		}
+
+		counters := [5]uint64{}
+		for n, f := range fields[len(fields)-5:] {
+			v, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid counter in %q. %v", scanner.Text(), err)
+			}
+			counters[n] = v
+		}
+		s := stats.IPVSStats{
+			Connections: counters[0],
+			InPackets:   counters[1],
+			OutPackets:  counters[2],
+			InBytes:     counters[3],
+			OutBytes:    counters[4],
+		}
+
+		switch fields[0] {
+		case "->":
+			if service.Protocol == "" {
+				return nil, fmt.Errorf("realserver %q listed before any service", fields[1])
+			}
+			s.Protocol, s.VIP, s.Port, s.RealServer = service.Protocol, service.VIP, service.Port, fields[1]
+		case "FWM":
+			s.Protocol, s.VIP = "fwmark", fields[1]
+		case "TCP", "UDP":
+			host, port, err := net.SplitHostPort(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid service address in %q. %v", scanner.Text(), err)
+			}
+			s.Protocol, s.VIP, s.Port = strings.ToLower(fields[0]), host, port
+		}
+		out = append(out, s)
+		if s.RealServer == "" {
+			service = s
+		}
+	}
+	return out, scanner.Err()
+}
+
+// ipvsStatsKey names the service, or realserver of a service, that s counts.
+func ipvsStatsKey(s stats.IPVSStats) string {
+	return strings.Join([]string{s.Protocol, s.VIP, s.Port, s.RealServer}, " ")
+}
+
+// parseIPVSAdmConns parses the weights and active connections of the
+// realservers listed by ipvsadm -Ln --exact, e.g.
+//
+//    IP Virtual Server version 1.2.1 (size=4096)
+//    Prot LocalAddress:Port Scheduler Flags
+//      -> RemoteAddress:Port           Forward Weight ActiveConn InActConn
+//    TCP  10.54.213.253:5678 wrr
+//      -> 10.54.213.246:5678           Route   1      3          10
+//
+// The realservers are returned by ipvsStatsKey, as parseIPVSAdmStats names them.
+func parseIPVSAdmConns(b []byte) (map[string]stats.IPVSStats, error) {
+	out := map[string]stats.IPVSStats{}
+	service := stats.IPVSStats{}
+
+	scanner := bufio.NewScanner(bytes.NewBuffer(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "FWM":
+			service = stats.IPVSStats{Protocol: "fwmark", VIP: fields[1]}
+		case "TCP", "UDP":
+			host, port, err := net.SplitHostPort(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid service address in %q. %v", scanner.Text(), err)
+			}
+			service = stats.IPVSStats{Protocol: strings.ToLower(fields[0]), VIP: host, Port: port}
+		case "->":
+			// the realserver header has no counts
+			if len(fields) < 6 || fields[1] == "RemoteAddress:Port" {
+				continue
+			}
+			if service.Protocol == "" {
+				return nil, fmt.Errorf("realserver %q listed before any service", fields[1])
+			}
+			weight, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("invalid weight in %q. %v", scanner.Text(), err)
+			}
+			active, err := strconv.ParseUint(fields[4], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid active connections in %q. %v", scanner.Text(), err)
+			}
+			rs := service
+			rs.RealServer, rs.Weight, rs.ActiveConnections = fields[1], weight, active
+			out[ipvsStatsKey(rs)] = rs
+		}
+	}
+	return out, scanner.Err()
+}
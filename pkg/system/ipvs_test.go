@@ -1,13 +1,23 @@
 package system
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"os"
 	"reflect"
 	"sort"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
 	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
-	"k8s.io/api/core/v1"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
 )
 
 // /app # ipvsadm -Sn
@@ -50,15 +60,15 @@ func TestMergeIPVSRuleSets(t *testing.T) {
 		"-a -t 172.27.223.81:82 -r 172.27.223.103:82 -g -w 1",
 	}
 	expects := []string{
-		"-D -t 172.27.223.81:80",
 		"-d -t 172.27.223.81:80 -r 172.27.223.101:80",
-		"-A -t 172.27.223.81:82 -s wlc",
-		"-a -t 172.27.223.81:82 -r 172.27.223.101:82 -g -w 1",
-		"-a -t 172.27.223.81:82 -r 172.27.223.103:82 -g -w 1",
+		"-D -t 172.27.223.81:80",
 	}
 
-	instance := &ipvs{}
-	out := instance.Merge(configured, generated)
+	instance := &ipvs{logger: logrus.New()}
+	out := instance.merge(configured, generated)
+	if len(out) != len(expects) {
+		t.Fatalf("expected %d rules. saw %v", len(expects), out)
+	}
 	for i, rule := range out {
 		if rule != expects[i] {
 			t.Fatalf("expected rule to match at index %d. %s!=%s", i, rule, expects[i])
@@ -66,12 +76,137 @@ func TestMergeIPVSRuleSets(t *testing.T) {
 	}
 }
 
+func TestMergePersistence(t *testing.T) {
+	configured := []string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 1",
+		"-A -t 172.27.223.81:1935 -s wrr -p 300",
+		"-a -t 172.27.223.81:1935 -r 172.27.223.101:1935 -g -w 1",
+	}
+	generated := []string{
+		"-A -t 172.27.223.81:80 -s wrr -p 600 -M 255.255.255.0",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 1 -x 0 -y 0",
+		"-A -t 172.27.223.81:1935 -s wrr",
+		"-a -t 172.27.223.81:1935 -r 172.27.223.101:1935 -g -w 1 -x 0 -y 0",
+	}
+	expects := []string{
+		"-E -t 172.27.223.81:80 -s wrr -p 600 -M 255.255.255.0",
+		"-E -t 172.27.223.81:1935 -s wrr",
+	}
+
+	if ipvsEquality(configured, append([]string{}, generated...), false) {
+		t.Fatalf("expected a change of persistence to break parity")
+	}
+
+	instance := &ipvs{logger: logrus.New()}
+	out := instance.merge(configured, generated)
+	if !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+}
+
+func TestMergeIncremental(t *testing.T) {
+	configured := []string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 1",
+		"-a -t 172.27.223.81:80 -r 172.27.223.102:80 -g -w 1 -x 500",
+		"-a -t 172.27.223.81:80 -r 172.27.223.103:80 -g -w 1",
+		"-a -t 172.27.223.81:80 -r 172.27.223.104:80 -g -w 1",
+	}
+	generated := []string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 1 -x 0 -y 0",
+		"-a -t 172.27.223.81:80 -r 172.27.223.102:80 -g -w 1 -x 400 -y 0",
+		"-a -t 172.27.223.81:80 -r 172.27.223.103:80 -i -w 1 -x 0 -y 0",
+		"-a -t 172.27.223.81:80 -r 172.27.223.104:80 -g -w 10 -x 0 -y 0",
+		"-a -t 172.27.223.81:80 -r 172.27.223.105:80 -g -w 1 -x 0 -y 0",
+	}
+	// only the realservers that change are touched, none are re-created
+	expects := []string{
+		"-e -t 172.27.223.81:80 -r 172.27.223.102:80 -g -w 1 -x 400 -y 0",
+		"-e -t 172.27.223.81:80 -r 172.27.223.103:80 -i -w 1 -x 0 -y 0",
+		"-e -t 172.27.223.81:80 -r 172.27.223.104:80 -g -w 10 -x 0 -y 0",
+		"-a -t 172.27.223.81:80 -r 172.27.223.105:80 -g -w 1 -x 0 -y 0",
+	}
+
+	instance := &ipvs{logger: logrus.New()}
+	out := instance.merge(configured, generated)
+	if !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+	if ipvsEquality(configured, generated, false) {
+		t.Fatalf("expected configurations to differ")
+	}
+
+	// weights are ignored for a new configuration
+	generated = []string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 5 -x 0 -y 0",
+	}
+	if !ipvsEquality(configured[:2], generated, true) {
+		t.Fatalf("expected weights to be ignored for a new configuration")
+	}
+	if ipvsEquality(configured[:2], generated, false) {
+		t.Fatalf("expected weights to matter for an existing configuration")
+	}
+}
+
+func TestMergeDrain(t *testing.T) {
+	configured := []string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 1",
+		"-a -t 172.27.223.81:80 -r 172.27.223.102:80 -g -w 1",
+		"-A -t 172.27.223.81:82 -s wrr",
+		"-a -t 172.27.223.81:82 -r 172.27.223.101:82 -g -w 1",
+	}
+	generated := func() []string {
+		return []string{
+			"-A -t 172.27.223.81:80 -s wrr",
+			"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 1 -x 0 -y 0",
+		}
+	}
+
+	instance := &ipvs{logger: logrus.New(), drainGracePeriod: time.Minute, draining: map[string]time.Time{}}
+
+	// the realserver of a service that remains is drained, the other is deleted with its service
+	out := instance.merge(configured, generated())
+	expects := []string{
+		"-e -t 172.27.223.81:80 -r 172.27.223.102:80 -g -w 0",
+		"-d -t 172.27.223.81:82 -r 172.27.223.101:82",
+		"-D -t 172.27.223.81:82",
+	}
+	if !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+
+	// within the grace period, nothing is done
+	configured = []string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 1",
+		"-a -t 172.27.223.81:80 -r 172.27.223.102:80 -g -w 0",
+	}
+	if out := instance.merge(configured, generated()); len(out) != 0 {
+		t.Fatalf("expected no rules while draining. saw %v", out)
+	}
+
+	// after it, the realserver is deleted
+	instance.draining["-t 172.27.223.81:80 -r 172.27.223.102:80"] = time.Now().Add(-2 * time.Minute)
+	out = instance.merge(configured, generated())
+	expects = []string{"-d -t 172.27.223.81:80 -r 172.27.223.102:80"}
+	if !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+	if len(instance.draining) != 0 {
+		t.Fatalf("expected the deleted realserver to be forgotten. saw %v", instance.draining)
+	}
+}
+
 func TestGetNodeWeightsAndLimits(t *testing.T) {
 	// generate a list of 3 nodes
 	nodes := []types.Node{
-		types.Node{Status: v1.NodeStatus{Addresses: []v1.NodeAddress{v1.NodeAddress{Type: "InternalIP", Address: "10.11.12.13"}}}},
-		types.Node{Status: v1.NodeStatus{Addresses: []v1.NodeAddress{v1.NodeAddress{Type: "InternalIP", Address: "10.11.12.14"}}}},
-		types.Node{Status: v1.NodeStatus{Addresses: []v1.NodeAddress{v1.NodeAddress{Type: "InternalIP", Address: "10.11.12.15"}}}},
+		types.Node{Addresses: []string{"10.11.12.13"}},
+		types.Node{Addresses: []string{"10.11.12.14"}},
+		types.Node{Addresses: []string{"10.11.12.15"}},
 	}
 
 	// expects a set of input ipvsoptions to emit a specific nodeconfig
@@ -82,19 +217,20 @@ func TestGetNodeWeightsAndLimits(t *testing.T) {
 		n nodeConfig
 		d string
 	}{
-		{types.IPVSOptions{X: 0, Y: 0, F: ""}, nodeConfig{"g", 1, 0, 0}, "empty set sensible defaults"},
-		{types.IPVSOptions{X: 6000, Y: 3000, F: ""}, nodeConfig{"g", 1, 2000, 1000}, "even distribution of conns"},
-		{types.IPVSOptions{X: 600000, Y: 0, F: ""}, nodeConfig{"g", 1, 0, 0}, "reset excessive limits"},
-		{types.IPVSOptions{X: 60000, Y: 0, F: "i"}, nodeConfig{"i", 1, 20000, 0}, "Y empty"},
-		{types.IPVSOptions{X: 6, Y: 12, F: ""}, nodeConfig{"g", 1, 0, 0}, "Y exceeds X"},
-		{types.IPVSOptions{X: 0, Y: 0, F: "bogus"}, nodeConfig{"g", 1, 0, 0}, "bogus F defaults to G"},
+		{types.IPVSOptions{RawUThreshold: 0, RawLThreshold: 0, RawForwardingMethod: ""}, nodeConfig{"g", 1, 0, 0}, "empty set sensible defaults"},
+		{types.IPVSOptions{RawUThreshold: 6000, RawLThreshold: 3000, RawForwardingMethod: ""}, nodeConfig{"g", 1, 2000, 1000}, "even distribution of conns"},
+		{types.IPVSOptions{RawUThreshold: 600000, RawLThreshold: 0, RawForwardingMethod: ""}, nodeConfig{"g", 1, 0, 0}, "reset excessive limits"},
+		{types.IPVSOptions{RawUThreshold: 60000, RawLThreshold: 0, RawForwardingMethod: "i"}, nodeConfig{"i", 1, 20000, 0}, "Y empty"},
+		{types.IPVSOptions{RawUThreshold: 6, RawLThreshold: 12, RawForwardingMethod: ""}, nodeConfig{"g", 1, 0, 0}, "Y exceeds X"},
+		{types.IPVSOptions{RawUThreshold: 2, RawLThreshold: 1, RawForwardingMethod: ""}, nodeConfig{"g", 1, 1, 1}, "thresholds smaller than the node count stay limited"},
+		{types.IPVSOptions{RawUThreshold: 0, RawLThreshold: 0, RawForwardingMethod: "bogus"}, nodeConfig{"g", 1, 0, 0}, "bogus F defaults to G"},
 	}
 
 	for _, test := range tests {
 		sc := &types.ServiceDef{
 			IPVSOptions: test.i,
 		}
-		out := getNodeWeightsAndLimits(nodes, sc)
+		out := getNodeWeightsAndLimits(nodes, sc, true, 1)
 		if len(out) != len(nodes) {
 			t.Fatalf("expected %d nodes. saw %d", len(nodes), len(out))
 		}
@@ -106,3 +242,889 @@ func TestGetNodeWeightsAndLimits(t *testing.T) {
 	}
 
 }
+
+func TestParseIPVSRule(t *testing.T) {
+	// rules in the form emitted by ipvsadm -Sn format back to themselves
+	rules := []string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-A -u 172.27.223.81:53 -s sh -p 300",
+		"-A -t 172.27.223.81:443 -s wlc -p 60 -M 255.255.255.0",
+		"-A -t [2001:558:1044:159::81]:80 -s rr -p 300 -M 64",
+		"-A -f 7 -s wrr",
+		"-A -t 172.27.223.81:443 -s mh -b mh-fallback,mh-port -p 300",
+		"-A -u 172.27.223.81:53 -s mh -b mh-port",
+		"-A -f 8 -s rr -o",
+		"-A -u 172.27.223.81:53 -s sh -p 300 -o",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 1",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -i -w 3 -x 2000 -y 1000",
+		"-a -u 172.27.223.81:53 -r 172.27.223.101:53 -m -w 0",
+		"-a -t [2001:558:1044:159::81]:80 -r [2001:558:1044:159::101]:80 -g -w 1",
+	}
+	for _, rule := range rules {
+		r, err := parseIPVSRule(rule)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", rule, err)
+		}
+		out := r.service.rule()
+		if r.isDest() {
+			out = r.dest.rule(r.service)
+		}
+		if out != rule {
+			t.Fatalf("expected %q to format as itself. saw %q", rule, out)
+		}
+	}
+
+	// rules generated by ravel carry thresholds of zero, which ipvsadm omits
+	r, err := parseIPVSRule("-a -t 172.27.223.81:82 -r 172.27.223.103:82 -g -w 2 -x 0 -y 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := r.dest.rule(r.service); out != "-a -t 172.27.223.81:82 -r 172.27.223.103:82 -g -w 2" {
+		t.Fatalf("unexpected rule %q", out)
+	}
+
+	r, err = parseIPVSRule("-d -t 172.27.223.81:80 -r 172.27.223.101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.dest.port != 80 {
+		t.Fatalf("expected the realserver port to default to the service port. saw %d", r.dest.port)
+	}
+
+	for _, rule := range []string{"", "-Z", "-A -s wrr", "-a -t 172.27.223.81:80 -g", "-A -t 172.27.223.81:80 -s", "-a -t 172.27.223.81:80 -r 172.27.223.101:80 -w heavy"} {
+		if _, err := parseIPVSRule(rule); err == nil {
+			t.Fatalf("expected an error parsing %q", rule)
+		}
+	}
+}
+
+func TestNetlinkAttrs(t *testing.T) {
+	s := ipvsService{
+		af:        unix.AF_INET,
+		protocol:  unix.IPPROTO_TCP,
+		addr:      net.ParseIP("172.27.223.81").To4(),
+		port:      8080,
+		scheduler: "wrr",
+		flags:     ipvsSvcFlagPersistent,
+		timeout:   300,
+		netmask:   0xffffff00,
+	}
+	attrs := s.attrs(true)
+	if len(attrs)%unix.NLA_ALIGNTO != 0 {
+		t.Fatalf("attributes are not aligned. length %d", len(attrs))
+	}
+	parsed, err := parseIPVSService(attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, s) {
+		t.Fatalf("expected %+v. saw %+v", s, parsed)
+	}
+
+	d := ipvsDest{addr: net.ParseIP("172.27.223.101").To4(), port: 8080, fwdMethod: ipvsFwdTunnel, weight: 4, uThresh: 100, lThresh: 50}
+	parsedDest, err := parseIPVSDest(d.attrs(unix.AF_INET, true), unix.AF_INET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsedDest, d) {
+		t.Fatalf("expected %+v. saw %+v", d, parsedDest)
+	}
+}
+
+func TestNetlinkReceiveTimeout(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	c := &netlinkConn{fd: fds[0]}
+	defer c.Close()
+
+	// the kernel never replies
+	if err := setReceiveTimeout(c.fd, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.receive(make([]byte, netlinkReceiveBuffer)); err == nil {
+		t.Fatal("expected the receive to time out")
+	}
+}
+
+func TestParseIPVSDaemons(t *testing.T) {
+	master := netlinkAttrs{}
+	master.addUint32(ipvsDaemonAttrState, ipvsStateMaster)
+	master.addString(ipvsDaemonAttrMcastIf, "eth0")
+	master.addUint32(ipvsDaemonAttrSyncID, 1)
+	backup := netlinkAttrs{}
+	backup.addUint32(ipvsDaemonAttrState, ipvsStateBackup)
+	backup.addString(ipvsDaemonAttrMcastIf, "bond0")
+	backup.addUint32(ipvsDaemonAttrSyncID, 7)
+
+	replies := [][]byte{}
+	for _, d := range []netlinkAttrs{master, backup} {
+		attrs := netlinkAttrs{}
+		attrs.addNested(ipvsCmdAttrDaemon, d)
+		replies = append(replies, attrs)
+	}
+	expect := map[string]syncDaemon{
+		SyncDaemonMaster: {iface: "eth0", syncID: 1},
+		SyncDaemonBackup: {iface: "bond0", syncID: 7},
+	}
+	daemons, err := parseIPVSDaemons(replies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(daemons, expect) {
+		t.Fatalf("expected %v. saw %v", expect, daemons)
+	}
+
+	out := []byte("master sync daemon (mcast=eth0, syncid=1)\nbackup sync daemon (mcast=bond0, syncid=7, maxlen=1472)\n")
+	if daemons := parseIPVSAdmDaemons(out); !reflect.DeepEqual(daemons, expect) {
+		t.Fatalf("expected %v. saw %v", expect, daemons)
+	}
+}
+
+// ack formats the kernel's acknowledgement of request seq, failed with errno
+// when it is not 0.
+func ack(seq uint32, errno syscall.Errno) []byte {
+	msg := make([]byte, unix.NLMSG_HDRLEN+4+unix.NLMSG_HDRLEN)
+	nativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:6], unix.NLMSG_ERROR)
+	nativeEndian.PutUint32(msg[8:12], seq)
+	nativeEndian.PutUint32(msg[unix.NLMSG_HDRLEN:], uint32(-int32(errno)))
+	return msg
+}
+
+func TestNetlinkBatchAcks(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	c := &netlinkConn{fd: fds[0]}
+	defer c.Close()
+
+	// acknowledgements of other requests are ignored, and those of a batch
+	// may arrive over several reads
+	writes := [][]byte{
+		append(ack(9, 0), ack(10, 0)...),
+		append(ack(11, syscall.EEXIST), ack(12, syscall.ENOENT)...),
+		ack(13, 0),
+	}
+	for _, w := range writes {
+		if _, err := unix.Write(fds[1], w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failed, err := c.acks(10, 13)
+	if failed != 11 || err != syscall.EEXIST {
+		t.Fatalf("expected request 11 to fail with %v. saw %d %v", syscall.EEXIST, failed, err)
+	}
+
+	if _, err := unix.Write(fds[1], append(ack(14, 0), ack(15, 0)...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.acks(14, 15); err != nil {
+		t.Fatalf("expected no error. saw %v", err)
+	}
+}
+
+// benchmarkRules returns the rules for 500 VIPs with two ports and ten
+// realservers each.
+func benchmarkRules() []string {
+	rules := []string{}
+	for v := 0; v < 500; v++ {
+		vip := fmt.Sprintf("10.%d.%d.%d", 200+v/65536, v/256%256, v%256)
+		for _, port := range []int{80, 443} {
+			rules = append(rules, fmt.Sprintf("-A -t %s:%d -s wrr", vip, port))
+			for r := 1; r <= 10; r++ {
+				rules = append(rules, fmt.Sprintf("-a -t %s:%d -r 192.168.0.%d:%d -g -w 1", vip, port, r, port))
+			}
+		}
+	}
+	return rules
+}
+
+// The benchmarks flush the host's IPVS table, so they only run as root when
+// RAVEL_IPVS_BENCH is set, e.g.
+//
+//	RAVEL_IPVS_BENCH=1 go test -run XXX -bench IPVS ./pkg/system
+func benchmarkIPVSBackend(b *testing.B, client ipvsClient) {
+	if os.Getenv("RAVEL_IPVS_BENCH") == "" || os.Geteuid() != 0 {
+		b.Skip("set RAVEL_IPVS_BENCH and run as root to benchmark against the kernel")
+	}
+	ctx := context.Background()
+	rules := benchmarkRules()
+	defer client.teardown(ctx)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		if err := client.teardown(ctx); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		if out, err := client.set(ctx, rules); err != nil {
+			b.Fatalf("%v: %s", err, out)
+		}
+		configured, err := client.get(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(configured) != len(rules) {
+			b.Fatalf("expected %d rules to be configured. saw %d", len(rules), len(configured))
+		}
+	}
+}
+
+func BenchmarkIPVSAdm(b *testing.B) {
+	benchmarkIPVSBackend(b, &ipvsadmClient{})
+}
+
+func BenchmarkIPVSNetlink(b *testing.B) {
+	benchmarkIPVSBackend(b, newNetlinkClient())
+}
+
+func TestGetNodeWeightsFromPods(t *testing.T) {
+	// nodeWithPods returns a node running n pods of default/nginx:http
+	nodeWithPods := func(ip string, n int) types.Node {
+		addresses := []types.Address{}
+		for i := 0; i < n; i++ {
+			addresses = append(addresses, types.Address{PodIP: fmt.Sprintf("100.64.0.%d", i)})
+		}
+		return types.Node{
+			Addresses: []string{ip},
+			Endpoints: []types.Endpoints{{
+				EndpointMeta: types.EndpointMeta{Namespace: "default", Service: "nginx"},
+				Subsets:      []types.Subset{{Addresses: addresses, Ports: []types.Port{{Name: "http", Port: 80}}}},
+			}},
+		}
+	}
+	nodes := types.NodesList{
+		nodeWithPods("10.11.12.13", 1),
+		nodeWithPods("10.11.12.14", 3),
+		nodeWithPods("10.11.12.15", 0),
+	}
+	sc := &types.ServiceDef{
+		Namespace:   "default",
+		Service:     "nginx",
+		PortName:    "http",
+		IPVSOptions: types.IPVSOptions{RawUThreshold: 4000, RawLThreshold: 2000},
+	}
+
+	expects := map[string]nodeConfig{
+		"10.11.12.13": {"g", 1, 1000, 500},
+		"10.11.12.14": {"g", 3, 3000, 1500},
+		"10.11.12.15": {"g", 0, 0, 0},
+	}
+	if out := getNodeWeightsAndLimits(nodes, sc, false, 1); !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %+v. saw %+v", expects, out)
+	}
+
+	// the override weighs every node equally
+	out := getNodeWeightsAndLimits(nodes, sc, true, 1)
+	if out["10.11.12.14"].weight != 1 || out["10.11.12.14"].uThreshold != 1333 {
+		t.Fatalf("expected equal weights with the override. saw %+v", out)
+	}
+
+	// a node's weight annotation scales its pods
+	nodes[0].Annotations = map[string]string{types.WeightAnnotation: "3"}
+	out = getNodeWeightsAndLimits(nodes, sc, false, 1)
+	if out["10.11.12.13"].weight != 3 || out["10.11.12.13"].uThreshold != 2000 {
+		t.Fatalf("expected the annotated node to weigh 3. saw %+v", out)
+	}
+}
+
+func TestExternalTrafficPolicyLocal(t *testing.T) {
+	nginx := types.Endpoints{
+		EndpointMeta: types.EndpointMeta{Namespace: "default", Service: "nginx"},
+		Subsets:      []types.Subset{{Addresses: []types.Address{{PodIP: "100.64.0.1"}}, Ports: []types.Port{{Name: "http", Port: 80}}}},
+	}
+	nodes := types.NodesList{
+		{Addresses: []string{"10.11.12.13"}, Endpoints: []types.Endpoints{nginx}},
+		{Addresses: []string{"10.11.12.14"}},
+		{Addresses: []string{"10.11.12.15"}, Endpoints: []types.Endpoints{nginx}},
+	}
+	sc := &types.ServiceDef{
+		Namespace:   "default",
+		Service:     "nginx",
+		PortName:    "http",
+		IPVSOptions: types.IPVSOptions{RawUThreshold: 4000, RawLThreshold: 2000},
+	}
+
+	// every node is a realserver by default, whether it runs pods or not
+	if out := realServerRules("-t 10.54.213.253:80", "80", "g", nodes, sc, true, 1, false); len(out) != 3 {
+		t.Fatalf("expected a realserver for each node. saw %v", out)
+	}
+
+	// with Local, thresholds are divided among the nodes running pods only
+	sc.IPVSOptions.RawExternalTrafficPolicy = types.TrafficPolicyLocal
+	out := realServerRules("-t 10.54.213.253:80", "80", "g", nodes, sc, true, 1, false)
+	expects := []string{
+		"-a -t 10.54.213.253:80 -r 10.11.12.13:80 -g -w 1 -x 2000 -y 1000",
+		"-a -t 10.54.213.253:80 -r 10.11.12.15:80 -g -w 1 -x 2000 -y 1000",
+	}
+	if !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+}
+
+func TestGenerateFwmarkRules(t *testing.T) {
+	ftp := &types.ServiceDef{Namespace: "ftp", Service: "ftp", PortName: "ftp", IPVSOptions: types.IPVSOptions{RawScheduler: "wrr"}}
+	passive := &types.ServiceDef{Namespace: "ftp", Service: "ftp", PortName: "passive", UDPEnabled: true}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"172.27.223.81": {"21": ftp, "20000:21000": passive},
+			"172.27.223.82": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+		},
+		VIPOptions: map[types.ServiceIP]*types.VIPOptions{"172.27.223.81": {Fwmark: 7}},
+	}
+	nodes := types.NodesList{
+		{Addresses: []string{"172.27.223.101"}, Ready: true},
+		{Addresses: []string{"172.27.223.102"}, Ready: true},
+	}
+
+	instance := &ipvs{logger: logrus.New(), weightOverride: true, defaultWeight: 1}
+	out, err := instance.generateRules(nodes, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expects := []string{
+		"-A -t 172.27.223.82:80 -s wrr",
+		"-a -t 172.27.223.82:80 -r 172.27.223.101:80 -g -w 1 -x 0 -y 0",
+		"-a -t 172.27.223.82:80 -r 172.27.223.102:80 -g -w 1 -x 0 -y 0",
+		"-A -f 7 -s wrr",
+		"-a -f 7 -r 172.27.223.101:0 -g -w 1 -x 0 -y 0",
+		"-a -f 7 -r 172.27.223.102:0 -g -w 1 -x 0 -y 0",
+	}
+	if !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+
+	marks := []string{
+		`-A RAVEL-FWMARK -d 172.27.223.81/32 -p tcp -m tcp --dport 20000:21000 -m comment --comment "ftp/ftp:passive" -j MARK --set-xmark 0x7/0xffffffff`,
+		`-A RAVEL-FWMARK -d 172.27.223.81/32 -p tcp -m tcp --dport 21 -m comment --comment "ftp/ftp:ftp" -j MARK --set-xmark 0x7/0xffffffff`,
+		`-A RAVEL-FWMARK -d 172.27.223.81/32 -p udp -m udp --dport 20000:21000 -m comment --comment "ftp/ftp:passive" -j MARK --set-xmark 0x7/0xffffffff`,
+	}
+	if out := fwmarkRules(config); !reflect.DeepEqual(out, marks) {
+		t.Fatalf("expected %v. saw %v", marks, out)
+	}
+}
+
+func TestGenerateOnePacketRules(t *testing.T) {
+	dns := &types.ServiceDef{Namespace: "kube-system", Service: "dns", PortName: "dns", UDPEnabled: true, IPVSOptions: types.IPVSOptions{RawScheduler: "rr", RawOnePacket: true}}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"172.27.223.81": {"53": dns},
+			"172.27.223.82": {"53": dns},
+		},
+		VIPOptions: map[types.ServiceIP]*types.VIPOptions{"172.27.223.81": {Fwmark: 8}},
+	}
+	nodes := types.NodesList{{Addresses: []string{"172.27.223.101"}, Ready: true}}
+
+	instance := &ipvs{logger: logrus.New(), weightOverride: true, defaultWeight: 1}
+	out, err := instance.generateRules(nodes, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the fwmark service carries udp, so only it schedules one packet at a time
+	expects := []string{
+		"-A -t 172.27.223.82:53 -s rr",
+		"-a -t 172.27.223.82:53 -r 172.27.223.101:53 -g -w 1 -x 0 -y 0",
+		"-A -f 8 -s rr -o",
+		"-a -f 8 -r 172.27.223.101:0 -g -w 1 -x 0 -y 0",
+	}
+	if !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+}
+
+func TestGenerateNATRules(t *testing.T) {
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"172.27.223.81": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+			"172.27.223.82": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+		},
+		VIPOptions: map[types.ServiceIP]*types.VIPOptions{"172.27.223.81": {ForwardingMethod: types.ForwardingNAT}},
+	}
+	nodes := types.NodesList{{Addresses: []string{"172.27.223.101"}, Ready: true}}
+
+	instance := &ipvs{logger: logrus.New(), weightOverride: true, defaultWeight: 1}
+	out, err := instance.generateRules(nodes, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expects := []string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -m -w 1 -x 0 -y 0",
+		"-A -t 172.27.223.82:80 -s wrr",
+		"-a -t 172.27.223.82:80 -r 172.27.223.101:80 -g -w 1 -x 0 -y 0",
+	}
+	if !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+
+	masquerades := []string{
+		`-A RAVEL-NAT -m ipvs --vaddr 172.27.223.81/32 --vdir ORIGINAL --vmethod MASQ -m comment --comment "172.27.223.81" -j MASQUERADE`,
+	}
+	if out := natRules(config, false); !reflect.DeepEqual(out, masquerades) {
+		t.Fatalf("expected %v. saw %v", masquerades, out)
+	}
+	masquerades[0] += " --random-fully"
+	if out := natRules(config, true); !reflect.DeepEqual(out, masquerades) {
+		t.Fatalf("expected %v. saw %v", masquerades, out)
+	}
+}
+
+func TestGenerateNoTrackRules(t *testing.T) {
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"172.27.223.81": {
+				"53": &types.ServiceDef{Namespace: "default", Service: "dns", PortName: "dns", UDPEnabled: true},
+				"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http", IPVSOptions: types.IPVSOptions{RawForwardingMethod: "i"}},
+			},
+			"172.27.223.82": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+		},
+		VIPOptions: map[types.ServiceIP]*types.VIPOptions{"172.27.223.81": {NoTrack: true}},
+	}
+	expects := []string{
+		`-A RAVEL-NOTRACK -d 172.27.223.81/32 -p tcp -m tcp --dport 53 -m comment --comment "default/dns:dns" -j CT --notrack`,
+		`-A RAVEL-NOTRACK -d 172.27.223.81/32 -p tcp -m tcp --dport 80 -m comment --comment "default/nginx:http" -j CT --notrack`,
+		`-A RAVEL-NOTRACK -d 172.27.223.81/32 -p udp -m udp --dport 53 -m comment --comment "default/dns:dns" -j CT --notrack`,
+	}
+	if out := notrackRules(config); !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+}
+
+func TestGenerateDSCPRules(t *testing.T) {
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"172.27.223.81": {
+				"53": &types.ServiceDef{Namespace: "default", Service: "dns", PortName: "dns", UDPEnabled: true},
+				"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"},
+			},
+			"172.27.223.82": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+		},
+		VIPOptions: map[types.ServiceIP]*types.VIPOptions{"172.27.223.81": {DSCP: 46}},
+	}
+	expects := []string{
+		`-A RAVEL-DSCP -p tcp -m conntrack --ctorigdst 172.27.223.81/32 --ctorigdstport 53 --ctdir REPLY -m comment --comment "default/dns:dns" -j DSCP --set-dscp 0x2e`,
+		`-A RAVEL-DSCP -p tcp -m conntrack --ctorigdst 172.27.223.81/32 --ctorigdstport 80 --ctdir REPLY -m comment --comment "default/nginx:http" -j DSCP --set-dscp 0x2e`,
+		`-A RAVEL-DSCP -p udp -m conntrack --ctorigdst 172.27.223.81/32 --ctorigdstport 53 --ctdir REPLY -m comment --comment "default/dns:dns" -j DSCP --set-dscp 0x2e`,
+	}
+	if out := dscpRules(config); !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+}
+
+func TestGenerateConnLimitRules(t *testing.T) {
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"172.27.223.81": {
+				"80":  &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http", MaxConnections: 1000},
+				"443": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "https"},
+			},
+		},
+		Config6: map[types.ServiceIP]types.PortMap{
+			"2001:db8::82": {"80": &types.ServiceDef{Namespace: "default", Service: "web", PortName: "http", MaxConnections: 500}},
+		},
+		IPV6: map[types.ServiceIP]string{"172.27.223.81": "2001:db8::81"},
+	}
+	expects := []string{
+		`-A RAVEL-CONNLIMIT -d 172.27.223.81/32 -p tcp -m tcp --dport 80 --tcp-flags FIN,SYN,RST,ACK SYN -m connlimit --connlimit-above 1000 --connlimit-mask 0 -m comment --comment "default/nginx:http" -j REJECT --reject-with tcp-reset`,
+	}
+	if out := connlimitRules(config, false); !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+	expects6 := []string{
+		`-A RAVEL-CONNLIMIT -d 2001:db8::81/128 -p tcp -m tcp --dport 80 --tcp-flags FIN,SYN,RST,ACK SYN -m connlimit --connlimit-above 1000 --connlimit-mask 0 -m comment --comment "default/nginx:http" -j REJECT --reject-with tcp-reset`,
+		`-A RAVEL-CONNLIMIT -d 2001:db8::82/128 -p tcp -m tcp --dport 80 --tcp-flags FIN,SYN,RST,ACK SYN -m connlimit --connlimit-above 500 --connlimit-mask 0 -m comment --comment "default/web:http" -j REJECT --reject-with tcp-reset`,
+	}
+	if out := connlimitRules(config, true); !reflect.DeepEqual(out, expects6) {
+		t.Fatalf("expected %v. saw %v", expects6, out)
+	}
+}
+
+func TestGenerateSynLimitRules(t *testing.T) {
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"172.27.223.81": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+			"172.27.223.82": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+			"172.27.223.83": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+		},
+		VIPOptions: map[types.ServiceIP]*types.VIPOptions{
+			"172.27.223.81": {SynRateLimit: &types.SynRateLimit{Rate: 1000}},
+			"172.27.223.82": {SynRateLimit: &types.SynRateLimit{Rate: 10, Burst: 50, PerSource: true}},
+		},
+		IPV6: map[types.ServiceIP]string{"172.27.223.82": "2001:db8::82"},
+	}
+	expects := []string{
+		`-A RAVEL-SYNLIMIT -d 172.27.223.81/32 -p tcp -m tcp --tcp-flags FIN,SYN,RST,ACK SYN -m hashlimit --hashlimit-above 1000/sec --hashlimit-burst 1000 --hashlimit-mode dstip --hashlimit-name ` + hashlimitName("172.27.223.81") + ` -m comment --comment "172.27.223.81" -j DROP`,
+		`-A RAVEL-SYNLIMIT -d 172.27.223.82/32 -p tcp -m tcp --tcp-flags FIN,SYN,RST,ACK SYN -m hashlimit --hashlimit-above 10/sec --hashlimit-burst 50 --hashlimit-mode srcip --hashlimit-name ` + hashlimitName("172.27.223.82") + ` -m comment --comment "172.27.223.82" -j DROP`,
+	}
+	if out := synlimitRules(config, false); !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+	expects6 := []string{
+		`-A RAVEL-SYNLIMIT -d 2001:db8::82/128 -p tcp -m tcp --tcp-flags FIN,SYN,RST,ACK SYN -m hashlimit --hashlimit-above 10/sec --hashlimit-burst 50 --hashlimit-mode srcip --hashlimit-name ` + hashlimitName("2001:db8::82") + ` -m comment --comment "2001:db8::82" -j DROP`,
+	}
+	if out := synlimitRules(config, true); !reflect.DeepEqual(out, expects6) {
+		t.Fatalf("expected %v. saw %v", expects6, out)
+	}
+	if name := hashlimitName("172.27.223.81"); len(name) > 15 || name == hashlimitName("172.27.223.82") {
+		t.Fatalf("expected distinct hashlimit names of at most 15 characters. saw %s", name)
+	}
+}
+
+func TestGenerateTargetPortRules(t *testing.T) {
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"172.27.223.81": {"443": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "https", TargetPort: "8443"}},
+			"172.27.223.82": {"443": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "https", TargetPort: "8443"}},
+		},
+		VIPOptions: map[types.ServiceIP]*types.VIPOptions{"172.27.223.81": {ForwardingMethod: types.ForwardingNAT}},
+	}
+	nodes := types.NodesList{{Addresses: []string{"172.27.223.101"}, Ready: true}}
+
+	instance := &ipvs{logger: logrus.New(), weightOverride: true, defaultWeight: 1}
+	out, err := instance.generateRules(nodes, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// direct routing cannot change the port, so only the nat vip translates it
+	expects := []string{
+		"-A -t 172.27.223.81:443 -s wrr",
+		"-a -t 172.27.223.81:443 -r 172.27.223.101:8443 -m -w 1 -x 0 -y 0",
+		"-A -t 172.27.223.82:443 -s wrr",
+		"-a -t 172.27.223.82:443 -r 172.27.223.101:443 -g -w 1 -x 0 -y 0",
+	}
+	if !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+}
+
+// daemonClient records the sync daemon calls made to it
+type daemonClient struct {
+	ipvsadmClient
+	calls []string
+}
+
+func (c *daemonClient) startDaemon(ctx context.Context, state, iface string, syncID int) error {
+	c.calls = append(c.calls, fmt.Sprintf("start %s %s %d", state, iface, syncID))
+	return nil
+}
+
+func (c *daemonClient) stopDaemon(ctx context.Context, state string) error {
+	c.calls = append(c.calls, "stop "+state)
+	return nil
+}
+
+func TestSyncDaemon(t *testing.T) {
+	client := &daemonClient{}
+	instance := &ipvs{logger: logrus.New(), client: client}
+	if err := instance.StartSyncDaemon(SyncDaemonMaster); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.calls) != 0 {
+		t.Fatalf("expected no calls without a sync interface. saw %v", client.calls)
+	}
+
+	instance.syncInterface, instance.syncID = "eth0", 7
+	instance.StartSyncDaemon(SyncDaemonBackup)
+	instance.StopSyncDaemon(SyncDaemonBackup)
+	expects := []string{"start backup eth0 7", "stop backup"}
+	if !reflect.DeepEqual(client.calls, expects) {
+		t.Fatalf("expected %v. saw %v", expects, client.calls)
+	}
+
+	if _, err := daemonState("standby"); err == nil {
+		t.Fatalf("expected an unknown daemon state to fail")
+	}
+}
+
+func TestGenerateRules6(t *testing.T) {
+	config := &types.ClusterConfig{
+		Config6: map[types.ServiceIP]types.PortMap{
+			"2001:558:1044:19a::10": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+		},
+	}
+	nodes := types.NodesList{
+		{Addresses: []string{"172.27.223.101", "fe80::1", "2001:558:1044:159::101"}, Ready: true},
+		{Addresses: []string{"172.27.223.102"}, Ready: true},
+	}
+
+	instance := &ipvs{logger: logrus.New(), weightOverride: true, defaultWeight: 1}
+	out, err := instance.generateRules6(nodes, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expects := []string{
+		"-A -t [2001:558:1044:19a::10]:80 -s wrr",
+		"-a -t [2001:558:1044:19a::10]:80 -r [2001:558:1044:159::101]:80 -g -w 1 -x 0 -y 0",
+	}
+	if !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+
+	// each family only sees, and so only deletes, its own services
+	configured := append([]string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 1",
+	}, expects...)
+	if v6 := familyRules(configured, true); !reflect.DeepEqual(v6, expects) {
+		t.Fatalf("expected %v. saw %v", expects, v6)
+	}
+	if out := instance.merge(familyRules(configured, true), expects); len(out) != 0 {
+		t.Fatalf("expected no changes to ipv6 services. saw %v", out)
+	}
+	if v4 := familyRules(configured, false); !reflect.DeepEqual(v4, configured[:2]) {
+		t.Fatalf("expected %v. saw %v", configured[:2], v4)
+	}
+}
+
+// tableClient serves a fixed table, and records the reads of it and the rules
+// set on it
+type tableClient struct {
+	ipvsadmClient
+	table   []string
+	gets    int
+	applied []string
+}
+
+func (c *tableClient) get(ctx context.Context) ([]string, error) {
+	c.gets++
+	return c.table, nil
+}
+
+func (c *tableClient) set(ctx context.Context, rules []string) ([]byte, error) {
+	c.applied = append(c.applied, rules...)
+	return nil, nil
+}
+
+// fakeChainIPTables records the chains that applyChain restores and the jumps
+// it ensures.
+type fakeChainIPTables struct {
+	util.Interface
+	restored []string
+	jumps    []string
+}
+
+func (f *fakeChainIPTables) Restore(table util.Table, data []byte, flush util.FlushFlag, counters util.RestoreCountersFlag) error {
+	f.restored = append(f.restored, string(data))
+	return nil
+}
+
+func (f *fakeChainIPTables) EnsureRule(position util.RulePosition, table util.Table, chain util.Chain, args ...string) (bool, error) {
+	f.jumps = append(f.jumps, fmt.Sprintf("%s %s %s", position, chain, strings.Join(args, " ")))
+	return false, nil
+}
+
+func TestSetLimits(t *testing.T) {
+	ipt, ipt6 := &fakeChainIPTables{}, &fakeChainIPTables{}
+	i := &ipvs{iptables: ipt, iptables6: ipt6}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"172.27.223.81": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http", MaxConnections: 1000}},
+		},
+		VIPOptions: map[types.ServiceIP]*types.VIPOptions{
+			"172.27.223.81": {SynRateLimit: &types.SynRateLimit{Rate: 1000}},
+		},
+		IPV6: map[types.ServiceIP]string{"172.27.223.81": "2001:db8::81"},
+	}
+	if err := i.SetLimits(config); err != nil {
+		t.Fatal(err)
+	}
+
+	// the limits come ahead of any accept rules in INPUT
+	expects := []string{"-I INPUT -j RAVEL-CONNLIMIT", "-I INPUT -j RAVEL-SYNLIMIT"}
+	for _, f := range []*fakeChainIPTables{ipt, ipt6} {
+		if !reflect.DeepEqual(f.jumps, expects) {
+			t.Fatalf("expected jumps %v. saw %v", expects, f.jumps)
+		}
+		if len(f.restored) != 2 {
+			t.Fatalf("expected the connlimit and synlimit chains restored. saw %v", f.restored)
+		}
+	}
+	if !strings.Contains(ipt.restored[0], "-d 172.27.223.81/32") || !strings.Contains(ipt6.restored[1], "-d 2001:db8::81/128") {
+		t.Fatalf("expected the ipv4 and ipv6 addresses limited. saw %v and %v", ipt.restored, ipt6.restored)
+	}
+
+	// unchanged limits are not restored again
+	if err := i.SetLimits(config); err != nil {
+		t.Fatal(err)
+	}
+	if len(ipt.restored) != 2 || len(ipt6.restored) != 2 {
+		t.Fatalf("expected no changes restored. saw %v and %v", ipt.restored, ipt6.restored)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	client := &tableClient{table: []string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 1 -x 0 -y 0",
+		"-a -t 172.27.223.81:80 -r 172.27.223.102:80 -g -w 1 -x 0 -y 0",
+	}}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"172.27.223.81": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+		},
+	}
+	nodes := types.NodesList{{Addresses: []string{"172.27.223.101"}, Ready: true}}
+	instance := &ipvs{
+		logger: logrus.New(), client: client, weightOverride: true, defaultWeight: 1,
+		drainGracePeriod: time.Minute, draining: map[string]time.Time{}, dryRun: true,
+	}
+
+	expects := []string{"-e -t 172.27.223.81:80 -r 172.27.223.102:80 -g -w 0"}
+	out, err := instance.DiffIPVS(nodes, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+	if len(instance.draining) != 0 {
+		t.Fatalf("expected a diff to start no drains. saw %v", instance.draining)
+	}
+
+	if err := instance.SetIPVS(nodes, config, instance.logger); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.applied) != 0 {
+		t.Fatalf("expected a dry run to apply nothing. saw %v", client.applied)
+	}
+
+	instance.dryRun = false
+	if err := instance.SetIPVS(nodes, config, instance.logger); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(client.applied, expects) {
+		t.Fatalf("expected %v. saw %v", expects, client.applied)
+	}
+}
+
+func TestCheckConfigParityHash(t *testing.T) {
+	client := &tableClient{table: []string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 1 -x 0 -y 0",
+	}}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"172.27.223.81": {"80": &types.ServiceDef{Namespace: "default", Service: "nginx", PortName: "http"}},
+		},
+	}
+	nodes := types.NodesList{{Addresses: []string{"172.27.223.101"}, Ready: true}}
+	addresses := []string{"172.27.223.81"}
+	instance := &ipvs{logger: logrus.New(), client: client, weightOverride: true, defaultWeight: 1}
+
+	for n := 0; n < 2; n++ {
+		same, err := instance.CheckConfigParity(nodes, config, addresses, false)
+		if err != nil || !same {
+			t.Fatalf("expected parity. saw %v, %v", same, err)
+		}
+	}
+	if client.gets != 1 {
+		t.Fatalf("expected the table to be read once. saw %d reads", client.gets)
+	}
+
+	// a new node changes the hash, and the comparison finds the node missing
+	nodes = append(nodes, types.Node{Addresses: []string{"172.27.223.102"}, Ready: true})
+	if same, _ := instance.CheckConfigParity(nodes, config, addresses, false); same {
+		t.Fatalf("expected no parity with a new node")
+	}
+	if same, _ := instance.CheckConfigParity(nodes, config, addresses, false); same || client.gets != 3 {
+		t.Fatalf("expected the table to be read until parity is found. saw %v after %d reads", same, client.gets)
+	}
+}
+
+// /app # ipvsadm -Ln --stats --exact
+var ipvsadmStatsDump string = `IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port               Conns   InPkts  OutPkts  InBytes OutBytes
+  -> RemoteAddress:Port
+TCP  172.27.223.81:80                   12      345        0    23456        0
+  -> 172.27.223.102:80                   8      230        0    15634        0
+  -> 172.27.223.103:80                   4      115        0     7822        0
+TCP  [2001:558:1044:19a::10]:443          1        3        0      180        0
+FWM  3                                   0        0        0        0        0
+  -> 172.27.223.101:0                    0        0        0        0        0`
+
+func TestParseIPVSAdmStats(t *testing.T) {
+	out, err := parseIPVSAdmStats([]byte(ipvsadmStatsDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expects := []stats.IPVSStats{
+		{Protocol: "tcp", VIP: "172.27.223.81", Port: "80", Connections: 12, InPackets: 345, InBytes: 23456},
+		{Protocol: "tcp", VIP: "172.27.223.81", Port: "80", RealServer: "172.27.223.102:80", Connections: 8, InPackets: 230, InBytes: 15634},
+		{Protocol: "tcp", VIP: "172.27.223.81", Port: "80", RealServer: "172.27.223.103:80", Connections: 4, InPackets: 115, InBytes: 7822},
+		{Protocol: "tcp", VIP: "2001:558:1044:19a::10", Port: "443", Connections: 1, InPackets: 3, InBytes: 180},
+		{Protocol: "fwmark", VIP: "3"},
+		{Protocol: "fwmark", VIP: "3", RealServer: "172.27.223.101:0"},
+	}
+	if !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %+v. saw %+v", expects, out)
+	}
+}
+
+func TestParseIPVSAdmConns(t *testing.T) {
+	out := []byte(`IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port           Forward Weight ActiveConn InActConn
+TCP  10.54.213.253:5678 wrr
+  -> 10.54.213.246:5678           Route   100    3          10
+  -> 10.54.213.247:5678           Route   90     12         4
+FWM  3 wrr
+  -> 10.54.213.246:0              Route   1      0          0
+`)
+	conns, err := parseIPVSAdmConns(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expects := map[string]stats.IPVSStats{
+		"tcp 10.54.213.253 5678 10.54.213.246:5678": {Protocol: "tcp", VIP: "10.54.213.253", Port: "5678", RealServer: "10.54.213.246:5678", Weight: 100, ActiveConnections: 3},
+		"tcp 10.54.213.253 5678 10.54.213.247:5678": {Protocol: "tcp", VIP: "10.54.213.253", Port: "5678", RealServer: "10.54.213.247:5678", Weight: 90, ActiveConnections: 12},
+		"fwmark 3  10.54.213.246:0":                 {Protocol: "fwmark", VIP: "3", RealServer: "10.54.213.246:0", Weight: 1},
+	}
+	if !reflect.DeepEqual(conns, expects) {
+		t.Fatalf("expected %v. saw %v", expects, conns)
+	}
+}
+
+func TestParseIPVSCounters(t *testing.T) {
+	counters64 := netlinkAttrs{}
+	for typ, v := range map[uint16]uint64{ipvsStatsAttrConns: 12, ipvsStatsAttrInPkts: 345, ipvsStatsAttrInBytes: 23456} {
+		b := make([]byte, 8)
+		nativeEndian.PutUint64(b, v)
+		counters64.add(typ, b)
+	}
+	counters32 := netlinkAttrs{}
+	counters32.addUint32(ipvsStatsAttrConns, 12)
+	counters32.addUint32(ipvsStatsAttrInPkts, 345)
+	b := make([]byte, 8)
+	nativeEndian.PutUint64(b, 23456)
+	counters32.add(ipvsStatsAttrInBytes, b)
+
+	expects := ipvsCounters{conns: 12, inPkts: 345, inBytes: 23456}
+
+	// kernels since 4.1 send both, and the 64 bit counters are preferred
+	attrs := netlinkAttrs{}
+	attrs.addNested(ipvsSvcAttrStats, netlinkAttrs{})
+	attrs.addNested(ipvsSvcAttrStats64, counters64)
+	if out := parseIPVSCounters(attrs, ipvsSvcAttrStats64, ipvsSvcAttrStats); out != expects {
+		t.Fatalf("expected %+v. saw %+v", expects, out)
+	}
+
+	attrs = netlinkAttrs{}
+	attrs.addNested(ipvsSvcAttrStats, counters32)
+	if out := parseIPVSCounters(attrs, ipvsSvcAttrStats64, ipvsSvcAttrStats); out != expects {
+		t.Fatalf("expected %+v. saw %+v", expects, out)
+	}
+
+	s := ipvsService{af: unix.AF_INET, protocol: unix.IPPROTO_UDP, addr: net.ParseIP("172.27.223.81").To4(), port: 53}
+	labelled := expects.stats(s, "172.27.223.101:53")
+	want := stats.IPVSStats{Protocol: "udp", VIP: "172.27.223.81", Port: "53", RealServer: "172.27.223.101:53", Connections: 12, InPackets: 345, InBytes: 23456}
+	if labelled != want {
+		t.Fatalf("expected %+v. saw %+v", want, labelled)
+	}
+}
@@ -0,0 +1,77 @@
+package system
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
+)
+
+// natChain is the nat chain, jumped to from POSTROUTING, that masquerades the
+// traffic of nat VIPs as it is forwarded to realservers, so that replies
+// return through the director.
+const natChain = "RAVEL-NAT"
+
+// ipvsConntrackSysctl lets netfilter see the connections of IPVS, which the
+// ipvs match in natChain relies on.
+const ipvsConntrackSysctl = "/proc/sys/net/ipv4/vs/conntrack"
+
+// natRules returns the rules that masquerade traffic to nat VIPs, sorted. With
+// randomFully, source ports are chosen with --random-fully, to avoid
+// collisions under heavy NAT load.
+func natRules(config *types.ClusterConfig, randomFully bool) []string {
+	target := "MASQUERADE"
+	if randomFully {
+		target = "MASQUERADE --random-fully"
+	}
+	rules := []string{}
+	for vip := range config.Config {
+		if !config.Masqueraded(vip) {
+			continue
+		}
+		// -A RAVEL-NAT -m ipvs --vaddr 10.54.213.253/32 --vdir ORIGINAL --vmethod MASQ -m comment --comment "10.54.213.253" -j MASQUERADE
+		rules = append(rules, fmt.Sprintf(`-A %s -m ipvs --vaddr %s/32 --vdir ORIGINAL --vmethod MASQ -m comment --comment "%s" -j %s`, natChain, vip, vip, target))
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// setMasquerades brings the masquerade rules of nat VIPs in line with config.
+func (i *ipvs) setMasquerades(config *types.ClusterConfig) error {
+	// iptables is only created once there are nat VIPs
+	rules := natRules(config, false)
+	if len(rules) == 0 && len(i.masquerades) == 0 {
+		return nil
+	}
+	if i.iptables == nil {
+		i.iptables = util.NewDefault()
+	}
+	if i.iptables.HasRandomFully() {
+		rules = natRules(config, true)
+	}
+	if len(rules) > 0 && len(i.masquerades) == 0 {
+		if err := ioutil.WriteFile(ipvsConntrackSysctl, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("enabling ipvs conntrack. %v", err)
+		}
+	}
+	applied, err := i.applyChain(util.TableNAT, natChain, util.ChainPostrouting, rules, i.masquerades)
+	if err != nil {
+		return fmt.Errorf("applying masquerade rules. %v", err)
+	}
+	i.masquerades = applied
+	return nil
+}
+
+// teardownMasquerades removes the masquerade rules of nat VIPs, if any were applied.
+func (i *ipvs) teardownMasquerades() error {
+	if len(i.masquerades) == 0 {
+		return nil
+	}
+	if err := i.iptables.FlushChain(util.TableNAT, natChain); err != nil {
+		return err
+	}
+	i.masquerades = nil
+	return nil
+}
@@ -0,0 +1,63 @@
+package system
+
+import (
+	"fmt"
+	"sort"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
+)
+
+// notrackChain is the raw chain, jumped to from PREROUTING, that exempts the
+// traffic of noTrack VIPs from connection tracking.
+const notrackChain = "RAVEL-NOTRACK"
+
+// notrackRules returns the raw rules that exempt traffic to the ports of
+// noTrack VIPs from connection tracking, sorted.
+func notrackRules(config *types.ClusterConfig) []string {
+	rules := []string{}
+	for vip, ports := range config.Config {
+		if !config.NoTrack(vip) {
+			continue
+		}
+		for port, service := range ports {
+			if service == nil {
+				continue
+			}
+			protocols := []string{"tcp"}
+			if service.UDPEnabled {
+				protocols = append(protocols, "udp")
+			}
+			ident := types.MakeIdent(service.Namespace, service.Service, service.PortName)
+			for _, protocol := range protocols {
+				// -A RAVEL-NOTRACK -d 10.54.213.253/32 -p tcp -m tcp --dport 80 -m comment --comment "default/nginx:http" -j CT --notrack
+				rules = append(rules, fmt.Sprintf(`-A %s -d %s/32 -p %s -m %s --dport %s -m comment --comment "%s" -j CT --notrack`,
+					notrackChain, vip, protocol, protocol, port, ident))
+			}
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// setNoTracks brings the raw rules of noTrack VIPs in line with config.
+func (i *ipvs) setNoTracks(config *types.ClusterConfig) error {
+	applied, err := i.applyChain(util.TableRaw, notrackChain, util.ChainPrerouting, notrackRules(config), i.notracks)
+	if err != nil {
+		return fmt.Errorf("applying notrack rules. %v", err)
+	}
+	i.notracks = applied
+	return nil
+}
+
+// teardownNoTracks removes the raw rules of noTrack VIPs, if any were applied.
+func (i *ipvs) teardownNoTracks() error {
+	if len(i.notracks) == 0 {
+		return nil
+	}
+	if err := i.iptables.FlushChain(util.TableRaw, notrackChain); err != nil {
+		return err
+	}
+	i.notracks = nil
+	return nil
+}
@@ -0,0 +1,82 @@
+package system
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/types"
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/util"
+)
+
+// synlimitChain is the filter chain, jumped to from the top of INPUT, that
+// drops the SYNs to VIPs with a synRateLimit beyond their rate, before IPVS
+// balances them or haproxy accepts them.
+const synlimitChain = "RAVEL-SYNLIMIT"
+
+// hashlimitName names the hashlimit table of a VIP, after a hash of it, within
+// the 15 characters that the kernel allows.
+func hashlimitName(vip types.ServiceIP) string {
+	hash := sha256.Sum256([]byte(vip))
+	encoded := base32.StdEncoding.EncodeToString(hash[:])
+	return "ravel-" + strings.ToLower(encoded[:9])
+}
+
+// synlimitRules returns the filter rules that drop the SYNs to VIPs with a
+// synRateLimit above its rate, sorted. The SYNs to all of a VIP's ports are
+// counted together, per client address with perSource. With ipv6, the rules
+// are those of the ipv6 VIPs and of the ipv6 addresses of ipv4 VIPs.
+func synlimitRules(config *types.ClusterConfig, ipv6 bool) []string {
+	rules := []string{}
+	for _, limited := range limitedAddresses(config, ipv6) {
+		limit := config.SynRateLimit(limited.vip)
+		if limit == nil {
+			continue
+		}
+		mode := "dstip"
+		if limit.PerSource {
+			mode = "srcip"
+		}
+		// -A RAVEL-SYNLIMIT -d 10.54.213.253/32 -p tcp -m tcp --tcp-flags FIN,SYN,RST,ACK SYN -m hashlimit --hashlimit-above 1000/sec --hashlimit-burst 2000 --hashlimit-mode dstip --hashlimit-name ravel-abcdefghi -m comment --comment "10.54.213.253" -j DROP
+		rules = append(rules, fmt.Sprintf(`-A %s -d %s -p tcp -m tcp --tcp-flags FIN,SYN,RST,ACK SYN -m hashlimit --hashlimit-above %d/sec --hashlimit-burst %d --hashlimit-mode %s --hashlimit-name %s -m comment --comment "%s" -j DROP`,
+			synlimitChain, hostPrefix(limited.addr, ipv6), limit.Rate, limit.BurstOrDefault(), mode, hashlimitName(limited.addr), limited.addr))
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// setSynLimits brings the filter rules of VIPs with a synRateLimit in line with
+// config, in iptables and ip6tables.
+func (i *ipvs) setSynLimits(config *types.ClusterConfig) error {
+	applied, err := i.applyChainAt(false, util.Prepend, util.TableFilter, synlimitChain, util.ChainInput, synlimitRules(config, false), i.synlimits)
+	if err != nil {
+		return fmt.Errorf("applying synlimit rules. %v", err)
+	}
+	i.synlimits = applied
+	applied, err = i.applyChainAt(true, util.Prepend, util.TableFilter, synlimitChain, util.ChainInput, synlimitRules(config, true), i.synlimits6)
+	if err != nil {
+		return fmt.Errorf("applying ipv6 synlimit rules. %v", err)
+	}
+	i.synlimits6 = applied
+	return nil
+}
+
+// teardownSynLimits removes the filter rules of VIPs with a synRateLimit, if
+// any were applied.
+func (i *ipvs) teardownSynLimits() error {
+	if len(i.synlimits) != 0 {
+		if err := i.iptables.FlushChain(util.TableFilter, synlimitChain); err != nil {
+			return err
+		}
+		i.synlimits = nil
+	}
+	if len(i.synlimits6) != 0 {
+		if err := i.iptables6.FlushChain(util.TableFilter, synlimitChain); err != nil {
+			return err
+		}
+		i.synlimits6 = nil
+	}
+	return nil
+}
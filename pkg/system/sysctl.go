@@ -0,0 +1,166 @@
+package system
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ipvsSysctlDir holds the IPVS sysctls, once the ip_vs module is loaded.
+const ipvsSysctlDir = "/proc/sys/net/ipv4/vs"
+
+// SysctlInterval is how often the workers verify the managed IPVS sysctls.
+const SysctlInterval = 30 * time.Second
+
+// ManagedIPVSSysctls are the IPVS sysctls that are verified as the workers
+// run, not only written at startup, as they decide what happens to
+// connections as realservers come and go. conn_reuse_mode decides whether a
+// new connection that reuses the address and port of an old one is scheduled
+// anew, rather than sent to the old one's realserver, which may have been
+// removed. expire_nodest_conn drops the connections of a deleted realserver
+// as soon as their next packet arrives, rather than letting them time out.
+var ManagedIPVSSysctls = []string{"conn_reuse_mode", "expire_nodest_conn"}
+
+// EnsureSysctls sets each managed IPVS sysctl that does not hold its
+// configured value, logging the ones that had drifted.
+func (i *ipvs) EnsureSysctls() error {
+	for _, name := range ManagedIPVSSysctls {
+		want, ok := i.sysctls[name]
+		if !ok || want == "" {
+			continue
+		}
+		file := filepath.Join(i.sysctlDir, name)
+		b, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("ipvs sysctl %s does not exist. is the ip_vs module loaded?", file)
+		} else if err != nil {
+			return fmt.Errorf("unable to read ipvs sysctl %s. %v", file, err)
+		}
+		have := strings.TrimSpace(string(b))
+		if have == want {
+			continue
+		}
+		if i.dryRun {
+			i.logger.Infof("ipvs dry run. ipvs sysctl %s is %s, not setting it to %s", name, have, want)
+			continue
+		}
+		i.logger.Warnf("ipvs sysctl %s is %s. setting it to %s", name, have, want)
+		if err := ioutil.WriteFile(file, []byte(want), 0644); err != nil {
+			return fmt.Errorf("unable to set ipvs sysctl %s to %s. %v", file, want, err)
+		}
+	}
+	return nil
+}
+
+// sysctlManager owns the sysctls that it sets: it records the value each one
+// held before it was first set, puts back those that another agent changes,
+// and restores the recorded values once they are no longer needed.
+type sysctlManager struct {
+	sync.Mutex
+
+	// sysctls holds the managed sysctls by file, and order their files in the
+	// order they were first set, for them to be restored in reverse
+	sysctls map[string]*managedSysctl
+	order   []string
+
+	logger logrus.FieldLogger
+}
+
+// managedSysctl is the value a sysctl is kept at, and the value it held
+// before.
+type managedSysctl struct {
+	want     string
+	original string
+}
+
+func newSysctlManager(logger logrus.FieldLogger) *sysctlManager {
+	return &sysctlManager{sysctls: map[string]*managedSysctl{}, logger: logger}
+}
+
+// set writes value to the sysctl in file, which is kept at it from then on.
+// The value the sysctl held is recorded the first time it is set.
+func (m *sysctlManager) set(file, value string) error {
+	m.Lock()
+	defer m.Unlock()
+	managed, ok := m.sysctls[file]
+	if !ok {
+		original, err := readSysctl(file)
+		if err != nil {
+			return err
+		}
+		managed = &managedSysctl{original: original}
+		m.sysctls[file] = managed
+		m.order = append(m.order, file)
+	}
+	managed.want = value
+	return writeSysctl(file, value)
+}
+
+// ensure sets each managed sysctl that does not hold its value, logging the
+// ones that had drifted.
+func (m *sysctlManager) ensure() error {
+	m.Lock()
+	defer m.Unlock()
+	for _, file := range m.order {
+		want := m.sysctls[file].want
+		have, err := readSysctl(file)
+		if err != nil {
+			return err
+		}
+		if have == want {
+			continue
+		}
+		m.logger.Warnf("sysctl %s is %s. setting it to %s", file, have, want)
+		if err := writeSysctl(file, want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore writes back the recorded value of each managed sysctl, the last
+// set first, and stops managing them.
+func (m *sysctlManager) restore() error {
+	m.Lock()
+	defer m.Unlock()
+	errs := []string{}
+	for n := len(m.order) - 1; n >= 0; n-- {
+		file := m.order[n]
+		if err := writeSysctl(file, m.sysctls[file].original); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	m.sysctls = map[string]*managedSysctl{}
+	m.order = nil
+	if len(errs) != 0 {
+		return fmt.Errorf("unable to restore %d sysctls. %v", len(errs), errs)
+	}
+	return nil
+}
+
+func readSysctl(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read sysctl %s. %v", file, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// writeSysctl writes value to the sysctl in file, which must exist.
+func writeSysctl(file, value string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return fmt.Errorf("unable to set sysctl %s to %s. %v", file, value, err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(value)); err != nil {
+		return fmt.Errorf("unable to set sysctl %s to %s. %v", file, value, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestEnsureSysctls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ravel-sysctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the kernel writes its values with a trailing newline
+	for name, value := range map[string]string{"conn_reuse_mode": "1\n", "expire_nodest_conn": "0\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	i := &ipvs{
+		logger:    logrus.New(),
+		sysctls:   map[string]string{"conn_reuse_mode": "1", "expire_nodest_conn": "1", "conntrack": "1"},
+		sysctlDir: dir,
+	}
+	if err := i.EnsureSysctls(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"conn_reuse_mode": "1\n", "expire_nodest_conn": "1"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Fatalf("expected %s to be %q. saw %q", name, want, b)
+		}
+	}
+	// only the managed sysctls are touched
+	if _, err := os.Stat(filepath.Join(dir, "conntrack")); !os.IsNotExist(err) {
+		t.Fatalf("expected conntrack to be left alone. saw %v", err)
+	}
+
+	os.Remove(filepath.Join(dir, "expire_nodest_conn"))
+	if err := i.EnsureSysctls(); err == nil {
+		t.Fatalf("expected an error for a missing sysctl")
+	}
+}
+
+func TestSysctlManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ravel-sysctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	announce := filepath.Join(dir, "arp_announce")
+	if err := ioutil.WriteFile(announce, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	read := func() string {
+		b, err := ioutil.ReadFile(announce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	m := newSysctlManager(logrus.New())
+	if err := m.set(announce, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.set(announce, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if read() != "1" {
+		t.Fatalf("expected arp_announce to be set to 1. saw %q", read())
+	}
+
+	// another agent flips it back
+	ioutil.WriteFile(announce, []byte("0\n"), 0644)
+	if err := m.ensure(); err != nil {
+		t.Fatal(err)
+	}
+	if read() != "1" {
+		t.Fatalf("expected arp_announce to be put back to 1. saw %q", read())
+	}
+
+	// the value held before the first set is restored, and no longer kept
+	if err := m.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if read() != "0" {
+		t.Fatalf("expected arp_announce to be restored to 0. saw %q", read())
+	}
+	ioutil.WriteFile(announce, []byte("2"), 0644)
+	if err := m.ensure(); err != nil || read() != "2" {
+		t.Fatalf("expected a restored sysctl to be left alone. saw %q %v", read(), err)
+	}
+
+	if err := m.set(filepath.Join(dir, "missing"), "1"); err == nil {
+		t.Fatalf("expected an error for a missing sysctl")
+	}
+}
@@ -38,12 +38,18 @@ type Watcher interface {
 
 	Nodes(ctx context.Context, watcherID string, nodeChan chan types.NodesList)
 	ConfigMap(ctx context.Context, watcherID string, cfgChan chan *types.ClusterConfig)
+
+	// Secrets sends the TLS secrets of the cluster, keyed by namespace/name,
+	// whenever one of them is added, changed or removed, so that the
+	// certificates that VIPs terminate TLS with follow their rotation.
+	Secrets(ctx context.Context, watcherID string, secretChan chan map[string]*v1.Secret)
 }
 
 type target struct {
-	ctx    context.Context
-	config chan *types.ClusterConfig
-	nodes  chan types.NodesList
+	ctx     context.Context
+	config  chan *types.ClusterConfig
+	nodes   chan types.NodesList
+	secrets chan map[string]*v1.Secret
 }
 
 type watcher struct {
@@ -59,6 +65,7 @@ type watcher struct {
 	allEndpoints     map[string]*v1.Endpoints
 	endpointsForNode map[string]*v1.Endpoints
 	configMap        *v1.ConfigMap
+	allSecrets       map[string]*v1.Secret
 
 	// client watches.
 	clientset  *kubernetes.Clientset
@@ -66,14 +73,16 @@ type watcher struct {
 	services   watch.Interface
 	endpoints  watch.Interface
 	configmaps watch.Interface
+	secrets    watch.Interface
 
 	// this is the 'official' configuration
 	clusterConfig *types.ClusterConfig
 	nodes         types.NodesList
 
 	// these are the targets who will receive the configuration
-	targets     map[string]target
-	nodeTargets map[string]target
+	targets       map[string]target
+	nodeTargets   map[string]target
+	secretTargets map[string]target
 
 	// default listen services for vips in the vip pool
 	autoSvc  string
@@ -116,8 +125,10 @@ func NewWatcher(ctx context.Context, kubeConfigFile, cmNamespace, cmName, config
 		allServices:      map[string]*v1.Service{},   // map of namespace/service to services
 		allEndpoints:     map[string]*v1.Endpoints{}, // map of namespace/service:port to endpoints
 		endpointsForNode: map[string]*v1.Endpoints{}, // map of namespace/service:port to endpoints on this node
+		allSecrets:       map[string]*v1.Secret{},    // map of namespace/name to tls secrets
 		targets:          map[string]target{},
 		nodeTargets:      map[string]target{},
+		secretTargets:    map[string]target{},
 
 		autoSvc:  autoSvc,
 		autoPort: autoPort,
@@ -142,6 +153,7 @@ func (w *watcher) stopWatch() {
 	w.services.Stop()
 	w.endpoints.Stop()
 	w.configmaps.Stop()
+	w.secrets.Stop()
 }
 
 func (w *watcher) initWatch() error {
@@ -179,10 +191,23 @@ func (w *watcher) initWatch() error {
 		return fmt.Errorf("error starting watch on nodes. %v", err)
 	}
 
+	// only tls secrets are watched. they hold the certificates of VIPs
+	// that terminate TLS in haproxy
+	secrets, err := w.clientset.CoreV1().Secrets("").Watch(metav1.ListOptions{FieldSelector: "type=" + string(v1.SecretTypeTLS)})
+	w.metrics.WatchErr("secrets", err)
+	if err != nil {
+		nodes.Stop()
+		configmaps.Stop()
+		services.Stop()
+		endpoints.Stop()
+		return fmt.Errorf("error starting watch on secrets. %v", err)
+	}
+
 	w.services = services
 	w.endpoints = endpoints
 	w.configmaps = configmaps
 	w.nodeWatch = nodes
+	w.secrets = secrets
 	w.metrics.WatchInit(time.Since(start))
 	return nil
 }
@@ -229,7 +254,7 @@ func (w *watcher) resetWatch() error {
 func (w *watcher) watches() {
 
 	metricsUpdateTicker := time.NewTicker(60000 * time.Millisecond)
-	totalUpdates, nodeUpdates, svcUpdates, epUpdates, cmUpdates := 0, 0, 0, 0, 0
+	totalUpdates, nodeUpdates, svcUpdates, epUpdates, cmUpdates, secretUpdates := 0, 0, 0, 0, 0, 0
 	defer metricsUpdateTicker.Stop()
 	for {
 		select {
@@ -299,6 +324,23 @@ func (w *watcher) watches() {
 			n := evt.Object.(*v1.Node)
 			w.processNode(evt.Type, n.DeepCopy())
 
+		case evt, ok := <-w.secrets.ResultChan():
+			if !ok || evt.Object == nil {
+				err := w.resetWatch()
+				if err != nil {
+					w.logger.Infof("secret watcher event, resetWatch() failed: %v", err)
+				}
+				continue
+			}
+			w.watchBackoffDuration = 0
+			secretUpdates++
+			w.metrics.WatchData("secrets")
+			w.logger.Debugf("got secrets update from result chan")
+			s := evt.Object.(*v1.Secret)
+			if w.processSecret(evt.Type, s.DeepCopy()) {
+				w.publishSecrets()
+			}
+
 		case <-metricsUpdateTicker.C:
 
 			w.metrics.WatchBackoffDuration(w.watchBackoffDuration)
@@ -309,10 +351,12 @@ func (w *watcher) watches() {
 				"services":      svcUpdates,
 				"endpoints":     epUpdates,
 				"configmap":     cmUpdates,
+				"secrets":       secretUpdates,
 				"nodeTargets":   len(w.nodeTargets),
 				"configTargets": len(w.targets),
+				"secretTargets": len(w.secretTargets),
 			}).Infof("watch summary")
-			totalUpdates, nodeUpdates, svcUpdates, epUpdates, cmUpdates = 0, 0, 0, 0, 0
+			totalUpdates, nodeUpdates, svcUpdates, epUpdates, cmUpdates, secretUpdates = 0, 0, 0, 0, 0, 0
 		}
 		// increment total only if the watchers didn't expire
 		totalUpdates++
@@ -373,7 +417,7 @@ func (w *watcher) buildNodeConfig() (types.NodesList, error) {
 	// on a node, can determine the appropriate ratio of traffic that a node should
 	// receive for a given service. These ratios are used by the ipvs master in order
 	// to capture traffic for local services, outside of ipvs, when the master is not
-	// running in an isolated context.
+	// running in an isolated context. Each address counts for the weight of its node.
 	addressTotals := map[string]int{}
 
 	seenAlready := make(map[string]bool)
@@ -381,9 +425,19 @@ func (w *watcher) buildNodeConfig() (types.NodesList, error) {
 		keyprefix := ep.Namespace + "/" + ep.Name + "/"
 		for _, subset := range ep.Subsets { // *v1.EndpointSubset
 
+			weighted := 0
+			for _, address := range subset.Addresses {
+				weight := 1
+				if address.NodeName != nil {
+					if idx, ok := nodeIndexes[*address.NodeName]; ok {
+						weight = nodes[idx].Weight()
+					}
+				}
+				weighted += weight
+			}
 			for _, port := range subset.Ports {
 				ident := types.MakeIdent(ep.Namespace, ep.Name, port.Name)
-				addressTotals[ident] += len(subset.Addresses)
+				addressTotals[ident] += weighted
 			}
 
 			for _, address := range subset.Addresses { // *v1.Address
@@ -555,6 +609,44 @@ func (w *watcher) publishNodes(nodes types.NodesList) {
 
 }
 
+// publishSecrets sends a copy of the tls secrets to each secret target.
+func (w *watcher) publishSecrets() {
+	w.Lock()
+	defer w.Unlock()
+
+	secretDeletes := []string{}
+	for key, tgt := range w.secretTargets {
+		select {
+		case <-tgt.ctx.Done():
+			w.logger.Infof("publish - secrets - removing watcher for key=%v", key)
+			secretDeletes = append(secretDeletes, key)
+			continue
+		default:
+		}
+
+		select {
+		case tgt.secrets <- w.copySecrets():
+			w.logger.Debug("publish - secrets - successfully published secrets")
+		case <-time.After(1 * time.Second):
+			w.logger.Errorf("publish - secrets - output channel full.")
+			continue
+		}
+	}
+
+	for _, key := range secretDeletes {
+		delete(w.secretTargets, key)
+	}
+}
+
+// copySecrets returns a copy of the map of tls secrets, for a target to own.
+func (w *watcher) copySecrets() map[string]*v1.Secret {
+	out := map[string]*v1.Secret{}
+	for k, v := range w.allSecrets {
+		out[k] = v
+	}
+	return out
+}
+
 // generates a new ClusterConfig object, compares it to the existing, and if different,
 // mutates the state of watcher with the new value. it returns a boolean indicating whether
 // the cluster state was changed, and an error
@@ -656,6 +748,35 @@ func (w *watcher) processNode(eventType watch.EventType, node *v1.Node) {
 	w.logger.Debugf("have %d nodes", len(w.nodes))
 }
 
+// processSecret records a change to a tls secret, and returns true if the
+// secrets changed. Resyncs that repeat a secret's data change nothing.
+func (w *watcher) processSecret(eventType watch.EventType, secret *v1.Secret) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if eventType == "ERROR" {
+		return false
+	}
+
+	identity := secret.ObjectMeta.Namespace + "/" + secret.ObjectMeta.Name
+	existing, found := w.allSecrets[identity]
+	switch eventType {
+	case "ADDED", "MODIFIED":
+		w.logger.Debugf("processSecret - %s - %s", eventType, identity)
+		if found && reflect.DeepEqual(existing.Data, secret.Data) {
+			return false
+		}
+		w.allSecrets[identity] = secret
+		return true
+
+	case "DELETED":
+		w.logger.Debugf("processSecret - DELETED - %s", identity)
+		delete(w.allSecrets, identity)
+		return found
+	}
+	return false
+}
+
 func (w *watcher) processConfigMap(eventType watch.EventType, configmap *v1.ConfigMap) {
 	if eventType == "ERROR" {
 		return
@@ -753,6 +874,24 @@ func (w *watcher) Nodes(ctx context.Context, name string, output chan types.Node
 	}
 }
 
+func (w *watcher) Secrets(ctx context.Context, name string, output chan map[string]*v1.Secret) {
+	w.logger.Debugf("registering secret watcher for ctx=%v name=%s", ctx, name)
+	w.Lock()
+	defer w.Unlock()
+
+	// as with the other watchers, a new target is sent the secrets that are
+	// already known
+	w.secretTargets[name] = target{
+		ctx:     ctx,
+		secrets: output,
+	}
+	select {
+	case output <- w.copySecrets():
+	default:
+		w.logger.Warnf("unable to write secrets to output channel for '%s'", name)
+	}
+}
+
 func (w *watcher) extractConfigKey(configmap *v1.ConfigMap) (*types.ClusterConfig, error) {
 	// Unmarshal the config map, retrieving only the configuration matching the configKey
 	clusterConfig, err := types.NewClusterConfig(configmap, w.configKey)
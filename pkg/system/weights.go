@@ -0,0 +1,186 @@
+package system
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
+)
+
+// WeightBalanceInterval is how often the workers that program IPVS compare the
+// active connections of realservers, when weight balancing is enabled.
+const WeightBalanceInterval = 10 * time.Second
+
+const (
+	// weightBalanceStep is how far, in percent of its weight, a realserver
+	// is moved by one adjustment, and weightBalanceFloor how far down it
+	// may be moved.
+	weightBalanceStep  = 10
+	weightBalanceFloor = 50
+
+	// weightBalanceMinConnections is the mean of active connections per
+	// realserver below which a service is left alone, as its counts are noise.
+	weightBalanceMinConnections = 10
+)
+
+// WeightBalance configures the adjustment of realserver weights from their
+// active connection counts. A realserver whose active connections per unit of
+// weight exceed its service's mean by more than Threshold, e.g. 0.25, is a hot
+// node, and has its weight lowered a step. It is raised a step again once it
+// falls below the mean by as much. Between the two it is left alone, and no
+// realserver is adjusted more than once per Interval.
+type WeightBalance struct {
+	Enabled   bool
+	Threshold float64
+	Interval  time.Duration
+}
+
+// weightBalancer holds the adjustments made to the weights of realservers.
+// Balanced weights are expressed in hundredths, so that a realserver of weight
+// 1 can be nudged, e.g. to 90, without changing its share relative to others.
+type weightBalancer struct {
+	threshold float64
+	interval  time.Duration
+
+	// factors holds the percentage of its weight given to each adjusted
+	// realserver, and changed when it was last adjusted, by ipvsStatsKey.
+	// Realservers without a factor get all of their weight.
+	factors map[string]int
+	changed map[string]time.Time
+}
+
+// newWeightBalancer returns nil when balancing is disabled.
+func newWeightBalancer(config WeightBalance) *weightBalancer {
+	if !config.Enabled {
+		return nil
+	}
+	return &weightBalancer{
+		threshold: config.Threshold,
+		interval:  config.Interval,
+		factors:   map[string]int{},
+		changed:   map[string]time.Time{},
+	}
+}
+
+// factor returns the percentage of its weight given to a realserver.
+func (b *weightBalancer) factor(key string) int {
+	if f, ok := b.factors[key]; ok {
+		return f
+	}
+	return 100
+}
+
+// weights scales the weights of the realserver rules among rules by their
+// factors, leaving the rest alone.
+func (b *weightBalancer) weights(rules []string) []string {
+	out := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		r, err := parseIPVSRule(rule)
+		if err != nil || r.command != "-a" {
+			out = append(out, rule)
+			continue
+		}
+		key := ipvsStatsKey(ipvsCounters{}.stats(r.service, formatIPVSAddress(r.dest.addr, r.dest.port)))
+		r.dest.weight = r.dest.weight * uint32(b.factor(key))
+		out = append(out, r.dest.rule(r.service))
+	}
+	return out
+}
+
+// update adjusts the factors of the realservers in counters, as of now, and
+// reports whether any changed. Realservers that are no longer listed are
+// forgotten.
+func (b *weightBalancer) update(counters []stats.IPVSStats, now time.Time, logger logrus.FieldLogger) bool {
+	// group the realservers of each service that take new connections
+	services := map[string][]stats.IPVSStats{}
+	listed := map[string]bool{}
+	for _, s := range counters {
+		if s.RealServer == "" {
+			continue
+		}
+		listed[ipvsStatsKey(s)] = true
+		if s.Weight <= 0 {
+			continue
+		}
+		service := s
+		service.RealServer = ""
+		services[ipvsStatsKey(service)] = append(services[ipvsStatsKey(service)], s)
+	}
+	for key := range b.factors {
+		if !listed[key] {
+			delete(b.factors, key)
+			delete(b.changed, key)
+		}
+	}
+
+	changed := false
+	for service, realServers := range services {
+		if len(realServers) < 2 {
+			continue
+		}
+		var active uint64
+		weight := 0
+		for _, rs := range realServers {
+			active += rs.ActiveConnections
+			weight += rs.Weight
+		}
+		if active < uint64(weightBalanceMinConnections*len(realServers)) {
+			continue
+		}
+		mean := float64(active) / float64(weight)
+
+		for _, rs := range realServers {
+			key := ipvsStatsKey(rs)
+			if now.Sub(b.changed[key]) < b.interval {
+				continue
+			}
+			load := float64(rs.ActiveConnections) / float64(rs.Weight) / mean
+			factor := b.factor(key)
+			next := factor
+			switch {
+			case load > 1+b.threshold && factor > weightBalanceFloor:
+				next = factor - weightBalanceStep
+				if next < weightBalanceFloor {
+					next = weightBalanceFloor
+				}
+			case load < 1-b.threshold && factor < 100:
+				next = factor + weightBalanceStep
+				if next > 100 {
+					next = 100
+				}
+			}
+			if next == factor {
+				continue
+			}
+			logger.Infof("realserver %s of %s has %d active connections, %.2f times its share. weight %d%% -> %d%%", rs.RealServer, service, rs.ActiveConnections, load, factor, next)
+			if next == 100 {
+				delete(b.factors, key)
+			} else {
+				b.factors[key] = next
+			}
+			b.changed[key] = now
+			changed = true
+		}
+	}
+	return changed
+}
+
+// BalanceWeights adjusts the weights of realservers from their active
+// connections, and reports whether any changed. A change clears the parity
+// of the last checks, so that the new weights are applied with the next
+// reconfigure. It does nothing unless weight balancing is enabled.
+func (i *ipvs) BalanceWeights() (bool, error) {
+	if i.balancer == nil {
+		return false, nil
+	}
+	counters, err := i.Stats()
+	if err != nil {
+		return false, err
+	}
+	if !i.balancer.update(counters, time.Now(), i.logger) {
+		return false, nil
+	}
+	i.parity, i.parity6 = 0, 0
+	return true, nil
+}
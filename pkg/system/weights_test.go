@@ -0,0 +1,85 @@
+package system
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.comcast.com/viper-sde/kube2ipvs/pkg/stats"
+)
+
+func TestWeightBalancer(t *testing.T) {
+	b := newWeightBalancer(WeightBalance{Enabled: true, Threshold: 0.25, Interval: time.Minute})
+	realServers := func(active ...uint64) []stats.IPVSStats {
+		out := []stats.IPVSStats{{Protocol: "tcp", VIP: "172.27.223.81", Port: "80"}}
+		for n, a := range active {
+			rs := "172.27.223.10" + string('1'+byte(n)) + ":80"
+			out = append(out, stats.IPVSStats{Protocol: "tcp", VIP: "172.27.223.81", Port: "80", RealServer: rs, Weight: b.factor("tcp 172.27.223.81 80 " + rs), ActiveConnections: a})
+		}
+		return out
+	}
+	hot := "tcp 172.27.223.81 80 172.27.223.101:80"
+	now := time.Now()
+
+	// within the threshold nothing moves
+	if b.update(realServers(110, 90, 100), now, logrus.New()) {
+		t.Fatalf("expected no change within the threshold. saw %v", b.factors)
+	}
+	// too few connections to judge
+	if b.update(realServers(20, 1, 1), now, logrus.New()) {
+		t.Fatalf("expected no change below the minimum connections. saw %v", b.factors)
+	}
+
+	if !b.update(realServers(200, 50, 50), now, logrus.New()) || b.factor(hot) != 90 {
+		t.Fatalf("expected the hot realserver to be lowered a step. saw %v", b.factors)
+	}
+	// rate limited
+	if b.update(realServers(200, 50, 50), now.Add(time.Second), logrus.New()) {
+		t.Fatalf("expected no change within the interval. saw %v", b.factors)
+	}
+
+	// lowered until the floor
+	for n := 1; n < 10; n++ {
+		b.update(realServers(200, 50, 50), now.Add(time.Duration(n)*time.Minute), logrus.New())
+	}
+	if b.factor(hot) != weightBalanceFloor {
+		t.Fatalf("expected the hot realserver to stop at %d%%. saw %d%%", weightBalanceFloor, b.factor(hot))
+	}
+
+	// and raised again once it is cold, but not while it is near the mean
+	// of its lowered weight
+	now = now.Add(time.Hour)
+	if b.update(realServers(50, 100, 100), now, logrus.New()) {
+		t.Fatalf("expected no change near the mean. saw %v", b.factors)
+	}
+	if !b.update(realServers(20, 100, 100), now, logrus.New()) || b.factor(hot) != weightBalanceFloor+weightBalanceStep {
+		t.Fatalf("expected the cold realserver to be raised a step. saw %v", b.factors)
+	}
+
+	// removed realservers are forgotten
+	b.update(realServers(), now, logrus.New())
+	if len(b.factors) != 0 || len(b.changed) != 0 {
+		t.Fatalf("expected removed realservers to be forgotten. saw %v", b.factors)
+	}
+
+	b.factors[hot] = 80
+	rules := []string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 2 -x 0 -y 0",
+		"-a -t 172.27.223.81:80 -r 172.27.223.102:80 -g -w 1 -x 0 -y 0",
+	}
+	expects := []string{
+		"-A -t 172.27.223.81:80 -s wrr",
+		"-a -t 172.27.223.81:80 -r 172.27.223.101:80 -g -w 160",
+		"-a -t 172.27.223.81:80 -r 172.27.223.102:80 -g -w 100",
+	}
+	if out := b.weights(rules); !reflect.DeepEqual(out, expects) {
+		t.Fatalf("expected %v. saw %v", expects, out)
+	}
+
+	if newWeightBalancer(WeightBalance{}) != nil {
+		t.Fatalf("expected no balancer when balancing is disabled")
+	}
+}
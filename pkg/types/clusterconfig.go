@@ -3,6 +3,9 @@ package types
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"k8s.io/api/core/v1"
@@ -25,6 +28,10 @@ type ClusterConfig struct {
 	IPV6       map[ServiceIP]string  `json:"ipv6"`
 	Config     map[ServiceIP]PortMap `json:"config"`
 	Config6    map[ServiceIP]PortMap `json:"config6"`
+
+	// VIPOptions holds settings that apply to a VIP as a whole, rather than
+	// to one of its ports. It is keyed the same way as Config and Config6.
+	VIPOptions map[ServiceIP]*VIPOptions `json:"vipOptions,omitempty"`
 }
 
 func NewClusterConfig(config *v1.ConfigMap, configKey string) (*ClusterConfig, error) {
@@ -44,6 +51,10 @@ func NewClusterConfig(config *v1.ConfigMap, configKey string) (*ClusterConfig, e
 		return nil, fmt.Errorf("json unmarshal error. %v", err)
 	}
 
+	if err := clusterConfig.expandPortRanges(); err != nil {
+		return nil, fmt.Errorf("validation error. %v", err)
+	}
+
 	// TODO: validate the cluster config in depth
 	if err := clusterConfig.Validate(); err != nil {
 		return nil, fmt.Errorf("validation error. %v", err)
@@ -51,8 +62,650 @@ func NewClusterConfig(config *v1.ConfigMap, configKey string) (*ClusterConfig, e
 	return clusterConfig, nil
 }
 
+// Copy returns a deep copy of the config, or nil for a nil config. Every field
+// of a ClusterConfig is serialized, so the copy is made through JSON, which
+// cannot fail on the strings, integers, bools, slices and string keyed maps
+// that it holds.
+func (c *ClusterConfig) Copy() *ClusterConfig {
+	if c == nil {
+		return nil
+	}
+	b, _ := json.Marshal(c)
+	out := &ClusterConfig{}
+	json.Unmarshal(b, out)
+	return out
+}
+
 func (c *ClusterConfig) Validate() error {
-	// TODO: add validation!
+	for _, config := range []map[ServiceIP]PortMap{c.Config, c.Config6} {
+		for vip, ports := range config {
+			if err := validateTargetPorts(ports); err != nil {
+				return fmt.Errorf("vip %s: %v", vip, err)
+			}
+			if err := validateOnePacket(ports, c.Fwmark(vip) != 0); err != nil {
+				return fmt.Errorf("vip %s: %v", vip, err)
+			}
+			if err := validateMaxConnections(ports, c.NoTrack(vip)); err != nil {
+				return fmt.Errorf("vip %s: %v", vip, err)
+			}
+			if err := validateHAProxyModes(ports); err != nil {
+				return fmt.Errorf("vip %s: %v", vip, err)
+			}
+			if err := validateHealthChecks(ports); err != nil {
+				return fmt.Errorf("vip %s: %v", vip, err)
+			}
+			if err := validateHAProxyDNS(ports); err != nil {
+				return fmt.Errorf("vip %s: %v", vip, err)
+			}
+			if err := validateSourceRanges(ports); err != nil {
+				return fmt.Errorf("vip %s: %v", vip, err)
+			}
+		}
+	}
+
+	marks := map[uint32]ServiceIP{}
+	for vip, opts := range c.VIPOptions {
+		if opts == nil {
+			continue
+		}
+		if err := opts.Validate(); err != nil {
+			return fmt.Errorf("vip %s: %v", vip, err)
+		}
+		if _, ok := c.Config6[vip]; ok && opts.HAProxyFrontend {
+			return fmt.Errorf("vip %s: haproxyFrontend applies to ipv4 vips, as ipv6 vips are balanced by IPVS", vip)
+		}
+		if opts.ForwardingMethod == ForwardingNAT {
+			// masquerading would hide the client address that Local preserves
+			for port, service := range c.Config[vip] {
+				if service != nil && service.IPVSOptions.ExternalTrafficPolicy() == TrafficPolicyLocal {
+					return fmt.Errorf("vip %s: port %s has externalTrafficPolicy %s, which cannot be used with forwardingMethod %s", vip, port, TrafficPolicyLocal, ForwardingNAT)
+				}
+			}
+		}
+		if opts.Fwmark == 0 {
+			continue
+		}
+		if other, ok := marks[opts.Fwmark]; ok {
+			return fmt.Errorf("vip %s: fwmark %d is already used by vip %s", vip, opts.Fwmark, other)
+		}
+		marks[opts.Fwmark] = vip
+		for _, config := range []map[ServiceIP]PortMap{c.Config, c.Config6} {
+			if err := validateFwmarkPorts(config[vip]); err != nil {
+				return fmt.Errorf("vip %s: %v", vip, err)
+			}
+		}
+	}
+	return nil
+}
+
+// expandPortRanges replaces each range of ports, e.g. "30000-30100", with an
+// entry for every port in it, so that the IPVS, iptables and haproxy
+// configurations are generated as though each port had been listed. Fwmark
+// VIPs are left alone, as they match their ranges, written low:high, whole.
+func (c *ClusterConfig) expandPortRanges() error {
+	for _, config := range []map[ServiceIP]PortMap{c.Config, c.Config6} {
+		for vip, ports := range config {
+			if c.Fwmark(vip) != 0 {
+				continue
+			}
+			expanded, err := expandPortRanges(ports)
+			if err != nil {
+				return fmt.Errorf("vip %s: %v", vip, err)
+			}
+			config[vip] = expanded
+		}
+	}
+	return nil
+}
+
+func expandPortRanges(ports PortMap) (PortMap, error) {
+	out := PortMap{}
+	for port, service := range ports {
+		if !strings.Contains(port, "-") {
+			if _, ok := out[port]; ok {
+				return nil, fmt.Errorf("port %s is also part of a port range", port)
+			}
+			out[port] = service
+			continue
+		}
+
+		bounds := strings.Split(port, "-")
+		low, errLow := strconv.Atoi(bounds[0])
+		high, errHigh := strconv.Atoi(bounds[len(bounds)-1])
+		if len(bounds) != 2 || errLow != nil || errHigh != nil || low < 1 || high > 65535 || low > high {
+			return nil, fmt.Errorf("port range %q must be low-high, between 1 and 65535", port)
+		}
+		if service != nil && service.TargetPort != "" {
+			return nil, fmt.Errorf("port range %s cannot have a targetPort", port)
+		}
+		for p := low; p <= high; p++ {
+			key := strconv.Itoa(p)
+			if _, ok := out[key]; ok {
+				return nil, fmt.Errorf("port %s of range %s is already configured", key, port)
+			}
+			if _, ok := ports[key]; ok {
+				return nil, fmt.Errorf("port %s of range %s is already configured", key, port)
+			}
+			out[key] = service
+		}
+	}
+	return out, nil
+}
+
+// validateOnePacket checks that one-packet scheduling is only asked of ports
+// whose udp traffic is balanced by IPVS, those of fwmark VIPs.
+func validateOnePacket(ports PortMap, fwmark bool) error {
+	for port, service := range ports {
+		if service == nil || !service.IPVSOptions.OnePacket() {
+			continue
+		}
+		if !service.UDPEnabled {
+			return fmt.Errorf("port %s: onePacket requires udpEnabled", port)
+		}
+		if !fwmark {
+			return fmt.Errorf("port %s: onePacket requires a fwmark vip, as udp is only balanced by fwmark virtual services", port)
+		}
+	}
+	return nil
+}
+
+// validateMaxConnections checks that the connection limits of a VIP's ports
+// are not negative, and that a noTrack VIP has none, as they are counted by
+// conntrack.
+func validateMaxConnections(ports PortMap, noTrack bool) error {
+	for port, service := range ports {
+		if service == nil || service.MaxConnections == 0 {
+			continue
+		}
+		if service.MaxConnections < 0 {
+			return fmt.Errorf("port %s: maxConnections %d must not be negative", port, service.MaxConnections)
+		}
+		if noTrack {
+			return fmt.Errorf("port %s: maxConnections cannot be used on a noTrack vip, as connections are counted by conntrack", port)
+		}
+	}
+	return nil
+}
+
+// validateHAProxyModes checks that the haproxy mode of a VIP's ports is tcp
+// or http, that http ports do not ask for the PROXY protocol, and that only
+// http ports speak HTTP/2 to their backends.
+func validateHAProxyModes(ports PortMap) error {
+	for port, service := range ports {
+		if service == nil {
+			continue
+		}
+		switch service.HAProxyMode {
+		case "", HAProxyModeTCP:
+			if service.HAProxyHTTP2 {
+				return fmt.Errorf("port %s: haproxyHTTP2 can only be used with haproxyMode %s", port, HAProxyModeHTTP)
+			}
+		case HAProxyModeHTTP:
+			if service.ProxyProtocolEnabled {
+				return fmt.Errorf("port %s: proxyProtocolEnabled cannot be used with haproxyMode %s, which forwards the client address in headers", port, HAProxyModeHTTP)
+			}
+		default:
+			return fmt.Errorf("port %s: haproxyMode %q must be %s or %s", port, service.HAProxyMode, HAProxyModeTCP, HAProxyModeHTTP)
+		}
+	}
+	return nil
+}
+
+// validateHealthChecks checks the haproxy health checks of a VIP's ports.
+func validateHealthChecks(ports PortMap) error {
+	for port, service := range ports {
+		if service == nil || service.HealthCheck == nil {
+			continue
+		}
+		if err := service.HealthCheck.Validate(); err != nil {
+			return fmt.Errorf("port %s: %v", port, err)
+		}
+	}
+	return nil
+}
+
+// validateHAProxyDNS checks the DNS resolved backends of a VIP's ports.
+func validateHAProxyDNS(ports PortMap) error {
+	for port, service := range ports {
+		if service == nil || service.HAProxyDNS == nil {
+			continue
+		}
+		if service.PortName == "" {
+			return fmt.Errorf("port %s: haproxyDNS needs a portName to resolve the SRV record of", port)
+		}
+		if service.HAProxyEndpoints {
+			return fmt.Errorf("port %s: haproxyDNS cannot be used with haproxyEndpoints", port)
+		}
+		if service.HAProxyDNS.Slots < 0 || service.HAProxyDNS.Slots > maxDNSSlots {
+			return fmt.Errorf("port %s: haproxyDNS slots %d must be between 0 and %d", port, service.HAProxyDNS.Slots, maxDNSSlots)
+		}
+	}
+	return nil
+}
+
+// validateSourceRanges checks that the source ranges of a VIP's ports are
+// CIDRs.
+func validateSourceRanges(ports PortMap) error {
+	for port, service := range ports {
+		if service == nil {
+			continue
+		}
+		for _, cidr := range service.SourceRanges {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("port %s: sourceRanges %q is not a CIDR", port, cidr)
+			}
+		}
+	}
+	return nil
+}
+
+// validateTargetPorts checks that the target ports of a VIP's ports are valid
+// port numbers.
+func validateTargetPorts(ports PortMap) error {
+	for port, service := range ports {
+		if service == nil || service.TargetPort == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(service.TargetPort); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("port %s: targetPort %q must be between 1 and 65535", port, service.TargetPort)
+		}
+	}
+	return nil
+}
+
+// validateFwmarkPorts checks the ports of a fwmark VIP. They may be ranges,
+// e.g. "20000:21000", and must all lead to the same service, as they share a
+// single virtual service and set of realservers.
+func validateFwmarkPorts(ports PortMap) error {
+	var first *ServiceDef
+	for port, service := range ports {
+		if service == nil {
+			continue
+		}
+		bounds := strings.Split(port, ":")
+		if len(bounds) > 2 {
+			return fmt.Errorf("port %q must be a port or a range of ports, low:high", port)
+		}
+		for _, bound := range bounds {
+			if n, err := strconv.Atoi(bound); err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("port %q must be a port or a range of ports, low:high", port)
+			}
+		}
+		if service.TargetPort != "" {
+			return fmt.Errorf("port %s: a fwmark vip's ports cannot have a targetPort", port)
+		}
+		if first == nil {
+			first = service
+		} else if service.Namespace != first.Namespace || service.Service != first.Service {
+			return fmt.Errorf("port %s leads to %s/%s, but a fwmark vip's ports must all lead to %s/%s", port, service.Namespace, service.Service, first.Namespace, first.Service)
+		}
+	}
+	return nil
+}
+
+// Fwmark returns the firewall mark of a VIP, or 0 if it has none.
+func (c *ClusterConfig) Fwmark(vip ServiceIP) uint32 {
+	if opts, ok := c.VIPOptions[vip]; ok && opts != nil {
+		return opts.Fwmark
+	}
+	return 0
+}
+
+// Tunneled returns true if any port of a VIP is forwarded in IPIP tunnel mode.
+// Realservers bind such VIPs on their tunnel device.
+func (c *ClusterConfig) Tunneled(vip ServiceIP) bool {
+	for _, service := range c.Config[vip] {
+		if service != nil && c.ForwardingMethod(vip, service) == "i" {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardingMethod returns the ipvsadm forwarding method of a VIP's port, g, i
+// or m. The VIP's forwarding method, if set, applies to all of its ports.
+func (c *ClusterConfig) ForwardingMethod(vip ServiceIP, service *ServiceDef) string {
+	if opts, ok := c.VIPOptions[vip]; ok && opts != nil {
+		switch opts.ForwardingMethod {
+		case ForwardingDR:
+			return "g"
+		case ForwardingTunnel:
+			return "i"
+		case ForwardingNAT:
+			return "m"
+		}
+	}
+	return service.IPVSOptions.ForwardingMethod()
+}
+
+// Masqueraded returns true if a VIP is forwarded in NAT mode.
+func (c *ClusterConfig) Masqueraded(vip ServiceIP) bool {
+	opts, ok := c.VIPOptions[vip]
+	return ok && opts != nil && opts.ForwardingMethod == ForwardingNAT
+}
+
+// NoTrack returns true if a VIP's traffic is exempt from connection tracking.
+func (c *ClusterConfig) NoTrack(vip ServiceIP) bool {
+	opts, ok := c.VIPOptions[vip]
+	return ok && opts != nil && opts.NoTrack
+}
+
+// DSCP returns the DSCP value that marks a VIP's egress traffic, or 0 if it
+// has none.
+func (c *ClusterConfig) DSCP(vip ServiceIP) uint8 {
+	if opts, ok := c.VIPOptions[vip]; ok && opts != nil {
+		return opts.DSCP
+	}
+	return 0
+}
+
+// SynRateLimit returns the SYN rate limit of a VIP, or nil if it has none.
+func (c *ClusterConfig) SynRateLimit(vip ServiceIP) *SynRateLimit {
+	if opts, ok := c.VIPOptions[vip]; ok && opts != nil {
+		return opts.SynRateLimit
+	}
+	return nil
+}
+
+// TLSSecret returns the namespace/name of the Secret that a VIP terminates
+// TLS with, or "" if it does not terminate TLS.
+func (c *ClusterConfig) TLSSecret(vip ServiceIP) string {
+	if opts, ok := c.VIPOptions[vip]; ok && opts != nil {
+		return opts.TLSSecret
+	}
+	return ""
+}
+
+// HAProxy returns the haproxy tuning of a VIP, or nil if it has none.
+func (c *ClusterConfig) HAProxy(vip ServiceIP) *HAProxyTuning {
+	if opts, ok := c.VIPOptions[vip]; ok && opts != nil {
+		return opts.HAProxy
+	}
+	return nil
+}
+
+// HAProxyFrontend returns true if an ipv4 VIP is served by haproxy rather than
+// IPVS.
+func (c *ClusterConfig) HAProxyFrontend(vip ServiceIP) bool {
+	opts, ok := c.VIPOptions[vip]
+	return ok && opts != nil && opts.HAProxyFrontend
+}
+
+// RoutePolicy returns the route policy for a VIP, or nil if it has none.
+func (c *ClusterConfig) RoutePolicy(vip ServiceIP) *RoutePolicy {
+	if opts, ok := c.VIPOptions[vip]; ok && opts != nil {
+		return opts.RoutePolicy
+	}
+	return nil
+}
+
+// VIPOptions contains per-VIP options.
+type VIPOptions struct {
+	// RoutePolicy describes how the VIP is advertised in BGP.
+	RoutePolicy *RoutePolicy `json:"routePolicy,omitempty"`
+
+	// Fwmark serves all of the VIP's ports with a single IPVS virtual
+	// service, matched on this firewall mark rather than on address and
+	// port. Traffic to the VIP's ports is marked in the mangle table. The
+	// ports of a fwmark VIP may be ranges, as in "20000:21000", which suits
+	// services such as passive FTP or SIP that listen on many ports.
+	Fwmark uint32 `json:"fwmark,omitempty"`
+
+	// ForwardingMethod is how directors forward the VIP's traffic to
+	// realservers: dr (direct routing), tunnel (IPIP) or nat. When empty, each
+	// port's ipvsOptions decide. Replies to nat VIPs return through the
+	// director, which masquerades the traffic it forwards so that realservers
+	// need not route through it.
+	ForwardingMethod string `json:"forwardingMethod,omitempty"`
+
+	// NoTrack exempts the traffic to the VIP's ports from connection
+	// tracking on directors, with NOTRACK rules in the raw table. Direct
+	// routed and tunneled traffic needs no conntrack entries, which otherwise
+	// fill nf_conntrack under high connection rates. It cannot be used with
+	// the nat forwarding method, whose masquerading relies on conntrack.
+	NoTrack bool `json:"noTrack,omitempty"`
+
+	// DSCP marks the egress traffic of the VIP, the replies to its clients,
+	// with this differentiated services code point, e.g. 46 for expedited
+	// forwarding, so that the network can tell service tiers apart. Replies
+	// are matched by conntrack as they leave realservers and nat directors,
+	// so it cannot be used with noTrack.
+	DSCP uint8 `json:"dscp,omitempty"`
+
+	// SynRateLimit drops the SYNs to the VIP beyond a rate on directors, with
+	// hashlimit rules in the filter table, to blunt SYN floods before IPVS
+	// balances them. SYN proxying is not offered, as directors that route
+	// directly or tunnel never see the replies that would complete it.
+	SynRateLimit *SynRateLimit `json:"synRateLimit,omitempty"`
+
+	// TLSSecret terminates TLS on the VIP's ports in haproxy, which serves
+	// the ipv6 address of an ipv4 VIP, with the certificate and key of this
+	// kubernetes.io/tls Secret, named as namespace/name. The backends then
+	// receive plain TCP. A rotated certificate is picked up by a reload.
+	TLSSecret string `json:"tlsSecret,omitempty"`
+
+	// HAProxy sizes the haproxy instance that serves the ipv6 address of an
+	// ipv4 VIP, so that heavy VIPs need not share the defaults of the rest.
+	HAProxy *HAProxyTuning `json:"haproxy,omitempty"`
+
+	// HAProxyFrontend serves an ipv4 VIP with haproxy on the bgp worker, as
+	// its ipv6 address is, in place of IPVS, for services that need L7
+	// features such as http mode or TLS termination. Its ports then balance
+	// across service addresses with haproxy's options rather than IPVS's.
+	HAProxyFrontend bool `json:"haproxyFrontend,omitempty"`
+}
+
+// HAProxyTuning overrides the limits of a VIP's haproxy instance. Zero keeps
+// the default of each.
+type HAProxyTuning struct {
+	// MaxConn is the global maxconn, the connections the instance holds at
+	// once across its ports. It defaults to 4096.
+	MaxConn int `json:"maxConn,omitempty"`
+	// NBThread is the number of threads the instance runs. By default
+	// haproxy decides.
+	NBThread int `json:"nbThread,omitempty"`
+	// FrontendMaxConn is the maxconn of each of the VIP's ports. It defaults
+	// to 28000.
+	FrontendMaxConn int `json:"frontendMaxConn,omitempty"`
+
+	// ConnectTimeout, ClientTimeout and ServerTimeout are haproxy's timeouts,
+	// in milliseconds, for connecting to a backend and for the client and
+	// backend sides of a connection to go idle. Long-lived streaming
+	// connections want longer client and server timeouts. They default to
+	// 5000, 50000 and 50000.
+	ConnectTimeout int `json:"connectTimeout,omitempty"`
+	ClientTimeout  int `json:"clientTimeout,omitempty"`
+	ServerTimeout  int `json:"serverTimeout,omitempty"`
+}
+
+// maxNBThread bounds HAProxyTuning.NBThread, the threads of a thread group.
+const maxNBThread = 64
+
+func (h *HAProxyTuning) Validate() error {
+	if h.MaxConn < 0 || h.FrontendMaxConn < 0 {
+		return fmt.Errorf("haproxy maxConn and frontendMaxConn must not be negative")
+	}
+	if h.ConnectTimeout < 0 || h.ClientTimeout < 0 || h.ServerTimeout < 0 {
+		return fmt.Errorf("haproxy connectTimeout, clientTimeout and serverTimeout must not be negative")
+	}
+	if h.NBThread < 0 || h.NBThread > maxNBThread {
+		return fmt.Errorf("haproxy nbThread %d must be between 0 and %d", h.NBThread, maxNBThread)
+	}
+	return nil
+}
+
+// SynRateLimit limits the rate of new connections to a VIP.
+type SynRateLimit struct {
+	// Rate is the SYNs per second that are let through, to all of the VIP's
+	// ports together, or from each client with PerSource.
+	Rate uint32 `json:"rate"`
+	// Burst is the SYNs let through at once above Rate. It defaults to Rate.
+	Burst     uint32 `json:"burst,omitempty"`
+	PerSource bool   `json:"perSource,omitempty"`
+}
+
+// BurstOrDefault returns the burst of the limit, or its rate when it has none.
+func (s *SynRateLimit) BurstOrDefault() uint32 {
+	if s.Burst == 0 {
+		return s.Rate
+	}
+	return s.Burst
+}
+
+// MaxDSCP is the largest differentiated services code point, in 6 bits.
+const MaxDSCP = 63
+
+// HealthCheck describes how haproxy checks the service address of a port.
+// Zero values keep haproxy's defaults.
+type HealthCheck struct {
+	// Interval is the time between checks, in milliseconds. It defaults to
+	// 2000.
+	Interval int `json:"interval,omitempty"`
+	// Rise is the number of passing checks after which a failed backend is
+	// used again. It defaults to 2.
+	Rise int `json:"rise,omitempty"`
+	// Fall is the number of failing checks after which a backend is no
+	// longer used. It defaults to 3.
+	Fall int `json:"fall,omitempty"`
+	// HTTPPath checks with an http GET of this path, passing on a 2xx or 3xx
+	// response, rather than with a tcp connect.
+	HTTPPath string `json:"httpPath,omitempty"`
+}
+
+// healthCheckPath matches the paths that a health check may GET.
+var healthCheckPath = regexp.MustCompile(`^/[A-Za-z0-9/._~%=?-]*$`)
+
+func (h *HealthCheck) Validate() error {
+	if h.Interval < 0 || h.Rise < 0 || h.Fall < 0 {
+		return fmt.Errorf("healthCheck interval, rise and fall must not be negative")
+	}
+	if h.HTTPPath != "" && !healthCheckPath.MatchString(h.HTTPPath) {
+		return fmt.Errorf("healthCheck httpPath %q must be a path of letters, digits and /._~%%=?-", h.HTTPPath)
+	}
+	return nil
+}
+
+// HAProxyDNS describes the servers of a port that haproxy resolves from the
+// cluster DNS.
+type HAProxyDNS struct {
+	// Slots is the most endpoints that the port balances across. It
+	// defaults to 16.
+	Slots int `json:"slots,omitempty"`
+}
+
+// maxDNSSlots bounds HAProxyDNS.Slots.
+const maxDNSSlots = 1024
+
+// HAProxy modes of a port. See ServiceDef.HAProxyMode.
+const (
+	HAProxyModeTCP  = "tcp"
+	HAProxyModeHTTP = "http"
+)
+
+// Forwarding methods of a VIP. See VIPOptions.ForwardingMethod.
+const (
+	ForwardingDR     = "dr"
+	ForwardingTunnel = "tunnel"
+	ForwardingNAT    = "nat"
+)
+
+func (v *VIPOptions) Validate() error {
+	switch v.ForwardingMethod {
+	case "", ForwardingDR, ForwardingTunnel, ForwardingNAT:
+	default:
+		return fmt.Errorf("forwardingMethod %q must be one of %s, %s or %s", v.ForwardingMethod, ForwardingDR, ForwardingTunnel, ForwardingNAT)
+	}
+	if v.NoTrack && v.ForwardingMethod == ForwardingNAT {
+		return fmt.Errorf("noTrack cannot be used with forwardingMethod %s, which relies on conntrack", ForwardingNAT)
+	}
+	if v.DSCP > MaxDSCP {
+		return fmt.Errorf("dscp %d must be at most %d", v.DSCP, MaxDSCP)
+	}
+	if v.DSCP != 0 && v.NoTrack {
+		return fmt.Errorf("dscp cannot be used with noTrack, as replies are matched by conntrack")
+	}
+	if v.SynRateLimit != nil && v.SynRateLimit.Rate == 0 {
+		return fmt.Errorf("synRateLimit must have a rate")
+	}
+	if parts := strings.Split(v.TLSSecret, "/"); v.TLSSecret != "" && (len(parts) != 2 || parts[0] == "" || parts[1] == "") {
+		return fmt.Errorf("tlsSecret %q must be namespace/name", v.TLSSecret)
+	}
+	if v.HAProxy != nil {
+		if err := v.HAProxy.Validate(); err != nil {
+			return err
+		}
+	}
+	if v.HAProxyFrontend && (v.Fwmark != 0 || v.ForwardingMethod != "") {
+		return fmt.Errorf("haproxyFrontend cannot be used with fwmark or forwardingMethod, which configure IPVS")
+	}
+	if v.RoutePolicy != nil {
+		return v.RoutePolicy.Validate()
+	}
+	return nil
+}
+
+// NextHopSelf is the RoutePolicy next hop that tells the BGP speaker to use
+// its own session address.
+const NextHopSelf = "self"
+
+// RoutePolicy contains the BGP path attributes attached to a VIP's announcement.
+type RoutePolicy struct {
+	// NextHop is either "self" or an explicit ip address. When empty, the
+	// bgp worker's default next hop is used.
+	NextHop string `json:"nextHop,omitempty"`
+
+	// LocalPref is the LOCAL_PREF attribute, used by iBGP peers to choose
+	// between Ravel nodes advertising the same VIP. Zero leaves the speaker's
+	// default in place. It is not sent to eBGP peers.
+	LocalPref uint32 `json:"localPref,omitempty"`
+
+	// Communities are standard communities, as "asn:value" or one of the
+	// well-known names no-export, no-advertise and no-export-subconfed.
+	Communities []string `json:"communities,omitempty"`
+
+	// MED is the MULTI_EXIT_DISC attribute. Zero leaves it unset.
+	MED uint32 `json:"med,omitempty"`
+
+	// Prepend is the number of times the local ASN is prepended to the
+	// AS_PATH, to make the route less attractive to peers.
+	Prepend int `json:"prepend,omitempty"`
+
+	// PeerGroup restricts the advertisement to the peers in the named group.
+	// When empty, the VIP is advertised to every peer.
+	PeerGroup string `json:"peerGroup,omitempty"`
+}
+
+// maxPrepend bounds RoutePolicy.Prepend. Longer paths are rejected by some
+// routers, and never needed to lose a best path comparison.
+const maxPrepend = 10
+
+var wellKnownCommunities = map[string]bool{
+	"no-export":           true,
+	"no-advertise":        true,
+	"no-export-subconfed": true,
+}
+
+func (r *RoutePolicy) Validate() error {
+	if r.NextHop != "" && r.NextHop != NextHopSelf && net.ParseIP(r.NextHop) == nil {
+		return fmt.Errorf("routePolicy nextHop %q must be %q or an ip address", r.NextHop, NextHopSelf)
+	}
+	for _, c := range r.Communities {
+		if wellKnownCommunities[c] {
+			continue
+		}
+		parts := strings.Split(c, ":")
+		if len(parts) != 2 {
+			return fmt.Errorf("routePolicy community %q must be asn:value", c)
+		}
+		for _, part := range parts {
+			if _, err := strconv.ParseUint(part, 10, 16); err != nil {
+				return fmt.Errorf("routePolicy community %q must be asn:value, each between 0 and 65535", c)
+			}
+		}
+	}
+	if r.Prepend < 0 || r.Prepend > maxPrepend {
+		return fmt.Errorf("routePolicy prepend %d must be between 0 and %d", r.Prepend, maxPrepend)
+	}
 	return nil
 }
 
@@ -70,15 +723,87 @@ type ServiceDef struct {
 	Service   string `json:"service"`
 	PortName  string `json:"portName"`
 
+	// TargetPort is the port that backends serve the VIP's port on, when it
+	// differs, e.g. a VIP listening on 443 for pods serving on 8443. Directors
+	// forward nat VIPs to the nodes on this port, and nodes DNAT to pods on it.
+	// When empty, the VIP's port is forwarded as is and pods are reached on
+	// the port of their endpoints.
+	TargetPort string `json:"targetPort,omitempty"`
+
+	// MaxConnections caps the tcp connections open to the VIP's port at once,
+	// from all clients together, so that one tenant cannot exhaust a shared
+	// director. New connections beyond it are reset. It is counted by
+	// conntrack, so it cannot be used on noTrack VIPs. 0 leaves it unlimited.
+	MaxConnections int `json:"maxConnections,omitempty"`
+
+	// SourceRanges are the CIDRs of the clients that may connect to the
+	// VIP's port, e.g. 10.0.0.0/8, so that an internal-only port is not
+	// exposed to the world through a public VIP. haproxy rejects other
+	// clients, and realservers do not forward them to pods. When empty,
+	// every client may connect.
+	SourceRanges []string `json:"sourceRanges,omitempty"`
+
 	// Here, the ServiceDef also defines x,y connection limits for IPVS, as well
 	// as any other per-LB options
 	IPVSOptions IPVSOptions `json:"ipvsOptions"`
 
-	IPV4Enabled          bool `json:"ipv4Enabled"`
-	IPV6Enabled          bool `json:"ipv6Enabled"`
-	TCPEnabled           bool `json:"tcpEnabled"`
-	UDPEnabled           bool `json:"udpEnabled"`
+	IPV4Enabled bool `json:"ipv4Enabled"`
+	IPV6Enabled bool `json:"ipv6Enabled"`
+	TCPEnabled  bool `json:"tcpEnabled"`
+	UDPEnabled  bool `json:"udpEnabled"`
+
+	// ProxyProtocolEnabled has haproxy, which serves the ipv6 address of an
+	// ipv4 VIP, send the PROXY protocol v2 header to the backends of the
+	// port rather than the v1 header, so that they receive the client's ipv6
+	// address despite the ipv6 to ipv4 hop.
 	ProxyProtocolEnabled bool `json:"proxyProtocolEnabled"`
+
+	// HAProxyMode is the mode that haproxy proxies the port in, tcp or http.
+	// In http mode, the client address reaches the backends in the
+	// X-Forwarded-For and Forwarded headers, for applications that cannot
+	// parse the PROXY protocol, which is then not sent. It defaults to tcp.
+	HAProxyMode string `json:"haproxyMode,omitempty"`
+
+	// HAProxyHTTP2 has haproxy speak HTTP/2 in cleartext to the backends of
+	// an http mode port, for gRPC services. Clients of a VIP that terminates
+	// TLS negotiate HTTP/2 or HTTP/1.1 with ALPN either way.
+	HAProxyHTTP2 bool `json:"haproxyHTTP2,omitempty"`
+
+	// HAProxyEndpoints has haproxy balance the port across the endpoints of
+	// its service itself, rather than forward to the service's cluster
+	// address for kube-proxy to balance.
+	HAProxyEndpoints bool `json:"haproxyEndpoints,omitempty"`
+
+	// HAProxyDNS has haproxy balance the port across the endpoints of its
+	// service as the cluster DNS resolves them, so that the servers follow
+	// the endpoints without a reload. The service must be headless and the
+	// port named, as the port's SRV record is resolved.
+	HAProxyDNS *HAProxyDNS `json:"haproxyDNS,omitempty"`
+
+	// HealthCheck has haproxy check the port's service address, so that it
+	// stops sending to a cluster IP whose backends are gone. Without one,
+	// haproxy relies on kube-proxy alone.
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+}
+
+// Sources returns the SourceRanges of one address family, ipv6 or ipv4, as
+// networks in the form that iptables-save prints them, e.g. 10.0.0.0/8 for
+// 10.1.2.3/8. A service without SourceRanges returns nil, as every client may
+// connect, whereas one whose ranges are all of the other family returns an
+// empty slice, as none may.
+func (s *ServiceDef) Sources(ipv6 bool) []string {
+	if len(s.SourceRanges) == 0 {
+		return nil
+	}
+	out := []string{}
+	for _, cidr := range s.SourceRanges {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil || (network.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		out = append(out, network.String())
+	}
+	return out
 }
 
 // IPVSOptions contains per-service options for the IPVS configuration.
@@ -119,6 +844,69 @@ type IPVSOptions struct {
 	// Scheduler is the way that connections are load balanced to the realservers. defaults to 'wrr'
 	// -s wrr
 	RawScheduler string `json:"scheduler"`
+
+	// The mh (maglev hashing) scheduler hashes the client address onto the
+	// realservers the same way on every director, so that a flow keeps its
+	// realserver when ECMP moves it to another director. MHPort includes the
+	// client port in the hash, MHFallback chooses another realserver when the
+	// hashed one is at weight 0 or over its threshold.
+	// -s mh -b mh-fallback,mh-port
+	RawMHFallback bool `json:"mhFallback"`
+	RawMHPort     bool `json:"mhPort"`
+
+	// RawPersistence is the persistence timeout, in seconds. When set, new
+	// connections from a client go to the realserver that its previous ones
+	// went to, until the timeout passes without any. Long-lived sessions such as
+	// RTMP or websockets need this when clients reconnect. 0 disables it.
+	// -p 300
+	RawPersistence int `json:"persistence"`
+
+	// RawPersistenceNetmask groups clients for persistence, so that all the
+	// clients of a network stick to the same realserver. defaults to
+	// 255.255.255.255, each client on its own.
+	// -M 255.255.255.0
+	RawPersistenceNetmask string `json:"persistenceNetmask"`
+
+	// RawExternalTrafficPolicy follows the kubernetes service field of the same
+	// name. With Local, only the nodes that run the service's pods are made
+	// realservers, so that traffic takes no extra hop between nodes and pods
+	// see the client's address. Defaults to Cluster, every eligible node.
+	RawExternalTrafficPolicy string `json:"externalTrafficPolicy"`
+
+	// RawOnePacket schedules each udp datagram on its own, rather than sending
+	// all of a client's datagrams to one realserver, for stateless protocols
+	// such as DNS. IPVS balances udp for fwmark VIPs with udpEnabled set.
+	// -o
+	RawOnePacket bool `json:"onePacket"`
+}
+
+// External traffic policies. See IPVSOptions.RawExternalTrafficPolicy.
+const (
+	TrafficPolicyCluster = "Cluster"
+	TrafficPolicyLocal   = "Local"
+)
+
+// Persistence outputs the persistence timeout, 0 when persistence is disabled
+func (i *IPVSOptions) Persistence() int {
+	if i.RawPersistence < 0 {
+		return 0
+	}
+	return i.RawPersistence
+}
+
+// PersistenceNetmask outputs the persistence netmask in dotted notation, or ""
+// for the default of one client per realserver. Masks that are not contiguous
+// are ignored.
+func (i *IPVSOptions) PersistenceNetmask() string {
+	ip := net.ParseIP(i.RawPersistenceNetmask).To4()
+	if ip == nil {
+		return ""
+	}
+	ones, bits := net.IPMask(ip).Size()
+	if bits == 0 || ones == 32 {
+		return ""
+	}
+	return ip.String()
 }
 
 // Scheduler returns a scheduler
@@ -137,6 +925,8 @@ func (i *IPVSOptions) Scheduler() string {
 		scheduler = "dh"
 	case "sh":
 		scheduler = "sh"
+	case "mh":
+		scheduler = "mh"
 	default:
 		// not supported:  lblc, lblcr, sed, nq
 		scheduler = "wrr"
@@ -144,6 +934,21 @@ func (i *IPVSOptions) Scheduler() string {
 	return scheduler
 }
 
+// SchedulerFlags outputs the scheduler flags, for the mh scheduler only
+func (i *IPVSOptions) SchedulerFlags() string {
+	if i.Scheduler() != "mh" {
+		return ""
+	}
+	flags := []string{}
+	if i.RawMHFallback {
+		flags = append(flags, "mh-fallback")
+	}
+	if i.RawMHPort {
+		flags = append(flags, "mh-port")
+	}
+	return strings.Join(flags, ",")
+}
+
 // UThreshold outputs the upper threshold
 func (i *IPVSOptions) UThreshold() int {
 	if i.RawLThreshold >= i.RawUThreshold {
@@ -178,6 +983,19 @@ func (i *IPVSOptions) ForwardingMethod() string {
 	return method
 }
 
+// ExternalTrafficPolicy outputs the external traffic policy, Cluster or Local
+func (i *IPVSOptions) ExternalTrafficPolicy() string {
+	if i.RawExternalTrafficPolicy == TrafficPolicyLocal {
+		return TrafficPolicyLocal
+	}
+	return TrafficPolicyCluster
+}
+
+// OnePacket outputs whether one-packet scheduling is enabled
+func (i *IPVSOptions) OnePacket() bool {
+	return i.RawOnePacket
+}
+
 // NewServiceDef accepts a kubernetes-formatted "namespace/service:port" identifier and
 // outputs a populated ServiceDef
 func NewServiceDef(s string) (*ServiceDef, error) {
@@ -3,8 +3,11 @@ package types
 import (
 	"fmt"
 	"net"
+	"path"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
@@ -31,7 +34,7 @@ func (n NodesList) Less(i, j int) bool { return n[i].Name < n[j].Name }
 func (n NodesList) Copy() NodesList {
 	out := make(NodesList, len(n))
 	for i, node := range n {
-		out[i] = node
+		out[i] = node.Copy()
 	}
 	return out
 }
@@ -49,6 +52,13 @@ type Node struct {
 	Ready         bool              `json:"ready"`
 	Labels        map[string]string `json:"labels"`
 
+	// Taints holds the sorted keys of the node's taints
+	Taints []string `json:"taints,omitempty"`
+
+	// Annotations holds the node's annotations under AnnotationPrefix. Others
+	// are dropped, so that their churn does not look like a node change.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
 	addressTotals map[string]int
 	localTotals   map[string]int
 
@@ -56,7 +66,8 @@ type Node struct {
 }
 
 // GetLocalServicePropability computes the likelihood that any traffic for the
-// service ends up on this particular node.
+// service ends up on this particular node, from its share of the service's
+// pods, each counted by the weight of the node it runs on.
 func (n *Node) GetLocalServicePropability(namespace, service, portName string, logger logrus.FieldLogger) float64 {
 	ident := MakeIdent(namespace, service, portName)
 	// logger.Infof("WAT local=%v total=%v", n.localTotals, n.addressTotals)
@@ -76,10 +87,61 @@ func (n *Node) SetTotals(totals map[string]int) {
 		for _, subset := range ep.Subsets {
 			for _, port := range subset.Ports {
 				ident := MakeIdent(ep.Namespace, ep.Service, port.Name)
-				n.localTotals[ident] += len(subset.Addresses)
+				n.localTotals[ident] += len(subset.Addresses) * n.Weight()
+			}
+		}
+	}
+}
+
+// Copy returns a deep copy of the node, which shares nothing with it.
+func (n Node) Copy() Node {
+	out := n
+	out.Addresses = append([]string(nil), n.Addresses...)
+	out.Labels = copyMap(n.Labels)
+	out.Taints = append([]string(nil), n.Taints...)
+	out.Annotations = copyMap(n.Annotations)
+	out.addressTotals = copyTotals(n.addressTotals)
+	out.localTotals = copyTotals(n.localTotals)
+	if n.Endpoints != nil {
+		out.Endpoints = make([]Endpoints, len(n.Endpoints))
+		for i, ep := range n.Endpoints {
+			out.Endpoints[i] = ep
+			if ep.Subsets == nil {
+				continue
+			}
+			out.Endpoints[i].Subsets = make([]Subset, len(ep.Subsets))
+			for j, subset := range ep.Subsets {
+				out.Endpoints[i].Subsets[j] = Subset{
+					TotalAddresses: subset.TotalAddresses,
+					Addresses:      append([]Address(nil), subset.Addresses...),
+					Ports:          append([]Port(nil), subset.Ports...),
+				}
 			}
 		}
 	}
+	return out
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func copyTotals(m map[string]int) map[string]int {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]int, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
 }
 
 // SortConstituents sort all the sub-elements of a given node
@@ -97,6 +159,74 @@ func (n *Node) SortConstituents() {
 	}
 }
 
+// AnnotationPrefix is the prefix of the node annotations that Ravel reads.
+const AnnotationPrefix = "ravel.io/"
+
+// WeightAnnotation sets the weight of each pod on a node, e.g. "2" on a node
+// twice the size of the others, so that it is sent twice the share of traffic
+// per pod. A weight of 0 sends it none.
+const WeightAnnotation = AnnotationPrefix + "weight"
+
+// Weight returns the weight of the node from WeightAnnotation, or 1 when it is
+// not set or is not a whole number of 0 or more.
+func (n *Node) Weight() int {
+	weight, err := strconv.Atoi(n.Annotations[WeightAnnotation])
+	if err != nil || weight < 0 {
+		return 1
+	}
+	return weight
+}
+
+// ExcludeAnnotation lists the VIPs and services that a node must not serve,
+// separated by commas, e.g. "10.54.213.253, tenant-a/*" to dedicate a node to
+// other tenants. An entry is a VIP, or a namespace/service glob matching the
+// services on any VIP. Directors leave the node out of the realservers of the
+// services it excludes, and the node does not DNAT their traffic.
+const ExcludeAnnotation = AnnotationPrefix + "exclude"
+
+// Excludes returns true if the node must not serve service on vip, as it is
+// listed by ExcludeAnnotation.
+func (n *Node) Excludes(vip ServiceIP, service *ServiceDef) bool {
+	annotation, ok := n.Annotations[ExcludeAnnotation]
+	if !ok {
+		return false
+	}
+	for _, entry := range strings.Split(annotation, ",") {
+		entry = strings.TrimSpace(entry)
+		if ip := net.ParseIP(entry); ip != nil {
+			if vipIP := net.ParseIP(string(vip)); vipIP != nil && ip.Equal(vipIP) {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(entry, service.Namespace+"/"+service.Service); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Served returns the services of vips that the node serves, leaving out the
+// ones it excludes, and the VIPs that are left without any.
+func (n *Node) Served(vips map[ServiceIP]PortMap) map[ServiceIP]PortMap {
+	if _, ok := n.Annotations[ExcludeAnnotation]; !ok {
+		return vips
+	}
+	served := map[ServiceIP]PortMap{}
+	for vip, ports := range vips {
+		for port, service := range ports {
+			if n.Excludes(vip, service) {
+				continue
+			}
+			if served[vip] == nil {
+				served[vip] = PortMap{}
+			}
+			served[vip][port] = service
+		}
+	}
+	return served
+}
+
 func NewNode(kubeNode *v1.Node) Node {
 	n := Node{}
 	n.Name = kubeNode.Name
@@ -104,11 +234,35 @@ func NewNode(kubeNode *v1.Node) Node {
 	n.Unschedulable = kubeNode.Spec.Unschedulable
 	n.Ready = isInReadyState(kubeNode)
 	n.Labels = kubeNode.GetLabels()
+	for _, taint := range kubeNode.Spec.Taints {
+		n.Taints = append(n.Taints, taint.Key)
+	}
+	sort.Strings(n.Taints)
+	for k, v := range kubeNode.GetAnnotations() {
+		if !strings.HasPrefix(k, AnnotationPrefix) {
+			continue
+		}
+		if n.Annotations == nil {
+			n.Annotations = map[string]string{}
+		}
+		n.Annotations[k] = v
+	}
 
 	n.Endpoints = []Endpoints{}
 	return n
 }
 
+// IPV6 returns the node's first global ipv6 address, or "" if it has none.
+func (n *Node) IPV6() string {
+	for _, addr := range n.Addresses {
+		i := net.ParseIP(addr)
+		if i != nil && i.To4() == nil && i.IsGlobalUnicast() {
+			return i.String()
+		}
+	}
+	return ""
+}
+
 func (n *Node) IPV4() string {
 	for _, addr := range n.Addresses {
 		i := net.ParseIP(addr)
@@ -119,13 +273,30 @@ func (n *Node) IPV4() string {
 	return ""
 }
 
-func (n *Node) IsEligibleBackend(labels map[string]string, ip string, ignoreCordon bool) (bool, string) {
+// Maintenance returns why the node is out of service for maintenance, because
+// it is cordoned or carries one of drainTaints, or "" if it is in service. The
+// cordon is not counted with ignoreCordon.
+func (n *Node) Maintenance(ignoreCordon bool, drainTaints []string) string {
+	if n.Unschedulable && !ignoreCordon {
+		return fmt.Sprintf("node %s has unschedulable set. saw %v", n.IPV4(), n.Unschedulable)
+	}
+	for _, taint := range n.Taints {
+		for _, drainTaint := range drainTaints {
+			if taint == drainTaint {
+				return fmt.Sprintf("node %s has the taint %s", n.IPV4(), taint)
+			}
+		}
+	}
+	return ""
+}
+
+func (n *Node) IsEligibleBackend(labels map[string]string, ip string, ignoreCordon bool, drainTaints []string) (bool, string) {
 	if len(n.Addresses) == 0 {
 		return false, fmt.Sprintf("node %s does not have an IP address", n.Name)
 	}
 
-	if n.Unschedulable && !ignoreCordon {
-		return false, fmt.Sprintf("node %s has unschedulable set. saw %v", n.IPV4(), n.Unschedulable)
+	if reason := n.Maintenance(ignoreCordon, drainTaints); reason != "" {
+		return false, reason
 	}
 
 	if !n.Ready {
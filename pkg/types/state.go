@@ -0,0 +1,60 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// WorkerState is a worker's current view of the cluster, as served by the
+// admin endpoint for debugging: the config and nodes it last received, when
+// it last received an update and last reconfigured, and the depths of its
+// inbound channels.
+type WorkerState struct {
+	Config *ClusterConfig `json:"config"`
+	Nodes  NodesList      `json:"nodes"`
+
+	LastInboundUpdate time.Time `json:"lastInboundUpdate"`
+	LastReconfigure   time.Time `json:"lastReconfigure"`
+
+	// ForcedReconfigure is set while the worker reconfigures without a
+	// parity check every forced-reconfigure-interval.
+	ForcedReconfigure bool `json:"forcedReconfigure,omitempty"`
+
+	// QueueDepths is the number of updates waiting on each inbound channel
+	QueueDepths map[string]int `json:"queueDepths"`
+}
+
+// WorkerStatus is a summary of how a worker's last applies and parity checks
+// went, for the top-level command to report its health from.
+type WorkerStatus struct {
+	Running bool `json:"running"`
+
+	// LastApply is when a configuration was last applied, and LastError the
+	// error of the last apply or parity check that failed, at LastErrorTime.
+	LastApply     time.Time `json:"lastApply"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime"`
+
+	// Parity is set while the last check or apply left the node configured
+	// as its config says, and cleared by a failure.
+	Parity bool `json:"parity"`
+
+	// VIPs and Rules count what the last apply configured: VIP addresses,
+	// and iptables rules or IPVS services, depending on the worker.
+	VIPs  int `json:"vips"`
+	Rules int `json:"rules"`
+}
+
+// Health returns nil if the worker is running with the node in parity, or an
+// error saying why not.
+func (s WorkerStatus) Health() error {
+	switch {
+	case !s.Running:
+		return fmt.Errorf("worker is not running")
+	case !s.Parity && s.LastError != "":
+		return fmt.Errorf("last apply failed at %s. %s", s.LastErrorTime.Format(time.RFC3339), s.LastError)
+	case !s.Parity:
+		return fmt.Errorf("node is not configured as its config says")
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package types
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
 	"k8s.io/api/core/v1"
 )
@@ -26,3 +28,586 @@ func TestConfigDataConvert(t *testing.T) {
 
 	fmt.Printf("clusterConfig: %v", clusterConfig)
 }
+
+func TestRoutePolicyNextHop(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.165":{
+                        "80":{"namespace": "syseng", "service": "mod-super8", "portName": "http"}
+                    }
+                },
+                "vipOptions": {
+                    "10.54.213.165": {"routePolicy": {"nextHop": "10.131.153.70", "localPref": 200}}
+                }
+        }`}
+
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := clusterConfig.RoutePolicy("10.54.213.165"); p == nil || p.NextHop != "10.131.153.70" {
+		t.Fatalf("expected next hop 10.131.153.70. saw %+v", p)
+	}
+	if p := clusterConfig.RoutePolicy("10.54.213.165"); p.LocalPref != 200 {
+		t.Fatalf("expected local-pref 200. saw %d", p.LocalPref)
+	}
+	if p := clusterConfig.RoutePolicy("10.54.213.166"); p != nil {
+		t.Fatalf("expected no route policy. saw %+v", p)
+	}
+
+	for _, policy := range []string{
+		`{"nextHop": "router"}`,
+		`{"communities": ["65000"]}`,
+		`{"communities": ["65000:70000"]}`,
+		`{"prepend": 11}`,
+	} {
+		data["green"] = `{"vipOptions": {"10.54.213.165": {"routePolicy": ` + policy + `}}}`
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green"); err == nil {
+			t.Fatalf("expected route policy %s to fail validation", policy)
+		}
+	}
+}
+
+func TestIPVSOptionsPersistence(t *testing.T) {
+	tests := []struct {
+		options     IPVSOptions
+		persistence int
+		netmask     string
+	}{
+		{IPVSOptions{}, 0, ""},
+		{IPVSOptions{RawPersistence: 300}, 300, ""},
+		{IPVSOptions{RawPersistence: -1}, 0, ""},
+		{IPVSOptions{RawPersistence: 300, RawPersistenceNetmask: "255.255.255.0"}, 300, "255.255.255.0"},
+		{IPVSOptions{RawPersistence: 300, RawPersistenceNetmask: "255.255.255.255"}, 300, ""},
+		{IPVSOptions{RawPersistence: 300, RawPersistenceNetmask: "255.0.255.0"}, 300, ""},
+		{IPVSOptions{RawPersistence: 300, RawPersistenceNetmask: "24"}, 300, ""},
+	}
+	for _, test := range tests {
+		if p := test.options.Persistence(); p != test.persistence {
+			t.Fatalf("%+v: expected persistence %d. saw %d", test.options, test.persistence, p)
+		}
+		if m := test.options.PersistenceNetmask(); m != test.netmask {
+			t.Fatalf("%+v: expected netmask %q. saw %q", test.options, test.netmask, m)
+		}
+	}
+}
+
+func TestIPVSOptionsSchedulerFlags(t *testing.T) {
+	tests := []struct {
+		options IPVSOptions
+		flags   string
+	}{
+		{IPVSOptions{RawScheduler: "mh"}, ""},
+		{IPVSOptions{RawScheduler: "mh", RawMHFallback: true}, "mh-fallback"},
+		{IPVSOptions{RawScheduler: "mh", RawMHFallback: true, RawMHPort: true}, "mh-fallback,mh-port"},
+		{IPVSOptions{RawScheduler: "wrr", RawMHPort: true}, ""},
+	}
+	for _, test := range tests {
+		if flags := test.options.SchedulerFlags(); flags != test.flags {
+			t.Fatalf("%+v: expected flags %q. saw %q", test.options, test.flags, flags)
+		}
+	}
+}
+
+func TestFwmarkValidation(t *testing.T) {
+	config := func(ports, options string) map[string]string {
+		return map[string]string{"green": `{
+                "config": {"10.54.213.165": {` + ports + `}, "10.54.213.166": {"21": {"namespace": "ftp", "service": "ftp", "portName": "ftp"}}},
+                "vipOptions": {` + options + `}
+        }`}
+	}
+	ftp := `"21": {"namespace": "ftp", "service": "ftp", "portName": "ftp"}, "20000:21000": {"namespace": "ftp", "service": "ftp", "portName": "passive"}`
+
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: config(ftp, `"10.54.213.165": {"fwmark": 7}`)}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark := clusterConfig.Fwmark("10.54.213.165"); mark != 7 {
+		t.Fatalf("expected fwmark 7. saw %d", mark)
+	}
+	if mark := clusterConfig.Fwmark("10.54.213.166"); mark != 0 {
+		t.Fatalf("expected no fwmark. saw %d", mark)
+	}
+
+	for _, test := range []struct{ ports, options string }{
+		{ftp, `"10.54.213.165": {"fwmark": 7}, "10.54.213.166": {"fwmark": 7}`},
+		{`"21": {"namespace": "ftp", "service": "ftp"}, "20000:": {"namespace": "ftp", "service": "ftp"}`, `"10.54.213.165": {"fwmark": 7}`},
+		{`"21": {"namespace": "ftp", "service": "ftp"}, "0:100": {"namespace": "ftp", "service": "ftp"}`, `"10.54.213.165": {"fwmark": 7}`},
+		{`"21": {"namespace": "ftp", "service": "ftp"}, "5060": {"namespace": "voice", "service": "sip"}`, `"10.54.213.165": {"fwmark": 7}`},
+	} {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: config(test.ports, test.options)}, "green"); err == nil {
+			t.Fatalf("expected ports {%s} with options {%s} to fail validation", test.ports, test.options)
+		}
+	}
+
+	// ports without a service are skipped, and those of an ipv6 vip are
+	// checked as well
+	config6 := &ClusterConfig{
+		Config: map[ServiceIP]PortMap{"10.54.213.165": {"21": nil}},
+		Config6: map[ServiceIP]PortMap{"2001:558:1044:159::165": {
+			"21":   &ServiceDef{Namespace: "ftp", Service: "ftp"},
+			"5060": &ServiceDef{Namespace: "voice", Service: "sip"},
+		}},
+		VIPOptions: map[ServiceIP]*VIPOptions{"10.54.213.165": {Fwmark: 7}},
+	}
+	if err := config6.Validate(); err != nil {
+		t.Fatalf("expected a port without a service to be skipped. saw %v", err)
+	}
+	config6.VIPOptions["2001:558:1044:159::165"] = &VIPOptions{Fwmark: 8}
+	if err := config6.Validate(); err == nil {
+		t.Fatalf("expected the ipv6 vip's ports to fail validation")
+	}
+}
+
+func TestTunneled(t *testing.T) {
+	config := &ClusterConfig{Config: map[ServiceIP]PortMap{
+		"10.54.213.165": {"80": &ServiceDef{IPVSOptions: IPVSOptions{RawForwardingMethod: "g"}}},
+		"10.54.213.166": {
+			"80":  &ServiceDef{},
+			"443": &ServiceDef{IPVSOptions: IPVSOptions{RawForwardingMethod: "i"}},
+		},
+	}}
+	if config.Tunneled("10.54.213.165") {
+		t.Fatalf("expected 10.54.213.165 to be direct routed")
+	}
+	if !config.Tunneled("10.54.213.166") {
+		t.Fatalf("expected 10.54.213.166 to be tunneled")
+	}
+}
+
+func TestVIPForwardingMethod(t *testing.T) {
+	tunnel := &ServiceDef{IPVSOptions: IPVSOptions{RawForwardingMethod: "i"}}
+	config := &ClusterConfig{
+		Config: map[ServiceIP]PortMap{
+			"10.54.213.165": {"80": tunnel},
+			"10.54.213.166": {"80": tunnel},
+		},
+		VIPOptions: map[ServiceIP]*VIPOptions{"10.54.213.166": {ForwardingMethod: ForwardingNAT}},
+	}
+	if m := config.ForwardingMethod("10.54.213.165", tunnel); m != "i" {
+		t.Fatalf("expected the port's forwarding method i. saw %s", m)
+	}
+	if m := config.ForwardingMethod("10.54.213.166", tunnel); m != "m" {
+		t.Fatalf("expected the vip's forwarding method m. saw %s", m)
+	}
+	if config.Masqueraded("10.54.213.165") || !config.Masqueraded("10.54.213.166") {
+		t.Fatalf("expected only 10.54.213.166 to be masqueraded")
+	}
+	if config.Tunneled("10.54.213.166") {
+		t.Fatalf("expected the vip's forwarding method to override tunneling")
+	}
+
+	if err := (&VIPOptions{ForwardingMethod: "fullnat"}).Validate(); err == nil {
+		t.Fatalf("expected forwardingMethod fullnat to fail validation")
+	}
+	if err := (&VIPOptions{ForwardingMethod: ForwardingNAT, NoTrack: true}).Validate(); err == nil {
+		t.Fatalf("expected noTrack to fail validation on a nat vip")
+	}
+	if err := (&VIPOptions{DSCP: 64}).Validate(); err == nil {
+		t.Fatalf("expected dscp 64 to fail validation")
+	}
+	if err := (&VIPOptions{DSCP: 46, NoTrack: true}).Validate(); err == nil {
+		t.Fatalf("expected dscp to fail validation on a noTrack vip")
+	}
+	if err := (&VIPOptions{DSCP: 46, ForwardingMethod: ForwardingNAT}).Validate(); err != nil {
+		t.Fatalf("expected dscp to pass validation on a nat vip. %v", err)
+	}
+	if err := (&VIPOptions{SynRateLimit: &SynRateLimit{Burst: 10}}).Validate(); err == nil {
+		t.Fatalf("expected a synRateLimit without a rate to fail validation")
+	}
+	for _, secret := range []string{"tls", "/tls", "ns/", "ns/tls/key"} {
+		if err := (&VIPOptions{TLSSecret: secret}).Validate(); err == nil {
+			t.Fatalf("expected tlsSecret %q to fail validation", secret)
+		}
+	}
+	if err := (&VIPOptions{TLSSecret: "ns/tls"}).Validate(); err != nil {
+		t.Fatalf("expected tlsSecret ns/tls to pass validation. %v", err)
+	}
+	if err := (&VIPOptions{HAProxy: &HAProxyTuning{NBThread: 65}}).Validate(); err == nil {
+		t.Fatalf("expected haproxy nbThread 65 to fail validation")
+	}
+	if err := (&VIPOptions{HAProxy: &HAProxyTuning{MaxConn: -1}}).Validate(); err == nil {
+		t.Fatalf("expected a negative haproxy maxConn to fail validation")
+	}
+	if err := (&VIPOptions{HAProxy: &HAProxyTuning{ClientTimeout: -1}}).Validate(); err == nil {
+		t.Fatalf("expected a negative haproxy clientTimeout to fail validation")
+	}
+}
+
+func TestExternalTrafficPolicy(t *testing.T) {
+	if p := (&IPVSOptions{RawExternalTrafficPolicy: "local"}).ExternalTrafficPolicy(); p != TrafficPolicyCluster {
+		t.Fatalf("expected unknown policies to default to %s. saw %s", TrafficPolicyCluster, p)
+	}
+
+	local := &ServiceDef{IPVSOptions: IPVSOptions{RawExternalTrafficPolicy: TrafficPolicyLocal}}
+	config := &ClusterConfig{
+		Config:     map[ServiceIP]PortMap{"10.54.213.165": {"80": local}},
+		VIPOptions: map[ServiceIP]*VIPOptions{"10.54.213.165": {ForwardingMethod: ForwardingTunnel}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected Local to be valid on a tunneled vip. saw %v", err)
+	}
+	config.VIPOptions["10.54.213.165"].ForwardingMethod = ForwardingNAT
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected Local to fail validation on a nat vip")
+	}
+}
+
+func TestTargetPortValidation(t *testing.T) {
+	config := &ClusterConfig{Config: map[ServiceIP]PortMap{
+		"10.54.213.165": {"443": &ServiceDef{TargetPort: "8443"}},
+	}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected targetPort 8443 to be valid. saw %v", err)
+	}
+
+	config.Config["10.54.213.165"]["443"].TargetPort = "https"
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected a named targetPort to fail validation")
+	}
+
+	config.Config["10.54.213.165"]["443"].TargetPort = "8443"
+	config.VIPOptions = map[ServiceIP]*VIPOptions{"10.54.213.165": {Fwmark: 1}}
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected a targetPort on a fwmark vip to fail validation")
+	}
+}
+
+func TestMaxConnectionsValidation(t *testing.T) {
+	nginx := &ServiceDef{MaxConnections: 1000}
+	config := &ClusterConfig{Config: map[ServiceIP]PortMap{"10.54.213.165": {"80": nginx}}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected maxConnections to be valid. saw %v", err)
+	}
+
+	config.VIPOptions = map[ServiceIP]*VIPOptions{"10.54.213.165": {NoTrack: true}}
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected maxConnections on a noTrack vip to fail validation")
+	}
+
+	config.VIPOptions = nil
+	nginx.MaxConnections = -1
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected negative maxConnections to fail validation")
+	}
+}
+
+func TestHAProxyModeValidation(t *testing.T) {
+	web := &ServiceDef{HAProxyMode: HAProxyModeHTTP}
+	config := &ClusterConfig{Config: map[ServiceIP]PortMap{"10.54.213.165": {"80": web}}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected haproxyMode http to be valid. saw %v", err)
+	}
+
+	web.ProxyProtocolEnabled = true
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected proxyProtocolEnabled in haproxyMode http to fail validation")
+	}
+
+	web.ProxyProtocolEnabled = false
+	web.HAProxyHTTP2 = true
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected haproxyHTTP2 in haproxyMode http to be valid. saw %v", err)
+	}
+
+	web.HAProxyMode = HAProxyModeTCP
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected haproxyHTTP2 in haproxyMode tcp to fail validation")
+	}
+
+	web.HAProxyHTTP2 = false
+	web.HAProxyMode = "h2"
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected haproxyMode h2 to fail validation")
+	}
+}
+
+func TestHAProxyFrontendValidation(t *testing.T) {
+	web := PortMap{"443": &ServiceDef{HAProxyMode: HAProxyModeHTTP}}
+	opts := &VIPOptions{HAProxyFrontend: true}
+	config := &ClusterConfig{
+		Config:     map[ServiceIP]PortMap{"10.54.213.165": web},
+		VIPOptions: map[ServiceIP]*VIPOptions{"10.54.213.165": opts},
+	}
+	if err := config.Validate(); err != nil || !config.HAProxyFrontend("10.54.213.165") {
+		t.Fatalf("expected an haproxy frontend to be valid. saw %v", err)
+	}
+
+	opts.ForwardingMethod = ForwardingNAT
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected an haproxy frontend with a forwardingMethod to fail validation")
+	}
+
+	opts.ForwardingMethod = ""
+	config.Config6 = map[ServiceIP]PortMap{"10.54.213.165": web}
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected an ipv6 haproxy frontend to fail validation")
+	}
+}
+
+func TestHealthCheckValidation(t *testing.T) {
+	web := &ServiceDef{HealthCheck: &HealthCheck{Interval: 1000, HTTPPath: "/healthz?full=1"}}
+	config := &ClusterConfig{Config: map[ServiceIP]PortMap{"10.54.213.165": {"80": web}}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected the health check to be valid. saw %v", err)
+	}
+
+	for _, path := range []string{"healthz", "/health check", "/healthz?a=1&b=2"} {
+		web.HealthCheck.HTTPPath = path
+		if err := config.Validate(); err == nil {
+			t.Fatalf("expected httpPath %q to fail validation", path)
+		}
+	}
+
+	web.HealthCheck = &HealthCheck{Fall: -1}
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected a negative fall to fail validation")
+	}
+}
+
+func TestHAProxyDNSValidation(t *testing.T) {
+	web := &ServiceDef{Namespace: "default", Service: "app", PortName: "http", HAProxyDNS: &HAProxyDNS{Slots: 8}}
+	config := &ClusterConfig{Config: map[ServiceIP]PortMap{"10.54.213.165": {"80": web}}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected haproxyDNS to be valid. saw %v", err)
+	}
+
+	web.HAProxyDNS.Slots = maxDNSSlots + 1
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected %d slots to fail validation", web.HAProxyDNS.Slots)
+	}
+
+	web.HAProxyDNS.Slots = 0
+	web.HAProxyEndpoints = true
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected haproxyDNS with haproxyEndpoints to fail validation")
+	}
+
+	web.HAProxyEndpoints = false
+	web.PortName = ""
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected haproxyDNS without a portName to fail validation")
+	}
+}
+
+func TestSourceRanges(t *testing.T) {
+	web := &ServiceDef{SourceRanges: []string{"10.1.2.3/8", "2001:db8::1/32", "192.168.0.0/16"}}
+	config := &ClusterConfig{Config: map[ServiceIP]PortMap{"10.54.213.165": {"80": web}}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected the source ranges to be valid. saw %v", err)
+	}
+	if sources := web.Sources(false); !reflect.DeepEqual(sources, []string{"10.0.0.0/8", "192.168.0.0/16"}) {
+		t.Fatalf("expected the ipv4 networks. saw %v", sources)
+	}
+	if sources := web.Sources(true); !reflect.DeepEqual(sources, []string{"2001:db8::/32"}) {
+		t.Fatalf("expected the ipv6 network. saw %v", sources)
+	}
+	if sources := (&ServiceDef{}).Sources(false); sources != nil {
+		t.Fatalf("expected no ranges to allow every source. saw %v", sources)
+	}
+
+	web.SourceRanges = []string{"10.0.0.1"}
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected an address without a mask to fail validation")
+	}
+}
+
+func TestOnePacketValidation(t *testing.T) {
+	dns := &ServiceDef{UDPEnabled: true, IPVSOptions: IPVSOptions{RawOnePacket: true}}
+	config := &ClusterConfig{
+		Config:     map[ServiceIP]PortMap{"10.54.213.165": {"53": dns}},
+		VIPOptions: map[ServiceIP]*VIPOptions{"10.54.213.165": {Fwmark: 1}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected onePacket on a fwmark vip to be valid. saw %v", err)
+	}
+
+	dns.UDPEnabled = false
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected onePacket without udpEnabled to fail validation")
+	}
+
+	dns.UDPEnabled = true
+	config.VIPOptions = nil
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected onePacket on a vip without a fwmark to fail validation")
+	}
+}
+
+func TestPortRanges(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.165":{
+                        "80":{"namespace": "syseng", "service": "mod-super8", "portName": "http"},
+                        "30000-30002":{"namespace": "syseng", "service": "media", "portName": "rtp"}
+                    },
+                    "10.54.213.166":{
+                        "20000:21000":{"namespace": "ftp", "service": "ftp", "portName": "passive"}
+                    }
+                },
+                "vipOptions": {
+                    "10.54.213.166": {"fwmark": 1}
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := clusterConfig.Config["10.54.213.165"]
+	if len(ports) != 4 {
+		t.Fatalf("expected the range to expand to 3 ports beside port 80. saw %v", ports)
+	}
+	for _, port := range []string{"30000", "30001", "30002"} {
+		if ports[port] == nil || ports[port].Service != "media" {
+			t.Fatalf("expected port %s to lead to media. saw %v", port, ports[port])
+		}
+	}
+	if _, ok := clusterConfig.Config["10.54.213.166"]["20000:21000"]; !ok {
+		t.Fatalf("expected the fwmark vip's range to be left alone")
+	}
+
+	for _, ports := range []PortMap{
+		{"30000-29000": &ServiceDef{}},
+		{"30000-30002-30004": &ServiceDef{}},
+		{"30000-30002": &ServiceDef{}, "30001": &ServiceDef{}},
+		{"30000-30002": &ServiceDef{}, "30002-30004": &ServiceDef{}},
+		{"30000-30002": &ServiceDef{TargetPort: "8080"}},
+	} {
+		if _, err := expandPortRanges(ports); err == nil {
+			t.Fatalf("expected %v to fail to expand", ports)
+		}
+	}
+}
+
+func TestNodeWeight(t *testing.T) {
+	endpoints := func(pods int) []Endpoints {
+		addresses := make([]Address, pods)
+		return []Endpoints{{EndpointMeta: EndpointMeta{Namespace: "default", Service: "nginx"}, Subsets: []Subset{{Addresses: addresses, Ports: []Port{{Name: "http", Port: 80}}}}}}
+	}
+	ident := MakeIdent("default", "nginx", "http")
+
+	// two pods here, of weight 2, and three pods of weight 1 elsewhere
+	node := Node{Annotations: map[string]string{WeightAnnotation: "2"}, Endpoints: endpoints(2)}
+	node.SetTotals(map[string]int{ident: 7})
+	if p := node.GetLocalServicePropability("default", "nginx", "http", nil); p != 4.0/7.0 {
+		t.Fatalf("expected a probability of 4/7. saw %v", p)
+	}
+
+	for value, expect := range map[string]int{"": 1, "3": 3, "0": 0, "-1": 1, "1.5": 1, "heavy": 1} {
+		node := Node{Annotations: map[string]string{WeightAnnotation: value}}
+		if node.Weight() != expect {
+			t.Fatalf("expected a weight of %d from %q. saw %d", expect, value, node.Weight())
+		}
+	}
+	if (&Node{}).Weight() != 1 {
+		t.Fatalf("expected a node without annotations to weigh 1")
+	}
+}
+
+func TestNodeExcludes(t *testing.T) {
+	tenantA := &ServiceDef{Namespace: "tenant-a", Service: "nginx"}
+	tenantB := &ServiceDef{Namespace: "tenant-b", Service: "nginx"}
+	vips := map[ServiceIP]PortMap{
+		"10.54.213.253": {"80": tenantA},
+		"10.54.213.254": {"80": tenantA, "443": tenantB},
+		"2001:db8::fe":  {"80": tenantB},
+	}
+
+	node := Node{}
+	if !reflect.DeepEqual(node.Served(vips), vips) {
+		t.Fatalf("expected a node without the annotation to serve every VIP")
+	}
+
+	node.Annotations = map[string]string{ExcludeAnnotation: "tenant-a/*, 2001:DB8::FE"}
+	if !node.Excludes("10.54.213.254", tenantA) || node.Excludes("10.54.213.254", tenantB) {
+		t.Fatalf("expected tenant-a's services alone to be excluded")
+	}
+	expects := map[ServiceIP]PortMap{"10.54.213.254": {"443": tenantB}}
+	if served := node.Served(vips); !reflect.DeepEqual(served, expects) {
+		t.Fatalf("expected %v to be served. saw %v", expects, served)
+	}
+
+	node.Annotations[ExcludeAnnotation] = "10.54.213.253"
+	if !node.Excludes("10.54.213.253", tenantB) || node.Excludes("10.54.213.254", tenantA) {
+		t.Fatalf("expected every service of 10.54.213.253 alone to be excluded")
+	}
+}
+
+func TestNodeMaintenance(t *testing.T) {
+	kubeNode := &v1.Node{Spec: v1.NodeSpec{Taints: []v1.Taint{
+		{Key: "maintenance", Effect: v1.TaintEffectNoSchedule},
+		{Key: "dedicated", Value: "lb", Effect: v1.TaintEffectNoSchedule},
+	}}}
+	node := NewNode(kubeNode)
+	if !reflect.DeepEqual(node.Taints, []string{"dedicated", "maintenance"}) {
+		t.Fatalf("expected the sorted taint keys. saw %v", node.Taints)
+	}
+
+	if reason := node.Maintenance(false, nil); reason != "" {
+		t.Fatalf("expected a node without drain taints to be in service. saw %s", reason)
+	}
+	if reason := node.Maintenance(false, []string{"maintenance"}); reason == "" {
+		t.Fatalf("expected a node with a drain taint to be under maintenance")
+	}
+
+	node.Unschedulable = true
+	if reason := node.Maintenance(false, nil); reason == "" {
+		t.Fatalf("expected a cordoned node to be under maintenance")
+	}
+	if reason := node.Maintenance(true, nil); reason != "" {
+		t.Fatalf("expected a cordon to be ignored. saw %s", reason)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	config := &ClusterConfig{
+		Config:     map[ServiceIP]PortMap{"10.54.213.165": {"80": &ServiceDef{Service: "web", HealthCheck: &HealthCheck{HTTPPath: "/healthz"}}}},
+		VIPOptions: map[ServiceIP]*VIPOptions{"10.54.213.165": {HAProxyFrontend: true}},
+	}
+	copied := config.Copy()
+	if !reflect.DeepEqual(config, copied) {
+		t.Fatalf("expected an equal copy. saw %+v", copied)
+	}
+	copied.Config["10.54.213.165"]["80"].HealthCheck.HTTPPath = "/ready"
+	if config.Config["10.54.213.165"]["80"].HealthCheck.HTTPPath != "/healthz" {
+		t.Fatalf("expected the copy to share nothing with the config")
+	}
+	if (*ClusterConfig)(nil).Copy() != nil {
+		t.Fatalf("expected the copy of a nil config to be nil")
+	}
+
+	node := Node{
+		Name:      "node-1",
+		Endpoints: []Endpoints{{EndpointMeta: EndpointMeta{Namespace: "default", Service: "web"}, Subsets: []Subset{{Addresses: []Address{{PodIP: "100.64.0.5"}}}}}},
+	}
+	node.SetTotals(map[string]int{"default/web:": 2})
+	copiedNode := node.Copy()
+	if !reflect.DeepEqual(node, copiedNode) {
+		t.Fatalf("expected an equal copy. saw %+v", copiedNode)
+	}
+	copiedNode.Endpoints[0].Subsets[0].Addresses[0].PodIP = "100.64.0.6"
+	copiedNode.addressTotals["default/web:"] = 3
+	if node.Endpoints[0].Subsets[0].Addresses[0].PodIP != "100.64.0.5" || node.addressTotals["default/web:"] != 2 {
+		t.Fatalf("expected the copy to share nothing with the node")
+	}
+}
+
+func TestWorkerStatusHealth(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		status  WorkerStatus
+		healthy bool
+	}{
+		{WorkerStatus{Running: true, Parity: true, LastApply: now}, true},
+		{WorkerStatus{Running: false, Parity: true}, false},
+		{WorkerStatus{Running: true, Parity: false}, false},
+		{WorkerStatus{Running: true, Parity: false, LastError: "boom", LastErrorTime: now}, false},
+		// an error that a later apply recovered from
+		{WorkerStatus{Running: true, Parity: true, LastError: "boom", LastErrorTime: now.Add(-time.Minute), LastApply: now}, true},
+	}
+	for i, test := range tests {
+		if err := test.status.Health(); (err == nil) != test.healthy {
+			t.Fatalf("%d: expected healthy=%v. saw %v", i, test.healthy, err)
+		}
+	}
+}
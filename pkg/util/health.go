@@ -12,7 +12,7 @@ import (
 )
 
 // listens on a port and returns a set of information about the health of the system
-func ListenForHealth(primaryInterface string, port int, logger logrus.FieldLogger) {
+func ListenForHealth(primaryInterfaces []string, port int, logger logrus.FieldLogger) {
 	logger.Infof("initializing /health handler on port %d", port)
 
 	http.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
@@ -20,7 +20,7 @@ func ListenForHealth(primaryInterface string, port int, logger logrus.FieldLogge
 		defer func() {
 			logger.Info("request completed in %v", time.Now().Sub(start))
 		}()
-		data := health(primaryInterface, logger)
+		data := health(primaryInterfaces, logger)
 		b, _ := json.MarshalIndent(data, " ", " ")
 		w.Write(b)
 	})
@@ -40,7 +40,7 @@ type healthData struct {
 	Errors []string `json:"errors,omitempty"`
 }
 
-func health(primaryInterface string, logger logrus.FieldLogger) *healthData {
+func health(primaryInterfaces []string, logger logrus.FieldLogger) *healthData {
 	h := &healthData{
 		Mode:      "unknown",
 		Interface: map[string][]string{},
@@ -62,7 +62,7 @@ func health(primaryInterface string, logger logrus.FieldLogger) *healthData {
 	h.IPTables = strings.Split(string(out), "\n")
 
 	// what are the interface rules
-	for _, iface := range []string{"lo", primaryInterface} {
+	for _, iface := range append([]string{"lo"}, primaryInterfaces...) {
 		out, err = exec.Command("ip", "addr", "show", "dev", iface).Output()
 		if err != nil {
 			h.Errors = append(h.Errors, err.Error())
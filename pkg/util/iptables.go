@@ -19,9 +19,11 @@ package util
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/coreos/go-semver/semver"
 	"github.com/golang/glog"
@@ -57,6 +59,9 @@ type Interface interface {
 	DeleteRule(table Table, chain Chain, args ...string) error
 	// IsIpv6 returns true if this is managing ipv6 tables
 	IsIpv6() bool
+	// HasRandomFully returns true if iptables and the kernel support the
+	// --random-fully flag of SNAT and MASQUERADE
+	HasRandomFully() bool
 	// TODO: (BenTheElder) Unit-Test Save/SaveAll, Restore/RestoreAll
 	// Save calls `iptables-save` for table.
 	Save(table Table) ([]byte, error)
@@ -88,6 +93,8 @@ type Table string
 const (
 	TableNAT    Table = "nat"
 	TableFilter Table = "filter"
+	TableMangle Table = "mangle"
+	TableRaw    Table = "raw"
 )
 
 type Chain string
@@ -104,10 +111,12 @@ const (
 )
 
 const (
-	cmdIptablesSave    string = "iptables-save"
-	cmdIptablesRestore string = "iptables-restore"
-	cmdIptables        string = "iptables"
-	cmdIp6tables       string = "ip6tables"
+	cmdIptablesSave     string = "iptables-save"
+	cmdIptablesRestore  string = "iptables-restore"
+	cmdIptables         string = "iptables"
+	cmdIp6tablesSave    string = "ip6tables-save"
+	cmdIp6tablesRestore string = "ip6tables-restore"
+	cmdIp6tables        string = "ip6tables"
 )
 
 // Option flag for Restore
@@ -130,6 +139,23 @@ const MinCheckVersion = "1.4.11"
 const MinWaitVersion = "1.4.20"
 const MinWait2Version = "1.4.22"
 
+// Minimum iptables version supporting the -W flag, and -w and -W for
+// iptables-restore
+const MinWaitIntervalVersion = "1.6.2"
+
+// DefaultLockWait is how long iptables waits for the xtables lock, unless
+// told otherwise, and lockWaitInterval how often it tries to take the lock
+// while waiting.
+const DefaultLockWait = 2 * time.Second
+const lockWaitInterval = 100 * time.Millisecond
+
+// Minimum iptables and kernel versions supporting the --random-fully flag
+const MinRandomFullyVersion = "1.6.2"
+const MinRandomFullyKernelVersion = "3.13.0"
+
+// kernelReleaseFile holds the release of the running kernel, e.g. 4.15.0-112-generic
+const kernelReleaseFile = "/proc/sys/kernel/osrelease"
+
 // runner implements Interface in terms of exec("iptables").
 type runner struct {
 	mu       sync.Mutex
@@ -139,6 +165,11 @@ type runner struct {
 	hasCheck bool
 	waitFlag []string
 
+	// restoreWaitFlag is the waitFlag of iptables-restore
+	restoreWaitFlag []string
+
+	hasRandomFully bool
+
 	reloadFuncs []func()
 	signal      chan *godbus.Signal
 }
@@ -151,6 +182,12 @@ func NewDefault() Interface {
 
 // New returns a new Interface which will exec iptables.
 func New(exec utilexec.Interface, dbus utildbus.Interface, protocol Protocol) Interface {
+	return NewWithLockWait(exec, dbus, protocol, DefaultLockWait)
+}
+
+// NewWithLockWait returns a new Interface which will exec iptables, waiting
+// up to lockWait for the xtables lock where iptables supports it.
+func NewWithLockWait(exec utilexec.Interface, dbus utildbus.Interface, protocol Protocol, lockWait time.Duration) Interface {
 	vstring, err := getIptablesVersionString(exec)
 	if err != nil {
 		glog.Warningf("Error checking iptables version, assuming version at least %s: %v", MinCheckVersion, err)
@@ -161,7 +198,11 @@ func New(exec utilexec.Interface, dbus utildbus.Interface, protocol Protocol) In
 		dbus:     dbus,
 		protocol: protocol,
 		hasCheck: getIptablesHasCheckCommand(vstring),
-		waitFlag: getIptablesWaitFlag(vstring),
+		waitFlag: getIptablesWaitFlag(vstring, lockWait),
+
+		restoreWaitFlag: getIptablesRestoreWaitFlag(vstring, lockWait),
+
+		hasRandomFully: getIptablesHasRandomFully(vstring) && getKernelHasRandomFully(kernelReleaseFile),
 	}
 	runner.connectToFirewallD()
 	return runner
@@ -306,6 +347,11 @@ func (runner *runner) IsIpv6() bool {
 	return runner.protocol == ProtocolIpv6
 }
 
+// HasRandomFully is part of Interface.
+func (runner *runner) HasRandomFully() bool {
+	return runner.hasRandomFully
+}
+
 // Save is part of Interface.
 func (runner *runner) Save(table Table) ([]byte, error) {
 	runner.mu.Lock()
@@ -314,7 +360,7 @@ func (runner *runner) Save(table Table) ([]byte, error) {
 	// run and return
 	args := []string{"-t", string(table)}
 	glog.V(4).Infof("running iptables-save %v", args)
-	return runner.exec.Command(cmdIptablesSave, args...).CombinedOutput()
+	return runner.exec.Command(runner.saveCommand(), args...).CombinedOutput()
 }
 
 // SaveAll is part of Interface.
@@ -324,7 +370,7 @@ func (runner *runner) SaveAll() ([]byte, error) {
 
 	// run and return
 	glog.V(4).Infof("running iptables-save")
-	return runner.exec.Command(cmdIptablesSave, []string{}...).CombinedOutput()
+	return runner.exec.Command(runner.saveCommand(), []string{}...).CombinedOutput()
 }
 
 // Restore is part of Interface.
@@ -346,6 +392,7 @@ func (runner *runner) restoreInternal(args []string, data []byte, flush FlushFla
 	runner.mu.Lock()
 	defer runner.mu.Unlock()
 
+	args = append(append([]string{}, runner.restoreWaitFlag...), args...)
 	if !flush {
 		args = append(args, "--noflush")
 	}
@@ -354,7 +401,7 @@ func (runner *runner) restoreInternal(args []string, data []byte, flush FlushFla
 	}
 
 	// run the command and return the output or an error including the output and error
-	cmd := runner.exec.Command(cmdIptablesRestore, args...)
+	cmd := runner.exec.Command(runner.restoreCommand(), args...)
 	cmd.SetStdin(bytes.NewBuffer(data))
 	b, err := cmd.CombinedOutput()
 	if err != nil {
@@ -363,6 +410,20 @@ func (runner *runner) restoreInternal(args []string, data []byte, flush FlushFla
 	return nil
 }
 
+func (runner *runner) saveCommand() string {
+	if runner.IsIpv6() {
+		return cmdIp6tablesSave
+	}
+	return cmdIptablesSave
+}
+
+func (runner *runner) restoreCommand() string {
+	if runner.IsIpv6() {
+		return cmdIp6tablesRestore
+	}
+	return cmdIptablesRestore
+}
+
 func (runner *runner) iptablesCommand() string {
 	if runner.IsIpv6() {
 		return cmdIp6tables
@@ -374,7 +435,7 @@ func (runner *runner) iptablesCommand() string {
 func (runner *runner) run(op operation, args []string) ([]byte, error) {
 	iptablesCmd := runner.iptablesCommand()
 
-	fullArgs := append(runner.waitFlag, string(op))
+	fullArgs := append(append([]string{}, runner.waitFlag...), string(op))
 	fullArgs = append(fullArgs, args...)
 	glog.V(4).Infof("running iptables %s %v", string(op), args)
 	return runner.exec.Command(iptablesCmd, fullArgs...).CombinedOutput()
@@ -396,7 +457,7 @@ func (runner *runner) checkRule(table Table, chain Chain, args ...string) (bool,
 // of hack and half-measures.  We should nix this ASAP.
 func (runner *runner) checkRuleWithoutCheck(table Table, chain Chain, args ...string) (bool, error) {
 	glog.V(1).Infof("running iptables-save -t %s", string(table))
-	out, err := runner.exec.Command(cmdIptablesSave, "-t", string(table)).CombinedOutput()
+	out, err := runner.exec.Command(runner.saveCommand(), "-t", string(table)).CombinedOutput()
 	if err != nil {
 		return false, fmt.Errorf("error checking rule: %v", err)
 	}
@@ -487,8 +548,55 @@ func getIptablesHasCheckCommand(vstring string) bool {
 	return true
 }
 
-// Checks if iptables version has a "wait" flag
-func getIptablesWaitFlag(vstring string) []string {
+// Checks if iptables version has the --random-fully flag
+func getIptablesHasRandomFully(vstring string) bool {
+	minVersion, err := semver.NewVersion(MinRandomFullyVersion)
+	if err != nil {
+		glog.Errorf("MinRandomFullyVersion (%s) is not a valid version string: %v", MinRandomFullyVersion, err)
+		return false
+	}
+	version, err := semver.NewVersion(vstring)
+	if err != nil {
+		glog.Errorf("vstring (%s) is not a valid version string: %v", vstring, err)
+		return false
+	}
+	return !version.LessThan(*minVersion)
+}
+
+// Checks if the running kernel, whose release is read from file, supports
+// --random-fully. Kernels whose release cannot be read are assumed not to.
+func getKernelHasRandomFully(file string) bool {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		glog.Warningf("Error reading the kernel release, assuming no --random-fully support: %v", err)
+		return false
+	}
+	match := regexp.MustCompile("^([0-9]+\\.[0-9]+)(\\.[0-9]+)?").FindStringSubmatch(strings.TrimSpace(string(b)))
+	if match == nil {
+		glog.Warningf("No kernel version found in %s, assuming no --random-fully support", b)
+		return false
+	}
+	vstring := match[1] + ".0"
+	if match[2] != "" {
+		vstring = match[1] + match[2]
+	}
+	minVersion, err := semver.NewVersion(MinRandomFullyKernelVersion)
+	if err != nil {
+		glog.Errorf("MinRandomFullyKernelVersion (%s) is not a valid version string: %v", MinRandomFullyKernelVersion, err)
+		return false
+	}
+	version, err := semver.NewVersion(vstring)
+	if err != nil {
+		glog.Errorf("kernel release (%s) is not a valid version string: %v", vstring, err)
+		return false
+	}
+	return !version.LessThan(*minVersion)
+}
+
+// Checks if iptables version has a "wait" flag, and the flags that wait up to
+// wait for the xtables lock. Versions that take no number of seconds wait
+// indefinitely.
+func getIptablesWaitFlag(vstring string, wait time.Duration) []string {
 	version, err := semver.NewVersion(vstring)
 	if err != nil {
 		glog.Errorf("vstring (%s) is not a valid version string: %v", vstring, err)
@@ -511,9 +619,47 @@ func getIptablesWaitFlag(vstring string) []string {
 	}
 	if version.LessThan(*minVersion) {
 		return []string{"-w"}
-	} else {
-		return []string{"-w2"}
 	}
+
+	flags := []string{fmt.Sprintf("-w%d", lockWaitSeconds(wait))}
+	minVersion, err = semver.NewVersion(MinWaitIntervalVersion)
+	if err != nil {
+		glog.Errorf("MinWaitIntervalVersion (%s) is not a valid version string: %v", MinWaitIntervalVersion, err)
+		return flags
+	}
+	if version.LessThan(*minVersion) {
+		return flags
+	}
+	return append(flags, fmt.Sprintf("-W%d", lockWaitInterval/time.Microsecond))
+}
+
+// Checks if iptables-restore has a "wait" flag, and the flags that wait up to
+// wait for the xtables lock.
+func getIptablesRestoreWaitFlag(vstring string, wait time.Duration) []string {
+	version, err := semver.NewVersion(vstring)
+	if err != nil {
+		glog.Errorf("vstring (%s) is not a valid version string: %v", vstring, err)
+		return nil
+	}
+	minVersion, err := semver.NewVersion(MinWaitIntervalVersion)
+	if err != nil {
+		glog.Errorf("MinWaitIntervalVersion (%s) is not a valid version string: %v", MinWaitIntervalVersion, err)
+		return nil
+	}
+	if version.LessThan(*minVersion) {
+		return nil
+	}
+	return []string{fmt.Sprintf("-w%d", lockWaitSeconds(wait)), fmt.Sprintf("-W%d", lockWaitInterval/time.Microsecond)}
+}
+
+// lockWaitSeconds rounds wait up to whole seconds, of which iptables waits at
+// least one.
+func lockWaitSeconds(wait time.Duration) int {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
 }
 
 // getIptablesVersionString runs "iptables --version" to get the version string
@@ -579,6 +725,21 @@ func (runner *runner) reload() {
 	}
 }
 
+// IsLockError returns true if the error indicates that iptables could not
+// take the xtables lock, which other agents such as kube-proxy hold while
+// they apply their rules. Like IsNotFoundError, it parses the error string.
+func IsLockError(err error) bool {
+	es := err.Error()
+	if strings.Contains(es, "xtables lock") {
+		return true
+	}
+	if strings.Contains(es, "Resource temporarily unavailable") {
+		return true
+	}
+	// iptables exits with status 4 when the lock cannot be taken
+	return strings.Contains(es, "exit status 4")
+}
+
 // IsNotFoundError returns true if the error indicates "not found".  It parses
 // the error string looking for known values, which is imperfect but works in
 // practice.
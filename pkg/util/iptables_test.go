@@ -0,0 +1,56 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHasRandomFully(t *testing.T) {
+	for vstring, expects := range map[string]bool{"1.4.21": false, "1.6.1": false, "1.6.2": true, "1.8.4": true} {
+		if getIptablesHasRandomFully(vstring) != expects {
+			t.Fatalf("expected iptables %s to support --random-fully %v", vstring, expects)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "ravel-osrelease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "osrelease")
+	for release, expects := range map[string]bool{"3.10.0-1160.el7.x86_64\n": false, "3.13\n": true, "4.15.0-112-generic\n": true, "unknown\n": false} {
+		if err := ioutil.WriteFile(file, []byte(release), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if getKernelHasRandomFully(file) != expects {
+			t.Fatalf("expected kernel %q to support --random-fully %v", release, expects)
+		}
+	}
+	if getKernelHasRandomFully(filepath.Join(dir, "missing")) {
+		t.Fatalf("expected a missing kernel release not to support --random-fully")
+	}
+}
+
+func TestIptablesWaitFlag(t *testing.T) {
+	for vstring, expects := range map[string][]string{
+		"1.4.19": nil,
+		"1.4.21": {"-w"},
+		"1.4.22": {"-w5"},
+		"1.6.2":  {"-w5", "-W100000"},
+	} {
+		if flags := getIptablesWaitFlag(vstring, 4500*time.Millisecond); !reflect.DeepEqual(flags, expects) {
+			t.Fatalf("expected iptables %s to wait with %v. saw %v", vstring, expects, flags)
+		}
+	}
+
+	if flags := getIptablesRestoreWaitFlag("1.6.1", time.Second); flags != nil {
+		t.Fatalf("expected iptables-restore 1.6.1 not to wait. saw %v", flags)
+	}
+	if flags := getIptablesRestoreWaitFlag("1.8.4", 0); !reflect.DeepEqual(flags, []string{"-w1", "-W100000"}) {
+		t.Fatalf("expected iptables-restore 1.8.4 to wait at least a second. saw %v", flags)
+	}
+}